@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// runCommand runs an admin command and returns the exit code.
+// The server should be stopped while a command changes data.
+func runCommand(logger *log.Logger, args []string) int {
+	switch args[0] {
+	case "check-integrity":
+		return runCheckIntegrity(logger, args[1:])
+	default:
+		logger.Printf("Unknown command '%s'. Available commands: check-integrity", args[0])
+		return 2
+	}
+}
+
+// runCheckIntegrity checks the data of one or all users. The keys of the users
+// are not known here, so the encrypted values are not checked.
+func runCheckIntegrity(logger *log.Logger, args []string) int {
+	flags := flag.NewFlagSet("check-integrity", flag.ContinueOnError)
+	userID := flags.Int("user", 0, "only check the user with this id (default: all users)")
+	repair := flags.Bool("repair", false, "repair dangling file references, duplicate pin ids and orphaned files")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// Collect the users to check
+	userIDs := []int{}
+	if *userID != 0 {
+		userIDs = append(userIDs, *userID)
+	} else {
+		users, err := utils.GetUsers()
+		if err != nil {
+			logger.Printf("Error getting users: %v", err)
+			return 1
+		}
+		usersList, _ := users["users"].([]any)
+		for _, u := range usersList {
+			user, ok := u.(map[string]any)
+			if !ok {
+				continue
+			}
+			if id, ok := user["user_id"].(float64); ok {
+				userIDs = append(userIDs, int(id))
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	exitCode := 0
+	for _, id := range userIDs {
+		report, err := utils.CheckIntegrity(id, "", *repair)
+		if err != nil {
+			logger.Printf("Error checking user %d: %v", id, err)
+			exitCode = 1
+			continue
+		}
+
+		// Issues that are left are an error
+		for _, issue := range report.Issues {
+			if !issue.Repaired {
+				exitCode = 1
+			}
+		}
+
+		logger.Printf("User %d: %d months, %d days, %d files checked, %d issues found", id, report.MonthsChecked, report.DaysChecked, report.FilesChecked, len(report.Issues))
+		if err := encoder.Encode(report); err != nil {
+			logger.Printf("Error writing report: %v", err)
+			return 1
+		}
+	}
+
+	return exitCode
+}
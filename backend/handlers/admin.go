@@ -1,12 +1,12 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -14,54 +14,116 @@ import (
 	"github.com/phitux/dailytxt/backend/utils"
 )
 
-type AdminRequest struct {
-	AdminPassword string `json:"admin_password"`
-}
-
 type AdminUserResponse struct {
 	ID        int    `json:"id"`
 	Username  string `json:"username"`
 	DiskUsage int64  `json:"disk_usage"`
+	Quota     int64  `json:"quota"`
+	QuotaMB   *int   `json:"quota_mb"`
+	Admin     bool   `json:"admin"`
+	// Argon2Outdated is set until the user logs in with the password again
+	Argon2Outdated bool `json:"argon2_outdated"`
 }
 
-// ValidateAdminPassword validates the admin password
-func ValidateAdminPassword(w http.ResponseWriter, r *http.Request) {
-	adminPassword := os.Getenv("ADMIN_PASSWORD")
-	if adminPassword == "" {
+// AdminLogin turns the current session into an admin session. Admins enter
+// their own password, ADMIN_PASSWORD works for every user.
+func AdminLogin(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value(utils.UserIDKey).(int)
+	sessionID, _ := r.Context().Value(utils.SessionIDKey).(string)
+
+	var req struct {
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Wrong passwords are throttled per user and client like the login
+	throttleKeys := []utils.ThrottleKey{utils.AdminThrottleKey(userID), utils.IPThrottleKey(r)}
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
+	valid := false
+	if utils.IsAdmin(userID) {
+		var err error
+		valid, err = utils.VerifyUserPassword(userID, req.Password)
+		if err != nil {
+			log.Printf("Error checking password of user %d: %v", userID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if adminPassword := os.Getenv("ADMIN_PASSWORD"); !valid && adminPassword != "" {
+		valid = subtle.ConstantTimeCompare([]byte(req.Password), []byte(adminPassword)) == 1
+	}
+
+	if !valid {
+		utils.ThrottleFailure(throttleKeys...)
+		utils.AdminAudit(r, "login_failed", nil)
+
+		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]bool{
 			"valid": false,
 		})
 		return
 	}
 
-	var req struct {
-		Password string `json:"password"`
+	utils.ThrottleSuccess(throttleKeys[0])
+
+	until, err := utils.StartAdminSession(userID, sessionID)
+	if err != nil {
+		log.Printf("Error starting admin session of user %d: %v", userID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
+	utils.AdminAudit(r, "login", nil)
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"valid":       true,
+		"admin_until": until.Format(time.RFC3339),
+	})
+}
+
+// AdminLogout ends the admin session
+func AdminLogout(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value(utils.UserIDKey).(int)
+	sessionID, _ := r.Context().Value(utils.SessionIDKey).(string)
+
+	if err := utils.EndAdminSession(userID, sessionID); err != nil {
+		log.Printf("Error ending admin session of user %d: %v", userID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	utils.AdminAudit(r, "logout", nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{
-		"valid": req.Password == adminPassword,
+		"success": true,
 	})
 }
 
-// validateAdminPasswordInRequest checks if the admin password in request is valid
-func validateAdminPasswordInRequest(r *http.Request) bool {
-	adminPassword := os.Getenv("ADMIN_PASSWORD")
-	if adminPassword == "" {
-		return false
-	}
+// GetAdminSession returns if the current session is an admin session
+func GetAdminSession(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value(utils.UserIDKey).(int)
+	sessionID, _ := r.Context().Value(utils.SessionIDKey).(string)
 
-	var req AdminRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return false
+	response := map[string]any{
+		"active":   false,
+		"is_admin": utils.IsAdmin(userID),
+	}
+	if until := utils.AdminSessionUntil(userID, sessionID); !until.IsZero() {
+		response["active"] = true
+		response["admin_until"] = until.Format(time.RFC3339)
 	}
 
-	return req.AdminPassword == adminPassword
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // GetAdminData returns:
@@ -70,11 +132,6 @@ func validateAdminPasswordInRequest(r *http.Request) bool {
 // - migration-info
 // - app settings (env-vars)
 func GetAdminData(w http.ResponseWriter, r *http.Request) {
-	if !validateAdminPasswordInRequest(r) {
-		http.Error(w, "Invalid admin password", http.StatusUnauthorized)
-		return
-	}
-
 	// Read users.json
 	users, err := utils.GetUsers()
 	if err != nil {
@@ -106,10 +163,20 @@ func GetAdminData(w http.ResponseWriter, r *http.Request) {
 		// Calculate disk usage for this user
 		diskUsage := calculateUserDiskUsage(int(userID))
 
+		// The quota set for this user (nil if the default applies)
+		var quotaMB *int
+		if override, ok := utils.UserQuotaOverride(int(userID)); ok {
+			quotaMB = &override
+		}
+
 		adminUsers = append(adminUsers, AdminUserResponse{
-			ID:        int(userID),
-			Username:  username,
-			DiskUsage: diskUsage,
+			ID:             int(userID),
+			Username:       username,
+			DiskUsage:      diskUsage,
+			Quota:          utils.UserQuota(int(userID)),
+			QuotaMB:        quotaMB,
+			Admin:          user["admin"] == true,
+			Argon2Outdated: utils.Argon2Outdated(user),
 		})
 	}
 
@@ -132,25 +199,16 @@ func GetAdminData(w http.ResponseWriter, r *http.Request) {
 		"free_space":   freeSpace,
 		"old_data":     oldDirInfo,
 		"app_settings": appSettings,
+		"files_gc":     utils.GetFilesGCStatus(),
+		"lockouts":     utils.GetLockouts(),
+		"jwt_keys":     utils.GetJWTKeys(),
+		"audit":        utils.GetAdminAudit(100),
 	})
 }
 
 // calculateUserDiskUsage calculates the total disk usage for a user
 func calculateUserDiskUsage(userID int) int64 {
-	userDataDir := filepath.Join(utils.Settings.DataPath, strconv.Itoa(userID))
-	var totalSize int64
-
-	// Calculate size recursively
-	err := filepath.Walk(userDataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil // Continue on errors
-		}
-		if !info.IsDir() {
-			totalSize += info.Size()
-		}
-		return nil
-	})
-
+	totalSize, err := utils.GetUserDiskUsage(userID)
 	if err != nil {
 		log.Printf("Error calculating disk usage for user %d: %v", userID, err)
 	}
@@ -227,8 +285,7 @@ func getOldDirectoryInfo() map[string]any {
 // DeleteUser deletes a user and all their data
 func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		AdminPassword string `json:"admin_password"`
-		UserID        int    `json:"user_id"`
+		UserID int `json:"user_id"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -236,13 +293,6 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate admin password
-	adminPassword := os.Getenv("ADMIN_PASSWORD")
-	if adminPassword == "" || req.AdminPassword != adminPassword {
-		http.Error(w, "Invalid admin password", http.StatusUnauthorized)
-		return
-	}
-
 	// Use the shared delete function from users.go
 	if err := deleteUserByID(req.UserID); err != nil {
 		log.Printf("Error deleting user %d: %v", req.UserID, err)
@@ -254,6 +304,7 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	utils.AdminAudit(r, "delete_user", map[string]any{"user_id": req.UserID})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{
@@ -261,13 +312,44 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// DeleteOldData deletes the entire old directory
-func DeleteOldData(w http.ResponseWriter, r *http.Request) {
-	if !validateAdminPasswordInRequest(r) {
-		http.Error(w, "Invalid admin password", http.StatusUnauthorized)
+// SetUserQuota sets the storage quota (in MB, 0 is unlimited) of a user.
+// quota_mb null removes it, then the default quota (USER_QUOTA_MB) applies.
+func SetUserQuota(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID  int  `json:"user_id"`
+		QuotaMB *int `json:"quota_mb"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.QuotaMB != nil && *req.QuotaMB < 0 {
+		http.Error(w, "Invalid quota", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.SetUserQuotaOverride(req.UserID, req.QuotaMB); err != nil {
+		log.Printf("Error setting quota of user %d: %v", req.UserID, err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error setting quota", http.StatusInternalServerError)
+		}
 		return
 	}
+	utils.AdminAudit(r, "set_quota", map[string]any{"user_id": req.UserID, "quota_mb": req.QuotaMB})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"quota":   utils.UserQuota(req.UserID),
+	})
+}
 
+// DeleteOldData deletes the entire old directory
+func DeleteOldData(w http.ResponseWriter, r *http.Request) {
 	oldDirPath := filepath.Join(utils.Settings.DataPath, "old")
 
 	// Check if old directory exists
@@ -284,6 +366,7 @@ func DeleteOldData(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("Old directory successfully deleted by admin (id: %d, username: %s)", r.Context().Value(utils.UserIDKey), r.Context().Value(utils.UsernameKey))
+	utils.AdminAudit(r, "delete_old_data", nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{
@@ -293,22 +376,15 @@ func DeleteOldData(w http.ResponseWriter, r *http.Request) {
 
 // OpenRegistrationTemp allows admin to open registration for a limited time window
 func OpenRegistrationTemp(w http.ResponseWriter, r *http.Request) {
-	// Decode request (admin password + optional seconds)
+	// Decode request (optional seconds)
 	var req struct {
-		AdminPassword string `json:"admin_password"`
-		Seconds       int    `json:"seconds"`
+		Seconds int `json:"seconds"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	adminPassword := os.Getenv("ADMIN_PASSWORD")
-	if adminPassword == "" || req.AdminPassword != adminPassword {
-		http.Error(w, "Invalid admin password", http.StatusUnauthorized)
-		return
-	}
-
 	// Default duration 5 minutes; optionally allow custom seconds (max 15 min)
 	duration := 5 * 60 // seconds
 	if req.Seconds > 0 && req.Seconds <= 15*60 {
@@ -316,6 +392,7 @@ func OpenRegistrationTemp(w http.ResponseWriter, r *http.Request) {
 	}
 
 	utils.SetRegistrationOverride(time.Duration(duration) * time.Second)
+	utils.AdminAudit(r, "open_registration", map[string]any{"seconds": duration})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]any{
@@ -324,3 +401,57 @@ func OpenRegistrationTemp(w http.ResponseWriter, r *http.Request) {
 		"duration": duration,
 	})
 }
+
+// RotateJWTKey replaces the signing key of the tokens. Tokens signed with the
+// previous key stay valid until they expire.
+func RotateJWTKey(w http.ResponseWriter, r *http.Request) {
+	kid, err := utils.RotateJWTKey()
+	if err != nil {
+		log.Printf("Error rotating signing key: %v", err)
+		http.Error(w, "Error rotating signing key", http.StatusInternalServerError)
+		return
+	}
+	utils.AdminAudit(r, "rotate_jwt_key", map[string]any{"kid": kid})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"kid":     kid,
+		"keys":    utils.GetJWTKeys(),
+	})
+}
+
+// SetUserAdmin flags a user as admin or removes the flag
+func SetUserAdmin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID int  `json:"user_id"`
+		Admin  bool `json:"admin"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Don't lock yourself out of the admin area
+	if userID, _ := r.Context().Value(utils.UserIDKey).(int); userID == req.UserID && !req.Admin {
+		http.Error(w, "You can't remove your own admin flag", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.SetAdmin(req.UserID, req.Admin); err != nil {
+		log.Printf("Error setting admin flag of user %d: %v", req.UserID, err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error setting admin flag", http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.AdminAudit(r, "set_admin", map[string]any{"user_id": req.UserID, "admin": req.Admin})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"success": true,
+	})
+}
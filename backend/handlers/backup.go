@@ -4,8 +4,8 @@ import (
 	"archive/zip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -17,6 +17,7 @@ import (
 type BackupRequest struct {
 	Username         string `json:"username,omitempty"`
 	Password         string `json:"password"`
+	TOTPCode         string `json:"totpCode,omitempty"`
 	Encrypted        bool   `json:"encrypted"`
 	StartDate        string `json:"startDate,omitempty"`
 	EndDate          string `json:"endDate,omitempty"`
@@ -54,23 +55,42 @@ func Backup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Wait after too many wrong passwords
+	username, _ := r.Context().Value(utils.UsernameKey).(string)
+	throttleKeys := []utils.ThrottleKey{utils.UserThrottleKey(username), utils.IPThrottleKey(r)}
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Verify password
 	derivedKey, _, err := utils.CheckPasswordForUser(userID, req.Password)
-	if err != nil {
+	if err != nil || derivedKey == "" {
+		utils.ThrottleFailure(throttleKeys...)
 		http.Error(w, "Invalid password", http.StatusBadRequest)
 		return
 	}
+	utils.ThrottleSuccess(throttleKeys[0])
 
+	utils.LogSecurityEvent(r, userID, derivedKey, "backup", map[string]any{"encrypted": req.Encrypted})
 	performBackup(w, userID, derivedKey, req)
 }
 
-// BackupUser handles the export of user data without login (requires explicit credentials)
+// BackupUser handles the export of user data without login (requires explicit
+// credentials and the TOTP code if enabled)
 func BackupUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	// The password alone isn't enough if logins need single sign-on
+	if utils.PasswordLoginDisabled() {
+		http.Error(w, "Password login is disabled, use single sign-on", http.StatusForbidden)
+		return
+	}
+
 	var req BackupRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -82,6 +102,14 @@ func BackupUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Wait after too many wrong passwords for this user or from this client
+	throttleKeys := []utils.ThrottleKey{utils.UserThrottleKey(req.Username), utils.IPThrottleKey(r)}
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
 	users, err := utils.GetUsers()
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -108,12 +136,46 @@ func BackupUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify password
-	derivedKey, _, err := utils.CheckPasswordForUser(userID, req.Password)
-	if err != nil {
+	derivedKey, availableBackupCodes, err := utils.CheckPasswordForUser(userID, req.Password)
+	if err != nil || derivedKey == "" {
+		if userID != 0 {
+			utils.LogSecurityEvent(r, userID, "", "backup_failed", nil)
+		}
+		utils.ThrottleFailure(throttleKeys...)
 		http.Error(w, "Invalid password", http.StatusBadRequest)
 		return
 	}
 
+	// The second factor is needed like for the login, a backup code replaces it
+	if availableBackupCodes == -1 && utils.TOTPEnabled(userID) {
+		if req.TOTPCode == "" {
+			http.Error(w, "TOTP code required", http.StatusForbidden)
+			return
+		}
+
+		encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		valid, err := utils.VerifyTOTP(userID, req.TOTPCode, encKey)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			utils.LogSecurityEvent(r, userID, derivedKey, "backup_failed", map[string]any{"reason": "totp"})
+			utils.ThrottleFailure(throttleKeys...)
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+	}
+	utils.ThrottleSuccess(throttleKeys[0])
+
+	utils.LogSecurityEvent(r, userID, derivedKey, "backup", map[string]any{
+		"encrypted":     req.Encrypted,
+		"without_login": true,
+	})
 	performBackup(w, userID, derivedKey, req)
 }
 
@@ -245,21 +307,15 @@ func performBackup(w http.ResponseWriter, userID int, derivedKey string, req Bac
 	}
 
 	// 4. Export Log Entries
-	// Walk data/<userID>/<year>/<month.json>
-	userPath := filepath.Join(utils.Settings.DataPath, fmt.Sprintf("%d", userID))
-
+	// Walk all years and months of the user
 	// Collect file UUIDs to export (uuid -> targetFilename)
 	filesToExport := make(map[string]string)
 	// Track used filenames to handle duplicates (filename -> unused)
 	usedFilenames := make(map[string]bool)
 
-	entries, err := os.ReadDir(userPath)
+	years, err := utils.GetYears(userID)
 	if err == nil {
-		for _, yearEntry := range entries {
-			if !yearEntry.IsDir() {
-				continue
-			}
-			yearStr := yearEntry.Name()
+		for _, yearStr := range years {
 			year, err := strconv.Atoi(yearStr)
 			if err != nil {
 				continue
@@ -270,49 +326,29 @@ func performBackup(w http.ResponseWriter, userID int, derivedKey string, req Bac
 			// Ideally parsing StartDate/EndDate.
 			// Here we process month by month.
 
-			monthDir := filepath.Join(userPath, yearStr)
-			monthEntries, err := os.ReadDir(monthDir)
+			months, err := utils.GetMonths(userID, yearStr)
 			if err != nil {
 				continue
 			}
 
-			for _, monthEntry := range monthEntries {
-				if monthEntry.IsDir() || !strings.HasSuffix(monthEntry.Name(), ".json") {
-					continue
-				}
-				monthStr := strings.TrimSuffix(monthEntry.Name(), ".json")
+			for _, monthStr := range months {
 				month, err := strconv.Atoi(monthStr)
 				if err != nil {
 					continue
 				}
 
 				// Read Month JSON
-				monthContent, err := utils.GetMonth(userID, year, month)
+				monthContent, err := utils.ReadMonth(userID, year, month)
 				if err != nil {
 					continue
 				}
 
-				daysArray, ok := monthContent["days"].([]any)
-				if !ok {
-					continue
-				}
-
-				newDays := []any{}
-				hasData := false
-
-				for _, dayInterface := range daysArray {
-					day, ok := dayInterface.(map[string]any)
-					if !ok {
-						continue
-					}
-
-					dayNum, ok := day["day"].(float64)
-					if !ok {
-						continue
-					}
+				newDays := []utils.Day{}
+				decryptedDays := []any{}
 
+				for _, day := range monthContent.Days {
 					// Check Date Range
-					currentDateStr := fmt.Sprintf("%04d-%02d-%02d", year, month, int(dayNum))
+					currentDateStr := fmt.Sprintf("%04d-%02d-%02d", year, month, day.Day)
 					if req.StartDate != "" && currentDateStr < req.StartDate {
 						continue
 					}
@@ -321,189 +357,75 @@ func performBackup(w http.ResponseWriter, userID int, derivedKey string, req Bac
 					}
 
 					// Remove history
-					delete(day, "history")
+					day.History = nil
 
 					if !includeTags {
-						delete(day, "tags")
+						day.Tags = nil
 					}
-
 					if !includeBookmarks {
-						delete(day, "isBookmarked")
+						day.IsBookmarked = false
 					}
-
 					if !includeFiles {
-						delete(day, "files")
-					} else if req.Encrypted {
-						if files, ok := day["files"].([]any); ok {
-							for _, f := range files {
-								if fileMap, ok := f.(map[string]any); ok {
-									uuid := ""
-									if u, ok := fileMap["uuid"].(string); ok {
-										uuid = u
-									} else if u, ok := fileMap["uuid_filename"].(string); ok {
-										uuid = u
-									}
-									if uuid != "" {
-										filesToExport[uuid] = uuid
-									}
-								}
-							}
-						}
+						day.Files = nil
 					}
-
 					if !includePins {
-						delete(day, "pins")
+						day.Pins = nil
 					}
 
-					// Decrypt keys if requested
-					if !req.Encrypted {
-						if encryptedText, ok := day["text"].(string); ok && encryptedText != "" {
-							decryptedText, err := utils.DecryptText(encryptedText, encKey)
-							if err == nil {
-								day["text"] = decryptedText
-							}
-						}
-
-						if encryptedDate, ok := day["date_written"].(string); ok && encryptedDate != "" {
-							decryptedDate, err := utils.DecryptText(encryptedDate, encKey)
-							if err == nil {
-								day["date_written"] = decryptedDate
-							}
-						}
-
-						if includeFiles {
-							if files, ok := day["files"].([]any); ok {
-								newFiles := []any{}
-								for _, f := range files {
-									if fileMap, ok := f.(map[string]any); ok {
-										// Determine filename
-										filename := ""
-										uuid := ""
-										if u, ok := fileMap["uuid"].(string); ok {
-											uuid = u
-										} else if u, ok := fileMap["uuid_filename"].(string); ok {
-											uuid = u
-										}
-
-										if encFilename, ok := fileMap["enc_filename"].(string); ok {
-											decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-											if err == nil {
-												filename = decryptedFilename
-											}
-										}
-
-										// If we have uuid and filename, handle duplicate resolution for ZIP export
-										if includeFiles && uuid != "" && filename != "" {
-											// Check if we already processed this UUID (e.g. same file in multiple days?)
-											// If yes, reuse the assigned filename
-											targetName, exists := filesToExport[uuid]
-											if !exists {
-												targetName = filename
-												if usedFilenames[targetName] {
-													// Collision
-													ext := filepath.Ext(filename)
-													nameNoExt := strings.TrimSuffix(filename, ext)
-													counter := 2
-													for {
-														newName := fmt.Sprintf("%s (%d)%s", nameNoExt, counter, ext)
-														if !usedFilenames[newName] {
-															targetName = newName
-															break
-														}
-														counter++
-													}
-												}
-												usedFilenames[targetName] = true
-												filesToExport[uuid] = targetName
-											}
-											filename = targetName
-										}
-
-										// Only keep filename in decrypted JSON
-										newFileMap := map[string]any{
-											"filename": filename,
-										}
-										newFiles = append(newFiles, newFileMap)
-									}
-								}
-								day["files"] = newFiles
+					if req.Encrypted {
+						for _, file := range day.Files {
+							if file.UUIDFilename != "" {
+								filesToExport[file.UUIDFilename] = file.UUIDFilename
 							}
-						} else {
-							delete(day, "files")
 						}
+						newDays = append(newDays, day)
+						continue
+					}
 
-						if includePins {
-							if pins, ok := day["pins"].([]any); ok {
-								newPins := make([]any, 0, len(pins))
-								for _, p := range pins {
-									pinMap, ok := p.(map[string]any)
-									if !ok {
-										continue
-									}
-
-									newPin := map[string]any{}
-									if idVal, ok := pinMap["id"]; ok {
-										newPin["id"] = idVal
-									}
-
-									if encText, ok := pinMap["text"].(string); ok && encText != "" {
-										if decryptedText, err := utils.DecryptText(encText, encKey); err == nil {
-											newPin["text"] = decryptedText
-										}
-									}
-
-									if latVal, ok := pinMap["lat"]; ok {
-										switch latRaw := latVal.(type) {
-										case string:
-											if decLat, err := utils.DecryptText(latRaw, encKey); err == nil {
-												if latFloat, err := strconv.ParseFloat(decLat, 64); err == nil {
-													newPin["lat"] = latFloat
-												}
-											}
-										case float64:
-											newPin["lat"] = latRaw
-										}
-									}
-
-									if lonVal, ok := pinMap["lon"]; ok {
-										switch lonRaw := lonVal.(type) {
-										case string:
-											if decLon, err := utils.DecryptText(lonRaw, encKey); err == nil {
-												if lonFloat, err := strconv.ParseFloat(decLon, 64); err == nil {
-													newPin["lon"] = lonFloat
-												}
-											}
-										case float64:
-											newPin["lon"] = lonRaw
-										}
-									}
-
-									if len(newPin) > 0 {
-										newPins = append(newPins, newPin)
-									}
-								}
-								day["pins"] = newPins
-							}
-						} else {
-							delete(day, "pins")
+					// Decrypt the day for the readable backup
+					decryptedDay, err := decryptBackupDay(day, encKey, func(uuid, filename string) string {
+						// Reuse the assigned filename if the file is in multiple days
+						targetName, exists := filesToExport[uuid]
+						if !exists {
+							targetName = uniqueFilename(filename, usedFilenames)
+							usedFilenames[targetName] = true
+							filesToExport[uuid] = targetName
 						}
+						return targetName
+					})
+					if err != nil {
+						utils.Logger.Printf("Error converting day %d/%02d/%02d of user %d for the backup: %v", year, month, day.Day, userID, err)
+						continue
 					}
-
-					newDays = append(newDays, day)
-					hasData = true
+					decryptedDays = append(decryptedDays, decryptedDay)
 				}
 
-				if hasData {
-					monthContent["days"] = newDays
+				if len(newDays) == 0 && len(decryptedDays) == 0 {
+					continue
+				}
 
-					// Write to ZIP
-					zipPath := fmt.Sprintf("%d/%02d.json", year, month)
-					f, err := zw.Create(zipPath)
-					if err == nil {
-						enc := json.NewEncoder(f)
-						enc.SetIndent("", fmt.Sprintf("%*s", utils.Settings.Indent, ""))
-						enc.Encode(monthContent)
+				var document any
+				if req.Encrypted {
+					monthContent.Days = newDays
+					document = monthContent
+				} else {
+					// Keep schema version and unknown keys of the month
+					monthContent.Days = nil
+					monthMap, err := monthContent.ToMap()
+					if err != nil {
+						continue
 					}
+					monthMap["days"] = decryptedDays
+					document = monthMap
+				}
+
+				// Write to ZIP
+				zipPath := fmt.Sprintf("%d/%02d.json", year, month)
+				f, err := zw.Create(zipPath)
+				if err == nil {
+					enc := json.NewEncoder(f)
+					enc.SetIndent("", fmt.Sprintf("%*s", utils.Settings.Indent, ""))
+					enc.Encode(document)
 				}
 			}
 		}
@@ -512,29 +434,96 @@ func performBackup(w http.ResponseWriter, userID int, derivedKey string, req Bac
 	// 5. Export Files
 	if includeFiles {
 		for uuid, targetName := range filesToExport {
-			filePath := filepath.Join(utils.Settings.DataPath, fmt.Sprintf("%d", userID), "files", uuid)
-			if _, err := os.Stat(filePath); err == nil {
-				rawContent, errRead := os.ReadFile(filePath)
-				if errRead == nil {
-					var contentToWrite []byte
-					if req.Encrypted {
-						contentToWrite = rawContent
-					} else {
-						decrypted, errDec := utils.DecryptFile(rawContent, encKey)
-						if errDec == nil {
-							contentToWrite = decrypted
-						} else {
-							utils.Logger.Printf("Error decrypting file %s: %v", uuid, errDec)
-							continue
-						}
-					}
+			// An encrypted backup contains the stored files as they are
+			var content io.ReadCloser
+			var err error
+			if req.Encrypted {
+				content, err = utils.OpenFile(userID, uuid)
+			} else {
+				content, err = utils.OpenDecryptedFile(userID, uuid, encKey)
+			}
+			if err != nil {
+				utils.Logger.Printf("Error reading file %s: %v", uuid, err)
+				continue
+			}
 
-					f, err := zw.Create(fmt.Sprintf("files/%s", targetName))
-					if err == nil {
-						f.Write(contentToWrite)
-					}
-				}
+			f, err := zw.Create(fmt.Sprintf("files/%s", targetName))
+			if err == nil {
+				_, err = io.Copy(f, content)
 			}
+			content.Close()
+			if err != nil {
+				utils.Logger.Printf("Error writing file %s to backup: %v", uuid, err)
+			}
+		}
+	}
+}
+
+// decryptBackupDay converts a day into the readable format of the backup.
+// Files only keep the filename that assignFilename returns for them in the ZIP.
+func decryptBackupDay(day utils.Day, encKey string, assignFilename func(uuid, filename string) string) (map[string]any, error) {
+	if day.Text != "" {
+		if decryptedText, err := utils.DecryptText(day.Text, encKey); err == nil {
+			day.Text = decryptedText
+		}
+	}
+	if day.DateWritten != "" {
+		if decryptedDate, err := utils.DecryptText(day.DateWritten, encKey); err == nil {
+			day.DateWritten = decryptedDate
+		}
+	}
+
+	files := make([]any, 0, len(day.Files))
+	for _, file := range day.Files {
+		filename := ""
+		if decryptedFilename, err := utils.DecryptText(file.EncFilename, encKey); err == nil {
+			filename = decryptedFilename
+		}
+		if file.UUIDFilename != "" && filename != "" {
+			filename = assignFilename(file.UUIDFilename, filename)
+		}
+		files = append(files, map[string]any{"filename": filename})
+	}
+
+	pins := make([]any, 0, len(day.Pins))
+	for _, pin := range day.Pins {
+		// Pins that can't be decrypted are left out
+		decryptedPin, err := decryptPin(pin, encKey)
+		if err != nil || decryptedPin == nil {
+			continue
+		}
+		pins = append(pins, decryptedPin)
+	}
+
+	hasFiles, hasPins := len(day.Files) > 0, len(day.Pins) > 0
+	day.Files, day.Pins = nil, nil
+
+	content, err := day.ToMap()
+	if err != nil {
+		return nil, err
+	}
+	if hasFiles {
+		content["files"] = files
+	}
+	if hasPins {
+		content["pins"] = pins
+	}
+
+	return content, nil
+}
+
+// uniqueFilename returns the filename, numbered if it is already used ("name (2).ext")
+func uniqueFilename(filename string, usedFilenames map[string]bool) string {
+	if !usedFilenames[filename] {
+		return filename
+	}
+
+	ext := filepath.Ext(filename)
+	nameNoExt := strings.TrimSuffix(filename, ext)
+	for counter := 2; ; counter++ {
+		newName := fmt.Sprintf("%s (%d)%s", nameNoExt, counter, ext)
+		if !usedFilenames[newName] {
+			return newName
 		}
 	}
 }
@@ -150,6 +150,8 @@ func ExportData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	utils.LogSecurityEvent(r, userID, derivedKey, "export", map[string]any{"period": period})
+
 	// Set response headers for ZIP download
 	var filename string
 	if period == "periodAll" {
@@ -217,52 +219,35 @@ func ExportData(w http.ResponseWriter, r *http.Request) {
 
 		for month := startMonthLoop; month <= endMonthLoop; month++ {
 			// Get month data
-			content, err := utils.GetMonth(userID, year, month)
+			content, err := utils.ReadMonth(userID, year, month)
 			if err != nil {
-				continue // Skip months that don't exist
-			}
-
-			days, ok := content["days"].([]any)
-			if !ok {
-				continue
+				continue // Skip months that can't be read
 			}
 
 			// Process each day in the month
-			for _, dayInterface := range days {
-				day, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				dayNum, ok := day["day"].(float64)
-				if !ok {
-					continue
-				}
-
-				dayInt := int(dayNum)
-
+			for _, day := range content.Days {
 				// Check if this specific day is within the date range
-				if !isDateInRange(year, month, dayInt) {
+				if !isDateInRange(year, month, day.Day) {
 					continue
 				}
 
 				entry := LogEntry{
 					Year:  year,
 					Month: month,
-					Day:   dayInt,
+					Day:   day.Day,
 				}
 
 				// Decrypt text and date_written
-				if text, ok := day["text"].(string); ok && text != "" {
-					decryptedText, err := utils.DecryptText(text, encKey)
+				if day.Text != "" {
+					decryptedText, err := utils.DecryptText(day.Text, encKey)
 					if err != nil {
-						utils.Logger.Printf("Error decrypting text for %d-%d-%d: %v", year, month, dayInt, err)
+						utils.Logger.Printf("Error decrypting text for %d-%d-%d: %v", year, month, day.Day, err)
 						continue
 					}
 					entry.Text = decryptedText
 
-					if dateWritten, ok := day["date_written"].(string); ok && dateWritten != "" {
-						decryptedDate, err := utils.DecryptText(dateWritten, encKey)
+					if day.DateWritten != "" {
+						decryptedDate, err := utils.DecryptText(day.DateWritten, encKey)
 						if err == nil {
 							entry.DateWritten = decryptedDate
 						}
@@ -270,134 +255,75 @@ func ExportData(w http.ResponseWriter, r *http.Request) {
 				}
 
 				// Process files
-				if filesList, ok := day["files"].([]any); ok && len(filesList) > 0 {
-					for _, fileInterface := range filesList {
-						file, ok := fileInterface.(map[string]any)
-						if !ok {
-							continue
-						}
+				for _, file := range day.Files {
+					// Decrypt filename
+					decryptedFilename, err := utils.DecryptText(file.EncFilename, encKey)
+					if err != nil {
+						utils.Logger.Printf("Error decrypting filename %s: %v", file.UUIDFilename, err)
+						continue
+					}
 
-						fileID, ok := file["uuid_filename"].(string)
-						if !ok {
-							continue
-						}
+					// The file is decrypted while it is written to the ZIP
+					decryptedContent, err := utils.OpenDecryptedFile(userID, file.UUIDFilename, encKey)
+					if err != nil {
+						utils.Logger.Printf("Error reading file %s: %v", file.UUIDFilename, err)
+						continue
+					}
 
-						encFilename, ok := file["enc_filename"].(string)
-						if !ok {
-							continue
-						}
+					// Create unique filename to avoid conflicts in ZIP
+					dayKey := fmt.Sprintf("%d-%02d-%02d", year, month, day.Day)
+					if usedFilenamesPerDay[dayKey] == nil {
+						usedFilenamesPerDay[dayKey] = make(map[string]bool)
+					}
+					uniqueFilename := generateUniqueFilename(usedFilenamesPerDay[dayKey], decryptedFilename)
 
-						// Decrypt filename
-						decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-						if err != nil {
-							utils.Logger.Printf("Error decrypting filename %s: %v", fileID, err)
-							continue
-						}
+					// Add file to ZIP with unique filename
+					filePath := fmt.Sprintf("files/%d-%02d-%02d/%s", year, month, day.Day, uniqueFilename)
+					fileWriter, err := zipWriter.Create(filePath)
+					if err != nil {
+						decryptedContent.Close()
+						utils.Logger.Printf("Error creating file in ZIP %s: %v", filePath, err)
+						continue
+					}
 
-						// Read and decrypt file content
-						fileContent, err := utils.ReadFile(userID, fileID)
-						if err != nil {
-							utils.Logger.Printf("Error reading file %s: %v", fileID, err)
+					_, err = io.Copy(fileWriter, decryptedContent)
+					decryptedContent.Close()
+					if err != nil {
+						utils.Logger.Printf("Error writing file to ZIP %s: %v", filePath, err)
+						continue
+					}
+
+					entry.Files = append(entry.Files, uniqueFilename)
+				}
+
+				// Add tags
+				entry.Tags = append(entry.Tags, day.Tags...)
+
+				// Add pins (name + coordinates)
+				if pinsInHTML {
+					for _, pin := range day.Pins {
+						if pin.Text == "" {
 							continue
 						}
-
-						decryptedContent, err := utils.DecryptFile(fileContent, encKey)
+						name, err := utils.DecryptText(pin.Text, encKey)
 						if err != nil {
-							utils.Logger.Printf("Error decrypting file %s: %v", fileID, err)
 							continue
 						}
 
-						// Create unique filename to avoid conflicts in ZIP
-						dayKey := fmt.Sprintf("%d-%02d-%02d", year, month, dayInt)
-						if usedFilenamesPerDay[dayKey] == nil {
-							usedFilenamesPerDay[dayKey] = make(map[string]bool)
-						}
-						uniqueFilename := generateUniqueFilename(usedFilenamesPerDay[dayKey], decryptedFilename)
-
-						// Add file to ZIP with unique filename
-						filePath := fmt.Sprintf("files/%d-%02d-%02d/%s", year, month, dayInt, uniqueFilename)
-						fileWriter, err := zipWriter.Create(filePath)
+						lat, err := decryptCoordinate(pin.Lat, encKey)
 						if err != nil {
-							utils.Logger.Printf("Error creating file in ZIP %s: %v", filePath, err)
 							continue
 						}
-
-						_, err = fileWriter.Write(decryptedContent)
+						lon, err := decryptCoordinate(pin.Lon, encKey)
 						if err != nil {
-							utils.Logger.Printf("Error writing file to ZIP %s: %v", filePath, err)
 							continue
 						}
 
-						entry.Files = append(entry.Files, uniqueFilename)
-					}
-				}
-
-				// Add tags
-				if tags, ok := day["tags"].([]any); ok && len(tags) > 0 {
-					for _, tag := range tags {
-						if tagID, ok := tag.(float64); ok {
-							entry.Tags = append(entry.Tags, int(tagID))
-						}
-					}
-				}
-				// Add pins (name + coordinates)
-				if pinsInHTML {
-					if pins, ok := day["pins"].([]any); ok && len(pins) > 0 {
-						for _, pinInterface := range pins {
-							pinObj, ok := pinInterface.(map[string]any)
-							if !ok {
-								continue
-							}
-
-							encName, ok := pinObj["text"].(string)
-							if !ok || encName == "" {
-								continue
-							}
-							name, err := utils.DecryptText(encName, encKey)
-							if err != nil {
-								continue
-							}
-
-							var lat float64
-							switch latRaw := pinObj["lat"].(type) {
-							case string:
-								latStr, err := utils.DecryptText(latRaw, encKey)
-								if err != nil {
-									continue
-								}
-								lat, err = strconv.ParseFloat(latStr, 64)
-								if err != nil {
-									continue
-								}
-							case float64:
-								lat = latRaw
-							default:
-								continue
-							}
-
-							var lon float64
-							switch lonRaw := pinObj["lon"].(type) {
-							case string:
-								lonStr, err := utils.DecryptText(lonRaw, encKey)
-								if err != nil {
-									continue
-								}
-								lon, err = strconv.ParseFloat(lonStr, 64)
-								if err != nil {
-									continue
-								}
-							case float64:
-								lon = lonRaw
-							default:
-								continue
-							}
-
-							entry.Pins = append(entry.Pins, ExportPin{
-								Name: name,
-								Lat:  lat,
-								Lon:  lon,
-							})
-						}
+						entry.Pins = append(entry.Pins, ExportPin{
+							Name: name,
+							Lat:  lat,
+							Lon:  lon,
+						})
 					}
 				}
 
@@ -1144,6 +1070,15 @@ func loadAndDecryptTags(userID int, derivedKey string) (map[int]Tag, error) {
 	return tagMap, nil
 }
 
+// decryptCoordinate decrypts the latitude or longitude of a pin
+func decryptCoordinate(encCoordinate, encKey string) (float64, error) {
+	coordinate, err := utils.DecryptText(encCoordinate, encKey)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(coordinate, 64)
+}
+
 // generateUniqueFilename creates a unique filename by appending (2), (3), etc. if conflicts exist
 func generateUniqueFilename(usedFilenames map[string]bool, originalFilename string) string {
 	if !usedFilenames[originalFilename] {
@@ -2,20 +2,24 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/phitux/dailytxt/backend/utils"
 )
 
-// UploadFile handles uploading a file
+// UploadFile handles uploading a file. The file is encrypted and stored while
+// it is received, it is never kept in memory as a whole.
 func UploadFile(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -28,171 +32,364 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse form
-	if err := r.ParseMultipartForm(10 << 20); err != nil { // 10 MB max
+	// Get encryption key first (before reading large file)
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Don't receive a file that can't be stored anyway
+	if err := utils.CheckQuota(userID, max(0, r.ContentLength)); err != nil {
+		if errors.Is(err, utils.ErrQuotaExceeded) {
+			quotaExceeded(w, userID)
+		} else {
+			http.Error(w, fmt.Sprintf("Error checking storage quota: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Read the form as stream
+	reader, err := r.MultipartReader()
+	if err != nil {
 		http.Error(w, fmt.Sprintf("Error parsing form: %v", err), http.StatusBadRequest)
 		return
 	}
 
+	// The file is expected as last field. Older clients send the uuid after
+	// the file, then the file is buffered in a temporary file first.
+	fields := map[string]string{}
+	var filename string
+	var size int64
+	var metadata *utils.ImageMetadata
+	var spooled *os.File
+	fileWritten := false
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error parsing form: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() != "file" {
+			value, err := io.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error parsing form: %v", err), http.StatusBadRequest)
+				return
+			}
+			fields[part.FormName()] = string(value)
+			continue
+		}
+
+		filename = part.FileName()
+		if fields["uuid"] != "" && !utils.ValidFileUUID(fields["uuid"]) {
+			http.Error(w, "Invalid uuid parameter", http.StatusBadRequest)
+			return
+		}
+		if fields["uuid"] == "" {
+			// Like the stored file, the temporary file is encrypted and only
+			// as large as the quota allows
+			spooled, err = os.CreateTemp("", "dailytxt-upload-*")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error buffering file: %v", err), http.StatusInternalServerError)
+				return
+			}
+			defer os.Remove(spooled.Name())
+			defer spooled.Close()
+
+			if err := spoolUploadedFile(spooled, part, userID, encKey); err != nil {
+				if errors.Is(err, utils.ErrQuotaExceeded) {
+					quotaExceeded(w, userID)
+				} else {
+					http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusBadRequest)
+				}
+				return
+			}
+			continue
+		}
+
+		if size, metadata, err = writeUploadedFile(part, filename, userID, fields["uuid"], encKey); err != nil {
+			writeFileError(w, userID, err)
+			return
+		}
+		fileWritten = true
+	}
+
 	// Get form values
-	dayStr := r.FormValue("day")
+	uuid := fields["uuid"]
+	if uuid == "" {
+		http.Error(w, "Missing uuid parameter", http.StatusBadRequest)
+		return
+	}
+	if !utils.ValidFileUUID(uuid) {
+		http.Error(w, "Invalid uuid parameter", http.StatusBadRequest)
+		return
+	}
+
+	if !fileWritten {
+		if spooled == nil {
+			http.Error(w, "Error getting file: missing file", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		decrypted, err := utils.DecryptFileStream(spooled, encKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if size, metadata, err = writeUploadedFile(decrypted, filename, userID, uuid, encKey); err != nil {
+			writeFileError(w, userID, err)
+			return
+		}
+	}
+
+	// Remove the file again if the request is invalid
+	var thumbnails []int
+	fail := func(message string, status int) {
+		utils.RemoveFile(userID, uuid)
+		utils.RemoveThumbnails(userID, uuid, thumbnails)
+		utils.InvalidateUserUsage(userID)
+		http.Error(w, message, status)
+	}
+
+	dayStr := fields["day"]
 	if dayStr == "" {
-		http.Error(w, "Missing day parameter", http.StatusBadRequest)
+		fail("Missing day parameter", http.StatusBadRequest)
 		return
 	}
 	day, err := strconv.Atoi(dayStr)
 	if err != nil {
-		http.Error(w, "Invalid day parameter", http.StatusBadRequest)
+		fail("Invalid day parameter", http.StatusBadRequest)
 		return
 	}
 
-	monthStr := r.FormValue("month")
+	monthStr := fields["month"]
 	if monthStr == "" {
-		http.Error(w, "Missing month parameter", http.StatusBadRequest)
+		fail("Missing month parameter", http.StatusBadRequest)
 		return
 	}
 	month, err := strconv.Atoi(monthStr)
 	if err != nil {
-		http.Error(w, "Invalid month parameter", http.StatusBadRequest)
+		fail("Invalid month parameter", http.StatusBadRequest)
 		return
 	}
 
-	yearStr := r.FormValue("year")
+	yearStr := fields["year"]
 	if yearStr == "" {
-		http.Error(w, "Missing year parameter", http.StatusBadRequest)
+		fail("Missing year parameter", http.StatusBadRequest)
 		return
 	}
 	year, err := strconv.Atoi(yearStr)
 	if err != nil {
-		http.Error(w, "Invalid year parameter", http.StatusBadRequest)
+		fail("Invalid year parameter", http.StatusBadRequest)
 		return
 	}
 
-	uuid := r.FormValue("uuid")
-	if uuid == "" {
-		http.Error(w, "Missing uuid parameter", http.StatusBadRequest)
+	// Encrypt filename
+	encFilename, err := utils.EncryptText(filename, encKey)
+	if err != nil {
+		fail(fmt.Sprintf("Error encrypting filename: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Get file
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting file: %v", err), http.StatusBadRequest)
+	// Images get thumbnails
+	thumbnails = createThumbnails(userID, uuid, filename, encKey)
+
+	// Add file to day
+	if err := attachFile(userID, year, month, day, utils.FileRef{
+		EncFilename:  encFilename,
+		UUIDFilename: uuid,
+		Size:         size,
+		Thumbnails:   thumbnails,
+	}); err != nil {
+		fail(fmt.Sprintf("Error adding file to day: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 
-	// Get encryption key first (before reading large file)
-	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
-		return
+	// Return success
+	response := map[string]any{
+		"success":    true,
+		"thumbnails": thumbnails,
+	}
+	if suggestions := imageMetadataResponse(metadata, filename, year, month, day); suggestions != nil {
+		response["metadata"] = suggestions
 	}
+	utils.JSONResponse(w, http.StatusOK, response)
+}
 
-	// Read file into a buffer (more memory efficient)
-	fileBytes, err := io.ReadAll(file)
+// imageMetadataResponse returns what is offered to the user for the EXIF data
+// of an uploaded image: a pin (the body for addPin) and the capture date.
+// Returns nil if there is nothing to offer.
+func imageMetadataResponse(metadata *utils.ImageMetadata, filename string, year, month, day int) map[string]any {
+	if metadata == nil || (!metadata.HasLocation && metadata.CaptureTime.IsZero()) {
+		return nil
+	}
+
+	response := map[string]any{}
+	if metadata.HasLocation {
+		response["pin"] = AddPinRequest{
+			Lat:   metadata.Lat,
+			Lon:   metadata.Lon,
+			Text:  filename,
+			Day:   day,
+			Month: month,
+			Year:  year,
+		}
+	}
+	if !metadata.CaptureTime.IsZero() {
+		response["captured"] = map[string]any{
+			"year":  metadata.CaptureTime.Year(),
+			"month": int(metadata.CaptureTime.Month()),
+			"day":   metadata.CaptureTime.Day(),
+			"time":  metadata.CaptureTime.Format("15:04"),
+		}
+	}
+	return response
+}
+
+// createThumbnails creates the thumbnails of an uploaded file. A failure
+// doesn't fail the upload, the file just has no thumbnails.
+func createThumbnails(userID int, uuid string, filename string, encKey string) []int {
+	thumbnails, err := utils.CreateThumbnails(userID, uuid, filename, encKey)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
-		return
+		utils.Logger.Printf("Error creating thumbnails of file %s of user %d: %v", uuid, userID, err)
+		return nil
+	}
+	if len(thumbnails) > 0 {
+		// They count for the quota as well
+		utils.InvalidateUserUsage(userID)
 	}
-	// Ensure fileBytes is cleared when function exits
-	defer func() { fileBytes = nil }()
+	return thumbnails
+}
+
+// attachFile adds a stored file to a day (the day is created if necessary)
+func attachFile(userID, year, month, day int, file utils.FileRef) error {
+	// Lock the logs of this user (not while receiving the file, that can take long)
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
 
-	// Encrypt file
-	encryptedFile, err := utils.EncryptFile(fileBytes, encKey)
+	// Get month data
+	content, err := utils.ReadMonth(userID, year, month)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error encrypting file: %v", err), http.StatusInternalServerError)
-		return
+		return fmt.Errorf("error retrieving month data: %v", err)
 	}
-	// Ensure encryptedFile is cleared when function exits
-	defer func() { encryptedFile = nil }()
 
-	// Clear original file data from memory immediately after encryption
-	fileBytes = nil
+	dayObj := content.GetOrCreateDay(day)
+	dayObj.Files = append(dayObj.Files, file)
 
-	// Write file
-	if err := utils.WriteFile(encryptedFile, userID, uuid); err != nil {
-		http.Error(w, fmt.Sprintf("Error writing file: %v", err), http.StatusInternalServerError)
-		return
+	// Write month data
+	if err := utils.SaveMonth(userID, year, month, content); err != nil {
+		return fmt.Errorf("error writing month data: %v", err)
 	}
+	return nil
+}
 
-	// Clear encrypted data from memory immediately after writing
-	encryptedFile = nil
+// writeUploadedFile stores an uploaded file. The EXIF data of images is read
+// and removed from the stored image if the user wants that.
+func writeUploadedFile(content io.Reader, filename string, userID int, uuid string, encKey string) (int64, *utils.ImageMetadata, error) {
+	var metadata *utils.ImageMetadata
+	if utils.IsImageFilename(filename) {
+		settings, err := getSettings(userID, encKey)
+		if err != nil {
+			return 0, nil, err
+		}
+		strip, _ := settings["stripImageMetadata"].(bool)
 
-	// Get month data
-	content, err := utils.GetMonth(userID, year, month)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
-		return
+		inspected, imageMetadata := utils.InspectImage(content, strip)
+		defer inspected.Close()
+		content, metadata = inspected, imageMetadata
 	}
 
-	// Encrypt filename
-	encFilename, err := utils.EncryptText(header.Filename, encKey)
+	// Only as much as the quota allows
+	limited, err := utils.QuotaReader(userID, content)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error encrypting filename: %v", err), http.StatusInternalServerError)
-		return
+		return 0, nil, err
 	}
 
-	// Create new file entry
-	newFile := map[string]any{
-		"enc_filename":  encFilename,
-		"uuid_filename": uuid,
-		"size":          header.Size,
+	size, err := writeEncryptedFile(limited, userID, uuid, encKey)
+	limited.Release(size)
+	if err != nil {
+		return 0, nil, err
 	}
+	return size, metadata, nil
+}
 
-	// Add file to day
-	days, ok := content["days"].([]any)
-	if !ok {
-		days = []any{}
+// spoolUploadedFile writes an uploaded file encrypted to a temporary file,
+// as much as the quota allows. The quota is only reserved while spooling,
+// writeUploadedFile reserves it again for the stored file.
+func spoolUploadedFile(spooled *os.File, content io.Reader, userID int, encKey string) error {
+	limited, err := utils.QuotaReader(userID, content)
+	if err != nil {
+		return err
 	}
-
-	dayFound := false
-	for i, dayInterface := range days {
-		dayObj, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
+	defer limited.Release(0)
+	counter := &countingReader{reader: limited}
+	encrypted, err := utils.EncryptFileStream(counter, encKey)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(spooled, encrypted); err != nil {
+		// The error of reading the content is more useful (e.g. the quota)
+		if counter.err != nil {
+			return counter.err
 		}
+		return err
+	}
+	return nil
+}
 
-		dayNum, ok := dayObj["day"].(float64)
-		if !ok || int(dayNum) != day {
-			continue
-		}
+// writeFileError writes the response for an error of writeUploadedFile
+func writeFileError(w http.ResponseWriter, userID int, err error) {
+	if errors.Is(err, utils.ErrQuotaExceeded) {
+		quotaExceeded(w, userID)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Error writing file: %v", err), http.StatusInternalServerError)
+}
 
-		// Add file to existing day
-		dayFound = true
-		files, ok := dayObj["files"].([]any)
-		if !ok {
-			files = []any{}
-		}
-		files = append(files, newFile)
-		dayObj["files"] = files
-		days[i] = dayObj
-		break
+// writeEncryptedFile encrypts and stores a file while reading it.
+// Returns the size of the unencrypted file.
+func writeEncryptedFile(content io.Reader, userID int, uuid string, encKey string) (int64, error) {
+	counter := &countingReader{reader: content}
+	encrypted, err := utils.EncryptFileStream(counter, encKey)
+	if err != nil {
+		return 0, err
 	}
 
-	if !dayFound {
-		// Create new day with file
-		days = append(days, map[string]any{
-			"day":   day,
-			"files": []any{newFile},
-		})
+	if err := utils.WriteFileStream(encrypted, userID, uuid); err != nil {
+		// The error of reading the content is more useful (e.g. the quota)
+		if counter.err != nil {
+			return 0, counter.err
+		}
+		return 0, err
 	}
 
-	// Update days array
-	content["days"] = days
+	return counter.count, nil
+}
 
-	// Write month data
-	if err := utils.WriteMonth(userID, year, month, content); err != nil {
-		// Cleanup on error
-		utils.RemoveFile(userID, uuid)
-		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
-		return
-	}
+// countingReader counts the bytes read from reader and keeps the read error
+type countingReader struct {
+	reader io.Reader
+	count  int64
+	err    error
+}
 
-	// Return success
-	utils.JSONResponse(w, http.StatusOK, map[string]bool{
-		"success": true,
-	})
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return n, err
 }
 
 // DownloadFile handles downloading a file
@@ -223,51 +420,153 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read file
-	encryptedFile, err := utils.ReadFile(userID, uuid)
+	// Open file
+	file, err := utils.OpenFile(userID, uuid)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
 		return
 	}
-	// Ensure encryptedFile is cleared when function exits
-	defer func() { encryptedFile = nil }()
+	defer file.Close()
 
-	// Decrypt file
-	decryptedFile, err := utils.DecryptFile(encryptedFile, encKey)
+	// Decrypt only the parts that are sent
+	decrypted, err := utils.NewFileReader(file, encKey)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error decrypting file: %v", err), http.StatusInternalServerError)
 		return
 	}
-	// Ensure decryptedFile is cleared when function exits
-	defer func() { decryptedFile = nil }()
 
-	// Clear encrypted data from memory immediately after decryption
-	encryptedFile = nil
+	// With the day of the file, its name determines the content type.
+	// Otherwise the content type is sniffed.
+	filename := ""
+	if year, err := strconv.Atoi(r.URL.Query().Get("year")); err == nil {
+		month, _ := strconv.Atoi(r.URL.Query().Get("month"))
+		day, _ := strconv.Atoi(r.URL.Query().Get("day"))
+		filename = storedFilename(userID, year, month, day, uuid, encKey)
+	}
 
-	// Set response headers for streaming
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", "attachment")
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "true" {
+		disposition = "attachment"
+	}
+	if filename != "" {
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+	}
 
-	// Write file to response
-	if _, err := w.Write(decryptedFile); err != nil {
-		http.Error(w, fmt.Sprintf("Error writing response: %v", err), http.StatusInternalServerError)
+	serveFile(w, r, decrypted, filename, disposition)
+}
+
+// serveFile sends a decrypted file. Handles Range, If-None-Match and If-Range
+// requests.
+func serveFile(w http.ResponseWriter, r *http.Request, decrypted *utils.FileReader, filename string, disposition string) {
+	// A stored file never changes, the ETag only changes if the file is replaced
+	w.Header().Set("ETag", `"`+decrypted.Tag()+`"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Uploaded HTML or SVG files must not run scripts in the context of the app
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'")
+
+	http.ServeContent(w, r, filename, time.Time{}, decrypted)
+}
+
+// DownloadThumbnail handles downloading a thumbnail of an image
+func DownloadThumbnail(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get parameters
+	uuid := r.URL.Query().Get("uuid")
+	if uuid == "" {
+		http.Error(w, "Missing uuid parameter", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || !slices.Contains(utils.ThumbnailSizes, size) {
+		http.Error(w, "Invalid size parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Open thumbnail
+	file, err := utils.OpenFile(userID, utils.ThumbnailUUID(uuid, size))
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Thumbnail not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error reading thumbnail: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	decrypted, err := utils.NewFileReader(file, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decrypting thumbnail: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	serveFile(w, r, decrypted, "", "inline")
+}
+
+// storedFilename returns the decrypted name of a file of a day ("" if not found)
+func storedFilename(userID, year, month, day int, uuid string, encKey string) string {
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.RLock()
+	defer logsMutex.RUnlock()
+
+	content, err := utils.ReadMonth(userID, year, month)
+	if err != nil {
+		return ""
+	}
+
+	dayObj := content.FindDay(day)
+	if dayObj == nil {
+		return ""
+	}
+	file := dayObj.FindFile(uuid)
+	if file == nil {
+		return ""
+	}
+
+	filename, err := utils.DecryptText(file.EncFilename, encKey)
+	if err != nil {
+		return ""
+	}
+	return filename
 }
 
 // GetAllGPXFiles returns all GPX files with decrypted filename, decrypted content and date.
 // Response format:
 // [{"year":2026,"month":4,"day":11,"filename":"track.gpx","uuid_filename":"...","content":"..."}]
 func GetAllGPXFiles(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.RLock()
-	defer utils.LogsMutex.RUnlock()
-
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.RLock()
+	defer logsMutex.RUnlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -280,127 +579,75 @@ func GetAllGPXFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	years, err := utils.GetYears(userID)
+	// Only days with files are relevant
+	records, err := utils.QueryDays(userID, utils.DayFilter{WithFiles: true})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error retrieving years: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error retrieving days: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	allGPXFiles := make([]map[string]any, 0)
-
-	for _, yearStr := range years {
-		year, err := strconv.Atoi(yearStr)
-		if err != nil {
-			continue
-		}
+	// The files are written to the response one by one, only one of them is
+	// in memory at a time
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "[")
+	encoder := json.NewEncoder(w)
+	written := 0
 
-		months, err := utils.GetMonths(userID, yearStr)
-		if err != nil {
-			continue
-		}
+	for _, record := range records {
+		year := record.Year
+		month := record.Month
+		day := record.Day.Day
 
-		for _, monthStr := range months {
-			month, err := strconv.Atoi(monthStr)
-			if err != nil {
+		for _, file := range record.Day.Files {
+			uuid := file.UUIDFilename
+			if uuid == "" || file.EncFilename == "" {
 				continue
 			}
 
-			content, err := utils.GetMonth(userID, year, month)
+			filename, err := utils.DecryptText(file.EncFilename, encKey)
 			if err != nil {
 				continue
 			}
 
-			days, ok := content["days"].([]any)
-			if !ok {
+			if !strings.HasSuffix(strings.ToLower(filename), ".gpx") {
 				continue
 			}
 
-			for _, dayInterface := range days {
-				dayObj, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				day := 0
-				switch dayVal := dayObj["day"].(type) {
-				case float64:
-					day = int(dayVal)
-				case int:
-					day = dayVal
-				case string:
-					parsed, err := strconv.Atoi(dayVal)
-					if err != nil {
-						continue
-					}
-					day = parsed
-				default:
-					continue
-				}
-
-				filesList, ok := dayObj["files"].([]any)
-				if !ok || len(filesList) == 0 {
-					continue
-				}
+			decrypted, err := utils.OpenDecryptedFile(userID, uuid, encKey)
+			if err != nil {
+				continue
+			}
+			content, err := io.ReadAll(decrypted)
+			decrypted.Close()
+			if err != nil {
+				utils.Logger.Printf("Error decrypting file %s of user %d: %v", uuid, userID, err)
+				continue
+			}
 
-				for _, fileInterface := range filesList {
-					fileObj, ok := fileInterface.(map[string]any)
-					if !ok {
-						continue
-					}
-
-					uuid, ok := fileObj["uuid_filename"].(string)
-					if !ok || uuid == "" {
-						continue
-					}
-
-					encFilename, ok := fileObj["enc_filename"].(string)
-					if !ok || encFilename == "" {
-						continue
-					}
-
-					filename, err := utils.DecryptText(encFilename, encKey)
-					if err != nil {
-						continue
-					}
-
-					if !strings.HasSuffix(strings.ToLower(filename), ".gpx") {
-						continue
-					}
-
-					encryptedFile, err := utils.ReadFile(userID, uuid)
-					if err != nil {
-						continue
-					}
-
-					decryptedFile, err := utils.DecryptFile(encryptedFile, encKey)
-					encryptedFile = nil
-					if err != nil {
-						continue
-					}
-
-					allGPXFiles = append(allGPXFiles, map[string]any{
-						"year":     year,
-						"month":    month,
-						"day":      day,
-						"filename": filename,
-						//"uuid_filename": uuid,
-						"content": string(decryptedFile),
-					})
-
-					decryptedFile = nil
-				}
+			if written > 0 {
+				io.WriteString(w, ",")
+			}
+			if err := encoder.Encode(map[string]any{
+				"year":     year,
+				"month":    month,
+				"day":      day,
+				"filename": filename,
+				//"uuid_filename": uuid,
+				"content": string(content),
+			}); err != nil {
+				utils.Logger.Printf("Error writing GPX files of user %d: %v", userID, err)
+				return
 			}
+			written++
 		}
 	}
 
-	utils.JSONResponse(w, http.StatusOK, allGPXFiles)
+	io.WriteString(w, "]")
 }
 
 // DeleteFile handles deleting a file
 func DeleteFile(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -408,6 +655,11 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	// Get parameters
 	uuid := r.URL.Query().Get("uuid")
 	if uuid == "" {
@@ -449,78 +701,37 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, year, month)
+	content, err := utils.ReadMonth(userID, year, month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Check if days exist
-	days, ok := content["days"].([]any)
-	if !ok {
-		http.Error(w, "Day not found - json error", http.StatusInternalServerError)
-		return
-	}
-
 	// Find day and file
-	fileFound := false
-	for i, dayInterface := range days {
-		dayObj, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		dayNum, ok := dayObj["day"].(float64)
-		if !ok || int(dayNum) != day {
-			continue
-		}
-
-		// Check for files
-		files, ok := dayObj["files"].([]any)
-		if !ok {
-			continue
-		}
-
-		// Find file
-		for j, fileInterface := range files {
-			file, ok := fileInterface.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			uuidFilename, ok := file["uuid_filename"].(string)
-			if !ok || uuidFilename != uuid {
-				continue
-			}
-
-			// Remove file from array
-			if err := utils.RemoveFile(userID, uuid); err != nil {
-				http.Error(w, fmt.Sprintf("Failed to delete file: %v", err), http.StatusInternalServerError)
-				return
-			}
-
-			files = append(files[:j], files[j+1:]...)
-			dayObj["files"] = files
-			days[i] = dayObj
-			fileFound = true
-			break
-		}
-
-		if fileFound {
-			break
-		}
+	dayObj := content.FindDay(day)
+	if dayObj == nil || dayObj.FindFile(uuid) == nil {
+		http.Error(w, "Failed to delete file - not found in log", http.StatusInternalServerError)
+		return
 	}
 
-	if !fileFound {
-		http.Error(w, "Failed to delete file - not found in log", http.StatusInternalServerError)
+	if err := utils.RemoveFile(userID, uuid); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete file: %v", err), http.StatusInternalServerError)
 		return
 	}
+	utils.RemoveThumbnails(userID, uuid, dayObj.FindFile(uuid).Thumbnails)
+	utils.InvalidateUserUsage(userID)
 
-	// Update days array
-	content["days"] = days
+	// Remove file from array
+	files := make([]utils.FileRef, 0, len(dayObj.Files))
+	for _, file := range dayObj.Files {
+		if file.UUIDFilename != uuid {
+			files = append(files, file)
+		}
+	}
+	dayObj.Files = files
 
 	// Write month data
-	if err := utils.WriteMonth(userID, year, month, content); err != nil {
+	if err := utils.SaveMonth(userID, year, month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to write changes of deleted file: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -542,15 +753,18 @@ type RenameFileRequest struct {
 
 // RenameFile handles renaming a file
 func RenameFile(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -583,7 +797,7 @@ func RenameFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	content, err := utils.ReadMonth(userID, req.Year, req.Month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
@@ -602,61 +816,22 @@ func RenameFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Find and update the file
-	days, ok := content["days"].([]any)
-	if !ok {
-		utils.JSONResponse(w, http.StatusNotFound, map[string]any{
-			"success": false,
-			"message": "No days found",
-		})
-		return
-	}
-
-	found := false
-	for _, d := range days {
-		day, ok := d.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		dayNum, ok := day["day"].(float64)
-		if !ok || int(dayNum) != req.Day {
-			continue
-		}
-
-		files, ok := day["files"].([]any)
-		if !ok {
-			continue
-		}
-
-		// Find and rename the specific file
-		for _, f := range files {
-			file, ok := f.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			if uuid, ok := file["uuid_filename"].(string); ok && uuid == req.UUID {
-				file["enc_filename"] = enc_filename
-				found = true
-				break
-			}
-		}
-
-		if found {
-			break
-		}
+	var file *utils.FileRef
+	if dayObj := content.FindDay(req.Day); dayObj != nil {
+		file = dayObj.FindFile(req.UUID)
 	}
 
-	if !found {
+	if file == nil {
 		utils.JSONResponse(w, http.StatusNotFound, map[string]any{
 			"success": false,
 			"message": "File not found",
 		})
 		return
 	}
+	file.EncFilename = enc_filename
 
 	// Save the updated month data
-	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+	if err := utils.SaveMonth(userID, req.Year, req.Month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -675,9 +850,6 @@ type ReorderFilesRequest struct {
 
 // ReorderFiles handles reordering files within a day
 func ReorderFiles(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -685,6 +857,11 @@ func ReorderFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	// Parse request body
 	var req ReorderFilesRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -701,97 +878,35 @@ func ReorderFiles(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	content, err := utils.ReadMonth(userID, req.Year, req.Month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Find and reorder files for the specific day
-	days, ok := content["days"].([]any)
-	if !ok {
+	// Find the day
+	dayObj := content.FindDay(req.Day)
+	if dayObj == nil || len(dayObj.Files) == 0 {
 		utils.JSONResponse(w, http.StatusNotFound, map[string]any{
 			"success": false,
-			"message": "No days found",
+			"message": "Day not found",
 		})
 		return
 	}
 
-	found := false
-	for _, d := range days {
-		day, ok := d.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		dayNum, ok := day["day"].(float64)
-		if !ok || int(dayNum) != req.Day {
-			continue
-		}
-
-		files, ok := day["files"].([]any)
-		if !ok {
-			continue
+	// Sort files by their new order, files not in the reorder map are moved to the end
+	orderOf := func(file utils.FileRef) int {
+		if order, exists := req.FileOrder[file.UUIDFilename]; exists {
+			return order
 		}
-
-		// Create a slice to hold files with their new order
-		type fileWithOrder struct {
-			file  map[string]any
-			order int
-		}
-
-		var orderedFiles []fileWithOrder
-
-		// Assign order to each file
-		for _, f := range files {
-			file, ok := f.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			uuid, ok := file["uuid_filename"].(string)
-			if !ok {
-				continue
-			}
-
-			if order, exists := req.FileOrder[uuid]; exists {
-				orderedFiles = append(orderedFiles, fileWithOrder{file: file, order: order})
-			} else {
-				// Files not in the reorder map get appended at the end
-				orderedFiles = append(orderedFiles, fileWithOrder{file: file, order: len(req.FileOrder)})
-			}
-		}
-
-		// Sort files by their order
-		for i := 0; i < len(orderedFiles)-1; i++ {
-			for j := i + 1; j < len(orderedFiles); j++ {
-				if orderedFiles[i].order > orderedFiles[j].order {
-					orderedFiles[i], orderedFiles[j] = orderedFiles[j], orderedFiles[i]
-				}
-			}
-		}
-
-		// Update the files array with the new order
-		newFiles := make([]any, len(orderedFiles))
-		for i, fileWithOrder := range orderedFiles {
-			newFiles[i] = fileWithOrder.file
-		}
-		day["files"] = newFiles
-
-		found = true
-		break
-	}
-
-	if !found {
-		utils.JSONResponse(w, http.StatusNotFound, map[string]any{
-			"success": false,
-			"message": "Day not found",
-		})
-		return
+		return len(req.FileOrder)
 	}
+	sort.SliceStable(dayObj.Files, func(i, j int) bool {
+		return orderOf(dayObj.Files[i]) < orderOf(dayObj.Files[j])
+	})
 
 	// Save the updated month data
-	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+	if err := utils.SaveMonth(userID, req.Year, req.Month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
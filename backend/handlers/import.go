@@ -2,15 +2,14 @@ package handlers
 
 import (
 	"archive/zip"
-	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -20,9 +19,6 @@ import (
 
 // ImportData handles the import of user data
 func ImportData(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// 1. Auth check
 	val := r.Context().Value(utils.UserIDKey)
 	if val == nil {
@@ -35,6 +31,11 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	valKey := r.Context().Value(utils.DerivedKeyKey)
 	if valKey == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -53,19 +54,13 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, _, err := r.FormFile("file")
+	file, fileHeader, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, "Missing file part", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	fileBytes, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Error reading file", http.StatusInternalServerError)
-		return
-	}
-
 	encryptedStr := r.FormValue("encrypted")
 	isEncrypted := encryptedStr == "true"
 	password := r.FormValue("password")
@@ -86,31 +81,11 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 	coordKey := func(lat, lon float64) string {
 		return fmt.Sprintf("%.10f,%.10f", lat, lon)
 	}
-	parseStoredPinCoord := func(raw any, key string) (float64, bool) {
-		switch v := raw.(type) {
-		case float64:
-			return v, true
-		case string:
-			coordStr := v
-			if key != "" {
-				decrypted, err := utils.DecryptText(v, key)
-				if err != nil {
-					return 0, false
-				}
-				coordStr = decrypted
-			}
-			coord, err := strconv.ParseFloat(coordStr, 64)
-			if err != nil {
-				return 0, false
-			}
-			return coord, true
-		default:
-			return 0, false
-		}
-	}
 
 	// 3. Open Zip
-	zipReader, err := zip.NewReader(bytes.NewReader(fileBytes), int64(len(fileBytes)))
+	// The zip is read from the form (a temporary file if it is large), the
+	// entries are only read when they are imported
+	zipReader, err := zip.NewReader(file, fileHeader.Size)
 	if err != nil {
 		http.Error(w, "Invalid zip file", http.StatusBadRequest)
 		return
@@ -169,7 +144,12 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		found := false
 		if utils.VerifyPassword(password, storedHash) {
 			// Password correct
-			dkBytes, err := utils.DeriveKeyFromPassword(password, salt)
+			params, err := utils.KeyParams(userMap)
+			if err != nil {
+				http.Error(w, "Invalid backup: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			dkBytes, err := utils.DeriveKeyFromPassword(password, salt, params)
 			if err != nil {
 				http.Error(w, "Error deriving key", http.StatusInternalServerError)
 				return
@@ -191,7 +171,11 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 						encDerKey := getString(codeMap, "enc_derived_key")
 
 						// Derive temp key from backup code
-						tempKeyBytes, err := utils.DeriveKeyFromPassword(password, codeSalt)
+						params, err := utils.KeyParams(codeMap)
+						if err != nil {
+							continue
+						}
+						tempKeyBytes, err := utils.DeriveKeyFromPassword(password, codeSalt, params)
 						if err != nil {
 							continue
 						}
@@ -200,6 +184,10 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 						// Using URLEncoding here as per security.go logic for backup codes
 						decryptedKey, err := utils.DecryptText(encDerKey, base64.URLEncoding.EncodeToString(tempKeyBytes))
 						if err == nil {
+							// The code may contain the derived key from before an Argon2 upgrade
+							if resolvedKey, err := utils.ResolveDerivedKey(userMap, decryptedKey); err == nil {
+								decryptedKey = resolvedKey
+							}
 							importKey = decryptedKey
 							found = true
 							break
@@ -370,93 +358,97 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 
 	// Prime hash map with already existing user files so identical imported content
 	// can reuse current files instead of creating duplicates.
-	existingFilesDir := filepath.Join(utils.Settings.DataPath, strconv.Itoa(userID), "files")
-	if existingFileEntries, err := os.ReadDir(existingFilesDir); err == nil {
-		for _, existing := range existingFileEntries {
-			if existing.IsDir() {
-				continue
-			}
-			uuid := existing.Name()
-			raw, err := utils.ReadFile(userID, uuid)
+	if existingUUIDs, err := utils.ListFiles(userID); err == nil {
+		for _, uuid := range existingUUIDs {
+			content, err := utils.OpenDecryptedFile(userID, uuid, currentEncKey)
 			if err != nil {
 				continue
 			}
-			decrypted, err := utils.DecryptFile(raw, currentEncKey)
+			hash, _, err := hashContent(content)
+			content.Close()
 			if err != nil {
 				continue
 			}
-			sum := sha256.Sum256(decrypted)
-			hash := hex.EncodeToString(sum[:])
 			if _, exists := contentHashToUUID[hash]; !exists {
 				contentHashToUUID[hash] = uuid
 			}
 		}
 	}
 
+	// openImportedFile opens a file of the zip, decrypted if it is an encrypted
+	// import (then the file in the zip is encrypted with importEncKey)
+	openImportedFile := func(f *zip.File) (io.ReadCloser, error) {
+		rc, err := f.Open()
+		if err != nil || !isEncrypted {
+			return rc, err
+		}
+		decrypted, err := utils.DecryptFileStream(rc, importEncKey)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{decrypted, rc}, nil
+	}
+
 	for _, f := range zipReader.File {
 		if strings.HasPrefix(f.Name, "files/") && !f.FileInfo().IsDir() {
+			// fname is the UUID in encrypted imports, the filename in decrypted imports
 			fname := filepath.Base(f.Name)
 			// Skip dotfiles (Mac artifacts etc)
 			if strings.HasPrefix(fname, ".") {
 				continue
 			}
 
-			// Read content
-			rc, err := f.Open()
+			// The content is read twice: to find out if the file already
+			// exists, and to write it. It is never kept in memory.
+			content, err := openImportedFile(f)
 			if err != nil {
-				utils.Logger.Printf("Error opening zip file %s: %v", f.Name, err)
+				utils.Logger.Printf("Error opening imported file %s: %v", fname, err)
 				continue
 			}
-
-			content, err := io.ReadAll(rc)
-			rc.Close()
+			hash, size, err := hashContent(content)
+			content.Close()
 			if err != nil {
-				utils.Logger.Printf("Error reading zip file %s: %v", f.Name, err)
+				utils.Logger.Printf("Error reading imported file %s: %v", fname, err)
 				continue
 			}
 
-			// Decrypt if needed
-			var finalContent []byte
-			if isEncrypted {
-				// If encrypted import, file on disk (and in zip) is encrypted.
-				// We must decrypt it with importEncKey
-				dec, err := utils.DecryptFile(content, importEncKey)
-				if err != nil {
-					utils.Logger.Printf("Error decrypting imported file %s: %v", fname, err)
-					// skip or error?
-					continue
-				}
-				finalContent = dec
-				// fname is UUID in encrypted imports
-			} else {
-				// Decrypted import: content is plain.
-				finalContent = content
-				// fname is filename in decrypted imports
-			}
-
-			sum := sha256.Sum256(finalContent)
-			hash := hex.EncodeToString(sum[:])
 			if existingUUID, exists := contentHashToUUID[hash]; exists {
-				fileMap[fname] = importedFile{NewUUID: existingUUID, Size: int64(len(finalContent))}
+				fileMap[fname] = importedFile{NewUUID: existingUUID, Size: size}
 				continue
 			}
 
 			// Generate new UUID only for genuinely new file content.
 			newUUID, _ := utils.GenerateUUID()
 
-			// Write
-			encContent, err := utils.EncryptFile(finalContent, currentEncKey)
+			content, err = openImportedFile(f)
 			if err != nil {
-				utils.Logger.Printf("Error encrypting new file: %v", err)
+				utils.Logger.Printf("Error opening imported file %s: %v", fname, err)
 				continue
 			}
 
-			if err := utils.WriteFile(encContent, userID, newUUID); err != nil {
+			// The sizes in the zip can't be trusted, the quota is checked
+			// with the bytes that are actually written. Files written before
+			// the quota was exceeded are removed by the garbage collection.
+			limited, err := utils.QuotaReader(userID, content)
+			if err == nil {
+				size, err = writeEncryptedFile(limited, userID, newUUID, currentEncKey)
+				limited.Release(size)
+			}
+			content.Close()
+			if err != nil {
+				if errors.Is(err, utils.ErrQuotaExceeded) {
+					quotaExceeded(w, userID)
+					return
+				}
 				utils.Logger.Printf("Error writing file %s: %v", newUUID, err)
 				continue
 			}
 
-			fileMap[fname] = importedFile{NewUUID: newUUID, Size: int64(len(finalContent))}
+			fileMap[fname] = importedFile{NewUUID: newUUID, Size: size}
 			contentHashToUUID[hash] = newUUID
 		}
 	}
@@ -482,18 +474,37 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 				json.NewDecoder(rc).Decode(&mData)
 				rc.Close()
 
+				// Months of old backups have the version 0 format, while the month
+				// they are merged into is already upgraded. Encrypted backups contain
+				// the stored month format and are upgraded like stored months.
+				// Decrypted backups have their own format for files and pins, their
+				// day numbers, tags and bookmarks are normalized below.
+				if isEncrypted {
+					if err := utils.UpgradeMonth(mData); err != nil {
+						utils.Logger.Printf("Error upgrading imported month %d/%02d: %v", year, month, err)
+						continue
+					}
+				}
 				days, _ := mData["days"].([]any)
 
 				// Load existing month
-				currentMonthData, _ := utils.GetMonth(userID, year, month)
-				if currentMonthData["days"] == nil {
-					currentMonthData["days"] = []any{}
+				currentMonth, err := utils.ReadMonth(userID, year, month)
+				if err != nil {
+					utils.Logger.Printf("Error reading month %d/%02d for import: %v", year, month, err)
+					continue
 				}
-				cDays := currentMonthData["days"].([]any)
 
 				for _, d := range days {
-					importDay := d.(map[string]any)
-					dayNum := int(getFloat64(importDay, "day"))
+					importDay, ok := d.(map[string]any)
+					if !ok {
+						continue
+					}
+					dayFloat, ok := utils.ToNumber(importDay["day"])
+					if !ok {
+						continue
+					}
+					dayNum := int(dayFloat)
+					newDay := utils.Day{Day: dayNum, IsBookmarked: utils.ToBool(importDay["isBookmarked"])}
 
 					// Decrypt Import Day
 					var plainText, plainDate string
@@ -509,11 +520,13 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 					// Handle Files:
 					// We map imported file references to newly generated UUIDs of files
 					// that were already written in step 6.
-					var newFiles []any
 					seenFileUUIDs := make(map[string]bool)
 					if files, ok := importDay["files"].([]any); ok {
 						for _, fi := range files {
-							fMap := fi.(map[string]any)
+							fMap, ok := fi.(map[string]any)
+							if !ok {
+								continue
+							}
 
 							// Find key
 							var key string
@@ -538,47 +551,35 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 								seenFileUUIDs[fileInfo.NewUUID] = true
 								newEncName, _ := utils.EncryptText(originalFilename, currentEncKey)
 
-								newFiles = append(newFiles, map[string]any{
-									"uuid_filename": fileInfo.NewUUID,
-									"enc_filename":  newEncName,
-									"size":          fileInfo.Size,
+								newDay.Files = append(newDay.Files, utils.FileRef{
+									UUIDFilename: fileInfo.NewUUID,
+									EncFilename:  newEncName,
+									Size:         fileInfo.Size,
 								})
 							}
 						}
 					}
 
-					if len(newFiles) > 0 {
-						importDay["files"] = newFiles
-					} else {
-						delete(importDay, "files")
-					}
-
 					// Handle Tags:
 					// Imported tag IDs are remapped to current user tag IDs via tagIDMap.
-					var newTagIDs []any
 					if tags, ok := importDay["tags"].([]any); ok {
 						for _, tid := range tags {
-							oldID := int(tid.(float64))
-							if newID, ok := tagIDMap[oldID]; ok {
-								newTagIDs = append(newTagIDs, float64(newID))
+							oldID, ok := utils.ToNumber(tid)
+							if !ok {
+								continue
+							}
+							if newID, ok := tagIDMap[int(oldID)]; ok {
+								newDay.Tags = append(newDay.Tags, newID)
 							}
 						}
 					}
 
-					if len(newTagIDs) > 0 {
-						importDay["tags"] = newTagIDs
-					} else {
-						delete(importDay, "tags")
-					}
-
 					// Handle Pins:
 					// 1) Normalize input (encrypted/decrypted backup)
 					// 2) Re-encrypt with currentEncKey
 					// 3) Reassign sequential IDs per day
-					var newPins []any
 					seenPinCoords := make(map[string]bool)
 					if pins, ok := importDay["pins"].([]any); ok {
-						newPins = make([]any, 0, len(pins))
 						for _, pinInterface := range pins {
 							pinMap, ok := pinInterface.(map[string]any)
 							if !ok {
@@ -643,199 +644,85 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 							}
 
 							// Persist pin in the internal encrypted storage format used by logs.
-							newPin := map[string]any{
-								"text": encPinText,
-								"lat":  encLat,
-								"lon":  encLon,
-							}
-
-							if idVal, ok := pinMap["id"]; ok {
-								switch id := idVal.(type) {
-								case float64:
-									newPin["id"] = id
-								case int:
-									newPin["id"] = float64(id)
-								case string:
-									if parsed, err := strconv.Atoi(id); err == nil {
-										newPin["id"] = float64(parsed)
-									}
-								}
-							}
-
-							newPins = append(newPins, newPin)
+							newDay.Pins = append(newDay.Pins, utils.Pin{
+								Text: encPinText,
+								Lat:  encLat,
+								Lon:  encLon,
+							})
 						}
 					}
 
-					// Normalize IDs to avoid collisions after merges/imports from different sources.
-					if len(newPins) > 0 {
-						for idx, p := range newPins {
-							if pMap, ok := p.(map[string]any); ok {
-								pMap["id"] = float64(idx + 1)
-								newPins[idx] = pMap
-							}
-						}
-						importDay["pins"] = newPins
-					} else {
-						delete(importDay, "pins")
-					}
-
 					// Re-Encrypt Text/Date
 					if plainText != "" {
-						encText, _ := utils.EncryptText(plainText, currentEncKey)
-						importDay["text"] = encText
-					} else {
-						delete(importDay, "text")
+						newDay.Text, _ = utils.EncryptText(plainText, currentEncKey)
 					}
-
 					if plainDate != "" {
-						encDate, _ := utils.EncryptText(plainDate, currentEncKey)
-						importDay["date_written"] = encDate
-					} else {
-						delete(importDay, "date_written")
+						newDay.DateWritten, _ = utils.EncryptText(plainDate, currentEncKey)
 					}
 
 					// Merge into existing month data:
 					// if day already exists, imported data becomes current main day content.
-					foundDay := false
-					for i, cd := range cDays {
-						cDay := cd.(map[string]any)
-						if int(getFloat64(cDay, "day")) == dayNum {
-							// Exists - Move to History
-							foundDay = true
-
-							cText := getString(cDay, "text")
-							if cText != "" {
-								// Imported data becomes MAIN. Old main becomes history.
-
-								var history []any
-								if h, ok := cDay["history"].([]any); ok {
-									history = h
-								} else {
-									history = []any{}
-								}
-
-								// Add current main to history
-								maxVer := 0
-								for _, h := range history {
-									if v, ok := h.(map[string]any)["version"].(float64); ok && int(v) > maxVer {
-										maxVer = int(v)
-									}
-								}
-
-								history = append(history, map[string]any{
-									"version":      float64(maxVer + 1),
-									"text":         cDay["text"],
-									"date_written": cDay["date_written"],
-								})
-
-								importDay["history"] = history
-
-							} else {
-								// Keep old history if any
-								if h, ok := cDay["history"].([]any); ok {
-									importDay["history"] = h
-								}
+					currentDay := currentMonth.FindDay(dayNum)
+					if currentDay != nil {
+						if currentDay.Text != "" {
+							// Imported data becomes MAIN. Old main becomes history.
+							maxVer := 0
+							for _, h := range currentDay.History {
+								maxVer = max(maxVer, h.Version)
 							}
 
-							// Keep existing files by appending them to imported files,
-							// but avoid duplicate UUID references.
-							if cFiles, ok := cDay["files"].([]any); ok {
-								var impFiles []any
-								if f, ok := importDay["files"].([]any); ok {
-									impFiles = f
-								}
-
-								seenFileUUIDsMerge := make(map[string]bool)
-								for _, f := range impFiles {
-									if fMap, ok := f.(map[string]any); ok {
-										uuid := getString(fMap, "uuid_filename")
-										if uuid == "" {
-											uuid = getString(fMap, "uuid")
-										}
-										if uuid != "" {
-											seenFileUUIDsMerge[uuid] = true
-										}
-									}
-								}
+							newDay.History = append(currentDay.History, utils.HistoryVersion{
+								Version:     maxVer + 1,
+								Text:        currentDay.Text,
+								DateWritten: currentDay.DateWritten,
+							})
+						} else {
+							// Keep old history if any
+							newDay.History = currentDay.History
+						}
 
-								for _, cf := range cFiles {
-									cFileMap, ok := cf.(map[string]any)
-									if !ok {
-										continue
-									}
-									uuid := getString(cFileMap, "uuid_filename")
-									if uuid == "" {
-										uuid = getString(cFileMap, "uuid")
-									}
-									if uuid != "" && seenFileUUIDsMerge[uuid] {
-										continue
-									}
-									if uuid != "" {
-										seenFileUUIDsMerge[uuid] = true
-									}
-									impFiles = append(impFiles, cFileMap)
-								}
-								importDay["files"] = impFiles
+						// Keep existing files by appending them to imported files,
+						// but avoid duplicate UUID references.
+						for _, file := range currentDay.Files {
+							if seenFileUUIDs[file.UUIDFilename] {
+								continue
 							}
+							seenFileUUIDs[file.UUIDFilename] = true
+							newDay.Files = append(newDay.Files, file)
+						}
 
-							// Keep existing pins by appending them to imported pins,
-							// then normalize IDs again to keep deterministic ordering.
-							if cPins, ok := cDay["pins"].([]any); ok {
-								var impPins []any
-								if p, ok := importDay["pins"].([]any); ok {
-									impPins = p
-								}
-
-								seenMergedCoords := make(map[string]bool)
-								for _, p := range impPins {
-									if pMap, ok := p.(map[string]any); ok {
-										lat, okLat := parseStoredPinCoord(pMap["lat"], currentEncKey)
-										lon, okLon := parseStoredPinCoord(pMap["lon"], currentEncKey)
-										if okLat && okLon {
-											seenMergedCoords[coordKey(lat, lon)] = true
-										}
-									}
-								}
-
-								for _, cp := range cPins {
-									cPinMap, ok := cp.(map[string]any)
-									if !ok {
-										continue
-									}
-									lat, okLat := parseStoredPinCoord(cPinMap["lat"], currentEncKey)
-									lon, okLon := parseStoredPinCoord(cPinMap["lon"], currentEncKey)
-									if !okLat || !okLon {
-										continue
-									}
-									key := coordKey(lat, lon)
-									if seenMergedCoords[key] {
-										continue
-									}
-									seenMergedCoords[key] = true
-									impPins = append(impPins, cPinMap)
-								}
-
-								for idx, p := range impPins {
-									if pMap, ok := p.(map[string]any); ok {
-										pMap["id"] = float64(idx + 1)
-										impPins[idx] = pMap
-									}
-								}
-								importDay["pins"] = impPins
+						// Keep existing pins by appending them to imported pins
+						for _, pin := range currentDay.Pins {
+							lat, errLat := decryptCoordinate(pin.Lat, currentEncKey)
+							lon, errLon := decryptCoordinate(pin.Lon, currentEncKey)
+							if errLat != nil || errLon != nil {
+								continue
 							}
-
-							cDays[i] = importDay
-							break
+							key := coordKey(lat, lon)
+							if seenPinCoords[key] {
+								continue
+							}
+							seenPinCoords[key] = true
+							newDay.Pins = append(newDay.Pins, pin)
 						}
 					}
 
-					// If day does not exist yet, append as a new day record.
-					if !foundDay {
-						cDays = append(cDays, importDay)
+					// Normalize IDs to avoid collisions after merges/imports from different sources.
+					for idx := range newDay.Pins {
+						newDay.Pins[idx].ID = idx + 1
+					}
+
+					if currentDay != nil {
+						newDay.Extra = currentDay.Extra
+						*currentDay = newDay
+					} else {
+						// If day does not exist yet, append as a new day record.
+						currentMonth.Days = append(currentMonth.Days, newDay)
 					}
 				}
-				currentMonthData["days"] = cDays
-				utils.WriteMonth(userID, year, month, currentMonthData)
+				if err := utils.SaveMonth(userID, year, month, currentMonth); err != nil {
+					utils.Logger.Printf("Error writing imported month %d/%02d: %v", year, month, err)
+				}
 			}
 		}
 	}
@@ -897,6 +784,24 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Imported images have no thumbnails yet
+	utils.StartThumbnailBackfill(userID, currentEncKey)
+
+	// The disk usage is recalculated with the imported data
+	utils.InvalidateUserUsage(userID)
+
+	utils.LogSecurityEvent(r, userID, derivedKey, "import", map[string]any{"encrypted": isEncrypted})
+
 	// Success
 	utils.JSONResponse(w, http.StatusOK, map[string]any{"success": true})
 }
+
+// hashContent returns the SHA-256 (hex) and the size of the content
+func hashContent(content io.Reader) (string, int64, error) {
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, content)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
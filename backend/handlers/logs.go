@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"net/http"
@@ -32,14 +33,17 @@ type AddPinRequest struct {
 // AddPin saves a pin for a specific day.
 // Stored encrypted: lat, lon, text. Stored plain: id.
 func AddPin(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -61,7 +65,7 @@ func AddPin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, err := utils.GetMonth(userID, year, month)
+	content, err := utils.ReadMonth(userID, year, month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
@@ -91,76 +95,17 @@ func AddPin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	days, ok := content["days"].([]any)
-	if !ok {
-		days = []any{}
-	}
-
-	dayIndex := -1
-	for i, dayInterface := range days {
-		dayObj, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-		dayNum, ok := dayObj["day"].(float64)
-		if ok && int(dayNum) == day {
-			dayIndex = i
-			break
-		}
-	}
-
-	if dayIndex == -1 {
-		days = append(days, map[string]any{"day": day})
-		dayIndex = len(days) - 1
-	}
-
-	dayObj, ok := days[dayIndex].(map[string]any)
-	if !ok {
-		http.Error(w, "Invalid day object", http.StatusInternalServerError)
-		return
-	}
-
-	pinsAny, ok := dayObj["pins"].([]any)
-	if !ok {
-		pinsAny = []any{}
-	}
-
-	maxID := 0
-	for _, pinInterface := range pinsAny {
-		pinObj, ok := pinInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		switch idVal := pinObj["id"].(type) {
-		case float64:
-			if int(idVal) > maxID {
-				maxID = int(idVal)
-			}
-		case int:
-			if idVal > maxID {
-				maxID = idVal
-			}
-		case string:
-			if parsed, err := strconv.Atoi(idVal); err == nil && parsed > maxID {
-				maxID = parsed
-			}
-		}
-	}
-
-	newID := maxID + 1
-	pinsAny = append(pinsAny, map[string]any{
-		"id":   newID,
-		"lat":  encLat,
-		"lon":  encLon,
-		"text": encText,
+	// Add the pin to the day (the day is created if necessary)
+	dayObj := content.GetOrCreateDay(day)
+	newID := dayObj.NextPinID()
+	dayObj.Pins = append(dayObj.Pins, utils.Pin{
+		ID:   newID,
+		Lat:  encLat,
+		Lon:  encLon,
+		Text: encText,
 	})
 
-	dayObj["pins"] = pinsAny
-	days[dayIndex] = dayObj
-	content["days"] = days
-
-	if err := utils.WriteMonth(userID, year, month, content); err != nil {
+	if err := utils.SaveMonth(userID, year, month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -186,14 +131,17 @@ type UpdatePinTextRequest struct {
 
 // UpdatePinText updates the text of an existing pin.
 func UpdatePinText(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -211,7 +159,7 @@ func UpdatePinText(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	content, err := utils.ReadMonth(userID, req.Year, req.Month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
@@ -229,83 +177,20 @@ func UpdatePinText(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	days, ok := content["days"].([]any)
-	if !ok {
+	dayObj := content.FindDay(req.Day)
+	if dayObj == nil {
 		http.Error(w, "Day not found", http.StatusNotFound)
 		return
 	}
 
-	dayIndex := -1
-	for i, dayInterface := range days {
-		dayObj, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-		dayNum, ok := dayObj["day"].(float64)
-		if ok && int(dayNum) == req.Day {
-			dayIndex = i
-			break
-		}
-	}
-
-	if dayIndex == -1 {
-		http.Error(w, "Day not found", http.StatusNotFound)
-		return
-	}
-
-	dayObj, ok := days[dayIndex].(map[string]any)
-	if !ok {
-		http.Error(w, "Invalid day object", http.StatusInternalServerError)
-		return
-	}
-
-	pinsAny, ok := dayObj["pins"].([]any)
-	if !ok {
+	pin := dayObj.FindPin(req.PinID)
+	if pin == nil {
 		http.Error(w, "Pin not found", http.StatusNotFound)
 		return
 	}
+	pin.Text = encText
 
-	pinUpdated := false
-	for i, pinInterface := range pinsAny {
-		pinObj, ok := pinInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		id := 0
-		switch idVal := pinObj["id"].(type) {
-		case float64:
-			id = int(idVal)
-		case int:
-			id = idVal
-		case string:
-			parsed, err := strconv.Atoi(idVal)
-			if err != nil {
-				continue
-			}
-			id = parsed
-		default:
-			continue
-		}
-
-		if id == req.PinID {
-			pinObj["text"] = encText
-			pinsAny[i] = pinObj
-			pinUpdated = true
-			break
-		}
-	}
-
-	if !pinUpdated {
-		http.Error(w, "Pin not found", http.StatusNotFound)
-		return
-	}
-
-	dayObj["pins"] = pinsAny
-	days[dayIndex] = dayObj
-	content["days"] = days
-
-	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+	if err := utils.SaveMonth(userID, req.Year, req.Month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -324,15 +209,17 @@ type DeletePinRequest struct {
 
 // DeletePin removes an existing pin from a specific day.
 func DeletePin(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	var req DeletePinRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -344,93 +231,24 @@ func DeletePin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	content, err := utils.ReadMonth(userID, req.Year, req.Month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	days, ok := content["days"].([]any)
-	if !ok {
-		http.Error(w, "Day not found", http.StatusNotFound)
-		return
-	}
-
-	dayIndex := -1
-	for i, dayInterface := range days {
-		dayObj, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-		dayNum, ok := dayObj["day"].(float64)
-		if ok && int(dayNum) == req.Day {
-			dayIndex = i
-			break
-		}
-	}
-
-	if dayIndex == -1 {
+	dayObj := content.FindDay(req.Day)
+	if dayObj == nil {
 		http.Error(w, "Day not found", http.StatusNotFound)
 		return
 	}
 
-	dayObj, ok := days[dayIndex].(map[string]any)
-	if !ok {
-		http.Error(w, "Invalid day object", http.StatusInternalServerError)
-		return
-	}
-
-	pinsAny, ok := dayObj["pins"].([]any)
-	if !ok {
+	if !dayObj.RemovePin(req.PinID) {
 		http.Error(w, "Pin not found", http.StatusNotFound)
 		return
 	}
 
-	filteredPins := make([]any, 0, len(pinsAny))
-	pinDeleted := false
-	for _, pinInterface := range pinsAny {
-		pinObj, ok := pinInterface.(map[string]any)
-		if !ok {
-			filteredPins = append(filteredPins, pinInterface)
-			continue
-		}
-
-		id := 0
-		switch idVal := pinObj["id"].(type) {
-		case float64:
-			id = int(idVal)
-		case int:
-			id = idVal
-		case string:
-			parsed, err := strconv.Atoi(idVal)
-			if err != nil {
-				filteredPins = append(filteredPins, pinInterface)
-				continue
-			}
-			id = parsed
-		default:
-			filteredPins = append(filteredPins, pinInterface)
-			continue
-		}
-
-		if id == req.PinID {
-			pinDeleted = true
-			continue
-		}
-
-		filteredPins = append(filteredPins, pinObj)
-	}
-
-	if !pinDeleted {
-		http.Error(w, "Pin not found", http.StatusNotFound)
-		return
-	}
-
-	dayObj["pins"] = filteredPins
-	days[dayIndex] = dayObj
-	content["days"] = days
-
-	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+	if err := utils.SaveMonth(userID, req.Year, req.Month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -451,14 +269,17 @@ type MovePinRequest struct {
 
 // MovePin updates the position of an existing pin.
 func MovePin(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -476,7 +297,7 @@ func MovePin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	content, err := utils.ReadMonth(userID, req.Year, req.Month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
@@ -501,84 +322,21 @@ func MovePin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	days, ok := content["days"].([]any)
-	if !ok {
+	dayObj := content.FindDay(req.Day)
+	if dayObj == nil {
 		http.Error(w, "Day not found", http.StatusNotFound)
 		return
 	}
 
-	dayIndex := -1
-	for i, dayInterface := range days {
-		dayObj, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-		dayNum, ok := dayObj["day"].(float64)
-		if ok && int(dayNum) == req.Day {
-			dayIndex = i
-			break
-		}
-	}
-
-	if dayIndex == -1 {
-		http.Error(w, "Day not found", http.StatusNotFound)
-		return
-	}
-
-	dayObj, ok := days[dayIndex].(map[string]any)
-	if !ok {
-		http.Error(w, "Invalid day object", http.StatusInternalServerError)
-		return
-	}
-
-	pinsAny, ok := dayObj["pins"].([]any)
-	if !ok {
-		http.Error(w, "Pin not found", http.StatusNotFound)
-		return
-	}
-
-	pinMoved := false
-	for i, pinInterface := range pinsAny {
-		pinObj, ok := pinInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		id := 0
-		switch idVal := pinObj["id"].(type) {
-		case float64:
-			id = int(idVal)
-		case int:
-			id = idVal
-		case string:
-			parsed, err := strconv.Atoi(idVal)
-			if err != nil {
-				continue
-			}
-			id = parsed
-		default:
-			continue
-		}
-
-		if id == req.PinID {
-			pinObj["lat"] = encLat
-			pinObj["lon"] = encLon
-			pinsAny[i] = pinObj
-			pinMoved = true
-			break
-		}
-	}
-
-	if !pinMoved {
+	pin := dayObj.FindPin(req.PinID)
+	if pin == nil {
 		http.Error(w, "Pin not found", http.StatusNotFound)
 		return
 	}
+	pin.Lat = encLat
+	pin.Lon = encLon
 
-	dayObj["pins"] = pinsAny
-	days[dayIndex] = dayObj
-	content["days"] = days
-
-	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+	if err := utils.SaveMonth(userID, req.Year, req.Month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -590,15 +348,18 @@ func MovePin(w http.ResponseWriter, r *http.Request) {
 
 // SaveLog handles saving a log entry
 func SaveLog(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -613,63 +374,12 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	content, err := utils.ReadMonth(userID, req.Year, req.Month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Check if there's a previous log to move to history
-	historyAvailable := false
-	days, ok := content["days"].([]any)
-	if ok {
-		for i, dayInterface := range days {
-			day, ok := dayInterface.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			dayNum, ok := day["day"].(float64)
-			if !ok || int(dayNum) != req.Day {
-				continue
-			}
-
-			// If this day has text, move it to history
-			if text, ok := day["text"].(string); ok && text != "" {
-				historyAvailable = true
-				historyVersion := 0
-
-				// Get or create history array
-				var history []any
-				if historyArray, ok := day["history"].([]any); ok {
-					history = historyArray
-					// Find highest version
-					for _, historyItem := range history {
-						if historyMap, ok := historyItem.(map[string]any); ok {
-							if version, ok := historyMap["version"].(float64); ok && int(version) > historyVersion {
-								historyVersion = int(version)
-							}
-						}
-					}
-				} else {
-					history = []any{}
-				}
-
-				historyVersion++
-				history = append(history, map[string]any{
-					"version":      historyVersion,
-					"text":         day["text"],
-					"date_written": day["date_written"],
-				})
-
-				day["history"] = history
-				days[i] = day
-			}
-			break
-		}
-		content["days"] = days
-	}
-
 	// Get encryption key
 	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
 	if err != nil {
@@ -690,54 +400,35 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Save new log
-	found := false
-	if days, ok := content["days"].([]any); ok {
-		for i, dayInterface := range days {
-			day, ok := dayInterface.(map[string]any)
-			if !ok {
-				continue
-			}
+	// Move a previous log to the history and save the new one
+	day := content.GetOrCreateDay(req.Day)
 
-			dayNum, ok := day["day"].(float64)
-			if !ok || int(dayNum) != req.Day {
-				continue
+	// The history only grows, so the quota is checked for everything that is added
+	growth := int64(len(encryptedText) + len(encryptedDateWritten))
+	if day.Text == "" {
+		growth -= int64(len(day.DateWritten))
+	}
+	if growth > 0 {
+		if err := utils.CheckQuota(userID, growth); err != nil {
+			if errors.Is(err, utils.ErrQuotaExceeded) {
+				quotaExceeded(w, userID)
+			} else {
+				http.Error(w, fmt.Sprintf("Error checking storage quota: %v", err), http.StatusInternalServerError)
 			}
-
-			// Update existing day
-			day["text"] = encryptedText
-			day["date_written"] = encryptedDateWritten
-			days[i] = day
-			found = true
-			break
-		}
-
-		if !found {
-			// Add new day
-			days = append(days, map[string]any{
-				"day":          req.Day,
-				"text":         encryptedText,
-				"date_written": encryptedDateWritten,
-			})
-		}
-
-		content["days"] = days
-	} else {
-		// Create new days array
-		content["days"] = []any{
-			map[string]any{
-				"day":          req.Day,
-				"text":         encryptedText,
-				"date_written": encryptedDateWritten,
-			},
+			return
 		}
 	}
 
+	historyAvailable := day.ArchiveText()
+	day.Text = encryptedText
+	day.DateWritten = encryptedDateWritten
+
 	// Write month data
-	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+	if err := utils.SaveMonth(userID, req.Year, req.Month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
+	utils.AddUserUsage(userID, growth)
 
 	// Return success
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
@@ -778,191 +469,160 @@ func GetLog(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, year, month)
+	content, err := utils.ReadMonth(userID, year, month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Default empty response
-	dummy := map[string]any{
-		"text":         "",
-		"date_written": "",
-		"files":        []any{},
-		"tags":         []any{},
-		"pins":         []any{},
+	// Find the day
+	day := content.FindDay(dayValue)
+	if day == nil {
+		// If day not found, return empty response
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"text":         "",
+			"date_written": "",
+			"files":        []any{},
+			"tags":         []any{},
+			"pins":         []any{},
+		})
+		return
 	}
 
-	// Check if days exist
-	days, ok := content["days"].([]any)
-	if !ok {
-		utils.JSONResponse(w, http.StatusOK, dummy)
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Find the day
-	for _, dayInterface := range days {
-		day, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
+	// Decrypt text and date_written
+	text := ""
+	dateWritten := ""
 
-		dayNum, ok := day["day"].(float64)
-		if !ok || int(dayNum) != dayValue {
-			continue
+	if day.Text != "" {
+		text, err = utils.DecryptText(day.Text, encKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error decrypting text: %v", err), http.StatusInternalServerError)
+			return
 		}
+	}
 
-		// Get encryption key
-		encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if day.DateWritten != "" {
+		dateWritten, err = utils.DecryptText(day.DateWritten, encKey)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Error decrypting date_written: %v", err), http.StatusInternalServerError)
 			return
 		}
+	}
 
-		// Decrypt text and date_written
-		text := ""
-		dateWritten := ""
-		historyAvailable := false
-
-		if encryptedText, ok := day["text"].(string); ok && encryptedText != "" {
-			decryptedText, err := utils.DecryptText(encryptedText, encKey)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error decrypting text: %v", err), http.StatusInternalServerError)
-				return
-			}
-			text = decryptedText
-		}
+	// Decrypt filenames
+	files, err := decryptFileRefs(day.Files, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decrypting filename: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-		if encryptedDate, ok := day["date_written"].(string); ok && encryptedDate != "" {
-			decryptedDate, err := utils.DecryptText(encryptedDate, encKey)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error decrypting date_written: %v", err), http.StatusInternalServerError)
-				return
-			}
-			dateWritten = decryptedDate
-		}
+	// Get tags
+	tags := day.Tags
+	if tags == nil {
+		tags = []int{}
+	}
 
-		// Check for history
-		if history, ok := day["history"].([]any); ok && len(history) > 0 {
-			historyAvailable = true
-		}
+	pins, err := decryptPins(day.Pins, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decrypting pin %v", err), http.StatusInternalServerError)
+		return
+	}
 
-		// Decrypt filenames if files exist
-		files := []any{}
-		if filesList, ok := day["files"].([]any); ok {
-			for _, fileInterface := range filesList {
-				file, ok := fileInterface.(map[string]any)
-				if !ok {
-					continue
-				}
+	// Return log data
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"text":              text,
+		"date_written":      dateWritten,
+		"files":             files,
+		"tags":              tags,
+		"pins":              pins,
+		"history_available": len(day.History) > 0,
+	})
+}
 
-				if encFilename, ok := file["enc_filename"].(string); ok {
-					decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-					if err != nil {
-						http.Error(w, fmt.Sprintf("Error decrypting filename: %v", err), http.StatusInternalServerError)
-						return
-					}
-					fileCopy := make(map[string]any)
-					for k, v := range file {
-						fileCopy[k] = v
-					}
-					fileCopy["filename"] = decryptedFilename
-					files = append(files, fileCopy)
-				}
-			}
+// decryptFileRefs returns the files of a day with the decrypted filename added
+func decryptFileRefs(fileRefs []utils.FileRef, encKey string) ([]any, error) {
+	files := []any{}
+	for _, file := range fileRefs {
+		if file.EncFilename == "" {
+			continue
 		}
 
-		// Get tags
-		tags := []any{}
-		if tagsList, ok := day["tags"].([]any); ok {
-			tags = tagsList
+		filename, err := utils.DecryptText(file.EncFilename, encKey)
+		if err != nil {
+			return nil, err
 		}
 
-		decryptedPins := []any{}
-		if pinsList, ok := day["pins"].([]any); ok {
-			for _, pinInterface := range pinsList {
-				pinObj, ok := pinInterface.(map[string]any)
-				if !ok {
-					continue
-				}
+		fileMap := map[string]any{
+			"enc_filename":  file.EncFilename,
+			"uuid_filename": file.UUIDFilename,
+			"size":          file.Size,
+			"filename":      filename,
+		}
+		if len(file.Thumbnails) > 0 {
+			fileMap["thumbnails"] = file.Thumbnails
+		}
+		files = append(files, fileMap)
+	}
 
-				id := 0
-				switch idVal := pinObj["id"].(type) {
-				case float64:
-					id = int(idVal)
-				case int:
-					id = idVal
-				case string:
-					parsed, err := strconv.Atoi(idVal)
-					if err != nil {
-						continue
-					}
-					id = parsed
-				default:
-					continue
-				}
+	return files, nil
+}
 
-				encLat, ok := pinObj["lat"].(string)
-				if !ok || encLat == "" {
-					continue
-				}
-				encLon, ok := pinObj["lon"].(string)
-				if !ok || encLon == "" {
-					continue
-				}
-				encText, ok := pinObj["text"].(string)
-				if !ok {
-					continue
-				}
+// decryptPin decrypts a pin. Pins with invalid coordinates return nil.
+func decryptPin(pin utils.Pin, encKey string) (map[string]any, error) {
+	latStr, err := utils.DecryptText(pin.Lat, encKey)
+	if err != nil {
+		return nil, fmt.Errorf("latitude: %v", err)
+	}
+	lonStr, err := utils.DecryptText(pin.Lon, encKey)
+	if err != nil {
+		return nil, fmt.Errorf("longitude: %v", err)
+	}
+	text := ""
+	if pin.Text != "" {
+		text, err = utils.DecryptText(pin.Text, encKey)
+		if err != nil {
+			return nil, fmt.Errorf("text: %v", err)
+		}
+	}
 
-				latStr, err := utils.DecryptText(encLat, encKey)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Error decrypting pin latitude: %v", err), http.StatusInternalServerError)
-					return
-				}
-				lonStr, err := utils.DecryptText(encLon, encKey)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Error decrypting pin longitude: %v", err), http.StatusInternalServerError)
-					return
-				}
-				textVal, err := utils.DecryptText(encText, encKey)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Error decrypting pin text: %v", err), http.StatusInternalServerError)
-					return
-				}
+	lat, err := strconv.ParseFloat(latStr, 64)
+	if err != nil {
+		return nil, nil
+	}
+	lon, err := strconv.ParseFloat(lonStr, 64)
+	if err != nil {
+		return nil, nil
+	}
 
-				lat, err := strconv.ParseFloat(latStr, 64)
-				if err != nil {
-					continue
-				}
-				lon, err := strconv.ParseFloat(lonStr, 64)
-				if err != nil {
-					continue
-				}
+	return map[string]any{
+		"id":   pin.ID,
+		"lat":  lat,
+		"lon":  lon,
+		"text": text,
+	}, nil
+}
 
-				decryptedPins = append(decryptedPins, map[string]any{
-					"id":   id,
-					"lat":  lat,
-					"lon":  lon,
-					"text": textVal,
-				})
-			}
+// decryptPins decrypts all pins of a day, skipping pins with invalid coordinates
+func decryptPins(pins []utils.Pin, encKey string) ([]any, error) {
+	decryptedPins := []any{}
+	for _, pin := range pins {
+		decryptedPin, err := decryptPin(pin, encKey)
+		if err != nil {
+			return nil, err
+		}
+		if decryptedPin != nil {
+			decryptedPins = append(decryptedPins, decryptedPin)
 		}
-
-		// Return log data
-		utils.JSONResponse(w, http.StatusOK, map[string]any{
-			"text":              text,
-			"date_written":      dateWritten,
-			"files":             files,
-			"tags":              tags,
-			"pins":              decryptedPins,
-			"history_available": historyAvailable,
-		})
-		return
 	}
 
-	// If day not found, return empty response
-	utils.JSONResponse(w, http.StatusOK, dummy)
+	return decryptedPins, nil
 }
 
 // GetAllPins handles retrieving all pins across all available days.
@@ -977,15 +637,18 @@ func GetLog(w http.ResponseWriter, r *http.Request) {
 //	  ]
 //	}]
 func GetAllPins(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.RLock()
-	defer utils.LogsMutex.RUnlock()
-
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.RLock()
+	defer logsMutex.RUnlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -1023,107 +686,19 @@ func GetAllPins(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			content, err := utils.GetMonth(userID, year, month)
+			content, err := utils.ReadMonth(userID, year, month)
 			if err != nil {
 				continue
 			}
 
-			days, ok := content["days"].([]any)
-			if !ok {
-				continue
-			}
-
-			for _, dayInterface := range days {
-				dayObj, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				day := 0
-				switch dayVal := dayObj["day"].(type) {
-				case float64:
-					day = int(dayVal)
-				case int:
-					day = dayVal
-				case string:
-					parsed, err := strconv.Atoi(dayVal)
-					if err != nil {
+			for _, day := range content.Days {
+				decryptedPins := make([]any, 0, len(day.Pins))
+				for _, pin := range day.Pins {
+					decryptedPin, err := decryptPin(pin, encKey)
+					if err != nil || decryptedPin == nil {
 						continue
 					}
-					day = parsed
-				default:
-					continue
-				}
-
-				pinsList, ok := dayObj["pins"].([]any)
-				if !ok || len(pinsList) == 0 {
-					continue
-				}
-
-				decryptedPins := make([]any, 0, len(pinsList))
-				for _, pinInterface := range pinsList {
-					pinObj, ok := pinInterface.(map[string]any)
-					if !ok {
-						continue
-					}
-
-					id := 0
-					switch idVal := pinObj["id"].(type) {
-					case float64:
-						id = int(idVal)
-					case int:
-						id = idVal
-					case string:
-						parsed, err := strconv.Atoi(idVal)
-						if err != nil {
-							continue
-						}
-						id = parsed
-					default:
-						continue
-					}
-
-					encLat, ok := pinObj["lat"].(string)
-					if !ok || encLat == "" {
-						continue
-					}
-					encLon, ok := pinObj["lon"].(string)
-					if !ok || encLon == "" {
-						continue
-					}
-					encText, ok := pinObj["text"].(string)
-					if !ok {
-						continue
-					}
-
-					latStr, err := utils.DecryptText(encLat, encKey)
-					if err != nil {
-						continue
-					}
-					lonStr, err := utils.DecryptText(encLon, encKey)
-					if err != nil {
-						continue
-					}
-					textVal, err := utils.DecryptText(encText, encKey)
-					if err != nil {
-						continue
-					}
-
-					lat, err := strconv.ParseFloat(latStr, 64)
-					if err != nil {
-						continue
-					}
-					lon, err := strconv.ParseFloat(lonStr, 64)
-					if err != nil {
-						continue
-					}
-
-					decryptedPins = append(decryptedPins, map[string]any{
-						"id":   id,
-						"lat":  lat,
-						"lon":  lon,
-						"text": textVal,
-					})
+					decryptedPins = append(decryptedPins, decryptedPin)
 				}
 
 				if len(decryptedPins) == 0 {
@@ -1133,7 +708,7 @@ func GetAllPins(w http.ResponseWriter, r *http.Request) {
 				allPins = append(allPins, map[string]any{
 					"year":  year,
 					"month": month,
-					"day":   day,
+					"day":   day.Day,
 					"pins":  decryptedPins,
 				})
 			}
@@ -1165,7 +740,7 @@ func GetMarkedDays(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, year, month)
+	content, err := utils.ReadMonth(userID, year, month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
@@ -1176,32 +751,15 @@ func GetMarkedDays(w http.ResponseWriter, r *http.Request) {
 	daysWithFiles := []int{}
 	daysBookmarked := []int{}
 
-	if days, ok := content["days"].([]any); ok {
-		for _, dayInterface := range days {
-			day, ok := dayInterface.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			dayNum, ok := day["day"].(float64)
-			if !ok {
-				continue
-			}
-
-			// Check for text
-			if _, ok := day["text"].(string); ok {
-				daysWithLogs = append(daysWithLogs, int(dayNum))
-			}
-
-			// Check for files
-			if files, ok := day["files"].([]any); ok && len(files) > 0 {
-				daysWithFiles = append(daysWithFiles, int(dayNum))
-			}
-
-			// Check if bookmarked
-			if bookmarked, ok := day["isBookmarked"].(bool); ok && bookmarked {
-				daysBookmarked = append(daysBookmarked, int(dayNum))
-			}
+	for _, day := range content.Days {
+		if day.Text != "" {
+			daysWithLogs = append(daysWithLogs, day.Day)
+		}
+		if len(day.Files) > 0 {
+			daysWithFiles = append(daysWithFiles, day.Day)
+		}
+		if day.IsBookmarked {
+			daysBookmarked = append(daysBookmarked, day.Day)
 		}
 	}
 
@@ -1215,9 +773,6 @@ func GetMarkedDays(w http.ResponseWriter, r *http.Request) {
 
 // BookmarkDay handles bookmarking a day
 func BookmarkDay(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -1225,6 +780,11 @@ func BookmarkDay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	// Get parameters
 	dayStr := r.URL.Query().Get("day")
 	if dayStr == "" {
@@ -1260,57 +820,19 @@ func BookmarkDay(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, year, month)
+	content, err := utils.ReadMonth(userID, year, month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Get or create days array
-	days, ok := content["days"].([]any)
-	if !ok {
-		days = []any{}
-	}
-
-	// Find day
-	dayFound := false
-	bookmarked := true
-	for i, dayInterface := range days {
-		dayObj, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		dayNum, ok := dayObj["day"].(float64)
-		if !ok || int(dayNum) != day {
-			continue
-		}
-
-		// Day found, toggle bookmark
-		dayFound = true
-		if bookmark, ok := dayObj["isBookmarked"].(bool); ok && bookmark {
-			dayObj["isBookmarked"] = false
-			bookmarked = false
-		} else {
-			dayObj["isBookmarked"] = true
-		}
-		days[i] = dayObj
-		break
-	}
-
-	if !dayFound {
-		// Create new day with bookmark
-		days = append(days, map[string]any{
-			"day":          day,
-			"isBookmarked": true,
-		})
-	}
-
-	// Update days array
-	content["days"] = days
+	// Toggle bookmark (a new day is created bookmarked)
+	dayObj := content.GetOrCreateDay(day)
+	dayObj.IsBookmarked = !dayObj.IsBookmarked
+	bookmarked := dayObj.IsBookmarked
 
 	// Write month data
-	if err := utils.WriteMonth(userID, year, month, content); err != nil {
+	if err := utils.SaveMonth(userID, year, month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to bookmark day - error writing log: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -1380,47 +902,29 @@ func GetALookBack(w http.ResponseWriter, r *http.Request) {
 	// Get logs from previous years
 	results := []any{}
 	for _, year := range years {
-		content, err := utils.GetMonth(userID, year, month)
+		content, err := utils.ReadMonth(userID, year, month)
 		if err != nil {
 			continue
 		}
 
-		days, ok := content["days"].([]any)
-		if !ok {
+		dayLog := content.FindDay(day)
+		if dayLog == nil || dayLog.Text == "" {
 			continue
 		}
 
-		for _, dayInterface := range days {
-			dayLog, ok := dayInterface.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			dayNum, ok := dayLog["day"].(float64)
-			if !ok || int(dayNum) != day {
-				continue
-			}
-
-			text, ok := dayLog["text"].(string)
-			if !ok || text == "" {
-				continue
-			}
-
-			// Decrypt text
-			decryptedText, err := utils.DecryptText(text, encKey)
-			if err != nil {
-				continue
-			}
-
-			results = append(results, map[string]any{
-				"years_old": currentYear - year,
-				"day":       day,
-				"month":     month,
-				"year":      year,
-				"text":      decryptedText,
-			})
-			break
+		// Decrypt text
+		decryptedText, err := utils.DecryptText(dayLog.Text, encKey)
+		if err != nil {
+			continue
 		}
+
+		results = append(results, map[string]any{
+			"years_old": currentYear - year,
+			"day":       day,
+			"month":     month,
+			"year":      year,
+			"text":      decryptedText,
+		})
 	}
 
 	// Return results
@@ -1465,7 +969,7 @@ func LoadMonthForReading(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, year, month)
+	content, err := utils.ReadMonth(userID, year, month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
@@ -1478,42 +982,30 @@ func LoadMonthForReading(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if days exist
-	days, ok := content["days"].([]any)
-	if !ok {
-		utils.JSONResponse(w, http.StatusOK, []any{})
-		return
-	}
-
 	// Process days
 	result := []any{}
-	for _, dayInterface := range days {
-		day, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		dayNum, ok := day["day"].(float64)
-		if !ok {
+	for _, day := range content.Days {
+		// Only days with text, files or tags are shown
+		if day.Text == "" && len(day.Files) == 0 && len(day.Tags) == 0 {
 			continue
 		}
 
 		// Create result day
 		resultDay := map[string]any{
-			"day": int(dayNum),
+			"day": day.Day,
 		}
 
 		// Decrypt text and date_written
-		if text, ok := day["text"].(string); ok && text != "" {
-			decryptedText, err := utils.DecryptText(text, encKey)
+		if day.Text != "" {
+			decryptedText, err := utils.DecryptText(day.Text, encKey)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("Error decrypting text: %v", err), http.StatusInternalServerError)
 				return
 			}
 			resultDay["text"] = decryptedText
 
-			if dateWritten, ok := day["date_written"].(string); ok && dateWritten != "" {
-				decryptedDate, err := utils.DecryptText(dateWritten, encKey)
+			if day.DateWritten != "" {
+				decryptedDate, err := utils.DecryptText(day.DateWritten, encKey)
 				if err != nil {
 					http.Error(w, fmt.Sprintf("Error decrypting date_written: %v", err), http.StatusInternalServerError)
 					return
@@ -1523,117 +1015,31 @@ func LoadMonthForReading(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Get tags
-		if tags, ok := day["tags"].([]any); ok && len(tags) > 0 {
-			resultDay["tags"] = tags
+		if len(day.Tags) > 0 {
+			resultDay["tags"] = day.Tags
 		}
 
 		// Get pins
-		if pins, ok := day["pins"].([]any); ok && len(pins) > 0 {
-			decryptedPins := []any{}
-			for _, pinInterface := range pins {
-				pinObj, ok := pinInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				id := 0
-				switch idVal := pinObj["id"].(type) {
-				case float64:
-					id = int(idVal)
-				case int:
-					id = idVal
-				case string:
-					parsed, err := strconv.Atoi(idVal)
-					if err != nil {
-						continue
-					}
-					id = parsed
-				default:
-					continue
-				}
-
-				encLat, ok := pinObj["lat"].(string)
-				if !ok || encLat == "" {
-					continue
-				}
-				encLon, ok := pinObj["lon"].(string)
-				if !ok || encLon == "" {
-					continue
-				}
-				encText, ok := pinObj["text"].(string)
-				if !ok {
-					continue
-				}
-
-				latStr, err := utils.DecryptText(encLat, encKey)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Error decrypting pin latitude: %v", err), http.StatusInternalServerError)
-					return
-				}
-				lonStr, err := utils.DecryptText(encLon, encKey)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Error decrypting pin longitude: %v", err), http.StatusInternalServerError)
-					return
-				}
-				textVal, err := utils.DecryptText(encText, encKey)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Error decrypting pin text: %v", err), http.StatusInternalServerError)
-					return
-				}
-
-				lat, err := strconv.ParseFloat(latStr, 64)
-				if err != nil {
-					continue
-				}
-				lon, err := strconv.ParseFloat(lonStr, 64)
-				if err != nil {
-					continue
-				}
-
-				decryptedPins = append(decryptedPins, map[string]any{
-					"id":   id,
-					"lat":  lat,
-					"lon":  lon,
-					"text": textVal,
-				})
+		if len(day.Pins) > 0 {
+			decryptedPins, err := decryptPins(day.Pins, encKey)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error decrypting pin %v", err), http.StatusInternalServerError)
+				return
 			}
 			resultDay["pins"] = decryptedPins
 		}
 
 		// Decrypt filenames if files exist
-		if filesList, ok := day["files"].([]any); ok && len(filesList) > 0 {
-			files := []any{}
-			for _, fileInterface := range filesList {
-				file, ok := fileInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				if encFilename, ok := file["enc_filename"].(string); ok {
-					decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-					if err != nil {
-						http.Error(w, fmt.Sprintf("Error decrypting filename: %v", err), http.StatusInternalServerError)
-						return
-					}
-					fileCopy := make(map[string]any)
-					for k, v := range file {
-						fileCopy[k] = v
-					}
-					fileCopy["filename"] = decryptedFilename
-					files = append(files, fileCopy)
-				}
+		if len(day.Files) > 0 {
+			files, err := decryptFileRefs(day.Files, encKey)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error decrypting filename: %v", err), http.StatusInternalServerError)
+				return
 			}
 			resultDay["files"] = files
 		}
 
-		// Add day to result if it has content
-		if _, hasText := resultDay["text"]; hasText {
-			result = append(result, resultDay)
-		} else if _, hasFiles := resultDay["files"]; hasFiles {
-			result = append(result, resultDay)
-		} else if _, hasTags := resultDay["tags"]; hasTags {
-			result = append(result, resultDay)
-		}
+		result = append(result, resultDay)
 	}
 
 	// Return result
@@ -1696,90 +1102,50 @@ func GetHistory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, year, month)
+	content, err := utils.ReadMonth(userID, year, month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Check if days exist
-	days, ok := content["days"].([]any)
-	if !ok {
+	// Find day
+	dayObj := content.FindDay(day)
+	if dayObj == nil {
 		utils.JSONResponse(w, http.StatusOK, []any{})
 		return
 	}
 
-	// Find day
-	for _, dayInterface := range days {
-		dayObj, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		dayNum, ok := dayObj["day"].(float64)
-		if !ok || int(dayNum) != day {
-			continue
-		}
-
-		// Check for history
-		history, ok := dayObj["history"].([]any)
-		if !ok || len(history) == 0 {
-			utils.JSONResponse(w, http.StatusOK, []any{})
+	// Decrypt history entries
+	result := []any{}
+	for _, historyEntry := range dayObj.History {
+		decryptedText, err := utils.DecryptText(historyEntry.Text, encKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error decrypting history text: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		// Decrypt history entries
-		result := []any{}
-		for _, historyInterface := range history {
-			historyEntry, ok := historyInterface.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			text, ok := historyEntry["text"].(string)
-			if !ok {
-				continue
-			}
-
-			dateWritten, ok := historyEntry["date_written"].(string)
-			if !ok {
-				continue
-			}
-
-			// Decrypt text and date
-			decryptedText, err := utils.DecryptText(text, encKey)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error decrypting history text: %v", err), http.StatusInternalServerError)
-				return
-			}
-
-			decryptedDate, err := utils.DecryptText(dateWritten, encKey)
+		decryptedDate := ""
+		if historyEntry.DateWritten != "" {
+			decryptedDate, err = utils.DecryptText(historyEntry.DateWritten, encKey)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("Error decrypting history date: %v", err), http.StatusInternalServerError)
 				return
 			}
-
-			result = append(result, map[string]any{
-				"text":         decryptedText,
-				"date_written": decryptedDate,
-			})
 		}
 
-		// Return history
-		utils.JSONResponse(w, http.StatusOK, result)
-		return
+		result = append(result, map[string]any{
+			"text":         decryptedText,
+			"date_written": decryptedDate,
+		})
 	}
 
-	// Day not found
-	utils.JSONResponse(w, http.StatusOK, []any{})
+	// Return history
+	utils.JSONResponse(w, http.StatusOK, result)
 }
 
 // DeleteDay deletes all data of the specified day
 // Also delete files, that might be uploaded
 func DeleteDay(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -1787,6 +1153,11 @@ func DeleteDay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	// Get parameters from URL
 	year, err := strconv.Atoi(r.URL.Query().Get("year"))
 	if err != nil {
@@ -1805,60 +1176,75 @@ func DeleteDay(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, year, month)
+	content, err := utils.ReadMonth(userID, year, month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	days, ok := content["days"].([]any)
-	if !ok {
+	// Remove the day from the days array
+	day, found := content.RemoveDay(dayValue)
+	if !found {
 		utils.JSONResponse(w, http.StatusOK, map[string]bool{"success": true})
 		return
 	}
 
-	for i, dayInterface := range days {
-		day, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
+	// Delete associated files
+	for _, file := range day.Files {
+		if err := utils.RemoveFile(userID, file.UUIDFilename); err != nil {
+			utils.Logger.Printf("Warning: Failed to delete file %s for user %d: %v", file.UUIDFilename, userID, err)
+			// Continue with deletion even if file removal fails
 		}
+		utils.RemoveThumbnails(userID, file.UUIDFilename, file.Thumbnails)
+	}
+	utils.InvalidateUserUsage(userID)
 
-		dayNum, ok := day["day"].(float64)
-		if !ok || int(dayNum) != dayValue {
-			continue
-		}
+	if err := utils.SaveMonth(userID, year, month, content); err != nil {
+		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-		// Delete associated files before removing the day entry
-		if filesList, ok := day["files"].([]any); ok && len(filesList) > 0 {
-			for _, fileInterface := range filesList {
-				file, ok := fileInterface.(map[string]any)
-				if !ok {
-					continue
-				}
+	utils.JSONResponse(w, http.StatusOK, map[string]bool{"success": true})
+}
 
-				if fileID, ok := file["uuid_filename"].(string); ok {
-					// Delete the actual file from the filesystem
-					err := utils.RemoveFile(userID, fileID)
-					if err != nil {
-						utils.Logger.Printf("Warning: Failed to delete file %s for user %d: %v", fileID, userID, err)
-						// Continue with deletion even if file removal fails
-					}
-				}
-			}
-		}
+// CheckIntegrity checks the months and files of the user for problems.
+// A POST request also repairs the problems that can be fixed.
+func CheckIntegrity(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-		// Remove the day from the days array
-		days = append(days[:i], days[i+1:]...)
-		content["days"] = days
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
 
-		if err := utils.WriteMonth(userID, year, month, content); err != nil {
-			http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
-			return
-		}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-		utils.JSONResponse(w, http.StatusOK, map[string]bool{"success": true})
+	repair := r.Method == http.MethodPost
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	utils.JSONResponse(w, http.StatusOK, map[string]bool{"success": true})
+	report, err := utils.CheckIntegrity(userID, encKey, repair)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking integrity: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Logger.Printf("Integrity check of user %d: %d issues found (repair: %t)", userID, len(report.Issues), repair)
+
+	// Return report
+	utils.JSONResponse(w, http.StatusOK, report)
 }
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// newTestUser uses a new in-memory store with one registered user and returns
+// the user ID and derived key for requests of this user
+func newTestUser(t *testing.T) (int, string) {
+	t.Helper()
+
+	store, err := utils.NewStore("memory")
+	if err != nil {
+		t.Fatalf("creating memory store: %v", err)
+	}
+	previous := utils.DataStore
+	utils.DataStore = store
+	t.Cleanup(func() { utils.DataStore = previous })
+
+	// Cheap Argon2 parameters, the tests don't need a strong hash
+	utils.Settings.Argon2TimeCost = 1
+	utils.Settings.Argon2MemoryMB = 8
+	utils.Settings.Argon2Threads = 1
+
+	if ok, err := Register("alice", "password"); !ok || err != nil {
+		t.Fatalf("registering user: %v", err)
+	}
+
+	derivedKey, _, err := utils.CheckPasswordForUser(1, "password")
+	if err != nil || derivedKey == "" {
+		t.Fatalf("checking password: %v", err)
+	}
+	return 1, derivedKey
+}
+
+// authRequest creates a request with the context RequireAuth would set
+func authRequest(method, target string, body any, userID int, derivedKey string) *http.Request {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+
+	r := httptest.NewRequest(method, target, &buf)
+	ctx := context.WithValue(r.Context(), utils.UserIDKey, userID)
+	ctx = context.WithValue(ctx, utils.UsernameKey, "alice")
+	ctx = context.WithValue(ctx, utils.DerivedKeyKey, derivedKey)
+	return r.WithContext(ctx)
+}
+
+// decodeResponse checks the status and decodes the JSON response
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var result map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return result
+}
+
+func TestSaveLogAndGetLog(t *testing.T) {
+	userID, derivedKey := newTestUser(t)
+
+	save := func(text string) map[string]any {
+		w := httptest.NewRecorder()
+		SaveLog(w, authRequest(http.MethodPost, "/logs/saveLog", LogRequest{
+			Day: 17, Month: 5, Year: 2024, Text: text, DateWritten: "17.05.2024, 20:15",
+		}, userID, derivedKey))
+		return decodeResponse(t, w)
+	}
+
+	if result := save("First version"); result["history_available"] != false {
+		t.Errorf("history_available = %v after the first save, want false", result["history_available"])
+	}
+	if result := save("Second version"); result["history_available"] != true {
+		t.Errorf("history_available = %v after the second save, want true", result["history_available"])
+	}
+
+	w := httptest.NewRecorder()
+	GetLog(w, authRequest(http.MethodGet, "/logs/getLog?year=2024&month=5&day=17", nil, userID, derivedKey))
+	result := decodeResponse(t, w)
+
+	if result["text"] != "Second version" {
+		t.Errorf("text = %q, want %q", result["text"], "Second version")
+	}
+	if result["date_written"] != "17.05.2024, 20:15" {
+		t.Errorf("date_written = %q, want %q", result["date_written"], "17.05.2024, 20:15")
+	}
+
+	// The text is stored encrypted
+	content, err := utils.DataStore.GetMonth(userID, 2024, 5)
+	if err != nil {
+		t.Fatalf("reading month: %v", err)
+	}
+	data, _ := json.Marshal(content)
+	if bytes.Contains(data, []byte("Second version")) {
+		t.Errorf("month contains the plain text: %s", data)
+	}
+}
+
+func TestGetLogOfEmptyDay(t *testing.T) {
+	userID, derivedKey := newTestUser(t)
+
+	w := httptest.NewRecorder()
+	GetLog(w, authRequest(http.MethodGet, "/logs/getLog?year=2024&month=5&day=3", nil, userID, derivedKey))
+	result := decodeResponse(t, w)
+
+	if result["text"] != "" {
+		t.Errorf("text = %q, want empty", result["text"])
+	}
+}
+
+func TestGetLogInvalidParameters(t *testing.T) {
+	userID, derivedKey := newTestUser(t)
+
+	w := httptest.NewRecorder()
+	GetLog(w, authRequest(http.MethodGet, "/logs/getLog?year=2024&month=x&day=3", nil, userID, derivedKey))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
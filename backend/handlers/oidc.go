@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// A login with single sign-on has two steps: OIDCCallback checks the code
+// from the provider and returns a ticket. With the ticket, the password
+// unlocks the data (OIDCUnlock), or links an existing account (OIDCLink) or
+// a new one (OIDCRegister) to the identity. Only the identity is kept in
+// memory in between.
+
+type pendingOIDCLogin struct {
+	identity *utils.OIDCIdentity
+	// userID is 0 if no user is linked to the identity yet
+	userID   int
+	username string
+	expires  time.Time
+	attempts int
+}
+
+var (
+	pendingOIDCLogins      = map[string]*pendingOIDCLogin{}
+	pendingOIDCLoginsMutex sync.Mutex
+)
+
+// createPendingOIDCLogin saves a login that was confirmed by the provider and returns its ticket
+func createPendingOIDCLogin(identity *utils.OIDCIdentity, userID int, username string) (string, error) {
+	ticketBytes := make([]byte, 32)
+	if _, err := rand.Read(ticketBytes); err != nil {
+		return "", err
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(ticketBytes)
+
+	pendingOIDCLoginsMutex.Lock()
+	defer pendingOIDCLoginsMutex.Unlock()
+
+	// Remove expired logins
+	for t, login := range pendingOIDCLogins {
+		if time.Now().After(login.expires) {
+			delete(pendingOIDCLogins, t)
+		}
+	}
+
+	pendingOIDCLogins[ticket] = &pendingOIDCLogin{
+		identity: identity,
+		userID:   userID,
+		username: username,
+		expires:  time.Now().Add(pendingLoginTTL),
+	}
+	return ticket, nil
+}
+
+// getPendingOIDCLogin returns the login of a ticket (nil if expired)
+func getPendingOIDCLogin(ticket string) *pendingOIDCLogin {
+	pendingOIDCLoginsMutex.Lock()
+	defer pendingOIDCLoginsMutex.Unlock()
+
+	login, ok := pendingOIDCLogins[ticket]
+	if ok && time.Now().After(login.expires) {
+		delete(pendingOIDCLogins, ticket)
+		return nil
+	}
+	return login
+}
+
+// failPendingOIDCLogin counts a wrong password, the login at the provider has
+// to be repeated after too many
+func failPendingOIDCLogin(ticket string) {
+	pendingOIDCLoginsMutex.Lock()
+	defer pendingOIDCLoginsMutex.Unlock()
+
+	if login, ok := pendingOIDCLogins[ticket]; ok {
+		login.attempts++
+		if login.attempts >= pendingLoginMaxAttempts {
+			delete(pendingOIDCLogins, ticket)
+		}
+	}
+}
+
+func deletePendingOIDCLogin(ticket string) {
+	pendingOIDCLoginsMutex.Lock()
+	defer pendingOIDCLoginsMutex.Unlock()
+
+	delete(pendingOIDCLogins, ticket)
+}
+
+// GetOIDCConfig returns if single sign-on and the password login are enabled
+func GetOIDCConfig(w http.ResponseWriter, r *http.Request) {
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"enabled":        utils.OIDCEnabled(),
+		"name":           utils.Settings.OIDCProviderName,
+		"password_login": !utils.PasswordLoginDisabled(),
+	})
+}
+
+// StartOIDCLogin returns the URL of the provider to log in
+func StartOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !utils.OIDCEnabled() {
+		http.Error(w, utils.ErrOIDCDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	authURL, state, err := utils.OIDCAuthURL()
+	if err != nil {
+		utils.Logger.Printf("Error starting single sign-on: %v", err)
+		http.Error(w, "Single sign-on provider not available", http.StatusBadGateway)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"url":   authURL,
+		"state": state,
+	})
+}
+
+// OIDCCallbackRequest represents the code and state the provider returned to the login page
+type OIDCCallbackRequest struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+// OIDCCallback checks the login at the provider. The user is logged in if the
+// derived key is stored for the subject, otherwise a ticket for the next step
+// is returned.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if !utils.OIDCEnabled() {
+		http.Error(w, utils.ErrOIDCDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Parse the request body
+	var req OIDCCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := utils.OIDCExchange(req.Code, req.State)
+	if err != nil {
+		utils.Logger.Printf("Login with single sign-on failed: %v", err)
+		http.Error(w, "Single sign-on failed", http.StatusBadRequest)
+		return
+	}
+
+	userID, username, err := utils.OIDCUserBySubject(identity)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if userID != 0 {
+		derivedKey, err := utils.UnlockWithOIDCSubject(userID, identity)
+		if err != nil {
+			// The password still unlocks the data
+			utils.Logger.Printf("Error unlocking the key of user '%s' for the subject: %v", username, err)
+		}
+		if derivedKey != "" {
+			completeOIDCLogin(w, r, userID, username, derivedKey, -1)
+			return
+		}
+	}
+
+	ticket, err := createPendingOIDCLogin(identity, userID, username)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if userID != 0 {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"unlock_required": true,
+			"ticket":          ticket,
+			"username":        username,
+		})
+		return
+	}
+
+	allowed, temporary := utils.IsRegistrationAllowed()
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"link_required":        true,
+		"ticket":               ticket,
+		"username":             identity.Username,
+		"registration_allowed": allowed || temporary,
+	})
+}
+
+// OIDCUnlockRequest represents the password for a ticket of OIDCCallback.
+// Username is only needed to link or register an account.
+type OIDCUnlockRequest struct {
+	Ticket   string `json:"ticket"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// OIDCUnlock unlocks the data of the user linked to the identity with the password
+func OIDCUnlock(w http.ResponseWriter, r *http.Request) {
+	var req OIDCUnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	login := getPendingOIDCLogin(req.Ticket)
+	if login == nil || login.userID == 0 {
+		http.Error(w, "Login expired", http.StatusGone)
+		return
+	}
+
+	unlockOIDCLogin(w, r, req, login, login.userID, login.username)
+}
+
+// OIDCLink links an existing account to the identity, after checking its password
+func OIDCLink(w http.ResponseWriter, r *http.Request) {
+	var req OIDCUnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	login := getPendingOIDCLogin(req.Ticket)
+	if login == nil || login.userID != 0 {
+		http.Error(w, "Login expired", http.StatusGone)
+		return
+	}
+
+	userID, username, err := findUserByUsername(req.Username)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	unlockOIDCLogin(w, r, req, login, userID, username)
+}
+
+// OIDCRegister creates a new account for the identity, the password unlocks its data
+func OIDCRegister(w http.ResponseWriter, r *http.Request) {
+	if allowed, temporary := utils.IsRegistrationAllowed(); !allowed && !temporary {
+		http.Error(w, "Registration is not allowed", http.StatusForbidden)
+		return
+	}
+
+	var req OIDCUnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || req.Password == "" {
+		http.Error(w, "Username and password required", http.StatusBadRequest)
+		return
+	}
+
+	login := getPendingOIDCLogin(req.Ticket)
+	if login == nil || login.userID != 0 {
+		http.Error(w, "Login expired", http.StatusGone)
+		return
+	}
+
+	if _, err := Register(req.Username, req.Password); err != nil {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success":        false,
+			"username_taken": strings.Contains(err.Error(), "already exists"),
+		})
+		return
+	}
+
+	userID, username, err := findUserByUsername(req.Username)
+	if err != nil || userID == 0 {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	unlockOIDCLogin(w, r, req, login, userID, username)
+}
+
+// unlockOIDCLogin checks the password of the user, links the identity (if not
+// linked yet) and completes the login
+func unlockOIDCLogin(w http.ResponseWriter, r *http.Request, req OIDCUnlockRequest, login *pendingOIDCLogin, userID int, username string) {
+	// Wait after too many wrong passwords for this user or from this client
+	throttleKeys := []utils.ThrottleKey{utils.UserThrottleKey(username), utils.IPThrottleKey(r)}
+	if username == "" {
+		throttleKeys[0] = utils.UserThrottleKey(req.Username)
+	}
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
+	derivedKey := ""
+	availableBackupCodes := -1
+	if userID != 0 {
+		var err error
+		derivedKey, availableBackupCodes, err = utils.CheckPasswordForUser(userID, req.Password)
+		if err != nil {
+			utils.Logger.Printf("Error checking password for user '%s': %v", username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if derivedKey == "" {
+		utils.Logger.Printf("Login with single sign-on failed. Password for user '%s' is incorrect", req.Username)
+		if userID != 0 {
+			utils.LogSecurityEvent(r, userID, "", "login_failed", map[string]any{"reason": "password"})
+		}
+		utils.ThrottleFailure(throttleKeys...)
+		failPendingOIDCLogin(req.Ticket)
+		http.Error(w, "User/Password combination not found", http.StatusNotFound)
+		return
+	}
+
+	// The failed attempts are only forgotten after the second factor
+	if availableBackupCodes != -1 || !utils.TOTPEnabled(userID) {
+		utils.ThrottleSuccess(throttleKeys[0])
+	}
+	deletePendingOIDCLogin(req.Ticket)
+
+	// Hash the password and derive the key again if the Argon2 parameters changed
+	if availableBackupCodes == -1 {
+		var err error
+		derivedKey, err = utils.UpgradeArgon2(userID, req.Password, derivedKey)
+		if err != nil {
+			utils.Logger.Printf("Error upgrading the Argon2 parameters of user '%s': %v", username, err)
+		}
+	}
+
+	// Also renews the derived key for the subject
+	newLink := login.userID == 0
+	if err := utils.LinkOIDC(userID, login.identity, derivedKey); err != nil {
+		utils.Logger.Printf("Error linking user '%s' to single sign-on: %v", username, err)
+		http.Error(w, "The identity is already linked to another account", http.StatusConflict)
+		return
+	}
+	if newLink {
+		utils.Logger.Printf("Linked user '%s' to subject '%s' of %s", username, login.identity.Subject, login.identity.Issuer)
+		utils.LogSecurityEvent(r, userID, derivedKey, "oidc_linked", map[string]any{
+			"issuer":   login.identity.Issuer,
+			"subject":  login.identity.Subject,
+			"username": login.identity.Username,
+		})
+	}
+
+	completeOIDCLogin(w, r, userID, username, derivedKey, availableBackupCodes)
+}
+
+// completeOIDCLogin asks for the TOTP code if the user enabled it, otherwise
+// the login is completed. A backup code replaces the TOTP code like at the
+// login with the password.
+func completeOIDCLogin(w http.ResponseWriter, r *http.Request, userID int, username string, derivedKey string, availableBackupCodes int) {
+	if availableBackupCodes == -1 && utils.TOTPEnabled(userID) {
+		ticket, err := createPendingLogin(userID, username, derivedKey)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"totp_required": true,
+			"ticket":        ticket,
+			"username":      username,
+		})
+		return
+	}
+
+	completeLogin(w, r, userID, username, derivedKey, availableBackupCodes, "oidc", "")
+}
+
+// findUserByUsername returns ID and name of a user (case-insensitive, 0 if not found)
+func findUserByUsername(username string) (int, string, error) {
+	users, err := utils.GetUsers()
+	if err != nil {
+		return 0, "", err
+	}
+
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		user, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		if name, ok := user["username"].(string); ok && strings.EqualFold(name, username) {
+			id, _ := user["user_id"].(float64)
+			return int(id), name, nil
+		}
+	}
+	return 0, "", nil
+}
+
+// GetOIDCStatus returns if the user is linked to the provider
+func GetOIDCStatus(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	link, err := utils.GetOIDCLink(userID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	result := map[string]any{
+		"enabled": utils.OIDCEnabled(),
+		"name":    utils.Settings.OIDCProviderName,
+		"linked":  link != nil,
+	}
+	if link != nil {
+		result["issuer"] = link.Issuer
+		result["linked_since"] = link.Linked
+		result["subject_key"] = link.EncDerivedKey != ""
+	}
+	utils.JSONResponse(w, http.StatusOK, result)
+}
+
+// UnlinkOIDC removes the link of the user to the provider
+func UnlinkOIDC(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, _ := r.Context().Value(utils.DerivedKeyKey).(string)
+
+	if err := utils.UnlinkOIDC(userID); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.LogSecurityEvent(r, userID, derivedKey, "oidc_unlinked", nil)
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
@@ -0,0 +1,521 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// A passkey is added in two ceremonies: the registration creates the
+// credential, then a login with it returns the PRF output that encrypts the
+// copy of the derived key. Only then the passkey is saved, so there is never a
+// passkey that can't unlock the data.
+
+const passkeyCeremonyTTL = 5 * time.Minute
+
+type passkeyCeremony struct {
+	userID     int
+	name       string
+	session    webauthn.SessionData
+	credential *webauthn.Credential
+	expires    time.Time
+}
+
+var (
+	passkeyCeremonies      = map[string]*passkeyCeremony{}
+	passkeyCeremoniesMutex sync.Mutex
+)
+
+// startPasskeyCeremony saves the state of a ceremony and returns its id
+func startPasskeyCeremony(ceremony *passkeyCeremony) (string, error) {
+	idBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(idBytes)
+
+	passkeyCeremoniesMutex.Lock()
+	defer passkeyCeremoniesMutex.Unlock()
+
+	// Remove expired ceremonies
+	for i, c := range passkeyCeremonies {
+		if time.Now().After(c.expires) {
+			delete(passkeyCeremonies, i)
+		}
+	}
+
+	ceremony.expires = time.Now().Add(passkeyCeremonyTTL)
+	passkeyCeremonies[id] = ceremony
+	return id, nil
+}
+
+// takePasskeyCeremony returns a ceremony and removes it (every ceremony is only used once)
+func takePasskeyCeremony(id string) (*passkeyCeremony, bool) {
+	passkeyCeremoniesMutex.Lock()
+	defer passkeyCeremoniesMutex.Unlock()
+
+	ceremony, ok := passkeyCeremonies[id]
+	if !ok {
+		return nil, false
+	}
+	delete(passkeyCeremonies, id)
+
+	if time.Now().After(ceremony.expires) {
+		return nil, false
+	}
+	return ceremony, true
+}
+
+// passkeyPRFExtension requests the PRF output for the derived key
+func passkeyPRFExtension() protocol.AuthenticationExtensions {
+	return protocol.AuthenticationExtensions{
+		"prf": map[string]any{
+			"eval": map[string]any{
+				"first": protocol.URLEncodedBase64(utils.PasskeyPRFInput),
+			},
+		},
+	}
+}
+
+// PasskeyResponseRequest represents the response of the authenticator in a ceremony
+type PasskeyResponseRequest struct {
+	Session    string          `json:"session"`
+	Credential json.RawMessage `json:"credential"`
+	// PRF output (base64url), only for logins
+	PRF string `json:"prf"`
+}
+
+// GetPasskeys returns the passkeys of the user
+func GetPasskeys(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	passkeys, err := utils.GetPasskeys(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading passkeys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	list := []map[string]any{}
+	for _, passkey := range passkeys {
+		list = append(list, map[string]any{
+			"id":        passkey.ID,
+			"name":      passkey.Name,
+			"created":   passkey.Created,
+			"last_used": passkey.LastUsed,
+		})
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"enabled":  utils.WebAuthn != nil,
+		"passkeys": list,
+	})
+}
+
+// IsPasskeyLoginEnabled returns if the login with passkeys is possible
+func IsPasskeyLoginEnabled(w http.ResponseWriter, r *http.Request) {
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"enabled": utils.WebAuthn != nil && !utils.PasswordLoginDisabled(),
+	})
+}
+
+// BeginPasskeyRegistrationRequest represents the request to add a passkey
+type BeginPasskeyRegistrationRequest struct {
+	Password string `json:"password"`
+	Name     string `json:"name"`
+}
+
+// BeginPasskeyRegistration returns the options to create a new passkey
+func BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if utils.WebAuthn == nil {
+		http.Error(w, utils.ErrPasskeysDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Parse the request body
+	var req BeginPasskeyRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Wait after too many wrong passwords
+	throttleKeys := reauthThrottleKeys(r)
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Check if password is correct
+	derivedKey, _, err := utils.CheckPasswordForUser(userID, req.Password)
+	if err != nil || derivedKey == "" {
+		utils.ThrottleFailure(throttleKeys...)
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success":            false,
+			"password_incorrect": true,
+		})
+		return
+	}
+	utils.ThrottleSuccess(throttleKeys[0])
+
+	user, err := utils.GetPasskeyUser(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading passkeys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// A passkey (discoverable credential) with user verification, so it replaces the password
+	creation, session, err := utils.WebAuthn.BeginRegistration(user,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		}),
+		webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()),
+		webauthn.WithExtensions(protocol.AuthenticationExtensions{"prf": map[string]any{}}),
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting registration: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	id, err := startPasskeyCeremony(&passkeyCeremony{userID: userID, name: name, session: *session})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+		"session": id,
+		"options": creation,
+	})
+}
+
+// FinishPasskeyRegistration verifies the new passkey and returns the options
+// for the login that activates it (with the PRF output)
+func FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if utils.WebAuthn == nil {
+		http.Error(w, utils.ErrPasskeysDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Parse the request body
+	var req PasskeyResponseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ceremony, ok := takePasskeyCeremony(req.Session)
+	if !ok || ceremony.userID != userID || ceremony.credential != nil {
+		http.Error(w, "Registration expired", http.StatusNotFound)
+		return
+	}
+
+	user, err := utils.GetPasskeyUser(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading passkeys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid passkey response: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	credential, err := utils.WebAuthn.CreateCredential(user, ceremony.session, parsed)
+	if err != nil {
+		utils.Logger.Printf("Passkey registration of user %d failed: %v", userID, err)
+		http.Error(w, "Passkey registration failed", http.StatusBadRequest)
+		return
+	}
+
+	// Login with only the new passkey to get the PRF output
+	pending := &utils.PasskeyUser{
+		UserID:   userID,
+		Username: user.Username,
+		Passkeys: []utils.Passkey{{Credential: *credential}},
+	}
+	assertion, session, err := utils.WebAuthn.BeginLogin(pending,
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+		webauthn.WithAssertionExtensions(passkeyPRFExtension()),
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting login: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := startPasskeyCeremony(&passkeyCeremony{
+		userID:     userID,
+		name:       ceremony.name,
+		session:    *session,
+		credential: credential,
+	})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"session": id,
+		"options": assertion,
+	})
+}
+
+// ActivatePasskey checks the login with the new passkey and saves it with the
+// derived key, encrypted with the PRF output
+func ActivatePasskey(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if utils.WebAuthn == nil {
+		http.Error(w, utils.ErrPasskeysDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Parse the request body
+	var req PasskeyResponseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ceremony, ok := takePasskeyCeremony(req.Session)
+	if !ok || ceremony.userID != userID || ceremony.credential == nil {
+		http.Error(w, "Registration expired", http.StatusNotFound)
+		return
+	}
+
+	// Without PRF the passkey can't decrypt the derived key
+	prfOutput, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.PRF, "="))
+	if err != nil || len(prfOutput) != 32 {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success":         false,
+			"prf_unsupported": true,
+		})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(req.Credential)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid passkey response: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	pending := &utils.PasskeyUser{
+		UserID:   userID,
+		Passkeys: []utils.Passkey{{Credential: *ceremony.credential}},
+	}
+	credential, err := utils.WebAuthn.ValidateLogin(pending, ceremony.session, parsed)
+	if err != nil {
+		utils.Logger.Printf("Passkey activation of user %d failed: %v", userID, err)
+		http.Error(w, "Passkey verification failed", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.AddPasskey(userID, ceremony.name, credential, prfOutput, derivedKey); err != nil {
+		http.Error(w, fmt.Sprintf("Error saving passkey: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Logger.Printf("Passkey added for user %d", userID)
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
+
+// DeletePasskeyRequest represents the request to remove a passkey
+type DeletePasskeyRequest struct {
+	ID string `json:"id"`
+}
+
+// DeletePasskey removes a passkey of the user
+func DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the request body
+	var req DeletePasskeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	passkey, err := utils.DeletePasskey(userID, req.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting passkey: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if passkey == nil {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	// Logins with the passkey end as well
+	revoked, err := utils.RevokePasskeySessions(userID, passkey.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	derivedKey, _ := r.Context().Value(utils.DerivedKeyKey).(string)
+	utils.LogSecurityEvent(r, userID, derivedKey, "passkey_removed", map[string]any{
+		"name":             passkey.Name,
+		"revoked_sessions": revoked,
+	})
+
+	utils.Logger.Printf("Passkey removed for user %d, %d sessions revoked", userID, revoked)
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
+
+// BeginPasskeyLogin returns the options for a login with a passkey (without username)
+func BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if utils.WebAuthn == nil {
+		http.Error(w, utils.ErrPasskeysDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	if utils.PasswordLoginDisabled() {
+		http.Error(w, "Password login is disabled, use single sign-on", http.StatusForbidden)
+		return
+	}
+
+	assertion, session, err := utils.WebAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+		webauthn.WithAssertionExtensions(passkeyPRFExtension()),
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting login: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := startPasskeyCeremony(&passkeyCeremony{session: *session})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"session": id,
+		"options": assertion,
+	})
+}
+
+// FinishPasskeyLogin checks the passkey, decrypts the derived key with the PRF output and logs the user in
+func FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if utils.WebAuthn == nil {
+		http.Error(w, utils.ErrPasskeysDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Parse the request body
+	var req PasskeyResponseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ceremony, ok := takePasskeyCeremony(req.Session)
+	if !ok || ceremony.userID != 0 || ceremony.credential != nil {
+		http.Error(w, "Login expired", http.StatusNotFound)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(req.Credential)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid passkey response: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var passkeyUser *utils.PasskeyUser
+	_, credential, err := utils.WebAuthn.ValidatePasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		user, err := utils.PasskeyUserByHandle(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		for _, passkey := range user.Passkeys {
+			if bytes.Equal(passkey.Credential.ID, rawID) {
+				passkeyUser = user
+				return user, nil
+			}
+		}
+		return nil, fmt.Errorf("passkey not found")
+	}, ceremony.session, parsed)
+	if err != nil {
+		utils.Logger.Printf("Login with passkey failed: %v", err)
+		http.Error(w, "User/Password combination not found", http.StatusNotFound)
+		return
+	}
+
+	if credential.Authenticator.CloneWarning {
+		utils.Logger.Printf("Login with passkey failed. The passkey of user '%s' might be cloned", passkeyUser.Username)
+		http.Error(w, "User/Password combination not found", http.StatusNotFound)
+		return
+	}
+
+	prfOutput, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.PRF, "="))
+	if err != nil {
+		http.Error(w, "Invalid PRF output", http.StatusBadRequest)
+		return
+	}
+
+	derivedKey, passkeyID, err := utils.UnlockWithPasskey(passkeyUser.UserID, credential, prfOutput)
+	if err != nil {
+		utils.Logger.Printf("Login with passkey failed. Could not unlock the key of user '%s': %v", passkeyUser.Username, err)
+		http.Error(w, "User/Password combination not found", http.StatusNotFound)
+		return
+	}
+
+	// A passkey is a second factor on its own (possession and user verification), so no TOTP code
+	completeLogin(w, r, passkeyUser.UserID, passkeyUser.Username, derivedKey, -1, "passkey", passkeyID)
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// quotaExceeded writes the response for a write that exceeds the storage quota
+func quotaExceeded(w http.ResponseWriter, userID int) {
+	usage, _ := utils.UserUsage(userID)
+	utils.JSONResponse(w, http.StatusRequestEntityTooLarge, map[string]any{
+		"success": false,
+		"message": "Storage quota exceeded",
+		"usage":   usage,
+		"quota":   utils.UserQuota(userID),
+	})
+}
+
+// GetStorageUsage returns the disk usage and the quota of the user (quota 0 is unlimited)
+func GetStorageUsage(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Always up to date when the user looks at it
+	utils.InvalidateUserUsage(userID)
+	usage, err := utils.UserUsage(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error calculating disk usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	quota := utils.UserQuota(userID)
+	response := map[string]any{
+		"usage": usage,
+		"quota": quota,
+	}
+	if quota > 0 {
+		response["remaining"] = max(0, quota-usage)
+	}
+
+	utils.JSONResponse(w, http.StatusOK, response)
+}
@@ -3,8 +3,6 @@ package handlers
 import (
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -46,89 +44,41 @@ func SearchTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all years and months
-	years, err := utils.GetYears(userID)
+	// Get all days with this tag
+	records, err := utils.QueryDays(userID, utils.DayFilter{TagID: tagID})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error retrieving years: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error retrieving days: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Search for tag
+	// Collect results
 	results := []any{}
-	for _, year := range years {
-		yearInt, _ := strconv.Atoi(year)
-		months, err := utils.GetMonths(userID, year)
-		if err != nil {
-			continue
-		}
+	for _, record := range records {
+		day := record.Day
 
-		for _, month := range months {
-			monthInt, _ := strconv.Atoi(month)
-			content, err := utils.GetMonth(userID, yearInt, monthInt)
+		// Get text snippet
+		context := ""
+		if day.Text != "" {
+			decryptedText, err := utils.DecryptText(day.Text, encKey)
 			if err != nil {
 				continue
 			}
-
-			days, ok := content["days"].([]any)
-			if !ok {
-				continue
-			}
-
-			// Check each day for the tag
-			for _, dayInterface := range days {
-				day, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				dayNum, ok := day["day"].(float64)
-				if !ok {
-					continue
-				}
-
-				tags, ok := day["tags"].([]any)
-				if !ok {
-					continue
-				}
-
-				// Check if tag is in tags
-				found := false
-				for _, t := range tags {
-					if tagIDFloat, ok := t.(float64); ok && int(tagIDFloat) == tagID {
-						found = true
-						break
-					}
-				}
-
-				if !found {
-					continue
-				}
-
-				// Get text snippet
-				context := ""
-				if text, ok := day["text"].(string); ok && text != "" {
-					decryptedText, err := utils.DecryptText(text, encKey)
-					if err != nil {
-						continue
-					}
-					// Get first few words
-					words := strings.Fields(decryptedText)
-					if len(words) > 5 {
-						context = strings.Join(words[:5], " ")
-					} else {
-						context = decryptedText
-					}
-				}
-
-				// Add to results
-				results = append(results, map[string]any{
-					"year":  yearInt,
-					"month": monthInt,
-					"day":   int(dayNum),
-					"text":  context,
-				})
+			// Get first few words
+			words := strings.Fields(decryptedText)
+			if len(words) > 5 {
+				context = strings.Join(words[:5], " ")
+			} else {
+				context = decryptedText
 			}
 		}
+
+		// Add to results
+		results = append(results, map[string]any{
+			"year":  record.Year,
+			"month": record.Month,
+			"day":   day.Day,
+			"text":  context,
+		})
 	}
 
 	// Return results
@@ -217,176 +167,110 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user directory
-	userDir := filepath.Join(utils.Settings.DataPath, strconv.Itoa(userID))
 	results := []any{}
 
-	// Traverse all years and months
-	yearEntries, err := os.ReadDir(userDir)
+	// Get all days
+	records, err := utils.QueryDays(userID, utils.DayFilter{})
 	if err != nil {
-		http.Error(w, "No logs found to be searched", http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("Error retrieving days: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Regex to match year directories (4 digits)
-	yearRegex := regexp.MustCompile(`^\d{4}$`)
-
-	for _, yearEntry := range yearEntries {
-		if !yearEntry.IsDir() || !yearRegex.MatchString(yearEntry.Name()) {
-			continue
+	for _, record := range records {
+		year := strconv.Itoa(record.Year)
+		month := fmt.Sprintf("%02d", record.Month)
+		dayLog := record.Day
+		day := dayLog.Day
+		addResult := func(context string) {
+			results = append(results, map[string]any{
+				"year":  year,
+				"month": month,
+				"day":   day,
+				"text":  context,
+			})
 		}
-		year := yearEntry.Name()
 
-		// Read month files in year directory
-		yearDir := filepath.Join(userDir, year)
-		monthEntries, err := os.ReadDir(yearDir)
-		if err != nil {
-			continue
-		}
-
-		// Regex to match month files (2 digits + .json)
-		monthRegex := regexp.MustCompile(`^(\d{2})\.json$`)
-
-		for _, monthEntry := range monthEntries {
-			if monthEntry.IsDir() {
+		// Check text
+		if dayLog.Text != "" {
+			decryptedText, err := utils.DecryptText(dayLog.Text, encKey)
+			if err != nil {
 				continue
 			}
 
-			matches := monthRegex.FindStringSubmatch(monthEntry.Name())
-			if len(matches) != 2 {
-				continue
+			// Apply search logic
+			if strings.HasPrefix(searchString, "\"") && strings.HasSuffix(searchString, "\"") {
+				// Exact match
+				searchTerm := searchString[1 : len(searchString)-1]
+				if strings.Contains(decryptedText, searchTerm) {
+					context := getContext(decryptedText, searchTerm, true)
+					addResult(context)
+				}
+			} else if strings.Contains(searchString, "|") {
+				// OR search
+				words := strings.SplitSeq(searchString, "|")
+				for word := range words {
+					wordTrimmed := strings.TrimSpace(word)
+					if strings.Contains(strings.ToLower(decryptedText), strings.ToLower(wordTrimmed)) {
+						context := getContext(decryptedText, wordTrimmed, false)
+						addResult(context)
+						break
+					}
+				}
+			} else if strings.Contains(searchString, " ") {
+				// AND search
+				words := strings.Split(searchString, " ")
+				allWordsMatch := true
+				for _, word := range words {
+					wordTrimmed := strings.TrimSpace(word)
+					if !strings.Contains(strings.ToLower(decryptedText), strings.ToLower(wordTrimmed)) {
+						allWordsMatch = false
+						break
+					}
+				}
+				if allWordsMatch {
+					context := getContext(decryptedText, strings.TrimSpace(words[0]), false)
+					addResult(context)
+				}
+			} else {
+				// Simple search
+				if strings.Contains(strings.ToLower(decryptedText), strings.ToLower(searchString)) {
+					context := getContext(decryptedText, searchString, false)
+					addResult(context)
+				}
 			}
-			month := matches[1]
+		}
 
-			// Get month content
-			monthInt, _ := strconv.Atoi(month)
-			yearInt, _ := strconv.Atoi(year)
-			content, err := utils.GetMonth(userID, yearInt, monthInt)
-			if err != nil {
+		// Check filenames
+		for _, file := range dayLog.Files {
+			if file.EncFilename == "" {
 				continue
 			}
-
-			days, ok := content["days"].([]any)
-			if !ok {
+			decryptedFilename, err := utils.DecryptText(file.EncFilename, encKey)
+			if err != nil {
 				continue
 			}
 
-			// Process each day
-			for _, dayInterface := range days {
-				dayLog, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				dayNum, ok := dayLog["day"].(float64)
-				if !ok {
-					continue
-				}
-				day := int(dayNum)
-				addResult := func(context string) {
-					results = append(results, map[string]any{
-						"year":  year,
-						"month": month,
-						"day":   day,
-						"text":  context,
-					})
-				}
-
-				// Check text
-				if text, ok := dayLog["text"].(string); ok {
-					decryptedText, err := utils.DecryptText(text, encKey)
-					if err != nil {
-						continue
-					}
-
-					// Apply search logic
-					if strings.HasPrefix(searchString, "\"") && strings.HasSuffix(searchString, "\"") {
-						// Exact match
-						searchTerm := searchString[1 : len(searchString)-1]
-						if strings.Contains(decryptedText, searchTerm) {
-							context := getContext(decryptedText, searchTerm, true)
-							addResult(context)
-						}
-					} else if strings.Contains(searchString, "|") {
-						// OR search
-						words := strings.SplitSeq(searchString, "|")
-						for word := range words {
-							wordTrimmed := strings.TrimSpace(word)
-							if strings.Contains(strings.ToLower(decryptedText), strings.ToLower(wordTrimmed)) {
-								context := getContext(decryptedText, wordTrimmed, false)
-								addResult(context)
-								break
-							}
-						}
-					} else if strings.Contains(searchString, " ") {
-						// AND search
-						words := strings.Split(searchString, " ")
-						allWordsMatch := true
-						for _, word := range words {
-							wordTrimmed := strings.TrimSpace(word)
-							if !strings.Contains(strings.ToLower(decryptedText), strings.ToLower(wordTrimmed)) {
-								allWordsMatch = false
-								break
-							}
-						}
-						if allWordsMatch {
-							context := getContext(decryptedText, strings.TrimSpace(words[0]), false)
-							addResult(context)
-						}
-					} else {
-						// Simple search
-						if strings.Contains(strings.ToLower(decryptedText), strings.ToLower(searchString)) {
-							context := getContext(decryptedText, searchString, false)
-							addResult(context)
-						}
-					}
-				}
+			if strings.Contains(strings.ToLower(decryptedFilename), strings.ToLower(searchString)) {
+				context := "📎 " + decryptedFilename
+				addResult(context)
+				break
+			}
+		}
 
-				// Check filenames
-				if files, ok := dayLog["files"].([]any); ok {
-					for _, fileInterface := range files {
-						file, ok := fileInterface.(map[string]any)
-						if !ok {
-							continue
-						}
-
-						if encFilename, ok := file["enc_filename"].(string); ok {
-							decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-							if err != nil {
-								continue
-							}
-
-							if strings.Contains(strings.ToLower(decryptedFilename), strings.ToLower(searchString)) {
-								context := "📎 " + decryptedFilename
-								addResult(context)
-								break
-							}
-						}
-					}
-				}
+		// Check pins
+		for _, pin := range dayLog.Pins {
+			if pin.Text == "" {
+				continue
+			}
+			decryptedPinText, err := utils.DecryptText(pin.Text, encKey)
+			if err != nil {
+				continue
+			}
 
-				// Check pins
-				if pins, ok := dayLog["pins"].([]any); ok {
-					for _, pinInterface := range pins {
-						pin, ok := pinInterface.(map[string]any)
-						if !ok {
-							continue
-						}
-
-						if encPinText, ok := pin["text"].(string); ok {
-							decryptedPinText, err := utils.DecryptText(encPinText, encKey)
-							if err != nil {
-								continue
-							}
-
-							if strings.Contains(strings.ToLower(decryptedPinText), strings.ToLower(searchString)) {
-								context := "📍 " + decryptedPinText
-								addResult(context)
-								break
-							}
-						}
-					}
-				}
+			if strings.Contains(strings.ToLower(decryptedPinText), strings.ToLower(searchString)) {
+				context := "📍 " + decryptedPinText
+				addResult(context)
+				break
 			}
 		}
 	}
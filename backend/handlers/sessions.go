@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// GetSessions returns the active sessions of the user
+func GetSessions(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and session ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentID, _ := r.Context().Value(utils.SessionIDKey).(string)
+
+	sessions, err := utils.GetSessions(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Mark the session of this request, so it isn't revoked by accident
+	result := []map[string]any{}
+	for _, session := range sessions {
+		result = append(result, map[string]any{
+			"id":         session.ID,
+			"device":     session.Device,
+			"user_agent": session.UserAgent,
+			"ip":         session.IP,
+			"created":    session.Created,
+			"last_seen":  session.LastSeen,
+			"current":    session.ID == currentID,
+		})
+	}
+
+	utils.JSONResponse(w, http.StatusOK, result)
+}
+
+// RevokeSessionRequest represents the request to revoke a session
+type RevokeSessionRequest struct {
+	ID string `json:"id"`
+}
+
+// RevokeSession logs out a session of the user
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the request body
+	var req RevokeSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	found, err := utils.RevokeSession(userID, req.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
+
+// RevokeOtherSessions logs out all sessions of the user except the current one
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and session ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentID, ok := r.Context().Value(utils.SessionIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	revoked, err := utils.RevokeOtherSessions(userID, currentID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+		"revoked": revoked,
+	})
+}
+
+// GetSecurityLog returns the security log of the user, newest first
+func GetSecurityLog(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	entries, err := utils.ReadSecurityLog(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading security log: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, entries)
+}
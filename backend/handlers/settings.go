@@ -37,6 +37,7 @@ func GetDefaultSettings() map[string]any {
 		"useGeolocationOnThisDevice":          true,
 		"showGPXFiles":                        true,
 		"readModeOldestFirst":                 true,
+		"stripImageMetadata":                  false,
 	}
 }
 
@@ -56,51 +57,46 @@ func GetUserSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user settings
-	encryptedSettings, err := utils.GetUserSettings(userID)
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error retrieving user settings: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Default settings
-	defaultSettings := GetDefaultSettings()
-
-	// If no settings found, return defaults
-	if len(encryptedSettings) == 0 {
-		utils.JSONResponse(w, http.StatusOK, defaultSettings)
+	settings, err := getSettings(userID, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving user settings: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Decrypt settings
-	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	// Return settings
+	utils.JSONResponse(w, http.StatusOK, settings)
+}
+
+// getSettings returns the decrypted settings of a user, missing keys have the default value
+func getSettings(userID int, encKey string) (map[string]any, error) {
+	settings := GetDefaultSettings()
+
+	encryptedSettings, err := utils.GetUserSettings(userID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	if len(encryptedSettings) == 0 {
+		return settings, nil
 	}
 
 	decryptedSettings, err := utils.DecryptText(encryptedSettings, encKey)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error decrypting settings: %v", err), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error decrypting settings: %v", err)
 	}
 
-	// Parse JSON
-	var settings map[string]any
-	if err := json.Unmarshal([]byte(decryptedSettings), &settings); err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing settings: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Apply defaults for missing keys
-	for key, value := range defaultSettings {
-		if _, exists := settings[key]; !exists {
-			settings[key] = value
-		}
+	var userSettings map[string]any
+	if err := json.Unmarshal([]byte(decryptedSettings), &userSettings); err != nil {
+		return nil, fmt.Errorf("error parsing settings: %v", err)
 	}
 
-	// Return settings
-	utils.JSONResponse(w, http.StatusOK, settings)
+	maps.Copy(settings, userSettings)
+	return settings, nil
 }
 
 // SaveUserSettings saves user settings
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 	"unicode"
 	"unicode/utf8"
 
@@ -51,111 +50,43 @@ func GetStatistics(w http.ResponseWriter, r *http.Request) {
 
 	dayStats := []DayStat{}
 
-	// Get all years
-	years, err := utils.GetYears(userID)
+	// Get all days
+	records, err := utils.QueryDays(userID, utils.DayFilter{})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error retrieving years: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error retrieving days: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Iterate years and months
-	for _, yearStr := range years {
-		yearInt, _ := strconv.Atoi(yearStr)
-		months, err := utils.GetMonths(userID, yearStr)
-		if err != nil {
-			continue // skip problematic year
-		}
-		for _, monthStr := range months {
-			monthInt, _ := strconv.Atoi(monthStr)
-			content, err := utils.GetMonth(userID, yearInt, monthInt)
-			if err != nil {
-				continue
-			}
-			daysArr, ok := content["days"].([]any)
-			if !ok {
-				continue
-			}
-			for _, dayInterface := range daysArr {
-				dayMap, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-				dayNumFloat, ok := dayMap["day"].(float64)
-				if !ok {
-					continue
-				}
-				dayNum := int(dayNumFloat)
-
-				// Word count (decrypt text if present)
-				wordCount := 0
-				if encText, ok := dayMap["text"].(string); ok && encText != "" {
-					if decrypted, err := utils.DecryptText(encText, encKey); err == nil {
-						wordCount = CountWords(decrypted)
-					}
-				}
-
-				// File count and total size
-				fileCount := 0
-				var totalFileSize int64 = 0
-				if filesAny, ok := dayMap["files"].([]any); ok {
-					fileCount = len(filesAny)
-					// Calculate total file size for this day
-					for _, fileInterface := range filesAny {
-						if fileMap, ok := fileInterface.(map[string]any); ok {
-							if sizeAny, ok := fileMap["size"]; ok {
-								// Handle both int64 and float64 types
-								switch size := sizeAny.(type) {
-								case int64:
-									totalFileSize += size
-								case float64:
-									totalFileSize += int64(size)
-								case int:
-									totalFileSize += int64(size)
-								}
-							}
-						}
-					}
-				}
-
-				// Pin count
-				pinCount := 0
-				if pinsAny, ok := dayMap["pins"].([]any); ok {
-					pinCount = len(pinsAny)
-				}
-
-				// Tags (IDs are numeric)
-				var tagIDs []int
-				if tagsAny, ok := dayMap["tags"].([]any); ok {
-					for _, t := range tagsAny {
-						if tf, ok := t.(float64); ok {
-							tagIDs = append(tagIDs, int(tf))
-						}
-					}
-				}
+	for _, record := range records {
+		yearInt := record.Year
+		monthInt := record.Month
+		day := record.Day
 
-				// Bookmark flag
-				isBookmarked := false
-				if bmRaw, ok := dayMap["isBookmarked"]; ok {
-					if b, ok2 := bmRaw.(bool); ok2 {
-						isBookmarked = b
-					} else if f, ok2 := bmRaw.(float64); ok2 { // if stored as number
-						isBookmarked = f != 0
-					}
-				}
-
-				dayStats = append(dayStats, DayStat{
-					Year:          yearInt,
-					Month:         monthInt,
-					Day:           dayNum,
-					WordCount:     wordCount,
-					FileCount:     fileCount,
-					FileSizeBytes: totalFileSize,
-					PinCount:      pinCount,
-					Tags:          tagIDs,
-					IsBookmarked:  isBookmarked,
-				})
+		// Word count (decrypt text if present)
+		wordCount := 0
+		if day.Text != "" {
+			if decrypted, err := utils.DecryptText(day.Text, encKey); err == nil {
+				wordCount = CountWords(decrypted)
 			}
 		}
+
+		// Total file size for this day
+		var totalFileSize int64 = 0
+		for _, file := range day.Files {
+			totalFileSize += file.Size
+		}
+
+		dayStats = append(dayStats, DayStat{
+			Year:          yearInt,
+			Month:         monthInt,
+			Day:           day.Day,
+			WordCount:     wordCount,
+			FileCount:     len(day.Files),
+			FileSizeBytes: totalFileSize,
+			PinCount:      len(day.Pins),
+			Tags:          day.Tags,
+			IsBookmarked:  day.IsBookmarked,
+		})
 	}
 
 	// Sort days by date descending (latest first) if desired; currently ascending by traversal. Keep ascending.
@@ -19,15 +19,18 @@ type EditTagRequest struct {
 
 // EditTag handles editing a tag
 func EditTag(w http.ResponseWriter, r *http.Request) {
-	utils.TagsMutex.Lock()
-	defer utils.TagsMutex.Unlock()
-
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the tags of this user
+	tagsMutex := utils.UserLocks.Tags(userID)
+	tagsMutex.Lock()
+	defer tagsMutex.Unlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -119,11 +122,6 @@ func EditTag(w http.ResponseWriter, r *http.Request) {
 
 // DeleteTag handles deleting a tag
 func DeleteTag(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-	utils.TagsMutex.Lock()
-	defer utils.TagsMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -131,6 +129,16 @@ func DeleteTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
+	// Lock the tags of this user
+	tagsMutex := utils.UserLocks.Tags(userID)
+	tagsMutex.Lock()
+	defer tagsMutex.Unlock()
+
 	// Get tag ID
 	idStr := r.URL.Query().Get("id")
 	if idStr == "" {
@@ -160,46 +168,22 @@ func DeleteTag(w http.ResponseWriter, r *http.Request) {
 
 		for _, month := range months {
 			monthInt, _ := strconv.Atoi(month)
-			content, err := utils.GetMonth(userID, yearInt, monthInt)
+			content, err := utils.ReadMonth(userID, yearInt, monthInt)
 			if err != nil {
 				continue
 			}
 
-			days, ok := content["days"].([]any)
-			if !ok {
-				continue
-			}
-
-			// Check each day for the tag
+			// Remove the tag from each day
 			modified := false
-			for i, dayInterface := range days {
-				day, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				tags, ok := day["tags"].([]any)
-				if !ok {
-					continue
-				}
-
-				// Find and remove the tag
-				for j, tagID := range tags {
-					if tagIDFloat, ok := tagID.(float64); ok && int(tagIDFloat) == id {
-						// Remove tag
-						tags = append(tags[:j], tags[j+1:]...)
-						day["tags"] = tags
-						days[i] = day
-						modified = true
-						break
-					}
+			for i := range content.Days {
+				if content.Days[i].RemoveTag(id) {
+					modified = true
 				}
 			}
 
 			// Write updated month if modified
 			if modified {
-				content["days"] = days
-				if err := utils.WriteMonth(userID, yearInt, monthInt, content); err != nil {
+				if err := utils.SaveMonth(userID, yearInt, monthInt, content); err != nil {
 					http.Error(w, fmt.Sprintf("Failed to delete tag - error writing log: %v", err), http.StatusInternalServerError)
 					return
 				}
@@ -265,9 +249,6 @@ type TagLogRequest struct {
 
 // AddTagToLog handles adding a tag to a log
 func AddTagToLog(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -275,6 +256,11 @@ func AddTagToLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	// Parse request body
 	var req TagLogRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -283,68 +269,20 @@ func AddTagToLog(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	content, err := utils.ReadMonth(userID, req.Year, req.Month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Get or create days array
-	days, ok := content["days"].([]any)
-	if !ok {
-		days = []any{}
-	}
-
-	// Find day
-	dayFound := false
-	for i, dayInterface := range days {
-		day, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		dayNum, ok := day["day"].(float64)
-		if !ok || int(dayNum) != req.Day {
-			continue
-		}
-
-		// Day found, add tag
-		dayFound = true
-		tags, ok := day["tags"].([]any)
-		if !ok {
-			tags = []any{}
-		}
-
-		// Check if tag already exists
-		tagExists := false
-		for _, tagID := range tags {
-			if tagIDFloat, ok := tagID.(float64); ok && int(tagIDFloat) == req.TagID {
-				tagExists = true
-				break
-			}
-		}
-
-		if !tagExists {
-			tags = append(tags, float64(req.TagID))
-			day["tags"] = tags
-			days[i] = day
-		}
-		break
-	}
-
-	if !dayFound {
-		// Create new day with tag
-		days = append(days, map[string]any{
-			"day":  req.Day,
-			"tags": []any{float64(req.TagID)},
-		})
+	// Add the tag to the day (the day is created if necessary)
+	day := content.GetOrCreateDay(req.Day)
+	if !day.HasTag(req.TagID) {
+		day.Tags = append(day.Tags, req.TagID)
 	}
 
-	// Update days array
-	content["days"] = days
-
 	// Write month data
-	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+	if err := utils.SaveMonth(userID, req.Year, req.Month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to write tag - error writing log: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -357,9 +295,6 @@ func AddTagToLog(w http.ResponseWriter, r *http.Request) {
 
 // RemoveTagFromLog handles removing a tag from a log
 func RemoveTagFromLog(w http.ResponseWriter, r *http.Request) {
-	utils.LogsMutex.Lock()
-	defer utils.LogsMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -367,6 +302,11 @@ func RemoveTagFromLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the logs of this user
+	logsMutex := utils.UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
 	// Parse request body
 	var req TagLogRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -375,68 +315,21 @@ func RemoveTagFromLog(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month data
-	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	content, err := utils.ReadMonth(userID, req.Year, req.Month)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Check if days exist
-	days, ok := content["days"].([]any)
-	if !ok {
-		http.Error(w, "Day not found - json error", http.StatusInternalServerError)
-		return
-	}
-
-	// Find day
-	found := false
-	for i, dayInterface := range days {
-		day, ok := dayInterface.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		dayNum, ok := day["day"].(float64)
-		if !ok || int(dayNum) != req.Day {
-			continue
-		}
-
-		// Day found, check for tags
-		tags, ok := day["tags"].([]any)
-		if !ok {
-			http.Error(w, "Failed to remove tag - not found in log", http.StatusInternalServerError)
-			return
-		}
-
-		// Find and remove tag
-		for j, tagID := range tags {
-			if tagIDFloat, ok := tagID.(float64); ok && int(tagIDFloat) == req.TagID {
-				// Remove tag
-				tags = append(tags[:j], tags[j+1:]...)
-				day["tags"] = tags
-				days[i] = day
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			http.Error(w, "Failed to remove tag - not found in log", http.StatusInternalServerError)
-			return
-		}
-		break
-	}
-
-	if !found {
+	// Find day and remove the tag
+	day := content.FindDay(req.Day)
+	if day == nil || !day.RemoveTag(req.TagID) {
 		http.Error(w, "Failed to remove tag - not found in log", http.StatusInternalServerError)
 		return
 	}
 
-	// Update days array
-	content["days"] = days
-
 	// Write month data
-	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+	if err := utils.SaveMonth(userID, req.Year, req.Month, content); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to remove tag - error writing log: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -535,15 +428,18 @@ type TagRequest struct {
 
 // SaveTags handles saving a new tag
 func SaveTags(w http.ResponseWriter, r *http.Request) {
-	utils.TagsMutex.Lock()
-	defer utils.TagsMutex.Unlock()
-
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the tags of this user
+	tagsMutex := utils.UserLocks.Tags(userID)
+	tagsMutex.Lock()
+	defer tagsMutex.Unlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
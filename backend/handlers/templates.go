@@ -89,15 +89,18 @@ func GetTemplates(w http.ResponseWriter, r *http.Request) {
 
 // SaveTemplates handles saving templates
 func SaveTemplates(w http.ResponseWriter, r *http.Request) {
-	utils.TemplatesMutex.Lock()
-	defer utils.TemplatesMutex.Unlock()
-
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	// Lock the templates of this user
+	templatesMutex := utils.UserLocks.Templates(userID)
+	templatesMutex.Lock()
+	defer templatesMutex.Unlock()
+
 	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
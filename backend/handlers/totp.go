@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// A login with TOTP has two steps: Login checks the password and returns a
+// ticket, LoginTOTP checks the code for this ticket and completes the login.
+// The derived key is only kept in memory in between.
+
+const (
+	pendingLoginTTL         = 5 * time.Minute
+	pendingLoginMaxAttempts = 5
+)
+
+type pendingLogin struct {
+	userID     int
+	username   string
+	derivedKey string
+	expires    time.Time
+	attempts   int
+}
+
+var (
+	pendingLogins      = map[string]*pendingLogin{}
+	pendingLoginsMutex sync.Mutex
+)
+
+// createPendingLogin saves a login whose password was correct and returns its ticket
+func createPendingLogin(userID int, username string, derivedKey string) (string, error) {
+	ticketBytes := make([]byte, 32)
+	if _, err := rand.Read(ticketBytes); err != nil {
+		return "", err
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(ticketBytes)
+
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+
+	// Remove expired logins
+	for t, login := range pendingLogins {
+		if time.Now().After(login.expires) {
+			delete(pendingLogins, t)
+		}
+	}
+
+	pendingLogins[ticket] = &pendingLogin{
+		userID:     userID,
+		username:   username,
+		derivedKey: derivedKey,
+		expires:    time.Now().Add(pendingLoginTTL),
+	}
+	return ticket, nil
+}
+
+// LoginTOTPRequest represents the second step of a login with TOTP
+type LoginTOTPRequest struct {
+	Ticket string `json:"ticket"`
+	Code   string `json:"code"`
+}
+
+// LoginTOTP completes a login with the TOTP code
+func LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var req LoginTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	pendingLoginsMutex.Lock()
+	login, ok := pendingLogins[req.Ticket]
+	if ok && time.Now().After(login.expires) {
+		delete(pendingLogins, req.Ticket)
+		ok = false
+	}
+	pendingLoginsMutex.Unlock()
+
+	if !ok {
+		http.Error(w, "Login expired", http.StatusNotFound)
+		return
+	}
+
+	// Wrong codes are throttled like wrong passwords
+	throttleKeys := []utils.ThrottleKey{utils.UserThrottleKey(login.username), utils.IPThrottleKey(r)}
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
+	encKey, err := utils.GetEncryptionKey(login.userID, login.derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	valid, err := utils.VerifyTOTP(login.userID, req.Code, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error verifying code: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	pendingLoginsMutex.Lock()
+	if valid {
+		delete(pendingLogins, req.Ticket)
+	} else {
+		// The password has to be entered again after too many wrong codes
+		login.attempts++
+		if login.attempts >= pendingLoginMaxAttempts {
+			delete(pendingLogins, req.Ticket)
+		}
+	}
+	pendingLoginsMutex.Unlock()
+
+	if !valid {
+		utils.ThrottleFailure(throttleKeys...)
+		utils.Logger.Printf("Login failed. TOTP code for user '%s' is incorrect", login.username)
+		utils.LogSecurityEvent(r, login.userID, login.derivedKey, "login_failed", map[string]any{"reason": "totp"})
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	utils.ThrottleSuccess(throttleKeys[0])
+
+	completeLogin(w, r, login.userID, login.username, login.derivedKey, -1, "totp", "")
+}
+
+// GetTOTPStatus returns if TOTP is enabled for the user
+func GetTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"enabled": utils.TOTPEnabled(userID),
+	})
+}
+
+// SetupTOTP creates a new TOTP secret. It is enabled with EnableTOTP once the
+// user entered a code of the authenticator app.
+func SetupTOTP(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	username, ok := r.Context().Value(utils.UsernameKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := utils.StartTOTPSetup(userID, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating TOTP secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	uri := utils.TOTPProvisioningURI(secret, username)
+	qrCode, err := utils.TOTPQRCode(uri)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating QR code: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"secret":  secret,
+		"uri":     uri,
+		"qr_code": "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrCode),
+	})
+}
+
+// EnableTOTPRequest represents the confirmation of the TOTP setup
+type EnableTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+// EnableTOTP enables TOTP if the code matches the secret of SetupTOTP
+func EnableTOTP(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the request body
+	var req EnableTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	valid, err := utils.ConfirmTOTPSetup(userID, req.Code, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error enabling TOTP: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success": false,
+			"message": "Invalid code",
+		})
+		return
+	}
+
+	utils.Logger.Printf("TOTP enabled for user %d", userID)
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
+
+// DisableTOTPRequest represents the request to disable TOTP
+type DisableTOTPRequest struct {
+	Password string `json:"password"`
+}
+
+// DisableTOTP disables TOTP after checking the password
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the request body
+	var req DisableTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Wait after too many wrong passwords
+	throttleKeys := reauthThrottleKeys(r)
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Check if password is correct
+	derivedKey, _, err := utils.CheckPasswordForUser(userID, req.Password)
+	if err != nil || derivedKey == "" {
+		utils.ThrottleFailure(throttleKeys...)
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success":            false,
+			"password_incorrect": true,
+		})
+		return
+	}
+	utils.ThrottleSuccess(throttleKeys[0])
+
+	if err := utils.DisableTOTP(userID); err != nil {
+		http.Error(w, fmt.Sprintf("Error disabling TOTP: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Logger.Printf("TOTP disabled for user %d", userID)
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// testTOTPCode returns the current code of a secret like an authenticator app
+func testTOTPCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("decoding secret: %v", err)
+	}
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, time.Now().Unix()/30+offset)
+	sum := mac.Sum(nil)
+	value := binary.BigEndian.Uint32(sum[sum[len(sum)-1]&0x0f:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// enableTestTOTP enables TOTP for the test user and returns the secret.
+// A completed login needs the signing keys and sessions that don't expire at once.
+func enableTestTOTP(t *testing.T, userID int, derivedKey string) string {
+	t.Helper()
+
+	previousPath, previousLogout := utils.Settings.DataPath, utils.Settings.LogoutAfterDays
+	utils.Settings.DataPath = t.TempDir()
+	utils.Settings.LogoutAfterDays = 30
+	t.Cleanup(func() { utils.Settings.DataPath, utils.Settings.LogoutAfterDays = previousPath, previousLogout })
+	if err := utils.InitJWTKeys(); err != nil {
+		t.Fatalf("creating signing keys: %v", err)
+	}
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := utils.StartTOTPSetup(userID, encKey)
+	if err != nil {
+		t.Fatalf("starting TOTP setup: %v", err)
+	}
+	// The code of the previous step, so the login can use the current one
+	if ok, err := utils.ConfirmTOTPSetup(userID, testTOTPCode(t, secret, -1), encKey); !ok || err != nil {
+		t.Fatalf("confirming TOTP setup: %v, %v", ok, err)
+	}
+	return secret
+}
+
+// loginTOTP sends the code for a ticket and returns the response
+func loginTOTP(ticket, code string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	LoginTOTP(w, authRequest(http.MethodPost, "/users/loginTOTP", LoginTOTPRequest{Ticket: ticket, Code: code}, 0, ""))
+
+	// Only the attempts of a ticket are tested, not the throttling
+	utils.ThrottleSuccess(utils.UserThrottleKey("alice"), utils.IPThrottleKey(httptest.NewRequest(http.MethodPost, "/", nil)))
+	return w
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	userID, derivedKey := newTestUser(t)
+	secret := enableTestTOTP(t, userID, derivedKey)
+
+	// The password alone only returns a ticket
+	w := httptest.NewRecorder()
+	Login(w, authRequest(http.MethodPost, "/users/login", LoginRequest{Username: "alice", Password: "password"}, 0, ""))
+	result := decodeResponse(t, w)
+	ticket, _ := result["ticket"].(string)
+	if result["totp_required"] != true || ticket == "" {
+		t.Fatalf("login response = %v, want a ticket for the TOTP code", result)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("token cookie set before the TOTP code")
+	}
+
+	code := testTOTPCode(t, secret, 0)
+	w = loginTOTP(ticket, code)
+	decodeResponse(t, w)
+	if len(w.Result().Cookies()) == 0 {
+		t.Errorf("no token cookie after the TOTP code")
+	}
+
+	// The ticket is used up and the code can't be used again
+	if w := loginTOTP(ticket, code); w.Code != http.StatusNotFound {
+		t.Errorf("used ticket: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	ticket, err := createPendingLogin(userID, "alice", derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := loginTOTP(ticket, code); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed code: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLoginTOTPAttemptLimit(t *testing.T) {
+	userID, derivedKey := newTestUser(t)
+	secret := enableTestTOTP(t, userID, derivedKey)
+
+	ticket, err := createPendingLogin(userID, "alice", derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= pendingLoginMaxAttempts; attempt++ {
+		if w := loginTOTP(ticket, "000000"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status %d, want %d", attempt, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// After too many wrong codes, the password has to be entered again
+	if w := loginTOTP(ticket, testTOTPCode(t, secret, 0)); w.Code != http.StatusNotFound {
+		t.Errorf("correct code after too many wrong ones: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestLoginTOTPExpiredTicket(t *testing.T) {
+	userID, derivedKey := newTestUser(t)
+	secret := enableTestTOTP(t, userID, derivedKey)
+
+	for _, tc := range []struct {
+		name   string
+		ticket func() string
+	}{
+		{name: "unknown", ticket: func() string { return "unknown" }},
+		{name: "expired", ticket: func() string {
+			ticket, err := createPendingLogin(userID, "alice", derivedKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pendingLoginsMutex.Lock()
+			pendingLogins[ticket].expires = time.Now().Add(-time.Second)
+			pendingLoginsMutex.Unlock()
+			return ticket
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := loginTOTP(tc.ticket(), testTOTPCode(t, secret, 0)); w.Code != http.StatusNotFound {
+				t.Errorf("status %d, want %d", w.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// Resumable uploads: createUpload, then uploadChunk until all data is sent
+// (uploadStatus returns the offset to continue at), then finalizeUpload.
+// cancelUpload (DELETE) removes an upload that is not finished.
+
+// CreateUploadRequest represents the create upload request body
+type CreateUploadRequest struct {
+	UUID     string `json:"uuid"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Day      int    `json:"day"`
+	Month    int    `json:"month"`
+	Year     int    `json:"year"`
+}
+
+// uploadResponse returns the state of an upload for the client
+func uploadResponse(upload *utils.Upload) map[string]any {
+	return map[string]any{
+		"success":    true,
+		"id":         upload.ID,
+		"offset":     upload.Offset,
+		"size":       upload.Size,
+		"expires_at": upload.ExpiresAt(),
+	}
+}
+
+// uploadError writes the response for an error of the resumable uploads
+func uploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, utils.ErrUploadNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, utils.ErrUploadBusy):
+		http.Error(w, "Upload is in use by another request", http.StatusConflict)
+	case errors.Is(err, utils.ErrTooManyUploads):
+		http.Error(w, "Too many open uploads", http.StatusTooManyRequests)
+	default:
+		http.Error(w, fmt.Sprintf("Error in upload: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// CreateUpload starts a resumable upload
+func CreateUpload(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse request body
+	var req CreateUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate input
+	if strings.TrimSpace(req.UUID) == "" {
+		http.Error(w, "Missing uuid parameter", http.StatusBadRequest)
+		return
+	}
+	if !utils.ValidFileUUID(req.UUID) {
+		http.Error(w, "Invalid uuid parameter", http.StatusBadRequest)
+		return
+	}
+	if req.Size < 0 {
+		http.Error(w, "Invalid size parameter", http.StatusBadRequest)
+		return
+	}
+	if req.Day < 1 || req.Day > 31 || req.Month < 1 || req.Month > 12 || req.Year < 1 {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The filename is staged encrypted as well
+	encFilename, err := utils.EncryptText(req.Filename, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting filename: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	upload := &utils.Upload{
+		UserID:      userID,
+		UUID:        req.UUID,
+		EncFilename: encFilename,
+		Year:        req.Year,
+		Month:       req.Month,
+		Day:         req.Day,
+		Size:        req.Size,
+	}
+	// Don't receive a file that can't be stored anyway
+	if err := utils.CreateUpload(upload); err != nil {
+		if errors.Is(err, utils.ErrQuotaExceeded) {
+			quotaExceeded(w, userID)
+		} else {
+			uploadError(w, err)
+		}
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, uploadResponse(upload))
+}
+
+// UploadChunk appends the request body to an upload. The offset parameter
+// must be the current offset of the upload, otherwise 409 with the current
+// offset is returned.
+func UploadChunk(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get parameters
+	id := r.URL.Query().Get("id")
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid offset parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Lock the upload
+	unlock, err := utils.LockUpload(id)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	defer unlock()
+
+	upload, err := utils.GetUpload(userID, id)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	if offset != upload.Offset {
+		utils.JSONResponse(w, http.StatusConflict, map[string]any{
+			"success": false,
+			"message": "Offset does not match the upload",
+			"offset":  upload.Offset,
+		})
+		return
+	}
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := utils.AppendUpload(upload, offset, r.Body, encKey); err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, uploadResponse(upload))
+}
+
+// GetUploadStatus returns the offset of an upload to continue at
+func GetUploadStatus(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	upload, err := utils.GetUpload(userID, r.URL.Query().Get("id"))
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, uploadResponse(upload))
+}
+
+// FinalizeUpload stores a complete upload and adds the file to its day
+func FinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse request body
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Lock the upload
+	unlock, err := utils.LockUpload(req.ID)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	defer unlock()
+
+	upload, err := utils.GetUpload(userID, req.ID)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	if !upload.Complete() {
+		utils.JSONResponse(w, http.StatusConflict, map[string]any{
+			"success": false,
+			"message": "Upload is incomplete",
+			"offset":  upload.Offset,
+		})
+		return
+	}
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	filename, err := utils.DecryptText(upload.EncFilename, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decrypting filename: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Store the file (encrypted again as a whole)
+	content, err := utils.OpenUpload(upload, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	size, metadata, err := writeUploadedFile(content, filename, userID, upload.UUID, encKey)
+	if err != nil {
+		utils.RemoveFile(userID, upload.UUID)
+		writeFileError(w, userID, err)
+		return
+	}
+
+	// Images get thumbnails
+	thumbnails := createThumbnails(userID, upload.UUID, filename, encKey)
+
+	// Add file to day
+	if err := attachFile(userID, upload.Year, upload.Month, upload.Day, utils.FileRef{
+		EncFilename:  upload.EncFilename,
+		UUIDFilename: upload.UUID,
+		Size:         size,
+		Thumbnails:   thumbnails,
+	}); err != nil {
+		utils.RemoveFile(userID, upload.UUID)
+		utils.RemoveThumbnails(userID, upload.UUID, thumbnails)
+		http.Error(w, fmt.Sprintf("Error adding file to day: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The staged data is not needed anymore
+	utils.RemoveUpload(upload.ID)
+
+	response := map[string]any{
+		"success":    true,
+		"thumbnails": thumbnails,
+	}
+	if suggestions := imageMetadataResponse(metadata, filename, upload.Year, upload.Month, upload.Day); suggestions != nil {
+		response["metadata"] = suggestions
+	}
+	utils.JSONResponse(w, http.StatusOK, response)
+}
+
+// CancelUpload removes an upload that won't be finished
+func CancelUpload(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+
+	// Lock the upload
+	unlock, err := utils.LockUpload(id)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	defer unlock()
+
+	if _, err := utils.GetUpload(userID, id); err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	if err := utils.RemoveUpload(id); err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]bool{
+		"success": true,
+	})
+}
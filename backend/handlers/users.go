@@ -22,6 +22,11 @@ type LoginRequest struct {
 
 // Login handles user login
 func Login(w http.ResponseWriter, r *http.Request) {
+	if utils.PasswordLoginDisabled() {
+		http.Error(w, "Password login is disabled, use single sign-on", http.StatusForbidden)
+		return
+	}
+
 	// Parse the request body
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -29,6 +34,14 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Wait after too many wrong passwords for this user or from this client
+	throttleKeys := []utils.ThrottleKey{utils.UserThrottleKey(req.Username), utils.IPThrottleKey(r)}
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Get users
 	users, err := utils.GetUsers()
 	if err != nil {
@@ -67,6 +80,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		oldUsers, err := utils.GetOldUsers()
 		if err != nil {
 			utils.Logger.Printf("Error accessing old users: %v", err)
+			utils.ThrottleFailure(throttleKeys...)
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
@@ -74,6 +88,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		oldUsersList, ok := oldUsers["users"].([]any)
 		if !ok || len(oldUsersList) == 0 {
 			utils.Logger.Printf("Login failed. User '%s' not found in new or old data", req.Username)
+			utils.ThrottleFailure(throttleKeys...)
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
@@ -94,6 +109,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 		if oldUser == nil {
 			utils.Logger.Printf("Login failed. User '%s' not found in new or old data", req.Username)
+			utils.ThrottleFailure(throttleKeys...)
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
@@ -102,6 +118,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		oldHashedPassword, ok := oldUser["password"].(string)
 		if !ok {
 			utils.Logger.Printf("Login failed. Password not found for '%s'", req.Username)
+			utils.ThrottleFailure(throttleKeys...)
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
@@ -109,6 +126,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		// Verify old password
 		if !utils.VerifyOldPassword(req.Password, oldHashedPassword) {
 			utils.Logger.Printf("Login failed. Old password for user '%s' is incorrect", req.Username)
+			utils.ThrottleFailure(throttleKeys...)
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
@@ -116,99 +134,119 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		// Start migration
 		utils.Logger.Printf("User '%s' found in old data. Starting migration...", req.Username)
 
-		// Check if there is already a migration in progress for this user
-		activeMigrationsMutex.RLock()
-		isActive := activeMigrations[username]
-		activeMigrationsMutex.RUnlock()
+		startMigration(w, username, func(progressChan chan<- utils.MigrationProgress) error {
+			return utils.MigrateUserData(username, req.Password, Register, progressChan)
+		})
+		return
+	}
 
-		if isActive {
-			utils.Logger.Printf("Migration already in progress for user '%s'. Rejecting second attempt.", req.Username)
-			utils.JSONResponse(w, http.StatusConflict, map[string]any{
-				"error": "Migration already in progress for this user. Please wait until it completes.",
-			})
+	derivedKey, availableBackupCodes, err := utils.CheckPasswordForUser(userID, req.Password)
+	if err != nil {
+		utils.Logger.Printf("Error checking password for user '%s': %v", req.Username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	} else if derivedKey == "" {
+		utils.Logger.Printf("Login failed. Password for user '%s' is incorrect", req.Username)
+		utils.LogSecurityEvent(r, userID, "", "login_failed", map[string]any{"reason": "password"})
+		utils.ThrottleFailure(throttleKeys...)
+		http.Error(w, "User/Password combination not found", http.StatusNotFound)
+		return
+	}
+
+	// Hash the password and derive the key again if the Argon2 parameters changed
+	if availableBackupCodes == -1 {
+		derivedKey, err = utils.UpgradeArgon2(userID, req.Password, derivedKey)
+		if err != nil {
+			utils.Logger.Printf("Error upgrading the Argon2 parameters of user '%s': %v", req.Username, err)
+		}
+	}
+
+	// Ask for the TOTP code if enabled. A backup code replaces it, so it
+	// stays the recovery if the authenticator is lost.
+	if availableBackupCodes == -1 && utils.TOTPEnabled(userID) {
+		ticket, err := createPendingLogin(userID, username, derivedKey)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		// Mark this user as having an active migration
-		activeMigrationsMutex.Lock()
-		activeMigrations[username] = true
-		activeMigrationsMutex.Unlock()
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"totp_required": true,
+			"ticket":        ticket,
+			"username":      username,
+		})
+		return
+	}
 
-		// Create a channel to report progress
-		progressChan := make(chan utils.MigrationProgress, 10)
+	// The failed attempts are only forgotten after the second factor, so a
+	// known password doesn't reset the counter for guessing TOTP codes
+	utils.ThrottleSuccess(throttleKeys[0])
 
-		// Start migration in a goroutine
-		go func() {
-			defer close(progressChan)
-
-			// Update progress channel to track migration progress
-			go func() {
-				for progress := range progressChan {
-					migrationProgressMutex.Lock()
-					// Convert from utils.MigrationProgress to handlers.MigrationProgress
-					migrationProgress[username] = MigrationProgress{
-						Phase:          progress.Phase,
-						ProcessedItems: progress.ProcessedItems,
-						TotalItems:     progress.TotalItems,
-						ErrorCount:     progress.ErrorCount,
-					}
-					migrationProgressMutex.Unlock()
-				}
-			}()
-
-			utils.Logger.Printf("Starting migration for user '%s'", username)
-
-			err := utils.MigrateUserData(username, req.Password, Register, progressChan)
-			if err != nil {
-				utils.Logger.Printf("Migration failed for user '%s': %v", username, err)
-				// Mark migration as completed even on error
-				activeMigrationsMutex.Lock()
-				activeMigrations[username] = false
-				activeMigrationsMutex.Unlock()
-				return
-			}
+	method := "password"
+	if availableBackupCodes != -1 {
+		method = "backup_code"
+	}
+	completeLogin(w, r, userID, username, derivedKey, availableBackupCodes, method, "")
+}
 
-			// Mark migration as completed
-			activeMigrationsMutex.Lock()
-			activeMigrations[username] = false
-			activeMigrationsMutex.Unlock()
-		}()
+// beginAttempt reserves a password attempt for the keys. It answers with 429
+// and returns false if the client has to wait before the next attempt. The
+// returned function releases the attempt after the password was checked.
+func beginAttempt(w http.ResponseWriter, keys ...utils.ThrottleKey) (func(), bool) {
+	release, wait := utils.ThrottleBegin(keys...)
+	if wait > 0 {
+		utils.TooManyAttempts(w, wait)
+		return nil, false
+	}
+	return release, true
+}
+
+// reauthThrottleKeys returns the throttle keys for the password checks of a
+// logged in user (e.g. before changing the password), the same as for the login
+func reauthThrottleKeys(r *http.Request) []utils.ThrottleKey {
+	username, _ := r.Context().Value(utils.UsernameKey).(string)
+	return []utils.ThrottleKey{utils.UserThrottleKey(username), utils.IPThrottleKey(r)}
+}
 
-		// Return migration status to client
-		utils.JSONResponse(w, http.StatusAccepted, map[string]any{
-			"migration_started": true,
-			"username":          username,
+// completeLogin finishes a login after all checks (password and TOTP code)
+// and sets the token cookie. The method is written to the security log.
+func completeLogin(w http.ResponseWriter, r *http.Request, userID int, username string, derivedKey string, availableBackupCodes int, method string, passkeyID string) {
+	// Migrate the data of the user if needed (needs the key of the user)
+	if utils.HasPendingUserMigrations(userID) {
+		utils.Logger.Printf("Data of user '%s' needs to be migrated. Starting migration...", username)
+		startMigration(w, username, func(progressChan chan<- utils.MigrationProgress) error {
+			return utils.RunUserMigrations(userID, username, derivedKey, progressChan)
 		})
 		return
 	}
 
-	derivedKey, availableBackupCodes, err := utils.CheckPasswordForUser(userID, req.Password)
+	// Create the thumbnails of files uploaded before thumbnails existed
+	if !utils.ThumbnailsBackfilled(userID) {
+		if encKey, err := utils.GetEncryptionKey(userID, derivedKey); err == nil {
+			utils.StartThumbnailBackfill(userID, encKey)
+		}
+	}
+
+	// Every login gets its own session, which can be revoked. The session
+	// stores the derived key, the token only the key to decrypt it.
+	sessionID, sessionKey, err := utils.CreateSession(userID, r, derivedKey, passkeyID)
 	if err != nil {
-		utils.Logger.Printf("Error checking password for user '%s': %v", req.Username, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
-	} else if derivedKey == "" {
-		utils.Logger.Printf("Login failed. Password for user '%s' is incorrect", req.Username)
-		http.Error(w, "User/Password combination not found", http.StatusNotFound)
-		return
 	}
 
 	// Create JWT token
-	token, err := utils.GenerateToken(userID, username, derivedKey)
+	token, err := utils.GenerateToken(userID, username, sessionID, sessionKey)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
 	// Set cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
-		Expires:  time.Now().Add(time.Duration(utils.Settings.LogoutAfterDays) * 24 * time.Hour),
-	})
+	utils.SetTokenCookie(w, token)
+
+	// Also moves the sealed events (like failed logins) into the log
+	utils.LogSecurityEvent(r, userID, derivedKey, "login", map[string]any{"method": method})
 
 	// Return success
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
@@ -218,6 +256,68 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// startMigration runs a migration of a user in the background and reports the
+// progress to GetMigrationProgress. The client logs in again when it is done.
+func startMigration(w http.ResponseWriter, username string, migrate func(progressChan chan<- utils.MigrationProgress) error) {
+	// Check if there is already a migration in progress for this user
+	activeMigrationsMutex.RLock()
+	isActive := activeMigrations[username]
+	activeMigrationsMutex.RUnlock()
+
+	if isActive {
+		utils.Logger.Printf("Migration already in progress for user '%s'. Rejecting second attempt.", username)
+		utils.JSONResponse(w, http.StatusConflict, map[string]any{
+			"error": "Migration already in progress for this user. Please wait until it completes.",
+		})
+		return
+	}
+
+	// Mark this user as having an active migration
+	activeMigrationsMutex.Lock()
+	activeMigrations[username] = true
+	activeMigrationsMutex.Unlock()
+
+	// Create a channel to report progress
+	progressChan := make(chan utils.MigrationProgress, 10)
+
+	// Start migration in a goroutine
+	go func() {
+		defer close(progressChan)
+
+		// Update progress channel to track migration progress
+		go func() {
+			for progress := range progressChan {
+				migrationProgressMutex.Lock()
+				// Convert from utils.MigrationProgress to handlers.MigrationProgress
+				migrationProgress[username] = MigrationProgress{
+					Phase:          progress.Phase,
+					ProcessedItems: progress.ProcessedItems,
+					TotalItems:     progress.TotalItems,
+					ErrorCount:     progress.ErrorCount,
+				}
+				migrationProgressMutex.Unlock()
+			}
+		}()
+
+		utils.Logger.Printf("Starting migration for user '%s'", username)
+
+		if err := migrate(progressChan); err != nil {
+			utils.Logger.Printf("Migration failed for user '%s': %v", username, err)
+		}
+
+		// Mark migration as completed (even on error)
+		activeMigrationsMutex.Lock()
+		activeMigrations[username] = false
+		activeMigrationsMutex.Unlock()
+	}()
+
+	// Return migration status to client
+	utils.JSONResponse(w, http.StatusAccepted, map[string]any{
+		"migration_started": true,
+		"username":          username,
+	})
+}
+
 func IsRegistrationAllowed(w http.ResponseWriter, r *http.Request) {
 
 	// Check if registration is allowed (consider env and temporary override)
@@ -308,7 +408,8 @@ func Register(username string, password string) (bool, error) {
 	saltBase64 := base64.StdEncoding.EncodeToString(salt)
 
 	// Create encryption key
-	derivedKey, err := utils.DeriveKeyFromPassword(password, saltBase64)
+	keyParams := utils.CurrentKeyParams()
+	derivedKey, err := utils.DeriveKeyFromPassword(password, saltBase64, keyParams)
 	if err != nil {
 		return false, fmt.Errorf("internal Server Error: %d", http.StatusInternalServerError)
 	}
@@ -333,19 +434,22 @@ func Register(username string, password string) (bool, error) {
 	encryptedKey := aead.Seal(nonce, nonce, encryptionKey, nil)
 	encEncKey := base64.StdEncoding.EncodeToString(encryptedKey)
 
-	// Create or update users
+	// Create or update users (a new user has no files without thumbnails)
 	if len(users) == 0 {
 		users = map[string]any{
 			"id_counter": 1,
 			"users": []map[string]any{
 				{
-					"user_id":           1,
-					"dailytxt_version":  2,
-					"last_seen_version": utils.AppVersion,
-					"username":          username,
-					"password":          hashedPassword,
-					"salt":              salt,
-					"enc_enc_key":       encEncKey,
+					"user_id":               1,
+					"dailytxt_version":      2,
+					"user_data_version":     utils.UserDataVersion,
+					"thumbnails_backfilled": true,
+					"last_seen_version":     utils.AppVersion,
+					"username":              username,
+					"password":              hashedPassword,
+					"salt":                  salt,
+					"kdf":                   keyParams.String(),
+					"enc_enc_key":           encEncKey,
 				},
 			},
 		}
@@ -365,13 +469,16 @@ func Register(username string, password string) (bool, error) {
 		}
 
 		usersList = append(usersList, map[string]any{
-			"user_id":           int(idCounter),
-			"dailytxt_version":  2,
-			"last_seen_version": utils.AppVersion,
-			"username":          username,
-			"password":          hashedPassword,
-			"salt":              salt,
-			"enc_enc_key":       encEncKey,
+			"user_id":               int(idCounter),
+			"dailytxt_version":      2,
+			"user_data_version":     utils.UserDataVersion,
+			"thumbnails_backfilled": true,
+			"last_seen_version":     utils.AppVersion,
+			"username":              username,
+			"password":              hashedPassword,
+			"salt":                  salt,
+			"kdf":                   keyParams.String(),
+			"enc_enc_key":           encEncKey,
 		})
 
 		users["users"] = usersList
@@ -388,6 +495,15 @@ func Register(username string, password string) (bool, error) {
 
 // Logout handles user logout
 func Logout(w http.ResponseWriter, r *http.Request) {
+	// Revoke the session of the token, so the token can't be used anymore
+	if cookie, err := r.Cookie("token"); err == nil {
+		if claims, err := utils.ValidateToken(cookie.Value); err == nil && claims.ID != "" {
+			if _, err := utils.RevokeSession(claims.UserID, claims.ID); err != nil {
+				utils.Logger.Printf("Error revoking session of user %d: %v", claims.UserID, err)
+			}
+		}
+	}
+
 	// Delete token cookie
 	http.SetCookie(w, &http.Cookie{
 		Name:     "token",
@@ -486,9 +602,6 @@ type ChangePasswordRequest struct {
 
 // ChangePassword changes the user's password
 func ChangePassword(w http.ResponseWriter, r *http.Request) {
-	utils.UsersFileMutex.Lock()
-	defer utils.UsersFileMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -519,6 +632,14 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Wait after too many wrong passwords
+	throttleKeys := reauthThrottleKeys(r)
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
 	derivedKey, availableBackupCodes, err := utils.CheckPasswordForUser(userID, req.OldPassword)
 	if err != nil {
 		utils.JSONResponse(w, http.StatusInternalServerError, map[string]any{
@@ -527,6 +648,7 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	} else if len(derivedKey) == 0 {
+		utils.ThrottleFailure(throttleKeys...)
 		utils.JSONResponse(w, http.StatusOK, map[string]any{
 			"success":                false,
 			"message":                "Old password is incorrect",
@@ -535,6 +657,16 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	utils.ThrottleSuccess(throttleKeys[0])
+
+	// Lock users.json only after checking the password, CheckPasswordForUser locks it as well.
+	// The sessions are replaced, so no other request may save them in between.
+	utils.SessionsMutex.Lock()
+	defer utils.SessionsMutex.Unlock()
+	utils.PasskeysMutex.Lock()
+	defer utils.PasskeysMutex.Unlock()
+	utils.UsersFileMutex.Lock()
+	defer utils.UsersFileMutex.Unlock()
 
 	// Get user data
 	users, err := utils.GetUsers()
@@ -619,7 +751,8 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	saltBase64 := base64.StdEncoding.EncodeToString(salt)
-	newDerivedKey, err := utils.DeriveKeyFromPassword(req.NewPassword, saltBase64)
+	keyParams := utils.CurrentKeyParams()
+	newDerivedKey, err := utils.DeriveKeyFromPassword(req.NewPassword, saltBase64, keyParams)
 	if err != nil {
 		utils.JSONResponse(w, http.StatusInternalServerError, map[string]any{
 			"success": false,
@@ -650,11 +783,34 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 
 	// Update user data with new salt and encrypted key
 	user["salt"] = saltBase64
+	user["kdf"] = keyParams.String()
 	user["enc_enc_key"] = encEncKey
 
+	// No copy of an older derived key is left
+	delete(user, "derived_key_upgrades")
+
 	// Remove backup codes if they exist
 	user["backup_codes"] = []any{}
 
+	// Passkeys store the old derived key as well
+	delete(user, "passkeys")
+
+	// And the link to single sign-on, if the key is stored for the subject
+	if link, ok := user["oidc"].(map[string]any); ok {
+		delete(link, "enc_derived_key")
+	}
+
+	// Log out all other devices, this device gets a new session
+	session, sessionKey, err := utils.NewSession(r, base64.StdEncoding.EncodeToString(newDerivedKey))
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]any{
+			"success": false,
+			"message": fmt.Sprintf("Error creating session: %v", err),
+		})
+		return
+	}
+	user["sessions"] = []utils.Session{session}
+
 	// Update users data
 	for i, u := range usersList {
 		if uMap, ok := u.(map[string]any); ok && uMap["user_id"] == userID {
@@ -672,8 +828,10 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	utils.LogSecurityEvent(r, userID, base64.StdEncoding.EncodeToString(newDerivedKey), "password_changed", nil)
+
 	// create new JWT token with updated derived key
-	token, err := utils.GenerateToken(userID, user["username"].(string), base64.StdEncoding.EncodeToString(newDerivedKey))
+	token, err := utils.GenerateToken(userID, user["username"].(string), session.ID, sessionKey)
 	if err != nil {
 		utils.JSONResponse(w, http.StatusInternalServerError, map[string]any{
 			"success": false,
@@ -683,14 +841,7 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Set new token cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
-		Expires:  time.Now().Add(time.Duration(utils.Settings.LogoutAfterDays) * 24 * time.Hour),
-	})
+	utils.SetTokenCookie(w, token)
 
 	// Return success and return a new cookie
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
@@ -775,8 +926,17 @@ func DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Wait after too many wrong passwords
+	throttleKeys := reauthThrottleKeys(r)
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
 	derived_key, _, err := utils.CheckPasswordForUser(userID, req.Password)
 	if err != nil || len(derived_key) == 0 {
+		utils.ThrottleFailure(throttleKeys...)
 		utils.JSONResponse(w, http.StatusOK, map[string]any{
 			"success":            false,
 			"message":            "Error checking password",
@@ -784,6 +944,7 @@ func DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	utils.ThrottleSuccess(throttleKeys[0])
 
 	// Use the shared delete function
 	if err := deleteUserByID(userID); err != nil {
@@ -827,10 +988,19 @@ func CreateBackupCodes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Wait after too many wrong passwords
+	throttleKeys := reauthThrottleKeys(r)
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Check if password is correct
 	derivedKey, backup_codes, err := utils.CheckPasswordForUser(userID, req.Password)
 	if err != nil || len(derivedKey) == 0 {
 		utils.Logger.Printf("Error checking password for user %d: %v", userID, err)
+		utils.ThrottleFailure(throttleKeys...)
 
 		utils.JSONResponse(w, http.StatusOK, map[string]any{
 			"success": false,
@@ -838,6 +1008,7 @@ func CreateBackupCodes(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	utils.ThrottleSuccess(throttleKeys[0])
 
 	// otherwise, we have the correct password
 
@@ -874,9 +1045,6 @@ func CreateBackupCodes(w http.ResponseWriter, r *http.Request) {
 
 // ChangeUsername handles changing a user's username
 func ChangeUsername(w http.ResponseWriter, r *http.Request) {
-	utils.UsersFileMutex.Lock()
-	defer utils.UsersFileMutex.Unlock()
-
 	// Get user info from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -904,15 +1072,29 @@ func ChangeUsername(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Wait after too many wrong passwords
+	throttleKeys := reauthThrottleKeys(r)
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// check password
 	derivedKey, availableBackupCodes, err := utils.CheckPasswordForUser(userID, req.Password)
 	if err != nil || len(derivedKey) == 0 {
+		utils.ThrottleFailure(throttleKeys...)
 		utils.JSONResponse(w, http.StatusOK, map[string]any{
 			"success":            false,
 			"password_incorrect": true,
 		})
 		return
 	}
+	utils.ThrottleSuccess(throttleKeys[0])
+
+	// Lock users.json only after checking the password, CheckPasswordForUser locks it as well
+	utils.UsersFileMutex.Lock()
+	defer utils.UsersFileMutex.Unlock()
 
 	// Get users
 	users, err := utils.GetUsers()
@@ -955,6 +1137,7 @@ func ChangeUsername(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update username
+	var oldUsername string
 	for _, u := range usersList {
 		user, ok := u.(map[string]any)
 		if !ok {
@@ -962,6 +1145,7 @@ func ChangeUsername(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if int(user["user_id"].(float64)) == userID {
+			oldUsername, _ = user["username"].(string)
 			user["username"] = req.NewUsername
 			//usersList[currentUserIndex] = user
 			users["users"] = usersList
@@ -977,6 +1161,10 @@ func ChangeUsername(w http.ResponseWriter, r *http.Request) {
 	}
 
 	utils.Logger.Printf("Username changed for user ID %d to '%s'", userID, req.NewUsername)
+	utils.LogSecurityEvent(r, userID, derivedKey, "username_changed", map[string]any{
+		"old_username": oldUsername,
+		"new_username": req.NewUsername,
+	})
 
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
 		"success":                true,
@@ -1005,8 +1193,21 @@ func ValidatePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Wait after too many wrong passwords
+	throttleKeys := reauthThrottleKeys(r)
+	release, ok := beginAttempt(w, throttleKeys...)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Validate password using the same method as login
 	derived_key, available_backup_codes, _ := utils.CheckPasswordForUser(userID, req.Password)
+	if derived_key == "" {
+		utils.ThrottleFailure(throttleKeys...)
+	} else {
+		utils.ThrottleSuccess(throttleKeys[0])
+	}
 
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
 		"valid":                  derived_key != "",
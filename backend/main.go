@@ -21,15 +21,24 @@ var AppVersion string
 // longTimeoutEndpoints defines endpoints that need extended/none timeouts
 // Paths are checked against the request URL path as seen by the top-level handler.
 var longTimeoutEndpoints = map[string]bool{
-	"/api/logs/uploadFile":   true,
-	"/api/logs/downloadFile": true,
-	"/api/logs/allGPXFiles":  true,
-	"/api/logs/exportData":   true,
-	"/api/logs/importData":   true,
-	"/api/logs/backup":       true,
-	"/api/logs/backupUser":   true,
-	"/api/users/login":       true,
-	"/api/users/statistics":  true,
+	"/api/logs/uploadFile":     true,
+	"/api/logs/uploadChunk":    true,
+	"/api/logs/finalizeUpload": true,
+	"/api/logs/downloadFile":   true,
+	"/api/logs/allGPXFiles":    true,
+	"/api/logs/exportData":     true,
+	"/api/logs/importData":     true,
+	"/api/logs/backup":         true,
+	"/api/logs/backupUser":     true,
+	"/api/logs/checkIntegrity": true,
+	"/api/users/login":         true,
+	"/api/users/loginTOTP":     true,
+	"/api/users/passkeyLogin":  true,
+	"/api/users/oidcCallback":  true,
+	"/api/users/oidcUnlock":    true,
+	"/api/users/oidcLink":      true,
+	"/api/users/oidcRegister":  true,
+	"/api/users/statistics":    true,
 }
 
 // timeoutMiddleware applies different timeouts based on the endpoint
@@ -71,8 +80,36 @@ func main() {
 		logger.Fatalf("Failed to initialize settings: %v", err)
 	}
 
-	// Check and handle old data migration if needed
-	utils.HandleOldData(logger)
+	// Migrate the data to the current version if needed
+	if err := utils.RunDataMigrations(logger); err != nil {
+		logger.Fatalf("Failed to migrate data: %v", err)
+	}
+
+	// Initialize the storage backend
+	if err := utils.InitStore(); err != nil {
+		logger.Fatalf("Failed to initialize storage backend: %v", err)
+	}
+
+	// Admin commands (e.g. "dailytxt check-integrity") run instead of the server
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(logger, os.Args[1:]))
+	}
+
+	// Load (or create) the signing keys of the tokens
+	if err := utils.InitJWTKeys(); err != nil {
+		logger.Fatalf("Failed to initialize signing keys: %v", err)
+	}
+
+	// Passkeys need the origins of the frontend
+	if err := utils.InitWebAuthn(); err != nil {
+		logger.Fatalf("Failed to initialize passkeys: %v", err)
+	}
+
+	// Clean up unreferenced files in the background
+	utils.StartFilesGC()
+
+	// Remove resumable uploads that were never finished
+	utils.StartUploadsCleanup()
 
 	// API sub-router
 	api := http.NewServeMux()
@@ -82,6 +119,16 @@ func main() {
 
 	// Users
 	api.HandleFunc("POST /users/login", handlers.Login)
+	api.HandleFunc("POST /users/loginTOTP", handlers.LoginTOTP)
+	api.HandleFunc("GET /users/isPasskeyLoginEnabled", handlers.IsPasskeyLoginEnabled)
+	api.HandleFunc("POST /users/passkeyLoginOptions", handlers.BeginPasskeyLogin)
+	api.HandleFunc("POST /users/passkeyLogin", handlers.FinishPasskeyLogin)
+	api.HandleFunc("GET /users/oidcConfig", handlers.GetOIDCConfig)
+	api.HandleFunc("POST /users/oidcStart", handlers.StartOIDCLogin)
+	api.HandleFunc("POST /users/oidcCallback", handlers.OIDCCallback)
+	api.HandleFunc("POST /users/oidcUnlock", handlers.OIDCUnlock)
+	api.HandleFunc("POST /users/oidcLink", handlers.OIDCLink)
+	api.HandleFunc("POST /users/oidcRegister", handlers.OIDCRegister)
 	api.HandleFunc("GET /users/migrationProgress", handlers.GetMigrationProgress)
 	api.HandleFunc("GET /users/isRegistrationAllowed", handlers.IsRegistrationAllowed)
 	api.HandleFunc("POST /users/register", handlers.RegisterHandler)
@@ -93,8 +140,24 @@ func main() {
 	api.HandleFunc("POST /users/changeUsername", middleware.RequireAuth(handlers.ChangeUsername))
 	api.HandleFunc("POST /users/deleteAccount", middleware.RequireAuth(handlers.DeleteAccount))
 	api.HandleFunc("POST /users/createBackupCodes", middleware.RequireAuth(handlers.CreateBackupCodes))
+	api.HandleFunc("GET /users/totpStatus", middleware.RequireAuth(handlers.GetTOTPStatus))
+	api.HandleFunc("POST /users/setupTOTP", middleware.RequireAuth(handlers.SetupTOTP))
+	api.HandleFunc("POST /users/enableTOTP", middleware.RequireAuth(handlers.EnableTOTP))
+	api.HandleFunc("POST /users/disableTOTP", middleware.RequireAuth(handlers.DisableTOTP))
+	api.HandleFunc("GET /users/passkeys", middleware.RequireAuth(handlers.GetPasskeys))
+	api.HandleFunc("POST /users/passkeyRegistrationOptions", middleware.RequireAuth(handlers.BeginPasskeyRegistration))
+	api.HandleFunc("POST /users/passkeyRegistration", middleware.RequireAuth(handlers.FinishPasskeyRegistration))
+	api.HandleFunc("POST /users/activatePasskey", middleware.RequireAuth(handlers.ActivatePasskey))
+	api.HandleFunc("POST /users/deletePasskey", middleware.RequireAuth(handlers.DeletePasskey))
+	api.HandleFunc("GET /users/sessions", middleware.RequireAuth(handlers.GetSessions))
+	api.HandleFunc("POST /users/revokeSession", middleware.RequireAuth(handlers.RevokeSession))
+	api.HandleFunc("POST /users/revokeOtherSessions", middleware.RequireAuth(handlers.RevokeOtherSessions))
+	api.HandleFunc("GET /users/securityLog", middleware.RequireAuth(handlers.GetSecurityLog))
+	api.HandleFunc("GET /users/oidcStatus", middleware.RequireAuth(handlers.GetOIDCStatus))
+	api.HandleFunc("POST /users/oidcUnlink", middleware.RequireAuth(handlers.UnlinkOIDC))
 	api.HandleFunc("POST /users/validatePassword", middleware.RequireAuth(handlers.ValidatePassword))
 	api.HandleFunc("GET /users/statistics", middleware.RequireAuth(handlers.GetStatistics))
+	api.HandleFunc("GET /users/storageUsage", middleware.RequireAuth(handlers.GetStorageUsage))
 	api.HandleFunc("GET /users/checkChangelog", middleware.RequireAuth(handlers.CheckChangelog))
 
 	// Logs
@@ -119,7 +182,13 @@ func main() {
 	api.HandleFunc("GET /logs/searchTag", middleware.RequireAuth(handlers.SearchTag))
 	api.HandleFunc("GET /logs/loadMonthForReading", middleware.RequireAuth(handlers.LoadMonthForReading))
 	api.HandleFunc("POST /logs/uploadFile", middleware.RequireAuth(handlers.UploadFile))
+	api.HandleFunc("POST /logs/createUpload", middleware.RequireAuth(handlers.CreateUpload))
+	api.HandleFunc("PATCH /logs/uploadChunk", middleware.RequireAuth(handlers.UploadChunk))
+	api.HandleFunc("GET /logs/uploadStatus", middleware.RequireAuth(handlers.GetUploadStatus))
+	api.HandleFunc("POST /logs/finalizeUpload", middleware.RequireAuth(handlers.FinalizeUpload))
+	api.HandleFunc("DELETE /logs/cancelUpload", middleware.RequireAuth(handlers.CancelUpload))
 	api.HandleFunc("GET /logs/downloadFile", middleware.RequireAuth(handlers.DownloadFile))
+	api.HandleFunc("GET /logs/downloadThumbnail", middleware.RequireAuth(handlers.DownloadThumbnail))
 	api.HandleFunc("GET /logs/allGPXFiles", middleware.RequireAuth(handlers.GetAllGPXFiles))
 	api.HandleFunc("GET /logs/deleteFile", middleware.RequireAuth(handlers.DeleteFile))
 	api.HandleFunc("POST /logs/renameFile", middleware.RequireAuth(handlers.RenameFile))
@@ -127,17 +196,24 @@ func main() {
 	api.HandleFunc("GET /logs/getHistory", middleware.RequireAuth(handlers.GetHistory))
 	api.HandleFunc("GET /logs/bookmarkDay", middleware.RequireAuth(handlers.BookmarkDay))
 	api.HandleFunc("GET /logs/deleteDay", middleware.RequireAuth(handlers.DeleteDay))
+	api.HandleFunc("GET /logs/checkIntegrity", middleware.RequireAuth(handlers.CheckIntegrity))
+	api.HandleFunc("POST /logs/checkIntegrity", middleware.RequireAuth(handlers.CheckIntegrity))
 	api.HandleFunc("GET /logs/exportData", middleware.RequireAuth(handlers.ExportData))
 	api.HandleFunc("POST /logs/importData", middleware.RequireAuth(handlers.ImportData))
 	api.HandleFunc("POST /logs/backup", middleware.RequireAuth(handlers.Backup))
 	api.HandleFunc("POST /logs/backupUser", handlers.BackupUser)
 
 	// Admin routes
-	api.HandleFunc("POST /admin/validate-password", middleware.RequireAuth(handlers.ValidateAdminPassword))
-	api.HandleFunc("POST /admin/get-data", middleware.RequireAuth(handlers.GetAdminData))
-	api.HandleFunc("POST /admin/delete-user", middleware.RequireAuth(handlers.DeleteUser))
-	api.HandleFunc("POST /admin/delete-old-data", middleware.RequireAuth(handlers.DeleteOldData))
-	api.HandleFunc("POST /admin/open-registration", middleware.RequireAuth(handlers.OpenRegistrationTemp))
+	api.HandleFunc("POST /admin/login", middleware.RequireAuth(handlers.AdminLogin))
+	api.HandleFunc("POST /admin/logout", middleware.RequireAuth(handlers.AdminLogout))
+	api.HandleFunc("GET /admin/session", middleware.RequireAuth(handlers.GetAdminSession))
+	api.HandleFunc("POST /admin/get-data", middleware.RequireAdmin(handlers.GetAdminData))
+	api.HandleFunc("POST /admin/delete-user", middleware.RequireAdmin(handlers.DeleteUser))
+	api.HandleFunc("POST /admin/set-quota", middleware.RequireAdmin(handlers.SetUserQuota))
+	api.HandleFunc("POST /admin/set-admin", middleware.RequireAdmin(handlers.SetUserAdmin))
+	api.HandleFunc("POST /admin/delete-old-data", middleware.RequireAdmin(handlers.DeleteOldData))
+	api.HandleFunc("POST /admin/open-registration", middleware.RequireAdmin(handlers.OpenRegistrationTemp))
+	api.HandleFunc("POST /admin/rotate-jwt-key", middleware.RequireAdmin(handlers.RotateJWTKey))
 
 	// Root mux mounts API under /api/
 	rootMux := http.NewServeMux()
@@ -22,7 +22,7 @@ func CORS(next http.Handler) http.Handler {
 		// Set CORS headers if origin is allowed
 		if allowed {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Content-Disposition")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 		}
@@ -56,16 +56,78 @@ func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		// Tokens of older versions contain the derived key, replace them
+		if claims.DerivedKey != "" {
+			token, err := utils.UpgradeLegacyToken(cookie.Value, claims, r)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				utils.Logger.Printf("Unauthorized access attempt, outdated token: %s %s", r.Method, r.URL.Path)
+				return
+			}
+			if token != "" {
+				utils.SetTokenCookie(w, token)
+			}
+		}
+
+		// Check if the session of the token was revoked
+		session, err := utils.TouchSession(claims.UserID, claims.ID, r)
+		if err != nil || session == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			utils.Logger.Printf("Unauthorized access attempt, session revoked: %s %s", r.Method, r.URL.Path)
+			return
+		}
+
+		// The derived key is stored in the session, encrypted with the key of the
+		// token (the upgrade of a legacy token resolved it after an Argon2 upgrade)
+		derivedKey := claims.DerivedKey
+		if derivedKey == "" {
+			derivedKey, err = session.DerivedKey(claims.SessionKey)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				utils.Logger.Printf("Unauthorized access attempt, invalid session key: %s %s", r.Method, r.URL.Path)
+				return
+			}
+
+			// Sessions from before an Argon2 upgrade contain the old derived key
+			if session.OutdatedKey {
+				derivedKey, err = utils.UpgradeSessionKey(claims.UserID, claims.ID, claims.SessionKey, derivedKey)
+				if err != nil {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					utils.Logger.Printf("Unauthorized access attempt, outdated session key: %s %s", r.Method, r.URL.Path)
+					return
+				}
+			}
+		}
+
 		// Add user info to request context
 		ctx := context.WithValue(r.Context(), utils.UserIDKey, claims.UserID)
 		ctx = context.WithValue(ctx, utils.UsernameKey, claims.Username)
-		ctx = context.WithValue(ctx, utils.DerivedKeyKey, claims.DerivedKey)
+		ctx = context.WithValue(ctx, utils.DerivedKeyKey, derivedKey)
+		ctx = context.WithValue(ctx, utils.SessionIDKey, claims.ID)
 
 		// Continue with the next handler
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// RequireAdmin middleware checks if the user is authenticated and the session
+// is an admin session
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := r.Context().Value(utils.UserIDKey).(int)
+		sessionID, _ := r.Context().Value(utils.SessionIDKey).(string)
+
+		// 403, a 401 would log out the user in the client
+		if utils.AdminSessionUntil(userID, sessionID).IsZero() {
+			http.Error(w, "Admin session required", http.StatusForbidden)
+			utils.Logger.Printf("Forbidden access attempt, no admin session: %s %s", r.Method, r.URL.Path)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Logger middleware logs all requests
 func Logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
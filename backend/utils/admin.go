@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Admins are users with "admin": true in users.json. To open the admin area,
+// an admin enters their own password again. ADMIN_PASSWORD (if set) opens it
+// for every user, so the first admins can be chosen. This turns the current
+// session into an admin session for adminSessionDuration ("admin_until" of the
+// session), only then the routes behind RequireAdmin can be used.
+//
+// Every admin action is written to admin_audit.json in the data directory.
+
+const (
+	adminSessionDuration = 15 * time.Minute
+	adminAuditFilename   = "admin_audit.json"
+	// Older entries are removed from the audit trail
+	adminAuditMaxEntries = 1000
+)
+
+// AdminAuditEntry is an action in the admin area
+type AdminAuditEntry struct {
+	Time     string         `json:"time"`
+	UserID   int            `json:"user_id"`
+	Username string         `json:"username"`
+	IP       string         `json:"ip"`
+	Action   string         `json:"action"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+var adminAuditMutex sync.Mutex
+
+// IsAdmin checks if a user is flagged as admin
+func IsAdmin(userID int) bool {
+	admin, err := getUserValue(userID, "admin")
+	return err == nil && admin == true
+}
+
+// SetAdmin flags a user as admin or removes the flag (and ends their admin sessions)
+func SetAdmin(userID int, admin bool) error {
+	if admin {
+		return setUserValue(userID, "admin", true)
+	}
+
+	if err := setUserValue(userID, "admin", nil); err != nil {
+		return err
+	}
+
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+
+	sessions, err := GetSessions(userID)
+	if err != nil {
+		return err
+	}
+	for i := range sessions {
+		sessions[i].AdminUntil = ""
+	}
+	return saveSessions(userID, sessions)
+}
+
+// StartAdminSession turns a session into an admin session. Returns when it ends.
+func StartAdminSession(userID int, sessionID string) (time.Time, error) {
+	until := time.Now().Add(adminSessionDuration).UTC()
+	return until, setAdminUntil(userID, sessionID, until.Format(time.RFC3339))
+}
+
+// EndAdminSession turns an admin session back into a normal session
+func EndAdminSession(userID int, sessionID string) error {
+	return setAdminUntil(userID, sessionID, "")
+}
+
+func setAdminUntil(userID int, sessionID, until string) error {
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+
+	sessions, err := GetSessions(userID)
+	if err != nil {
+		return err
+	}
+
+	for i, session := range sessions {
+		if session.ID == sessionID {
+			sessions[i].AdminUntil = until
+			return saveSessions(userID, sessions)
+		}
+	}
+	return fmt.Errorf("session not found")
+}
+
+// AdminSessionUntil returns when the admin session ends (zero if the session
+// is no admin session)
+func AdminSessionUntil(userID int, sessionID string) time.Time {
+	sessions, err := GetSessions(userID)
+	if err != nil {
+		return time.Time{}
+	}
+
+	for _, session := range sessions {
+		if session.ID != sessionID || session.AdminUntil == "" {
+			continue
+		}
+		until, err := time.Parse(time.RFC3339, session.AdminUntil)
+		if err == nil && time.Now().Before(until) {
+			return until
+		}
+	}
+	return time.Time{}
+}
+
+// AdminAudit writes an action of the user of the request to the audit trail
+func AdminAudit(r *http.Request, action string, details map[string]any) {
+	userID, _ := r.Context().Value(UserIDKey).(int)
+	username, _ := r.Context().Value(UsernameKey).(string)
+
+	entry := AdminAuditEntry{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		UserID:   userID,
+		Username: username,
+		IP:       ClientIP(r),
+		Action:   action,
+		Details:  details,
+	}
+
+	adminAuditMutex.Lock()
+	defer adminAuditMutex.Unlock()
+
+	entries, err := readAdminAudit()
+	if err != nil {
+		Logger.Printf("Error reading %s: %v", adminAuditFilename, err)
+		entries = []AdminAuditEntry{}
+	}
+
+	entries = append(entries, entry)
+	if len(entries) > adminAuditMaxEntries {
+		entries = entries[len(entries)-adminAuditMaxEntries:]
+	}
+
+	if err := writeAdminAudit(entries); err != nil {
+		Logger.Printf("Error writing %s: %v", adminAuditFilename, err)
+	}
+	Logger.Printf("Admin action '%s' by user %d (%s): %v", action, userID, username, details)
+}
+
+// GetAdminAudit returns the latest entries of the audit trail, newest first
+func GetAdminAudit(limit int) []AdminAuditEntry {
+	adminAuditMutex.Lock()
+	defer adminAuditMutex.Unlock()
+
+	entries, err := readAdminAudit()
+	if err != nil {
+		Logger.Printf("Error reading %s: %v", adminAuditFilename, err)
+		return []AdminAuditEntry{}
+	}
+
+	latest := []AdminAuditEntry{}
+	for i := len(entries) - 1; i >= 0 && len(latest) < limit; i-- {
+		latest = append(latest, entries[i])
+	}
+	return latest
+}
+
+func readAdminAudit() ([]AdminAuditEntry, error) {
+	entries := []AdminAuditEntry{}
+
+	data, err := os.ReadFile(filepath.Join(Settings.DataPath, adminAuditFilename))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func writeAdminAudit(entries []AdminAuditEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := createAtomicFile(filepath.Join(Settings.DataPath, adminAuditFilename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Commit()
+}
@@ -0,0 +1,322 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"runtime"
+)
+
+// The cost of Argon2 is set with ARGON2_TIME_COST, ARGON2_MEMORY_MB and
+// ARGON2_THREADS. Without them, password hashes and derived keys keep the
+// parameters of older versions (which differ). A password hash contains its
+// parameters, the parameters of the derived key are stored next to its salt
+// ("kdf", missing for keys of older versions). When a user logs in with weaker
+// parameters (less time or memory), the password is hashed again and the
+// encryption key is wrapped with a newly derived key. Stronger or merely
+// different parameters (like the number of threads) are kept.
+//
+// Backup codes, passkeys and sessions contain a copy of the derived key, which
+// can't be re-encrypted during the login. So the upgrade also stores the new
+// derived key, encrypted with a key derived (with the new parameters) from the
+// previous one, in "derived_key_upgrades". An older derived key is resolved
+// along this chain, passkeys and sessions are re-encrypted on their next use.
+// A password change removes the chain together with all copies.
+
+// Argon2Params are the cost parameters of Argon2id
+type Argon2Params struct {
+	TimeCost uint32
+	// MemoryCost in KiB
+	MemoryCost uint32
+	Threads    uint8
+}
+
+// legacyKeyParams derived the keys of older versions (without "kdf"), they
+// are also the default for new derived keys
+var legacyKeyParams = Argon2Params{TimeCost: 3, MemoryCost: 64 * 1024, Threads: 4}
+
+// defaultHashParams hash the passwords if nothing is configured, as in older versions
+var defaultHashParams = Argon2Params{TimeCost: 5, MemoryCost: 64 * 1024, Threads: uint8(min(runtime.NumCPU(), 255))}
+
+// derivedKeyUpgrade is a step of the chain from an older derived key to the next one
+type derivedKeyUpgrade struct {
+	Salt          string `json:"salt"`
+	KDF           string `json:"kdf"`
+	EncDerivedKey string `json:"enc_derived_key"`
+}
+
+// CurrentHashParams returns the parameters for new password hashes
+func CurrentHashParams() Argon2Params {
+	return configuredArgon2Params(defaultHashParams)
+}
+
+// CurrentKeyParams returns the parameters for new derived keys
+func CurrentKeyParams() Argon2Params {
+	return configuredArgon2Params(legacyKeyParams)
+}
+
+// configuredArgon2Params replaces the defaults with the configured values (0 is not set)
+func configuredArgon2Params(params Argon2Params) Argon2Params {
+	if Settings.Argon2TimeCost > 0 {
+		params.TimeCost = uint32(Settings.Argon2TimeCost)
+	}
+	if Settings.Argon2MemoryMB > 0 {
+		params.MemoryCost = uint32(Settings.Argon2MemoryMB) * 1024
+	}
+	if Settings.Argon2Threads > 0 {
+		params.Threads = uint8(Settings.Argon2Threads)
+	}
+	return params
+}
+
+// WeakerThan checks if the parameters are cheaper to guess than others. The
+// number of threads doesn't change the cost of guessing, so it is ignored.
+func (p Argon2Params) WeakerThan(other Argon2Params) bool {
+	return p.TimeCost < other.TimeCost || p.MemoryCost < other.MemoryCost
+}
+
+// String returns the parameters in the format of the password hashes
+func (p Argon2Params) String() string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d", p.MemoryCost, p.TimeCost, p.Threads)
+}
+
+func parseArgon2Params(kdf string) (Argon2Params, error) {
+	var params Argon2Params
+	if _, err := fmt.Sscanf(kdf, "m=%d,t=%d,p=%d", &params.MemoryCost, &params.TimeCost, &params.Threads); err != nil {
+		return params, fmt.Errorf("invalid argon2 parameters '%s': %v", kdf, err)
+	}
+	return params, nil
+}
+
+// KeyParams returns the parameters a key was derived with, from the "kdf" of
+// an entry in users.json (a user or a backup code)
+func KeyParams(entry map[string]any) (Argon2Params, error) {
+	kdf, ok := entry["kdf"].(string)
+	if !ok {
+		return legacyKeyParams, nil
+	}
+	return parseArgon2Params(kdf)
+}
+
+// HashNeedsUpgrade checks if a password hash was created with weaker parameters
+func HashNeedsUpgrade(encodedHash string) bool {
+	config, err := parseArgon2Hash(encodedHash)
+	if err != nil {
+		return false
+	}
+
+	params := Argon2Params{TimeCost: config.TimeCost, MemoryCost: config.MemoryCost, Threads: config.Threads}
+	return params.WeakerThan(CurrentHashParams())
+}
+
+// Argon2Outdated checks if the password hash or the derived key of a user
+// (an entry in users.json) uses weaker parameters than configured
+func Argon2Outdated(user map[string]any) bool {
+	passwordHash, _ := user["password"].(string)
+	params, err := KeyParams(user)
+	return HashNeedsUpgrade(passwordHash) || err != nil || params.WeakerThan(CurrentKeyParams())
+}
+
+// UpgradeArgon2 hashes the password again and wraps the encryption key with a
+// newly derived key, if the parameters of the user are weaker than configured. Returns the
+// derived key to use from now on (the given one if nothing changed).
+func UpgradeArgon2(userID int, password, derivedKey string) (string, error) {
+	// The sessions of the user are marked in the same write
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return derivedKey, fmt.Errorf("error retrieving users: %v", err)
+	}
+
+	var user map[string]any
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		if entry, ok := u.(map[string]any); ok {
+			if id, ok := entry["user_id"].(float64); ok && int(id) == userID {
+				user = entry
+				break
+			}
+		}
+	}
+	if user == nil {
+		return derivedKey, fmt.Errorf("user %d not found", userID)
+	}
+
+	current := CurrentKeyParams()
+	newDerivedKey := derivedKey
+	changed := false
+
+	if passwordHash, _ := user["password"].(string); HashNeedsUpgrade(passwordHash) {
+		newHash, err := HashPassword(password)
+		if err != nil {
+			return derivedKey, fmt.Errorf("error hashing password: %v", err)
+		}
+		user["password"] = newHash
+		changed = true
+	}
+
+	if params, err := KeyParams(user); err != nil || params.WeakerThan(current) {
+		newDerivedKey, err = rewrapEncryptionKey(user, password, derivedKey, current)
+		if err != nil {
+			return derivedKey, err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return derivedKey, nil
+	}
+
+	if err := WriteUsers(users); err != nil {
+		return derivedKey, fmt.Errorf("error writing users: %v", err)
+	}
+
+	Logger.Printf("Upgraded the Argon2 parameters of user %d (keys: %s, hash: %s)", userID, current, CurrentHashParams())
+	return newDerivedKey, nil
+}
+
+// rewrapEncryptionKey derives a new key from the password and encrypts the
+// encryption key with it. The copies of the old derived key are kept usable
+// with a new step of the chain. Returns the new derived key.
+func rewrapEncryptionKey(user map[string]any, password, derivedKey string, params Argon2Params) (string, error) {
+	encKey, err := encryptionKeyOfUser(user, derivedKey)
+	if err != nil {
+		return "", err
+	}
+	encKeyBytes, err := base64.URLEncoding.DecodeString(encKey)
+	if err != nil {
+		return "", fmt.Errorf("error decoding encryption key: %v", err)
+	}
+
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	newKey, err := DeriveKeyFromPassword(password, salt, params)
+	if err != nil {
+		return "", fmt.Errorf("error deriving key from password: %v", err)
+	}
+
+	// Encrypt the encryption key with the new derived key
+	aead, err := CreateAEAD(newKey)
+	if err != nil {
+		return "", fmt.Errorf("error creating cipher: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %v", err)
+	}
+	encEncKey := base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, encKeyBytes, nil))
+	newDerivedKey := base64.StdEncoding.EncodeToString(newKey)
+
+	// The key of the step is derived with the new parameters as well, so the
+	// chain isn't an easier target for guessing the password
+	upgradeSalt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	upgradeKey, err := DeriveKeyFromPassword(derivedKey, upgradeSalt, params)
+	if err != nil {
+		return "", fmt.Errorf("error deriving key: %v", err)
+	}
+	encDerivedKey, err := EncryptText(newDerivedKey, base64.URLEncoding.EncodeToString(upgradeKey))
+	if err != nil {
+		return "", fmt.Errorf("error encrypting derived key: %v", err)
+	}
+
+	upgrades, _ := user["derived_key_upgrades"].([]any)
+	user["derived_key_upgrades"] = append(upgrades, derivedKeyUpgrade{
+		Salt:          upgradeSalt,
+		KDF:           params.String(),
+		EncDerivedKey: encDerivedKey,
+	})
+	user["salt"] = salt
+	user["kdf"] = params.String()
+	user["enc_enc_key"] = encEncKey
+
+	// The sessions replace their copy on the next request
+	if sessions, ok := user["sessions"].([]any); ok {
+		for _, s := range sessions {
+			if session, ok := s.(map[string]any); ok {
+				session["outdated_key"] = true
+			}
+		}
+	}
+
+	return newDerivedKey, nil
+}
+
+// ResolveDerivedKey returns the current derived key of a user (an entry in
+// users.json) for a copy of an older derived key
+func ResolveDerivedKey(user map[string]any, derivedKey string) (string, error) {
+	if _, err := encryptionKeyOfUser(user, derivedKey); err == nil {
+		return derivedKey, nil
+	}
+
+	upgrades := []derivedKeyUpgrade{}
+	if value, ok := user["derived_key_upgrades"]; ok {
+		// users.json is read as map[string]any, convert it back
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(data, &upgrades); err != nil {
+			return "", fmt.Errorf("error reading derived key upgrades: %v", err)
+		}
+	}
+
+	// Only the step of the given key (and the following ones) can be decrypted
+	for _, upgrade := range upgrades {
+		params, err := parseArgon2Params(upgrade.KDF)
+		if err != nil {
+			continue
+		}
+		upgradeKey, err := DeriveKeyFromPassword(derivedKey, upgrade.Salt, params)
+		if err != nil {
+			continue
+		}
+		if newDerivedKey, err := DecryptText(upgrade.EncDerivedKey, base64.URLEncoding.EncodeToString(upgradeKey)); err == nil {
+			derivedKey = newDerivedKey
+		}
+	}
+
+	if _, err := encryptionKeyOfUser(user, derivedKey); err != nil {
+		return "", fmt.Errorf("derived key is outdated")
+	}
+	return derivedKey, nil
+}
+
+// resolveUserDerivedKey is ResolveDerivedKey for the user with the ID
+func resolveUserDerivedKey(userID int, derivedKey string) (string, error) {
+	UsersFileMutex.RLock()
+	defer UsersFileMutex.RUnlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return "", fmt.Errorf("error retrieving users: %v", err)
+	}
+
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		if user, ok := u.(map[string]any); ok {
+			if id, ok := user["user_id"].(float64); ok && int(id) == userID {
+				return ResolveDerivedKey(user, derivedKey)
+			}
+		}
+	}
+	return "", fmt.Errorf("user %d not found", userID)
+}
+
+// newSalt returns a random base64-encoded salt
+func newSalt() (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(salt), nil
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+)
+
+// setArgon2Settings configures cheap parameters for the test
+func setArgon2Settings(t *testing.T, timeCost, memoryMB, threads int) {
+	t.Helper()
+
+	previousTime, previousMemory, previousThreads := Settings.Argon2TimeCost, Settings.Argon2MemoryMB, Settings.Argon2Threads
+	Settings.Argon2TimeCost, Settings.Argon2MemoryMB, Settings.Argon2Threads = timeCost, memoryMB, threads
+	t.Cleanup(func() {
+		Settings.Argon2TimeCost, Settings.Argon2MemoryMB, Settings.Argon2Threads = previousTime, previousMemory, previousThreads
+	})
+}
+
+// newArgon2TestUser registers user 1 with the password "password" and the
+// current parameters. Returns the derived key and the encryption key.
+func newArgon2TestUser(t *testing.T) (string, string) {
+	t.Helper()
+
+	newSessionTestUser(t)
+
+	passwordHash, err := HashPassword("password")
+	if err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+	salt, err := newSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := CurrentKeyParams()
+	derivedKey, err := DeriveKeyFromPassword("password", salt, params)
+	if err != nil {
+		t.Fatalf("deriving key: %v", err)
+	}
+
+	encKey := make([]byte, 32)
+	rand.Read(encKey)
+	aead, err := CreateAEAD(derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+
+	err = WriteUsers(map[string]any{
+		"id_counter": float64(1),
+		"users": []any{
+			map[string]any{
+				"user_id":     float64(1),
+				"username":    "alice",
+				"password":    passwordHash,
+				"salt":        salt,
+				"kdf":         params.String(),
+				"enc_enc_key": base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, encKey, nil)),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("writing users: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(derivedKey), base64.URLEncoding.EncodeToString(encKey)
+}
+
+func TestArgon2ParamsWeakerThan(t *testing.T) {
+	current := Argon2Params{TimeCost: 3, MemoryCost: 64 * 1024, Threads: 4}
+
+	for _, tc := range []struct {
+		name   string
+		params Argon2Params
+		want   bool
+	}{
+		{name: "same", params: current, want: false},
+		{name: "less time", params: Argon2Params{TimeCost: 2, MemoryCost: 64 * 1024, Threads: 4}, want: true},
+		{name: "less memory", params: Argon2Params{TimeCost: 3, MemoryCost: 32 * 1024, Threads: 4}, want: true},
+		{name: "more time, less memory", params: Argon2Params{TimeCost: 5, MemoryCost: 32 * 1024, Threads: 4}, want: true},
+		{name: "stronger", params: Argon2Params{TimeCost: 5, MemoryCost: 128 * 1024, Threads: 4}, want: false},
+		{name: "other threads", params: Argon2Params{TimeCost: 3, MemoryCost: 64 * 1024, Threads: 1}, want: false},
+	} {
+		if got := tc.params.WeakerThan(current); got != tc.want {
+			t.Errorf("%s: %s weaker than %s = %v, want %v", tc.name, tc.params, current, got, tc.want)
+		}
+	}
+}
+
+func TestKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entry   map[string]any
+		want    Argon2Params
+		wantErr bool
+	}{
+		{name: "older version", entry: map[string]any{}, want: legacyKeyParams},
+		{name: "stored", entry: map[string]any{"kdf": "m=8192,t=2,p=1"}, want: Argon2Params{TimeCost: 2, MemoryCost: 8192, Threads: 1}},
+		{name: "invalid", entry: map[string]any{"kdf": "t=2"}, wantErr: true},
+	} {
+		got, err := KeyParams(tc.entry)
+		if (err != nil) != tc.wantErr || (!tc.wantErr && got != tc.want) {
+			t.Errorf("%s: KeyParams = %+v, %v, want %+v", tc.name, got, err, tc.want)
+		}
+	}
+
+	// The stored format is read back
+	params := Argon2Params{TimeCost: 7, MemoryCost: 19 * 1024, Threads: 2}
+	if got, err := parseArgon2Params(params.String()); err != nil || got != params {
+		t.Errorf("parsed %s = %+v, %v", params, got, err)
+	}
+}
+
+func TestUpgradeArgon2(t *testing.T) {
+	setArgon2Settings(t, 1, 8, 1)
+	firstKey, encKey := newArgon2TestUser(t)
+
+	// Nothing changes without stronger parameters
+	setArgon2Settings(t, 1, 8, 2)
+	if got, err := UpgradeArgon2(1, "password", firstKey); err != nil || got != firstKey {
+		t.Fatalf("upgrade with other threads = %q, %v, want the same key", got, err)
+	}
+	if upgrades, _ := getUserValue(1, "derived_key_upgrades"); upgrades != nil {
+		t.Errorf("derived_key_upgrades = %v, want none", upgrades)
+	}
+
+	sessionID, sessionKey, err := CreateSession(1, httptest.NewRequest("POST", "/users/login", nil), firstKey, "")
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+
+	// Two upgrades make a chain from the first key to the current one
+	keys := []string{firstKey}
+	for _, timeCost := range []int{2, 3} {
+		setArgon2Settings(t, timeCost, 8, 1)
+		previousHash, _ := getUserValue(1, "password")
+
+		newKey, err := UpgradeArgon2(1, "password", keys[len(keys)-1])
+		if err != nil {
+			t.Fatalf("upgrade to t=%d: %v", timeCost, err)
+		}
+		for _, key := range keys {
+			if newKey == key {
+				t.Fatalf("upgrade to t=%d kept the derived key", timeCost)
+			}
+		}
+		keys = append(keys, newKey)
+
+		if hash, _ := getUserValue(1, "password"); hash == previousHash || HashNeedsUpgrade(hash.(string)) {
+			t.Errorf("password hash after the upgrade to t=%d = %v", timeCost, hash)
+		}
+		if kdf, _ := getUserValue(1, "kdf"); kdf != CurrentKeyParams().String() {
+			t.Errorf("kdf = %v, want %s", kdf, CurrentKeyParams())
+		}
+	}
+
+	if upgrades, _ := getUserValue(1, "derived_key_upgrades"); len(upgrades.([]any)) != 2 {
+		t.Errorf("derived_key_upgrades = %v, want two steps", upgrades)
+	}
+
+	// The password leads to the current key
+	if derivedKey, _, err := CheckPasswordForUser(1, "password"); err != nil || derivedKey != keys[2] {
+		t.Errorf("derived key of the password = %q, %v, want %q", derivedKey, err, keys[2])
+	}
+
+	// Every older key resolves to the current one and the encryption key stays the same
+	for i, key := range keys {
+		resolved, err := resolveUserDerivedKey(1, key)
+		if err != nil || resolved != keys[2] {
+			t.Errorf("resolved key %d = %q, %v, want %q", i, resolved, err, keys[2])
+		}
+		if got, err := GetEncryptionKey(1, resolved); err != nil || got != encKey {
+			t.Errorf("encryption key with key %d = %q, %v", i, got, err)
+		}
+	}
+	if _, err := GetEncryptionKey(1, firstKey); err == nil {
+		t.Errorf("the first key decrypts the encryption key without the chain")
+	}
+
+	wrongKey := make([]byte, 32)
+	rand.Read(wrongKey)
+	if _, err := resolveUserDerivedKey(1, base64.StdEncoding.EncodeToString(wrongKey)); err == nil {
+		t.Errorf("resolving an unknown key: want an error")
+	}
+
+	// The session gets the current key on its next use
+	sessions, err := GetSessions(1)
+	if err != nil || len(sessions) != 1 || !sessions[0].OutdatedKey {
+		t.Fatalf("sessions = %+v, %v, want one with an outdated key", sessions, err)
+	}
+	if got, err := UpgradeSessionKey(1, sessionID, sessionKey, firstKey); err != nil || got != keys[2] {
+		t.Fatalf("upgrading session key = %q, %v, want %q", got, err, keys[2])
+	}
+	sessions, _ = GetSessions(1)
+	if sessions[0].OutdatedKey {
+		t.Errorf("session still has an outdated key")
+	}
+	if got, err := sessions[0].DerivedKey(sessionKey); err != nil || got != keys[2] {
+		t.Errorf("derived key of the session = %q, %v, want %q", got, err, keys[2])
+	}
+
+	// Weaker parameters than stored don't downgrade the user
+	setArgon2Settings(t, 1, 8, 1)
+	users, _ := GetUsers()
+	if Argon2Outdated(users["users"].([]any)[0].(map[string]any)) {
+		t.Errorf("user is outdated with weaker settings")
+	}
+	if got, err := UpgradeArgon2(1, "password", keys[2]); err != nil || got != keys[2] {
+		t.Errorf("upgrade with weaker settings = %q, %v, want the same key", got, err)
+	}
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Temporary files are named ".<name>.tmp-<random>" and live next to the file they replace
+const atomicTempMarker = ".tmp-"
+
+// atomicFile is a temporary file that replaces the target file on Commit.
+// Until then the target file stays untouched, so a crash in the middle of a
+// write never leaves a truncated file behind.
+type atomicFile struct {
+	*os.File
+	path      string
+	committed bool
+}
+
+// createAtomicFile creates a temporary file in the directory of path
+func createAtomicFile(path string) (*atomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+atomicTempMarker+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	// os.CreateTemp uses 0600, keep the permissions of os.Create
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &atomicFile{File: file, path: path}, nil
+}
+
+// Commit fsyncs the temporary file, renames it over the target file and
+// fsyncs the directory so that the rename itself is persisted
+func (f *atomicFile) Commit() error {
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.File.Name(), f.path); err != nil {
+		return err
+	}
+	f.committed = true
+
+	return syncDir(filepath.Dir(f.path))
+}
+
+// Close discards the temporary file if it was not committed
+func (f *atomicFile) Close() error {
+	if f.committed {
+		return nil
+	}
+
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
+
+// syncDir fsyncs a directory
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// isAtomicTempFile checks if the filename belongs to a temporary file of createAtomicFile
+func isAtomicTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, atomicTempMarker)
+}
+
+// RecoverTempFiles removes temporary files left behind by interrupted writes.
+// The target files were never touched by these writes, so they still hold the
+// last completely written version.
+func RecoverTempFiles(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Continue on errors
+			return nil
+		}
+
+		// Don't touch the data of version 1
+		if d.IsDir() && path == filepath.Join(root, "old") {
+			return filepath.SkipDir
+		}
+
+		if d.IsDir() || !isAtomicTempFile(d.Name()) {
+			return nil
+		}
+
+		Logger.Printf("Removing leftover temporary file from interrupted write: %s", path)
+		if err := os.Remove(path); err != nil {
+			Logger.Printf("Error removing %s: %v", path, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LocalBlobStore keeps the files of the users on the local disk:
+//
+//	<userID>/files/<uuid>
+//	<userID>/quarantine/<uuid> (unreferenced files, see FilesGC)
+type LocalBlobStore struct {
+	root string
+}
+
+// NewLocalBlobStore creates a LocalBlobStore rooted at the given directory
+func NewLocalBlobStore(root string) *LocalBlobStore {
+	return &LocalBlobStore{root: root}
+}
+
+// WriteFile writes a file for a specific user
+func (s *LocalBlobStore) WriteFile(content []byte, userID int, uuid string) error {
+	return s.WriteFileStream(bytes.NewReader(content), userID, uuid)
+}
+
+// WriteFileStream writes a file for a specific user from a reader
+func (s *LocalBlobStore) WriteFileStream(content io.Reader, userID int, uuid string) error {
+	if err := checkBlobName(uuid); err != nil {
+		return err
+	}
+	// Create the directory if it doesn't exist
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d/files", userID))
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		Logger.Printf("Error creating directory %s: %v", dirPath, err)
+		return fmt.Errorf("internal server error when trying to create directory %d/files", userID)
+	}
+
+	// Create the file
+	filePath := filepath.Join(dirPath, uuid)
+	file, err := createAtomicFile(filePath)
+	if err != nil {
+		Logger.Printf("Error creating %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to create file %s", uuid)
+	}
+	defer file.Close()
+
+	// Write the content to the file
+	if _, err := io.Copy(file, content); err != nil {
+		Logger.Printf("Error writing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to write file %s", uuid)
+	}
+
+	// Replace the file with the new content
+	if err := file.Commit(); err != nil {
+		Logger.Printf("Error committing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to write file %s", uuid)
+	}
+
+	return nil
+}
+
+// ReadFile reads a file for a specific user
+func (s *LocalBlobStore) ReadFile(userID int, uuid string) ([]byte, error) {
+	file, err := s.OpenFile(userID, uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Read the file content
+	content, err := io.ReadAll(file)
+	if err != nil {
+		Logger.Printf("Error reading file %s of user %d: %v", uuid, userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read file %s", uuid)
+	}
+
+	return content, nil
+}
+
+// OpenFile opens a file of a specific user for reading
+func (s *LocalBlobStore) OpenFile(userID int, uuid string) (io.ReadSeekCloser, error) {
+	if err := checkBlobName(uuid); err != nil {
+		return nil, err
+	}
+	// Try to open the file
+	filePath := filepath.Join(s.root, fmt.Sprintf("%d/files/%s", userID, uuid))
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			Logger.Printf("%s - File not found", filePath)
+			return nil, fmt.Errorf("file not found")
+		}
+		Logger.Printf("Error opening %s: %v", filePath, err)
+		return nil, fmt.Errorf("internal server error when trying to open file %s", uuid)
+	}
+
+	return file, nil
+}
+
+// RemoveFile removes a file for a specific user
+func (s *LocalBlobStore) RemoveFile(userID int, uuid string) error {
+	if err := checkBlobName(uuid); err != nil {
+		return err
+	}
+	// Try to remove the file
+	filePath := filepath.Join(s.root, fmt.Sprintf("%d/files/%s", userID, uuid))
+	if err := os.Remove(filePath); err != nil {
+		Logger.Printf("Error removing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to remove file %s", uuid)
+	}
+
+	return nil
+}
+
+// ListFiles returns the uuids of all files of a specific user
+func (s *LocalBlobStore) ListFiles(userID int) ([]string, error) {
+	// Try to read the files directory
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d/files", userID))
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		Logger.Printf("Error reading directory %s: %v", dirPath, err)
+		return nil, fmt.Errorf("internal server error when trying to read directory %d/files", userID)
+	}
+
+	uuids := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && !isAtomicTempFile(entry.Name()) {
+			uuids = append(uuids, entry.Name())
+		}
+	}
+
+	return uuids, nil
+}
+
+// FilesSize calculates the size of all files of a specific user
+func (s *LocalBlobStore) FilesSize(userID int) (int64, error) {
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d/files", userID))
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var totalSize int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			totalSize += info.Size()
+		}
+	}
+
+	return totalSize, nil
+}
+
+// RemoveAllFiles removes the files and quarantine directories of a specific user
+func (s *LocalBlobStore) RemoveAllFiles(userID int) error {
+	for _, dir := range []string{"files", "quarantine"} {
+		dirPath := filepath.Join(s.root, fmt.Sprintf("%d/%s", userID, dir))
+		if err := os.RemoveAll(dirPath); err != nil {
+			Logger.Printf("Error removing directory %s: %v", dirPath, err)
+			return fmt.Errorf("internal server error when trying to remove files of user %d", userID)
+		}
+	}
+
+	return nil
+}
+
+// QuarantineFile moves a file of a specific user into the quarantine directory
+func (s *LocalBlobStore) QuarantineFile(userID int, uuid string) (int64, error) {
+	if err := checkBlobName(uuid); err != nil {
+		return 0, err
+	}
+	filePath := filepath.Join(s.root, fmt.Sprintf("%d/files/%s", userID, uuid))
+	info, err := os.Stat(filePath)
+	if err != nil {
+		Logger.Printf("Error reading %s: %v", filePath, err)
+		return 0, fmt.Errorf("internal server error when trying to quarantine file %s", uuid)
+	}
+
+	// Create the directory if it doesn't exist
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d/quarantine", userID))
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		Logger.Printf("Error creating directory %s: %v", dirPath, err)
+		return 0, fmt.Errorf("internal server error when trying to create directory %d/quarantine", userID)
+	}
+
+	if err := os.Rename(filePath, filepath.Join(dirPath, uuid)); err != nil {
+		Logger.Printf("Error moving %s to quarantine: %v", filePath, err)
+		return 0, fmt.Errorf("internal server error when trying to quarantine file %s", uuid)
+	}
+
+	return info.Size(), nil
+}
+
+// RemoveQuarantinedFile removes a file from the quarantine directory
+func (s *LocalBlobStore) RemoveQuarantinedFile(userID int, uuid string) error {
+	if err := checkBlobName(uuid); err != nil {
+		return err
+	}
+	filePath := filepath.Join(s.root, fmt.Sprintf("%d/quarantine/%s", userID, uuid))
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		Logger.Printf("Error removing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to remove quarantined file %s", uuid)
+	}
+
+	return nil
+}
+
+// exists checks if a file of a specific user exists
+func (s *LocalBlobStore) exists(userID int, uuid string) bool {
+	if checkBlobName(uuid) != nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(s.root, fmt.Sprintf("%d/files/%s", userID, uuid)))
+	return err == nil
+}
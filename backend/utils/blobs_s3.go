@@ -0,0 +1,395 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the connection settings of an S3-compatible object storage
+type S3Config struct {
+	Endpoint  string // host[:port] without scheme
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// S3BlobStore keeps the files of the users in an S3-compatible bucket
+// (AWS S3, MinIO, ...) under the keys <userID>/files/<uuid> (and
+// <userID>/quarantine/<uuid> for unreferenced files, see FilesGC).
+// The files are already encrypted by EncryptFile, the bucket never sees plaintext.
+//
+// Files that were stored on the local disk before switching to S3 are still
+// served from there and are moved to the bucket in the background.
+type S3BlobStore struct {
+	client *minio.Client
+	bucket string
+	local  *LocalBlobStore
+
+	// Prevents removing a file while it is moved to the bucket
+	moveMutex sync.Mutex
+}
+
+// NewS3BlobStore connects to the bucket (creating it if necessary)
+func NewS3BlobStore(config S3Config, local *LocalBlobStore) (*S3BlobStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET must be set for the s3 blob backend")
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access S3 bucket %s: %v", config.Bucket, err)
+	}
+	if !exists {
+		Logger.Printf("Creating S3 bucket %s", config.Bucket)
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create S3 bucket %s: %v", config.Bucket, err)
+		}
+	}
+
+	store := &S3BlobStore{client: client, bucket: config.Bucket, local: local}
+
+	// Move files from the local disk to the bucket
+	go store.moveLocalFiles()
+
+	return store, nil
+}
+
+// objectKey returns the key of a file in the bucket
+func (s *S3BlobStore) objectKey(userID int, uuid string) string {
+	return fmt.Sprintf("%d/files/%s", userID, uuid)
+}
+
+// filesPrefix returns the key prefix of all files of a user
+func (s *S3BlobStore) filesPrefix(userID int) string {
+	return fmt.Sprintf("%d/files/", userID)
+}
+
+// quarantineKey returns the key of a quarantined file in the bucket
+func (s *S3BlobStore) quarantineKey(userID int, uuid string) string {
+	return fmt.Sprintf("%d/quarantine/%s", userID, uuid)
+}
+
+// WriteFile uploads a file for a specific user
+func (s *S3BlobStore) WriteFile(content []byte, userID int, uuid string) error {
+	if err := checkBlobName(uuid); err != nil {
+		return err
+	}
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectKey(userID, uuid),
+		bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		Logger.Printf("Error uploading %s to S3: %v", s.objectKey(userID, uuid), err)
+		return fmt.Errorf("internal server error when trying to write file %s", uuid)
+	}
+
+	return nil
+}
+
+// s3PartSize is the size of the parts of a streamed upload. Each upload
+// buffers one part in memory.
+const s3PartSize = 16 << 20
+
+// WriteFileStream uploads a file for a specific user from a reader
+func (s *S3BlobStore) WriteFileStream(content io.Reader, userID int, uuid string) error {
+	if err := checkBlobName(uuid); err != nil {
+		return err
+	}
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectKey(userID, uuid),
+		content, -1, minio.PutObjectOptions{ContentType: "application/octet-stream", PartSize: s3PartSize})
+	if err != nil {
+		Logger.Printf("Error uploading %s to S3: %v", s.objectKey(userID, uuid), err)
+		return fmt.Errorf("internal server error when trying to write file %s", uuid)
+	}
+
+	return nil
+}
+
+// ReadFile downloads a file for a specific user
+func (s *S3BlobStore) ReadFile(userID int, uuid string) ([]byte, error) {
+	object, err := s.OpenFile(userID, uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	content, err := io.ReadAll(object)
+	if err != nil {
+		Logger.Printf("Error downloading %s from S3: %v", s.objectKey(userID, uuid), err)
+		return nil, fmt.Errorf("internal server error when trying to read file %s", uuid)
+	}
+
+	return content, nil
+}
+
+// OpenFile opens a file of a specific user for reading
+func (s *S3BlobStore) OpenFile(userID int, uuid string) (io.ReadSeekCloser, error) {
+	if err := checkBlobName(uuid); err != nil {
+		return nil, err
+	}
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.objectKey(userID, uuid), minio.GetObjectOptions{})
+	if err == nil {
+		// GetObject doesn't send a request, Stat checks if the object exists
+		if _, err = object.Stat(); err == nil {
+			return object, nil
+		}
+		object.Close()
+	}
+
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		Logger.Printf("Error downloading %s from S3: %v", s.objectKey(userID, uuid), err)
+		return nil, fmt.Errorf("internal server error when trying to read file %s", uuid)
+	}
+
+	// The file might not have been moved to the bucket yet
+	if s.local.exists(userID, uuid) {
+		return s.local.OpenFile(userID, uuid)
+	}
+
+	Logger.Printf("%s - File not found", s.objectKey(userID, uuid))
+	return nil, fmt.Errorf("file not found")
+}
+
+// RemoveFile removes a file for a specific user
+func (s *S3BlobStore) RemoveFile(userID int, uuid string) error {
+	if err := checkBlobName(uuid); err != nil {
+		return err
+	}
+	s.moveMutex.Lock()
+	defer s.moveMutex.Unlock()
+
+	if s.local.exists(userID, uuid) {
+		if err := s.local.RemoveFile(userID, uuid); err != nil {
+			return err
+		}
+	}
+
+	if err := s.client.RemoveObject(context.Background(), s.bucket, s.objectKey(userID, uuid), minio.RemoveObjectOptions{}); err != nil {
+		Logger.Printf("Error removing %s from S3: %v", s.objectKey(userID, uuid), err)
+		return fmt.Errorf("internal server error when trying to remove file %s", uuid)
+	}
+
+	return nil
+}
+
+// QuarantineFile moves a file of a specific user to the quarantine keys
+func (s *S3BlobStore) QuarantineFile(userID int, uuid string) (int64, error) {
+	if err := checkBlobName(uuid); err != nil {
+		return 0, err
+	}
+	s.moveMutex.Lock()
+	defer s.moveMutex.Unlock()
+
+	// The file might not have been moved to the bucket yet
+	if s.local.exists(userID, uuid) {
+		return s.local.QuarantineFile(userID, uuid)
+	}
+
+	ctx := context.Background()
+	info, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.quarantineKey(userID, uuid)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.objectKey(userID, uuid)})
+	if err != nil {
+		Logger.Printf("Error copying %s to quarantine in S3: %v", s.objectKey(userID, uuid), err)
+		return 0, fmt.Errorf("internal server error when trying to quarantine file %s", uuid)
+	}
+
+	if err := s.client.RemoveObject(ctx, s.bucket, s.objectKey(userID, uuid), minio.RemoveObjectOptions{}); err != nil {
+		Logger.Printf("Error removing %s from S3: %v", s.objectKey(userID, uuid), err)
+		return 0, fmt.Errorf("internal server error when trying to quarantine file %s", uuid)
+	}
+
+	return info.Size, nil
+}
+
+// RemoveQuarantinedFile removes a quarantined file of a specific user
+func (s *S3BlobStore) RemoveQuarantinedFile(userID int, uuid string) error {
+	if err := checkBlobName(uuid); err != nil {
+		return err
+	}
+	if err := s.local.RemoveQuarantinedFile(userID, uuid); err != nil {
+		return err
+	}
+
+	if err := s.client.RemoveObject(context.Background(), s.bucket, s.quarantineKey(userID, uuid), minio.RemoveObjectOptions{}); err != nil {
+		Logger.Printf("Error removing %s from S3: %v", s.quarantineKey(userID, uuid), err)
+		return fmt.Errorf("internal server error when trying to remove quarantined file %s", uuid)
+	}
+
+	return nil
+}
+
+// listObjects returns all objects with the files prefix of a user
+func (s *S3BlobStore) listObjects(userID int) ([]minio.ObjectInfo, error) {
+	return s.listPrefix(s.filesPrefix(userID))
+}
+
+// listPrefix returns all objects with the given prefix
+func (s *S3BlobStore) listPrefix(prefix string) ([]minio.ObjectInfo, error) {
+	objects := []minio.ObjectInfo{}
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
+
+// ListFiles returns the uuids of all files of a specific user
+func (s *S3BlobStore) ListFiles(userID int) ([]string, error) {
+	objects, err := s.listObjects(userID)
+	if err != nil {
+		Logger.Printf("Error listing files of user %d in S3: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to list files of user %d", userID)
+	}
+
+	seen := map[string]bool{}
+	uuids := []string{}
+	for _, object := range objects {
+		uuid := object.Key[len(s.filesPrefix(userID)):]
+		seen[uuid] = true
+		uuids = append(uuids, uuid)
+	}
+
+	// Add files which were not moved to the bucket yet
+	localUUIDs, err := s.local.ListFiles(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, uuid := range localUUIDs {
+		if !seen[uuid] {
+			uuids = append(uuids, uuid)
+		}
+	}
+
+	return uuids, nil
+}
+
+// FilesSize sums up the size of all files of a specific user
+func (s *S3BlobStore) FilesSize(userID int) (int64, error) {
+	objects, err := s.listObjects(userID)
+	if err != nil {
+		Logger.Printf("Error listing files of user %d in S3: %v", userID, err)
+		return 0, fmt.Errorf("internal server error when trying to list files of user %d", userID)
+	}
+
+	var totalSize int64
+	for _, object := range objects {
+		totalSize += object.Size
+	}
+
+	localSize, err := s.local.FilesSize(userID)
+	return totalSize + localSize, err
+}
+
+// RemoveAllFiles removes all files of a specific user
+func (s *S3BlobStore) RemoveAllFiles(userID int) error {
+	s.moveMutex.Lock()
+	defer s.moveMutex.Unlock()
+
+	if err := s.local.RemoveAllFiles(userID); err != nil {
+		return err
+	}
+
+	objects, err := s.listObjects(userID)
+	if err != nil {
+		Logger.Printf("Error listing files of user %d in S3: %v", userID, err)
+		return fmt.Errorf("internal server error when trying to remove files of user %d", userID)
+	}
+
+	quarantined, err := s.listPrefix(fmt.Sprintf("%d/quarantine/", userID))
+	if err != nil {
+		Logger.Printf("Error listing quarantined files of user %d in S3: %v", userID, err)
+		return fmt.Errorf("internal server error when trying to remove files of user %d", userID)
+	}
+
+	for _, object := range append(objects, quarantined...) {
+		if err := s.client.RemoveObject(context.Background(), s.bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			Logger.Printf("Error removing %s from S3: %v", object.Key, err)
+			return fmt.Errorf("internal server error when trying to remove files of user %d", userID)
+		}
+	}
+
+	return nil
+}
+
+// moveLocalFiles uploads all files from the local disk to the bucket and
+// removes them locally afterwards
+func (s *S3BlobStore) moveLocalFiles() {
+	entries, err := os.ReadDir(s.local.root)
+	if err != nil {
+		Logger.Printf("Error reading data directory for moving files to S3: %v", err)
+		return
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		userID, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		uuids, err := s.local.ListFiles(userID)
+		if err != nil {
+			continue
+		}
+
+		for _, uuid := range uuids {
+			if err := s.moveLocalFile(userID, uuid); err != nil {
+				Logger.Printf("Error moving file %s of user %d to S3: %v", uuid, userID, err)
+				continue
+			}
+			moved++
+		}
+	}
+
+	if moved > 0 {
+		Logger.Printf("Moved %d files from the local disk to S3", moved)
+	}
+}
+
+// moveLocalFile uploads a single local file to the bucket and removes it locally
+func (s *S3BlobStore) moveLocalFile(userID int, uuid string) error {
+	s.moveMutex.Lock()
+	defer s.moveMutex.Unlock()
+
+	// The file might have been removed in the meantime
+	if !s.local.exists(userID, uuid) {
+		return nil
+	}
+
+	content, err := s.local.OpenFile(userID, uuid)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if err := s.WriteFileStream(content, userID, uuid); err != nil {
+		return err
+	}
+
+	return s.local.RemoveFile(userID, uuid)
+}
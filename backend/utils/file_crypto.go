@@ -0,0 +1,427 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encrypted files are stored in a chunked format, so they can be encrypted and
+// decrypted as a stream without keeping the whole file in memory:
+//
+//	header: "DailyTxT" | version (1 byte) | salt (16 bytes)
+//	chunks: FileChunkSize bytes of plaintext each, sealed with ChaCha20-Poly1305
+//
+// Every file gets its own key, derived from the user's encryption key and the
+// salt with HKDF-SHA256. The nonce of a chunk is its 11 byte big-endian index
+// followed by a flag which is 1 for the last chunk only. So chunks can't be
+// reordered, dropped or cut off without failing the decryption (like the STREAM
+// construction used by age).
+//
+// Files written before (version 1) have no header and are a single
+// nonce|ciphertext. They are still decrypted, but only as a whole.
+
+// FileChunkSize is the size of the plaintext of a chunk
+const FileChunkSize = 64 * 1024
+
+const (
+	fileMagic         = "DailyTxT"
+	fileStreamVersion = 2
+	fileSaltSize      = 16
+	fileHeaderSize    = len(fileMagic) + 1 + fileSaltSize
+	fileChunkOverhead = chacha20poly1305.Overhead
+	fileKeyInfo       = "DailyTxT file encryption"
+)
+
+// fileAEAD creates the cipher of a single file
+func fileAEAD(key string, salt []byte) (cipher.AEAD, error) {
+	keyBytes, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key: %v", err)
+	}
+
+	fileKey, err := hkdf.Key(sha256.New, keyBytes, salt, fileKeyInfo, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving file key: %v", err)
+	}
+
+	aead, err := chacha20poly1305.New(fileKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %v", err)
+	}
+	return aead, nil
+}
+
+// chunkNonce returns the nonce of the chunk with the given index
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// isStreamFile checks if data starts with the header of the chunked format
+func isStreamFile(header []byte) bool {
+	return len(header) > len(fileMagic) && string(header[:len(fileMagic)]) == fileMagic && header[len(fileMagic)] == fileStreamVersion
+}
+
+// fileEncrypter is the reader returned by EncryptFileStream
+type fileEncrypter struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	index uint64
+
+	buf    []byte // plaintext, one byte more than a chunk to detect the last chunk
+	carry  bool   // buf[FileChunkSize] belongs to the next chunk
+	sealed []byte // the last encrypted chunk
+	out    []byte // encrypted data not returned yet
+	done   bool
+}
+
+// EncryptFileStream returns a reader that reads src and returns it encrypted
+// in the chunked format
+func EncryptFileStream(src io.Reader, key string) (io.Reader, error) {
+	salt := make([]byte, fileSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("error creating salt: %v", err)
+	}
+
+	aead, err := fileAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, fileHeaderSize)
+	header = append(header, fileMagic...)
+	header = append(header, fileStreamVersion)
+	header = append(header, salt...)
+
+	return &fileEncrypter{
+		src:  src,
+		aead: aead,
+		buf:  make([]byte, FileChunkSize+1),
+		out:  header,
+	}, nil
+}
+
+func (e *fileEncrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.sealChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// sealChunk reads and encrypts the next chunk
+func (e *fileEncrypter) sealChunk() error {
+	start := 0
+	if e.carry {
+		e.buf[0] = e.buf[FileChunkSize]
+		start = 1
+	}
+
+	// Read one byte more than a chunk: if it exists, this is not the last chunk
+	n, err := io.ReadFull(e.src, e.buf[start:])
+	n += start
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := n <= FileChunkSize
+	size := min(n, FileChunkSize)
+	e.carry = !last
+
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.index, last), e.buf[:size], nil)
+	e.out = e.sealed
+	e.index++
+	e.done = last
+	return nil
+}
+
+// fileDecrypter is the reader returned by DecryptFileStream
+type fileDecrypter struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	index uint64
+
+	buf   []byte // ciphertext, one byte more than a chunk to detect the last chunk
+	carry bool   // buf[FileChunkSize+fileChunkOverhead] belongs to the next chunk
+	out   []byte // decrypted data not returned yet
+	done  bool
+}
+
+// DecryptFileStream returns a reader that returns the decrypted content of the
+// encrypted file src. Files of version 1 are read completely into memory.
+func DecryptFileStream(src io.Reader, key string) (io.Reader, error) {
+	header := make([]byte, fileHeaderSize)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+
+	if n < fileHeaderSize || !isStreamFile(header) {
+		// Version 1: decrypt the whole file at once
+		data, err := io.ReadAll(io.MultiReader(bytes.NewReader(header[:n]), src))
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := decryptFileV1(data, key)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(plaintext), nil
+	}
+
+	aead, err := fileAEAD(key, header[len(fileMagic)+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileDecrypter{
+		src:  src,
+		aead: aead,
+		buf:  make([]byte, FileChunkSize+fileChunkOverhead+1),
+	}, nil
+}
+
+func (d *fileDecrypter) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.openChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// openChunk reads and decrypts the next chunk
+func (d *fileDecrypter) openChunk() error {
+	chunkSize := FileChunkSize + fileChunkOverhead
+
+	start := 0
+	if d.carry {
+		d.buf[0] = d.buf[chunkSize]
+		start = 1
+	}
+
+	n, err := io.ReadFull(d.src, d.buf[start:])
+	n += start
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := n <= chunkSize
+	size := min(n, chunkSize)
+	d.carry = !last
+
+	if size < fileChunkOverhead {
+		return errors.New("error decrypting file: unexpected end of file")
+	}
+
+	plaintext, err := d.aead.Open(d.buf[:0], chunkNonce(d.index, last), d.buf[:size], nil)
+	if err != nil {
+		return fmt.Errorf("error decrypting chunk %d: %v", d.index, err)
+	}
+
+	d.out = plaintext
+	d.index++
+	d.done = last
+	return nil
+}
+
+// FileReader reads the decrypted content of an encrypted file at any offset.
+// Only the chunks that are read are decrypted. Files of version 1 are
+// decrypted completely when opened.
+type FileReader struct {
+	blob io.ReadSeeker
+	aead cipher.AEAD
+	size int64  // size of the decrypted file
+	tag  string // see Tag
+	pos  int64
+
+	decrypter *fileDecrypter // reads at pos, nil if a seek is needed
+	legacy    *bytes.Reader  // content of a file of version 1
+}
+
+// NewFileReader opens the encrypted file blob. The first chunk is decrypted
+// right away, so a wrong key or a damaged file is noticed before anything is
+// sent to the client.
+func NewFileReader(blob io.ReadSeeker, key string) (*FileReader, error) {
+	blobSize, err := blob.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := blob.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, min(blobSize, int64(fileHeaderSize)))
+	if _, err := io.ReadFull(blob, header); err != nil {
+		return nil, err
+	}
+
+	// The header contains a random salt (the random nonce for version 1), so
+	// it identifies this encrypted file
+	sum := sha256.Sum256(append(binary.BigEndian.AppendUint64(nil, uint64(blobSize)), header...))
+	f := &FileReader{blob: blob, tag: base64.RawURLEncoding.EncodeToString(sum[:18])}
+
+	if len(header) < fileHeaderSize || !isStreamFile(header) {
+		// Version 1: decrypt the whole file at once
+		decrypted, err := DecryptFileStream(io.MultiReader(bytes.NewReader(header), blob), key)
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(decrypted)
+		if err != nil {
+			return nil, err
+		}
+		f.legacy = bytes.NewReader(content)
+		f.size = int64(len(content))
+		return f, nil
+	}
+
+	f.aead, err = fileAEAD(key, header[len(fileMagic)+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Every chunk is FileChunkSize bytes plus the tag, except the last one
+	chunkSize := int64(FileChunkSize + fileChunkOverhead)
+	body := blobSize - int64(fileHeaderSize)
+	f.size = body / chunkSize * FileChunkSize
+	if rest := body % chunkSize; rest > 0 {
+		if rest < fileChunkOverhead {
+			return nil, errors.New("error decrypting file: unexpected end of file")
+		}
+		f.size += rest - fileChunkOverhead
+	}
+
+	f.decrypter = &fileDecrypter{src: blob, aead: f.aead, buf: make([]byte, chunkSize+1)}
+	if err := f.decrypter.openChunk(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Size returns the size of the decrypted file
+func (f *FileReader) Size() int64 {
+	return f.size
+}
+
+// Tag returns a string that is different for every stored file (and every
+// version of it), e.g. to be used as ETag
+func (f *FileReader) Tag() string {
+	return f.tag
+}
+
+func (f *FileReader) Read(p []byte) (int, error) {
+	if f.legacy != nil {
+		return f.legacy.Read(p)
+	}
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+
+	if f.decrypter == nil {
+		if err := f.seekChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.decrypter.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+// seekChunk starts decrypting at the chunk that contains pos
+func (f *FileReader) seekChunk() error {
+	chunk := f.pos / FileChunkSize
+	if _, err := f.blob.Seek(int64(fileHeaderSize)+chunk*int64(FileChunkSize+fileChunkOverhead), io.SeekStart); err != nil {
+		return err
+	}
+
+	decrypter := &fileDecrypter{src: f.blob, aead: f.aead, index: uint64(chunk), buf: make([]byte, FileChunkSize+fileChunkOverhead+1)}
+	if err := decrypter.openChunk(); err != nil {
+		return err
+	}
+
+	// Skip the beginning of the chunk
+	decrypter.out = decrypter.out[f.pos-chunk*FileChunkSize:]
+	f.decrypter = decrypter
+	return nil
+}
+
+// Seek sets the offset in the decrypted file for the next Read
+func (f *FileReader) Seek(offset int64, whence int) (int64, error) {
+	if f.legacy != nil {
+		return f.legacy.Seek(offset, whence)
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+
+	if offset != f.pos {
+		f.pos = offset
+		f.decrypter = nil
+	}
+	return offset, nil
+}
+
+// decryptFileV1 decrypts a file of version 1 (nonce|ciphertext)
+func decryptFileV1(ciphertext []byte, key string) ([]byte, error) {
+	// Decode key
+	keyBytes, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key: %v", err)
+	}
+
+	// Create AEAD cipher
+	aead, err := chacha20poly1305.New(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %v", err)
+	}
+
+	// Extract nonce from ciphertext
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	// Decrypt file
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting ciphertext: %v", err)
+	}
+
+	return plaintext, nil
+}
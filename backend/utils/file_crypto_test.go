@@ -0,0 +1,293 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+// newFileKey returns a random key as used for the files of a user
+func newFileKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.URLEncoding.EncodeToString(key)
+}
+
+// encryptForTest encrypts content in the chunked format
+func encryptForTest(t *testing.T, content []byte, key string) []byte {
+	t.Helper()
+	encrypter, err := EncryptFileStream(bytes.NewReader(content), key)
+	if err != nil {
+		t.Fatalf("creating encrypter: %v", err)
+	}
+	encrypted, err := io.ReadAll(encrypter)
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	return encrypted
+}
+
+// decryptForTest decrypts a file with DecryptFileStream
+func decryptForTest(encrypted []byte, key string) ([]byte, error) {
+	decrypter, err := DecryptFileStream(bytes.NewReader(encrypted), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(decrypter)
+}
+
+// chunkOffset returns the offset of a chunk in an encrypted file
+func chunkOffset(index int) int {
+	return fileHeaderSize + index*(FileChunkSize+fileChunkOverhead)
+}
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	rand.Read(content)
+	return content
+}
+
+func TestFileStreamRoundTrip(t *testing.T) {
+	key := newFileKey(t)
+
+	for _, size := range []int{0, 1, FileChunkSize - 1, FileChunkSize, FileChunkSize + 1, 2 * FileChunkSize, 3*FileChunkSize + 17} {
+		content := testContent(size)
+		encrypted := encryptForTest(t, content, key)
+
+		chunks := max(1, (size+FileChunkSize-1)/FileChunkSize)
+		if want := fileHeaderSize + size + chunks*fileChunkOverhead; len(encrypted) != want {
+			t.Errorf("size %d: encrypted size = %d, want %d", size, len(encrypted), want)
+		}
+
+		decrypted, err := decryptForTest(encrypted, key)
+		if err != nil {
+			t.Fatalf("size %d: decrypting: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, content) {
+			t.Fatalf("size %d: decrypted content differs", size)
+		}
+
+		// EncryptFile and DecryptFile use the same format
+		decrypted, err = DecryptFile(encrypted, key)
+		if err != nil || !bytes.Equal(decrypted, content) {
+			t.Fatalf("size %d: DecryptFile failed: %v", size, err)
+		}
+	}
+}
+
+func TestFileStreamWrongKey(t *testing.T) {
+	encrypted := encryptForTest(t, testContent(100), newFileKey(t))
+	if _, err := decryptForTest(encrypted, newFileKey(t)); err == nil {
+		t.Fatal("decrypting with another key succeeded")
+	}
+}
+
+func TestFileStreamDetectsTampering(t *testing.T) {
+	key := newFileKey(t)
+	content := testContent(3*FileChunkSize + 100)
+	encrypted := encryptForTest(t, content, key)
+
+	tests := []struct {
+		name   string
+		modify func([]byte) []byte
+	}{
+		{"truncated in the last chunk", func(e []byte) []byte { return e[:len(e)-10] }},
+		{"last chunk removed", func(e []byte) []byte { return e[:chunkOffset(3)] }},
+		{"cut after the header", func(e []byte) []byte { return e[:fileHeaderSize] }},
+		{"cut in the middle of a chunk", func(e []byte) []byte { return e[:chunkOffset(1)+100] }},
+		{"chunks reordered", func(e []byte) []byte {
+			modified := append([]byte(nil), e[:chunkOffset(0)]...)
+			modified = append(modified, e[chunkOffset(1):chunkOffset(2)]...)
+			modified = append(modified, e[chunkOffset(0):chunkOffset(1)]...)
+			return append(modified, e[chunkOffset(2):]...)
+		}},
+		{"chunk duplicated", func(e []byte) []byte {
+			modified := append([]byte(nil), e[:chunkOffset(2)]...)
+			modified = append(modified, e[chunkOffset(1):chunkOffset(2)]...)
+			return append(modified, e[chunkOffset(2):]...)
+		}},
+		{"byte flipped", func(e []byte) []byte {
+			modified := append([]byte(nil), e...)
+			modified[chunkOffset(2)+5] ^= 1
+			return modified
+		}},
+		{"salt changed", func(e []byte) []byte {
+			modified := append([]byte(nil), e...)
+			modified[len(fileMagic)+1] ^= 1
+			return modified
+		}},
+	}
+
+	for _, test := range tests {
+		if decrypted, err := decryptForTest(test.modify(encrypted), key); err == nil {
+			t.Errorf("%s: decrypting succeeded (%d bytes)", test.name, len(decrypted))
+		}
+	}
+}
+
+func TestFileStreamLastChunkFlag(t *testing.T) {
+	key := newFileKey(t)
+
+	// Two full chunks: the first chunk must not be accepted as the end of the
+	// file, it isn't flagged as the last chunk
+	encrypted := encryptForTest(t, testContent(2*FileChunkSize), key)
+	if len(encrypted) != chunkOffset(2) {
+		t.Fatalf("encrypted size = %d, want %d", len(encrypted), chunkOffset(2))
+	}
+	if _, err := decryptForTest(encrypted[:chunkOffset(1)], key); err == nil {
+		t.Error("file without its last chunk was accepted")
+	}
+
+	// Data after the last chunk
+	if _, err := decryptForTest(append(append([]byte(nil), encrypted...), encrypted[chunkOffset(0):chunkOffset(1)]...), key); err == nil {
+		t.Error("data after the last chunk was accepted")
+	}
+}
+
+func TestFileStreamReadsVersion1(t *testing.T) {
+	key := newFileKey(t)
+	content := []byte("a file from an older version")
+
+	aead, err := CreateAEAD(mustDecodeKey(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	encrypted := aead.Seal(nonce, nonce, content, nil)
+
+	decrypted, err := decryptForTest(encrypted, key)
+	if err != nil || !bytes.Equal(decrypted, content) {
+		t.Fatalf("decrypting version 1 = %q, %v", decrypted, err)
+	}
+
+	reader, err := NewFileReader(bytes.NewReader(encrypted), key)
+	if err != nil {
+		t.Fatalf("opening version 1: %v", err)
+	}
+	if reader.Size() != int64(len(content)) {
+		t.Errorf("size = %d, want %d", reader.Size(), len(content))
+	}
+	reader.Seek(7, io.SeekStart)
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != string(content[7:]) {
+		t.Errorf("content after seek = %q", rest)
+	}
+}
+
+func mustDecodeKey(t *testing.T, key string) []byte {
+	t.Helper()
+	decoded, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestFileReaderSeekAtChunkBoundaries(t *testing.T) {
+	key := newFileKey(t)
+	content := testContent(3*FileChunkSize + 1000)
+	encrypted := encryptForTest(t, content, key)
+
+	reader, err := NewFileReader(bytes.NewReader(encrypted), key)
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	if reader.Size() != int64(len(content)) {
+		t.Fatalf("size = %d, want %d", reader.Size(), len(content))
+	}
+
+	tests := []struct {
+		offset int64
+		length int
+	}{
+		{0, 10},
+		{FileChunkSize - 1, 2},                 // across the first boundary
+		{FileChunkSize, 10},                    // start of the second chunk
+		{2*FileChunkSize - 5, 10},              // across the second boundary
+		{FileChunkSize / 2, FileChunkSize * 2}, // over several chunks
+		{3 * FileChunkSize, 1000},              // the whole last chunk
+		{int64(len(content)) - 1, 1},           // the last byte
+		{10, 5},                                // back to the start
+	}
+
+	for _, test := range tests {
+		if _, err := reader.Seek(test.offset, io.SeekStart); err != nil {
+			t.Fatalf("seek to %d: %v", test.offset, err)
+		}
+		got := make([]byte, test.length)
+		if _, err := io.ReadFull(reader, got); err != nil {
+			t.Fatalf("reading %d bytes at %d: %v", test.length, test.offset, err)
+		}
+		if !bytes.Equal(got, content[test.offset:test.offset+int64(test.length)]) {
+			t.Errorf("content at %d (%d bytes) differs", test.offset, test.length)
+		}
+	}
+
+	// Reading at the end returns EOF
+	if _, err := reader.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := reader.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("read at the end = %d, %v, want EOF", n, err)
+	}
+	if _, err := reader.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seek before the start succeeded")
+	}
+}
+
+func TestFileReaderRangeRequests(t *testing.T) {
+	key := newFileKey(t)
+	content := testContent(2*FileChunkSize + 10)
+	encrypted := encryptForTest(t, content, key)
+
+	// io.SectionReader is what http.ServeContent uses for a single range
+	for _, r := range [][2]int64{{0, 1}, {FileChunkSize - 3, 6}, {FileChunkSize, FileChunkSize}, {2 * FileChunkSize, 10}} {
+		reader, err := NewFileReader(bytes.NewReader(encrypted), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.Seek(r[0], io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(io.LimitReader(reader, r[1]))
+		if err != nil {
+			t.Fatalf("range %v: %v", r, err)
+		}
+		if !bytes.Equal(got, content[r[0]:r[0]+r[1]]) {
+			t.Errorf("range %v differs", r)
+		}
+	}
+}
+
+func TestNewFileReaderRejectsDamagedFiles(t *testing.T) {
+	key := newFileKey(t)
+	encrypted := encryptForTest(t, testContent(FileChunkSize+10), key)
+
+	// The first chunk is checked when the file is opened
+	damaged := append([]byte(nil), encrypted...)
+	damaged[fileHeaderSize+3] ^= 1
+	if _, err := NewFileReader(bytes.NewReader(damaged), key); err == nil {
+		t.Error("opening a damaged file succeeded")
+	}
+
+	// A cut off file can't have a valid size
+	if _, err := NewFileReader(bytes.NewReader(encrypted[:chunkOffset(1)+5]), key); err == nil {
+		t.Error("opening a cut off file succeeded")
+	}
+
+	// Damage in a later chunk is noticed when it is read
+	damaged = append([]byte(nil), encrypted...)
+	damaged[chunkOffset(1)+3] ^= 1
+	reader, err := NewFileReader(bytes.NewReader(damaged), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(reader); err == nil || !strings.Contains(err.Error(), "chunk 1") {
+		t.Errorf("reading a damaged chunk: %v", err)
+	}
+}
@@ -6,226 +6,74 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
 )
 
-// Mutexes for file operations
+// Mutexes for file operations (the data of the users is locked per user, see UserLocks)
 var (
 	UsersFileMutex    sync.RWMutex // For users.json
 	UserSettingsMutex sync.RWMutex // For user settings
-	LogsMutex         sync.RWMutex // For log files
-	TagsMutex         sync.RWMutex // For tags.json
-	TemplatesMutex    sync.RWMutex // For templates.json
 )
 
+// usersGeneration counts the writes of users.json, caches of its content are
+// only valid for the generation they were read in
+var usersGeneration atomic.Uint64
+
 // GetUsers retrieves the users from the users.json file
 func GetUsers() (map[string]any, error) {
-	// Try to open the users.json file
-	filePath := filepath.Join(Settings.DataPath, "users.json")
-	file, err := os.Open(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			Logger.Printf("users.json - File not found")
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error opening users.json: %v", err)
-		return nil, fmt.Errorf("internal server error when trying to open users.json")
-	}
-	defer file.Close()
-
-	// Read the file content
-	var content map[string]any
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&content); err != nil {
-		if err == io.EOF {
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error decoding users.json: %v", err)
-		return nil, fmt.Errorf("internal server error when trying to decode users.json")
-	}
-
-	return content, nil
+	return DataStore.GetUsers()
 }
 
 // WriteUsers writes the users to the users.json file
 func WriteUsers(content map[string]any) error {
-
-	// Create the users.json file
-	filePath := filepath.Join(Settings.DataPath, "users.json")
-	file, err := os.Create(filePath)
-	if err != nil {
-		Logger.Printf("Error creating users.json: %v", err)
-		return fmt.Errorf("internal server error when trying to create users.json")
-	}
-	defer file.Close()
-
-	// Write the content to the file
-	var encoder *json.Encoder
-	if Settings.Indent > 0 {
-		encoder = json.NewEncoder(file)
-		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-	} else {
-		encoder = json.NewEncoder(file)
-	}
-
-	if err := encoder.Encode(content); err != nil {
-		Logger.Printf("Error encoding users.json: %v", err)
-		return fmt.Errorf("internal server error when trying to encode users.json")
-	}
-
-	return nil
+	// Also after a failed write, it may have been partial
+	defer usersGeneration.Add(1)
+	return DataStore.WriteUsers(content)
 }
 
-// GetMonth retrieves the logs for a specific month
+// GetMonth retrieves the logs for a specific month, upgraded to MonthSchemaVersion
 func GetMonth(userID int, year, month int) (map[string]any, error) {
-	// Try to open the month.json file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/%d/%02d.json", userID, year, month))
-	file, err := os.Open(filePath)
+	content, err := DataStore.GetMonth(userID, year, month)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to open %d/%02d.json", year, month)
+		return nil, err
 	}
-	defer file.Close()
 
-	// Read the file content
-	var content map[string]any
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&content); err != nil {
-		if err == io.EOF {
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error decoding %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to decode %d/%02d.json", year, month)
+	if err := UpgradeMonth(content); err != nil {
+		Logger.Printf("Error upgrading month %d/%02d of user %d: %v", year, month, userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read %d/%02d", year, month)
 	}
 
 	return content, nil
 }
 
-// WriteMonth writes the logs for a specific month
+// WriteMonth writes the logs for a specific month.
+// Documents without schema_version are upgraded before writing.
 func WriteMonth(userID int, year, month int, content map[string]any) error {
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/%d", userID, year))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d/%d", userID, year)
+	if err := UpgradeMonth(content); err != nil {
+		Logger.Printf("Error upgrading month %d/%02d of user %d: %v", year, month, userID, err)
+		return fmt.Errorf("internal server error when trying to write %d/%02d", year, month)
 	}
 
-	// Create the month.json file
-	filePath := filepath.Join(dirPath, fmt.Sprintf("%02d.json", month))
-	file, err := os.Create(filePath)
-	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create %d/%02d.json", year, month)
-	}
-	defer file.Close()
-
-	// Write the content to the file
-	var encoder *json.Encoder
-	if Settings.Indent > 0 {
-		encoder = json.NewEncoder(file)
-		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-	} else {
-		encoder = json.NewEncoder(file)
-	}
-
-	if err := encoder.Encode(content); err != nil {
-		Logger.Printf("Error encoding %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to encode %d/%02d.json", year, month)
-	}
-
-	return nil
+	return DataStore.WriteMonth(userID, year, month, content)
 }
 
 // GetTags retrieves the tags for a specific user
 func GetTags(userID int) (map[string]any, error) {
-	// Try to open the tags.json file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/tags.json", userID))
-	file, err := os.Open(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to open tags.json")
-	}
-	defer file.Close()
-
-	// Read the file content
-	var content map[string]any
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&content); err != nil {
-		if err == io.EOF {
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error decoding %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to decode tags.json")
-	}
-
-	return content, nil
+	return DataStore.GetTags(userID)
 }
 
 // WriteTags writes the tags for a specific user
 func WriteTags(userID int, content map[string]any) error {
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d", userID))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d", userID)
-	}
-
-	// Create the tags.json file
-	filePath := filepath.Join(dirPath, "tags.json")
-	file, err := os.Create(filePath)
-	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create tags.json")
-	}
-	defer file.Close()
-
-	// Write the content to the file
-	var encoder *json.Encoder
-	if Settings.Development && Settings.Indent > 0 {
-		encoder = json.NewEncoder(file)
-		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-	} else {
-		encoder = json.NewEncoder(file)
-	}
-
-	if err := encoder.Encode(content); err != nil {
-		Logger.Printf("Error encoding %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to encode tags.json")
-	}
-
-	return nil
+	return DataStore.WriteTags(userID, content)
 }
 
 // GetUserSettings retrieves the settings for a specific user
 func GetUserSettings(userID int) (string, error) {
-	// Try to open the settings.encrypted file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/settings.encrypted", userID))
-	file, err := os.Open(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return "", nil
-		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
-		return "", fmt.Errorf("internal server error when trying to open settings.encrypted")
-	}
-	defer file.Close()
-
-	// Read the file content
-	content, err := io.ReadAll(file)
-	if err != nil {
-		Logger.Printf("Error reading %s: %v", filePath, err)
-		return "", fmt.Errorf("internal server error when trying to read settings.encrypted")
-	}
-
-	return string(content), nil
+	return DataStore.GetUserSettings(userID)
 }
 
 // WriteUserSettings writes the settings for a specific user
@@ -233,223 +81,110 @@ func WriteUserSettings(userID int, content string) error {
 	UserSettingsMutex.Lock()
 	defer UserSettingsMutex.Unlock()
 
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d", userID))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d", userID)
-	}
-
-	// Create the settings.encrypted file
-	filePath := filepath.Join(dirPath, "settings.encrypted")
-	file, err := os.Create(filePath)
-	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create settings.encrypted")
-	}
-	defer file.Close()
-
-	// Write the content to the file
-	if _, err := file.WriteString(content); err != nil {
-		Logger.Printf("Error writing %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to write settings.encrypted")
-	}
-
-	return nil
+	return DataStore.WriteUserSettings(userID, content)
 }
 
 // GetTemplates retrieves the templates for a specific user
 func GetTemplates(userID int) (map[string]any, error) {
-	// Try to open the templates.json file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/templates.json", userID))
-	file, err := os.Open(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			Logger.Printf("%s - File not found", filePath)
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to open templates.json")
-	}
-	defer file.Close()
-
-	// Read the file content
-	var content map[string]any
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&content); err != nil {
-		if err == io.EOF {
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error decoding %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to decode templates.json")
-	}
-
-	return content, nil
+	return DataStore.GetTemplates(userID)
 }
 
 // WriteTemplates writes the templates for a specific user
 func WriteTemplates(userID int, content map[string]any) error {
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d", userID))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d", userID)
-	}
-
-	// Create the templates.json file
-	filePath := filepath.Join(dirPath, "templates.json")
-	file, err := os.Create(filePath)
-	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create templates.json")
-	}
-	defer file.Close()
-
-	// Write the content to the file
-	var encoder *json.Encoder
-	if Settings.Development && Settings.Indent > 0 {
-		encoder = json.NewEncoder(file)
-		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-	} else {
-		encoder = json.NewEncoder(file)
-	}
+	return DataStore.WriteTemplates(userID, content)
+}
 
-	if err := encoder.Encode(content); err != nil {
-		Logger.Printf("Error encoding %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to encode templates.json")
-	}
+// GetSecurityLog retrieves the security log of a specific user
+func GetSecurityLog(userID int) (map[string]any, error) {
+	return DataStore.GetSecurityLog(userID)
+}
 
-	return nil
+// WriteSecurityLog writes the security log of a specific user
+func WriteSecurityLog(userID int, content map[string]any) error {
+	return DataStore.WriteSecurityLog(userID, content)
 }
 
 // WriteFile writes a file for a specific user
 func WriteFile(content []byte, userID int, uuid string) error {
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/files", userID))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d/files", userID)
-	}
+	return DataStore.WriteFile(content, userID, uuid)
+}
 
-	// Create the file
-	filePath := filepath.Join(dirPath, uuid)
-	file, err := os.Create(filePath)
-	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create file %s", uuid)
-	}
-	defer file.Close()
+// ReadFile reads a file for a specific user
+func ReadFile(userID int, uuid string) ([]byte, error) {
+	return DataStore.ReadFile(userID, uuid)
+}
 
-	// Write the content to the file
-	if _, err := file.Write(content); err != nil {
-		Logger.Printf("Error writing %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to write file %s", uuid)
-	}
+// WriteFileStream writes a file for a specific user from a reader
+func WriteFileStream(content io.Reader, userID int, uuid string) error {
+	return DataStore.WriteFileStream(content, userID, uuid)
+}
 
-	return nil
+// OpenFile opens a file of a specific user for reading, the caller must close it
+func OpenFile(userID int, uuid string) (io.ReadSeekCloser, error) {
+	return DataStore.OpenFile(userID, uuid)
 }
 
-// ReadFile reads a file for a specific user
-func ReadFile(userID int, uuid string) ([]byte, error) {
-	// Try to open the file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/files/%s", userID, uuid))
-	file, err := os.Open(filePath)
+// OpenDecryptedFile opens a file of a specific user and decrypts it while it
+// is read, the caller must close it
+func OpenDecryptedFile(userID int, uuid string, key string) (io.ReadCloser, error) {
+	file, err := OpenFile(userID, uuid)
 	if err != nil {
-		if os.IsNotExist(err) {
-			Logger.Printf("%s - File not found", filePath)
-			return nil, fmt.Errorf("file not found")
-		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to open file %s", uuid)
+		return nil, err
 	}
-	defer file.Close()
 
-	// Read the file content
-	content, err := io.ReadAll(file)
+	decrypted, err := DecryptFileStream(file, key)
 	if err != nil {
-		Logger.Printf("Error reading %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to read file %s", uuid)
+		file.Close()
+		return nil, err
 	}
 
-	return content, nil
+	return struct {
+		io.Reader
+		io.Closer
+	}{decrypted, file}, nil
 }
 
 // RemoveFile removes a file for a specific user
 func RemoveFile(userID int, uuid string) error {
-	// Try to remove the file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/files/%s", userID, uuid))
-	if err := os.Remove(filePath); err != nil {
-		Logger.Printf("Error removing %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to remove file %s", uuid)
-	}
+	return DataStore.RemoveFile(userID, uuid)
+}
 
-	return nil
+// QuarantineFile moves a file of a specific user into the quarantine
+func QuarantineFile(userID int, uuid string) (int64, error) {
+	return DataStore.QuarantineFile(userID, uuid)
 }
 
-// GetYears returns the years available for a specific user
-func GetYears(userID int) ([]string, error) {
-	// Try to read the user directory
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d", userID))
-	entries, err := os.ReadDir(dirPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			Logger.Printf("%s - Directory not found", dirPath)
-			return []string{}, nil
-		}
-		Logger.Printf("Error reading directory %s: %v", dirPath, err)
-		return nil, fmt.Errorf("internal server error when trying to read directory %d", userID)
-	}
+// RemoveQuarantinedFile removes a quarantined file of a specific user
+func RemoveQuarantinedFile(userID int, uuid string) error {
+	return DataStore.RemoveQuarantinedFile(userID, uuid)
+}
 
-	// Filter years
-	years := []string{}
-	for _, entry := range entries {
-		if entry.IsDir() && len(entry.Name()) == 4 {
-			// Check if the name is a valid year (4 digits)
-			if _, err := strconv.Atoi(entry.Name()); err == nil {
-				years = append(years, entry.Name())
-			}
-		}
-	}
+// ListFiles returns the uuids of all files of a specific user
+func ListFiles(userID int) ([]string, error) {
+	return DataStore.ListFiles(userID)
+}
 
-	return years, nil
+// GetYears returns the years available for a specific user
+func GetYears(userID int) ([]string, error) {
+	return DataStore.GetYears(userID)
 }
 
 // GetMonths returns the months available for a specific user and year
 func GetMonths(userID int, year string) ([]string, error) {
-	// Try to read the year directory
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/%s", userID, year))
-	entries, err := os.ReadDir(dirPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			Logger.Printf("%s - Directory not found", dirPath)
-			return []string{}, nil
-		}
-		Logger.Printf("Error reading directory %s: %v", dirPath, err)
-		return nil, fmt.Errorf("internal server error when trying to read directory %d/%s", userID, year)
-	}
-
-	// Filter months
-	months := []string{}
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
-			// Extract month from filename (remove .json)
-			month := strings.TrimSuffix(entry.Name(), ".json")
-			months = append(months, month)
-		}
-	}
-
-	return months, nil
+	return DataStore.GetMonths(userID, year)
 }
 
+// DeleteUserData removes all data of a specific user
 func DeleteUserData(userID int) error {
-	// Try to remove the user directory
-	dirPath := filepath.Join(Settings.DataPath, strconv.Itoa(userID))
-	if err := os.RemoveAll(dirPath); err != nil {
-		Logger.Printf("Error removing directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to remove user data for ID %d", userID)
-	}
+	// Unfinished uploads are not part of the store
+	RemoveUserUploads(userID)
 
-	return nil
+	return DataStore.DeleteUserData(userID)
+}
+
+// GetUserDiskUsage returns the number of bytes used by a specific user
+func GetUserDiskUsage(userID int) (int64, error) {
+	return DataStore.UserDiskUsage(userID)
 }
 
 // saves the hash, salt and encrypted derived key of the backup codes to the users.json file
@@ -519,3 +254,20 @@ func GetChangelog() (map[string]any, error) {
 
 	return content, nil
 }
+
+// ValidFileUUID checks if a uuid sent by a client is a canonical UUID, as the
+// clients generate them for new files
+func ValidFileUUID(value string) bool {
+	parsed, err := uuid.Parse(value)
+	return err == nil && parsed.String() == value
+}
+
+// checkBlobName makes sure that the name of a stored file (a uuid, or the name
+// of a thumbnail) can't point outside of the directory of the user
+func checkBlobName(name string) error {
+	if !filepath.IsLocal(name) || strings.ContainsAny(name, `/\`) {
+		Logger.Printf("Rejected invalid file name %q", name)
+		return fmt.Errorf("invalid file name")
+	}
+	return nil
+}
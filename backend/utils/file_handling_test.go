@@ -0,0 +1,45 @@
+package utils
+
+import "testing"
+
+func TestValidFileUUID(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"01890a5d-ac96-774b-bcce-b302099a8057", true},
+		{"", false},
+		{"../../users.json", false},
+		{"01890A5D-AC96-774B-BCCE-B302099A8057", false},
+		{"{01890a5d-ac96-774b-bcce-b302099a8057}", false},
+		{"01890a5dac96774bbcceb302099a8057", false},
+		{"01890a5d-ac96-774b-bcce-b302099a8057/../x", false},
+	}
+
+	for _, test := range tests {
+		if got := ValidFileUUID(test.value); got != test.want {
+			t.Errorf("ValidFileUUID(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestLocalBlobStoreRejectsPathsOutsideOfTheUser(t *testing.T) {
+	store := NewLocalBlobStore(t.TempDir())
+
+	for _, name := range []string{"../../users.json", "../2/files/x", "/etc/passwd", `..\users.json`, "a/b", "..", ""} {
+		if err := store.WriteFile([]byte("x"), 1, name); err == nil {
+			t.Errorf("writing %q was not rejected", name)
+		}
+		if _, err := store.OpenFile(1, name); err == nil {
+			t.Errorf("opening %q was not rejected", name)
+		}
+		if err := store.RemoveFile(1, name); err == nil {
+			t.Errorf("removing %q was not rejected", name)
+		}
+	}
+
+	// Thumbnails are stored next to the files
+	if err := store.WriteFile([]byte("x"), 1, ThumbnailUUID("01890a5d-ac96-774b-bcce-b302099a8057", 256)); err != nil {
+		t.Errorf("writing a thumbnail: %v", err)
+	}
+}
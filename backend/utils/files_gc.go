@@ -0,0 +1,376 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Garbage collection of uploaded files that no day references anymore (e.g.
+// when an upload failed after the file was written or a delete failed halfway).
+//
+// A file is moved to the quarantine once it was unreferenced for the grace
+// period (FILES_GC_GRACE_HOURS) and deleted after the retention period
+// (FILES_GC_RETENTION_DAYS). Only the metadata of the months is read, no key of
+// the users is needed. The state is kept in files_gc.json in DATA_PATH.
+
+const filesGCStateFilename = "files_gc.json"
+
+// FilesGCRun is the result of a single run of the garbage collection
+type FilesGCRun struct {
+	StartedAt        time.Time `json:"started_at"`
+	FinishedAt       time.Time `json:"finished_at"`
+	Quarantined      int       `json:"quarantined"`
+	QuarantinedBytes int64     `json:"quarantined_bytes"`
+	Deleted          int       `json:"deleted"`
+	ReclaimedBytes   int64     `json:"reclaimed_bytes"`
+	SkippedUsers     int       `json:"skipped_users"`
+}
+
+// quarantinedFile is a file in the quarantine of a user
+type quarantinedFile struct {
+	Since time.Time `json:"since"`
+	Size  int64     `json:"size"`
+}
+
+// filesGCState is the content of files_gc.json
+type filesGCState struct {
+	// Unreferenced files per user with the time they were first seen
+	Orphans map[int]map[string]time.Time `json:"orphans"`
+	// Quarantined files per user
+	Quarantine map[int]map[string]quarantinedFile `json:"quarantine"`
+	// Bytes reclaimed by all runs
+	ReclaimedBytes int64       `json:"reclaimed_bytes"`
+	LastRun        *FilesGCRun `json:"last_run,omitempty"`
+}
+
+// filesGCMutex prevents concurrent runs
+var filesGCMutex sync.Mutex
+
+// StartFilesGC runs the garbage collection of files periodically
+func StartFilesGC() {
+	if Settings.FilesGCInterval <= 0 {
+		Logger.Printf("Garbage collection of files is disabled")
+		return
+	}
+	if Settings.StorageBackend == "memory" {
+		return
+	}
+
+	go func() {
+		// Don't slow down the startup
+		time.Sleep(time.Minute)
+
+		for {
+			if _, err := RunFilesGC(); err != nil {
+				Logger.Printf("Error in garbage collection of files: %v", err)
+			}
+			time.Sleep(time.Duration(Settings.FilesGCInterval) * time.Hour)
+		}
+	}()
+}
+
+// RunFilesGC quarantines unreferenced files and deletes quarantined files
+// after the retention period
+func RunFilesGC() (FilesGCRun, error) {
+	filesGCMutex.Lock()
+	defer filesGCMutex.Unlock()
+
+	run := FilesGCRun{StartedAt: time.Now()}
+
+	state, err := readFilesGCState()
+	if err != nil {
+		return run, err
+	}
+
+	// Get all users
+	users, err := GetUsers()
+	if err != nil {
+		return run, err
+	}
+
+	userIDs := map[int]bool{}
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		user, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		if id, ok := user["user_id"].(float64); ok {
+			userIDs[int(id)] = true
+		}
+	}
+
+	for userID := range userIDs {
+		if err := collectUserFiles(userID, state, &run); err != nil {
+			Logger.Printf("Garbage collection of files: skipping user %d: %v", userID, err)
+			run.SkippedUsers++
+		}
+	}
+
+	// Forget deleted users (their files were removed with the user)
+	for userID := range state.Orphans {
+		if !userIDs[userID] {
+			delete(state.Orphans, userID)
+		}
+	}
+	for userID := range state.Quarantine {
+		if !userIDs[userID] {
+			delete(state.Quarantine, userID)
+		}
+	}
+
+	run.FinishedAt = time.Now()
+	state.ReclaimedBytes += run.ReclaimedBytes
+	state.LastRun = &run
+
+	if err := writeFilesGCState(state); err != nil {
+		return run, err
+	}
+
+	Logger.Printf("Garbage collection of files: %d files (%d bytes) quarantined, %d files (%d bytes) deleted, %d users skipped",
+		run.Quarantined, run.QuarantinedBytes, run.Deleted, run.ReclaimedBytes, run.SkippedUsers)
+
+	return run, nil
+}
+
+// collectUserFiles runs the garbage collection for a single user
+func collectUserFiles(userID int, state *filesGCState, run *FilesGCRun) error {
+	// Lock the logs of this user
+	logsMutex := UserLocks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
+	referenced, err := referencedFiles(userID)
+	if err != nil {
+		return err
+	}
+
+	uuids, err := ListFiles(userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	retention := time.Duration(Settings.FilesGCRetention) * 24 * time.Hour
+
+	// Unreferenced files are quarantined after the grace period
+	quarantineOrphans(userID, uuids, referenced, state, run)
+
+	// Quarantined files are deleted after the retention period
+	for uuid, file := range state.Quarantine[userID] {
+		if now.Sub(file.Since) < retention {
+			continue
+		}
+
+		if referenced[uuid] {
+			// A day references the file again (e.g. restored by hand), keep it
+			Logger.Printf("Garbage collection of files: quarantined file %s of user %d is referenced, not deleting it", uuid, userID)
+			continue
+		}
+
+		if err := RemoveQuarantinedFile(userID, uuid); err != nil {
+			continue
+		}
+		Logger.Printf("Garbage collection of files: deleted file %s of user %d (%d bytes)", uuid, userID, file.Size)
+
+		delete(state.Quarantine[userID], uuid)
+		run.Deleted++
+		run.ReclaimedBytes += file.Size
+	}
+
+	return nil
+}
+
+// quarantineOrphans quarantines the unreferenced files of a user that were
+// unreferenced for the grace period and remembers the others. Returns the
+// quarantined files.
+func quarantineOrphans(userID int, uuids []string, referenced map[string]bool, state *filesGCState, run *FilesGCRun) map[string]bool {
+	now := time.Now()
+	grace := time.Duration(Settings.FilesGCGrace) * time.Hour
+
+	quarantined := map[string]bool{}
+	orphans := map[string]time.Time{}
+	for _, uuid := range uuids {
+		if referenced[uuid] {
+			continue
+		}
+
+		firstSeen, ok := state.Orphans[userID][uuid]
+		if !ok {
+			firstSeen = now
+		}
+
+		if now.Sub(firstSeen) < grace {
+			orphans[uuid] = firstSeen
+			continue
+		}
+
+		size, err := QuarantineFile(userID, uuid)
+		if err != nil {
+			orphans[uuid] = firstSeen
+			continue
+		}
+		Logger.Printf("Garbage collection of files: quarantined file %s of user %d (%d bytes)", uuid, userID, size)
+
+		if state.Quarantine[userID] == nil {
+			state.Quarantine[userID] = map[string]quarantinedFile{}
+		}
+		state.Quarantine[userID][uuid] = quarantinedFile{Since: now, Size: size}
+		quarantined[uuid] = true
+		run.Quarantined++
+		run.QuarantinedBytes += size
+	}
+	state.Orphans[userID] = orphans
+
+	return quarantined
+}
+
+// QuarantineOrphanedFiles hands the unreferenced files of a user to the
+// garbage collection: files that were unreferenced for the grace period are
+// quarantined right away, the others are quarantined by a later run. Returns
+// the quarantined files.
+//
+// The caller must hold the logs lock of the user. If the garbage collection
+// is running (it waits for that lock), nothing is done, it takes care of the
+// files itself.
+func QuarantineOrphanedFiles(userID int, uuids []string, referenced map[string]bool) (map[string]bool, error) {
+	if Settings.StorageBackend == "memory" {
+		return map[string]bool{}, nil
+	}
+	if !filesGCMutex.TryLock() {
+		return map[string]bool{}, nil
+	}
+	defer filesGCMutex.Unlock()
+
+	state, err := readFilesGCState()
+	if err != nil {
+		return nil, err
+	}
+
+	var run FilesGCRun
+	quarantined := quarantineOrphans(userID, uuids, referenced, state, &run)
+	if err := writeFilesGCState(state); err != nil {
+		return nil, err
+	}
+
+	return quarantined, nil
+}
+
+// referencedFiles returns the uuids of all files referenced by a day of the user.
+// Fails if any month can't be read, its files would be unknown.
+func referencedFiles(userID int) (map[string]bool, error) {
+	referenced := map[string]bool{}
+
+	years, err := GetYears(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, year := range years {
+		yearInt, _ := strconv.Atoi(year)
+		months, err := GetMonths(userID, year)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, month := range months {
+			monthInt, err := strconv.Atoi(month)
+			if err != nil {
+				continue
+			}
+
+			content, err := ReadMonth(userID, yearInt, monthInt)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, day := range content.Days {
+				for _, file := range day.Files {
+					referenced[file.UUIDFilename] = true
+					for _, size := range file.Thumbnails {
+						referenced[ThumbnailUUID(file.UUIDFilename, size)] = true
+					}
+				}
+			}
+		}
+	}
+
+	return referenced, nil
+}
+
+// GetFilesGCStatus returns the state of the garbage collection of files for the admin panel
+func GetFilesGCStatus() map[string]any {
+	filesGCMutex.Lock()
+	defer filesGCMutex.Unlock()
+
+	state, err := readFilesGCState()
+	if err != nil {
+		Logger.Printf("Error reading %s: %v", filesGCStateFilename, err)
+		return map[string]any{}
+	}
+
+	quarantinedFiles := 0
+	var quarantinedBytes int64
+	for _, files := range state.Quarantine {
+		for _, file := range files {
+			quarantinedFiles++
+			quarantinedBytes += file.Size
+		}
+	}
+
+	return map[string]any{
+		"enabled":           Settings.FilesGCInterval > 0 && Settings.StorageBackend != "memory",
+		"reclaimed_bytes":   state.ReclaimedBytes,
+		"quarantined_files": quarantinedFiles,
+		"quarantined_bytes": quarantinedBytes,
+		"last_run":          state.LastRun,
+	}
+}
+
+// readFilesGCState reads files_gc.json (empty state if it doesn't exist)
+func readFilesGCState() (*filesGCState, error) {
+	state := &filesGCState{}
+
+	data, err := os.ReadFile(filepath.Join(Settings.DataPath, filesGCStateFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading %s: %v", filesGCStateFilename, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", filesGCStateFilename, err)
+		}
+	}
+
+	if state.Orphans == nil {
+		state.Orphans = map[int]map[string]time.Time{}
+	}
+	if state.Quarantine == nil {
+		state.Quarantine = map[int]map[string]quarantinedFile{}
+	}
+
+	return state, nil
+}
+
+// writeFilesGCState atomically writes files_gc.json
+func writeFilesGCState(state *filesGCState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := createAtomicFile(filepath.Join(Settings.DataPath, filesGCStateFilename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Commit()
+}
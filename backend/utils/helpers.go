@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,6 +33,7 @@ const (
 	UserIDKey     ContextKey = "userID"
 	UsernameKey   ContextKey = "username"
 	DerivedKeyKey ContextKey = "derivedKey"
+	SessionIDKey  ContextKey = "sessionID"
 )
 
 // Settings holds the application settings
@@ -44,6 +46,35 @@ type AppSettings struct {
 	Indent            int      `json:"indent"`
 	AllowRegistration bool     `json:"allow_registration"`
 	BasePath          string   `json:"base_path"`
+	StorageBackend    string   `json:"storage_backend"`
+	BlobBackend       string   `json:"blob_backend"`
+	S3Endpoint        string   `json:"s3_endpoint"`
+	S3Bucket          string   `json:"s3_bucket"`
+	S3Region          string   `json:"s3_region"`
+	S3AccessKey       string   `json:"s3_access_key"`
+	S3SecretKey       string   `json:"s3_secret_key"`
+	S3UseSSL          bool     `json:"s3_use_ssl"`
+	FilesGCInterval   int      `json:"files_gc_interval_hours"`
+	FilesGCGrace      int      `json:"files_gc_grace_hours"`
+	FilesGCRetention  int      `json:"files_gc_retention_days"`
+	UploadsExpiry     int      `json:"uploads_expiry_hours"`
+	DefaultQuotaMB    int      `json:"default_quota_mb"`
+	WebAuthnOrigins   []string `json:"webauthn_origins"`
+	TrustedProxies    []string `json:"trusted_proxies"`
+	LoginMaxAttempts  int      `json:"login_max_attempts"`
+	LoginLockoutMins  int      `json:"login_lockout_minutes"`
+	Argon2TimeCost    int      `json:"argon2_time_cost"`
+	Argon2MemoryMB    int      `json:"argon2_memory_mb"`
+	Argon2Threads     int      `json:"argon2_threads"`
+	OIDCIssuer        string   `json:"oidc_issuer"`
+	OIDCClientID      string   `json:"oidc_client_id"`
+	OIDCClientSecret  string   `json:"oidc_client_secret"`
+	OIDCRedirectURL   string   `json:"oidc_redirect_url"`
+	OIDCScopes        []string `json:"oidc_scopes"`
+	OIDCProviderName  string   `json:"oidc_provider_name"`
+	OIDCSubjectKey    bool     `json:"oidc_subject_key"`
+	// OIDCDisablePasswordLogin only allows logins with single sign-on
+	OIDCDisablePasswordLogin bool `json:"oidc_disable_password_login"`
 }
 
 // Global settings
@@ -98,12 +129,23 @@ func InitSettings() error {
 	Settings = AppSettings{
 		DataPath:          "/data",
 		Development:       false,
-		SecretToken:       GenerateSecretToken(),
 		LogoutAfterDays:   30,
 		AllowedHosts:      []string{},
 		Indent:            0,
 		AllowRegistration: false,
 		BasePath:          "/",
+		StorageBackend:    "file",
+		BlobBackend:       "local",
+		S3UseSSL:          true,
+		FilesGCInterval:   24,
+		FilesGCGrace:      24,
+		FilesGCRetention:  30,
+		UploadsExpiry:     24,
+		TrustedProxies:    []string{"127.0.0.0/8", "::1"}, // only the nginx in the container
+		LoginMaxAttempts:  5,
+		LoginLockoutMins:  15,
+		OIDCScopes:        []string{"openid", "profile", "email"},
+		OIDCProviderName:  "SSO",
 	}
 
 	fmt.Print("\nDetected the following settings:\n================\n")
@@ -122,7 +164,7 @@ func InitSettings() error {
 	if secretToken := os.Getenv("SECRET_TOKEN"); secretToken != "" {
 		Settings.SecretToken = secretToken
 	}
-	fmt.Printf("Secret Token: %s\n", Settings.SecretToken)
+	fmt.Printf("Secret Token (only for tokens of older versions): %s\n", Settings.SecretToken)
 
 	if logoutDays := os.Getenv("LOGOUT_AFTER_DAYS"); logoutDays != "" {
 		// Parse logoutDays to int
@@ -167,6 +209,177 @@ func InitSettings() error {
 	}
 	fmt.Printf("Base Path: %s\n", Settings.BasePath)
 
+	if storageBackend := os.Getenv("STORAGE_BACKEND"); storageBackend != "" {
+		Settings.StorageBackend = strings.ToLower(strings.TrimSpace(storageBackend))
+	}
+	fmt.Printf("Storage Backend: %s\n", Settings.StorageBackend)
+
+	if blobBackend := os.Getenv("BLOB_BACKEND"); blobBackend != "" {
+		Settings.BlobBackend = strings.ToLower(strings.TrimSpace(blobBackend))
+	}
+	fmt.Printf("Blob Backend: %s\n", Settings.BlobBackend)
+
+	if Settings.BlobBackend == "s3" {
+		Settings.S3Endpoint = os.Getenv("S3_ENDPOINT")
+		Settings.S3Bucket = os.Getenv("S3_BUCKET")
+		Settings.S3Region = os.Getenv("S3_REGION")
+		Settings.S3AccessKey = os.Getenv("S3_ACCESS_KEY")
+		Settings.S3SecretKey = os.Getenv("S3_SECRET_KEY")
+		if os.Getenv("S3_USE_SSL") == "false" {
+			Settings.S3UseSSL = false
+		}
+		fmt.Printf("S3 Endpoint: %s\n", Settings.S3Endpoint)
+		fmt.Printf("S3 Bucket: %s\n", Settings.S3Bucket)
+		fmt.Printf("S3 Region: %s\n", Settings.S3Region)
+		fmt.Printf("S3 Access Key: %s\n", Settings.S3AccessKey)
+		fmt.Printf("S3 Use SSL: %t\n", Settings.S3UseSSL)
+	}
+
+	if interval := os.Getenv("FILES_GC_INTERVAL_HOURS"); interval != "" {
+		// Parse interval to int (0 disables the garbage collection of files)
+		var hours int
+		if _, err := fmt.Sscanf(interval, "%d", &hours); err == nil {
+			Settings.FilesGCInterval = hours
+		}
+	}
+	fmt.Printf("Files GC Interval (hours): %d\n", Settings.FilesGCInterval)
+
+	if grace := os.Getenv("FILES_GC_GRACE_HOURS"); grace != "" {
+		// Parse grace to int
+		var hours int
+		if _, err := fmt.Sscanf(grace, "%d", &hours); err == nil {
+			Settings.FilesGCGrace = hours
+		}
+	}
+	fmt.Printf("Files GC Grace Period (hours): %d\n", Settings.FilesGCGrace)
+
+	if retention := os.Getenv("FILES_GC_RETENTION_DAYS"); retention != "" {
+		// Parse retention to int
+		var days int
+		if _, err := fmt.Sscanf(retention, "%d", &days); err == nil {
+			Settings.FilesGCRetention = days
+		}
+	}
+	fmt.Printf("Files GC Retention (days): %d\n", Settings.FilesGCRetention)
+
+	if expiry := os.Getenv("UPLOADS_EXPIRY_HOURS"); expiry != "" {
+		// Parse expiry to int
+		var hours int
+		if _, err := fmt.Sscanf(expiry, "%d", &hours); err == nil && hours > 0 {
+			Settings.UploadsExpiry = hours
+		}
+	}
+	fmt.Printf("Unfinished Uploads Expiry (hours): %d\n", Settings.UploadsExpiry)
+
+	if quota := os.Getenv("USER_QUOTA_MB"); quota != "" {
+		// Parse quota to int (0 is unlimited)
+		var mb int
+		if _, err := fmt.Sscanf(quota, "%d", &mb); err == nil && mb >= 0 {
+			Settings.DefaultQuotaMB = mb
+		}
+	}
+	fmt.Printf("Default User Quota (MB): %d\n", Settings.DefaultQuotaMB)
+
+	if origins := os.Getenv("WEBAUTHN_ORIGINS"); origins != "" {
+		// Split origins by comma and trim spaces
+		for origin := range strings.SplitSeq(origins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				Settings.WebAuthnOrigins = append(Settings.WebAuthnOrigins, origin)
+			}
+		}
+	}
+	fmt.Printf("WebAuthn Origins: %v\n", Settings.WebAuthnOrigins)
+
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		// Split proxies (addresses or CIDR ranges) by comma and trim spaces. They
+		// are added to localhost, where the nginx of the container runs.
+		for proxy := range strings.SplitSeq(proxies, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				Settings.TrustedProxies = append(Settings.TrustedProxies, proxy)
+			}
+		}
+	} else {
+		Logger.Printf("Note: TRUSTED_PROXIES is not set, X-Forwarded-For is only used from localhost. Behind another reverse proxy, add it to TRUSTED_PROXIES, otherwise all clients share its address (e.g. for the lockout after wrong passwords).")
+	}
+	fmt.Printf("Trusted Proxies: %v\n", Settings.TrustedProxies)
+
+	if attempts := os.Getenv("LOGIN_MAX_ATTEMPTS"); attempts != "" {
+		// Parse attempts to int
+		var max int
+		if _, err := fmt.Sscanf(attempts, "%d", &max); err == nil && max > 0 {
+			Settings.LoginMaxAttempts = max
+		}
+	}
+	fmt.Printf("Login Max Attempts: %d\n", Settings.LoginMaxAttempts)
+
+	if lockout := os.Getenv("LOGIN_LOCKOUT_MINUTES"); lockout != "" {
+		// Parse lockout to int
+		var minutes int
+		if _, err := fmt.Sscanf(lockout, "%d", &minutes); err == nil && minutes > 0 {
+			Settings.LoginLockoutMins = minutes
+		}
+	}
+	fmt.Printf("Login Lockout (minutes): %d\n", Settings.LoginLockoutMins)
+
+	if timeCost := os.Getenv("ARGON2_TIME_COST"); timeCost != "" {
+		// Parse time cost to int
+		var iterations int
+		if _, err := fmt.Sscanf(timeCost, "%d", &iterations); err == nil && iterations > 0 {
+			Settings.Argon2TimeCost = iterations
+		}
+	}
+
+	if memory := os.Getenv("ARGON2_MEMORY_MB"); memory != "" {
+		// Parse memory to int
+		var mb int
+		if _, err := fmt.Sscanf(memory, "%d", &mb); err == nil && mb > 0 {
+			Settings.Argon2MemoryMB = mb
+		}
+	}
+
+	if threads := os.Getenv("ARGON2_THREADS"); threads != "" {
+		// Parse threads to int (Argon2 allows at most 255)
+		var count int
+		if _, err := fmt.Sscanf(threads, "%d", &count); err == nil && count > 0 && count <= 255 {
+			Settings.Argon2Threads = count
+		}
+	}
+
+	// Without configuration, hashes and keys keep the different parameters of older versions
+	fmt.Printf("Argon2 Password Hashes: %s\n", CurrentHashParams())
+	fmt.Printf("Argon2 Derived Keys: %s\n", CurrentKeyParams())
+
+	// Single sign-on is enabled with issuer, client ID and redirect URL
+	Settings.OIDCIssuer = strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	Settings.OIDCClientID = os.Getenv("OIDC_CLIENT_ID")
+	Settings.OIDCClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	Settings.OIDCRedirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	fmt.Printf("OIDC Issuer: %s\n", Settings.OIDCIssuer)
+	fmt.Printf("OIDC Client ID: %s\n", Settings.OIDCClientID)
+	fmt.Printf("OIDC Redirect URL: %s\n", Settings.OIDCRedirectURL)
+
+	if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+		// Split scopes by space or comma, "openid" is always requested
+		Settings.OIDCScopes = []string{"openid"}
+		for _, scope := range strings.FieldsFunc(scopes, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if !slices.Contains(Settings.OIDCScopes, scope) {
+				Settings.OIDCScopes = append(Settings.OIDCScopes, scope)
+			}
+		}
+	}
+	fmt.Printf("OIDC Scopes: %v\n", Settings.OIDCScopes)
+
+	if name := os.Getenv("OIDC_PROVIDER_NAME"); name != "" {
+		Settings.OIDCProviderName = name
+	}
+	fmt.Printf("OIDC Provider Name: %s\n", Settings.OIDCProviderName)
+
+	Settings.OIDCSubjectKey = os.Getenv("OIDC_SUBJECT_KEY") == "true"
+	fmt.Printf("OIDC Subject Key: %t\n", Settings.OIDCSubjectKey)
+
+	Settings.OIDCDisablePasswordLogin = os.Getenv("OIDC_DISABLE_PASSWORD_LOGIN") == "true"
+	fmt.Printf("OIDC Disable Password Login: %t\n", Settings.OIDCDisablePasswordLogin)
+
 	fmt.Print("================\n\n")
 
 	// Create data directory if it doesn't exist
@@ -185,6 +398,8 @@ func GetAppSettings() AppSettings {
 
 	// dont't show secret - remove it!
 	tempSettings.SecretToken = ""
+	tempSettings.S3SecretKey = ""
+	tempSettings.OIDCClientSecret = ""
 	return tempSettings
 }
 
@@ -233,34 +448,33 @@ func JSONResponse(w http.ResponseWriter, statusCode int, data any) {
 	}
 }
 
-// Move data to directory "old", if users.json is from dailytxt version 1
-func HandleOldData(logger *log.Logger) {
+// Move data to directory "old", if users.json is from dailytxt version 1.
+// Registered as data migration to version 2 (see migrations.go).
+func HandleOldData(logger *log.Logger) error {
 	// Check if users.json exists
 	usersFile := Settings.DataPath + "/users.json"
 	if _, err := os.Stat(usersFile); os.IsNotExist(err) {
 		logger.Println("No users.json found, skipping old data check.")
-		return
+		return nil
 	}
 
 	// Read the file
 	data, err := os.ReadFile(usersFile)
 	if err != nil {
-		logger.Printf("Error reading users.json: %v", err)
-		return
+		return fmt.Errorf("error reading users.json: %v", err)
 	}
 
 	// Check if the file is from dailytxt version 1
 	var usersData map[string]interface{}
 	if err := json.Unmarshal(data, &usersData); err != nil {
-		logger.Printf("Error parsing users.json: %v", err)
-		return
+		return fmt.Errorf("error parsing users.json: %v", err)
 	}
 
 	// Check if users array exists
 	usersArray, ok := usersData["users"].([]interface{})
 	if !ok || len(usersArray) == 0 {
 		logger.Println("No users found in users.json, skipping migration.")
-		return
+		return nil
 	}
 
 	// Check if any user is missing the dailytxt_version=2 field
@@ -283,14 +497,13 @@ func HandleOldData(logger *log.Logger) {
 	// If no migration is needed, return
 	if !needsMigration {
 		logger.Println("All users have dailytxt_version=2, no migration needed.")
-		return
+		return nil
 	}
 
 	// Create "old" directory
 	oldDir := Settings.DataPath + "/old"
 	if err := os.MkdirAll(oldDir, 0755); err != nil {
-		logger.Printf("Error creating old directory: %v", err)
-		return
+		return fmt.Errorf("error creating old directory: %v", err)
 	}
 
 	// Move all files from data to old
@@ -299,10 +512,10 @@ func HandleOldData(logger *log.Logger) {
 	// List all files and directories in the data path
 	entries, err := os.ReadDir(Settings.DataPath)
 	if err != nil {
-		logger.Printf("Error reading data directory: %v", err)
-		return
+		return fmt.Errorf("error reading data directory: %v", err)
 	}
 
+	failed := 0
 	for _, entry := range entries {
 		name := entry.Name()
 		// Skip the "old" directory itself
@@ -310,6 +523,16 @@ func HandleOldData(logger *log.Logger) {
 			continue
 		}
 
+		// Skip the files of the migration framework (data version, lock, snapshots)
+		if isMigrationFile(name) {
+			continue
+		}
+
+		// Skip the SQLite database (including -wal and -shm files)
+		if strings.HasPrefix(name, SQLiteFilename) {
+			continue
+		}
+
 		srcPath := Settings.DataPath + "/" + name
 		destPath := oldDir + "/" + name
 
@@ -324,6 +547,7 @@ func HandleOldData(logger *log.Logger) {
 			// For directories, copy recursively
 			if err := CopyDir(srcPath, destPath, logger); err != nil {
 				logger.Printf("Error copying directory %s to %s: %v", srcPath, destPath, err)
+				failed++
 			} else {
 				// Remove the original directory after successful copy
 				if err := os.RemoveAll(srcPath); err != nil {
@@ -334,6 +558,7 @@ func HandleOldData(logger *log.Logger) {
 			// For files, copy directly
 			if err := CopyFile(srcPath, destPath, logger); err != nil {
 				logger.Printf("Error copying file %s to %s: %v", srcPath, destPath, err)
+				failed++
 			} else {
 				// Remove the original file after successful copy
 				if err := os.Remove(srcPath); err != nil {
@@ -343,7 +568,12 @@ func HandleOldData(logger *log.Logger) {
 		}
 	}
 
+	if failed > 0 {
+		return fmt.Errorf("%d entries could not be moved to %s", failed, oldDir)
+	}
+
 	logger.Println("All old data has been moved to " + oldDir + ". When logging in to old account, the migration will be started.\n")
+	return nil
 }
 
 // CopyFile copies a file from src to dst
@@ -0,0 +1,517 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// EXIF data of uploaded images. The location and the capture time are offered
+// to the user (as pin and date), they are never stored unencrypted. If the
+// user wants it, the metadata is removed from JPEG and PNG images before they
+// are stored. Only the orientation is kept, otherwise the image is shown rotated.
+
+// ImageMetadata is the EXIF data of an image that is relevant for the user
+type ImageMetadata struct {
+	HasLocation bool
+	Lat         float64
+	Lon         float64
+	// CaptureTime is the local time of the camera (the time zone is unknown)
+	CaptureTime time.Time
+	Orientation int
+}
+
+// The EXIF data is expected at the beginning of the file
+const imageMetadataPeekSize = 256 * 1024
+
+var (
+	jpegSignature = []byte{0xFF, 0xD8}
+	pngSignature  = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+	exifHeader    = []byte("Exif\x00\x00")
+	xmpHeader     = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// InspectImage reads the EXIF data of an image while it is uploaded. The
+// returned reader returns the complete image, without metadata if strip is
+// set (JPEG and PNG only). Files that are no images (or have no EXIF data)
+// return nil metadata. The reader must be closed.
+func InspectImage(content io.Reader, strip bool) (io.ReadCloser, *ImageMetadata) {
+	buffered := bufio.NewReaderSize(content, imageMetadataPeekSize)
+	head, _ := buffered.Peek(imageMetadataPeekSize)
+
+	metadata := parseExif(findExif(head))
+
+	var stripper func(io.Reader, io.Writer, int) error
+	switch {
+	case bytes.HasPrefix(head, jpegSignature):
+		stripper = stripJPEGMetadata
+	case bytes.HasPrefix(head, pngSignature):
+		stripper = stripPNGMetadata
+	}
+
+	if !strip || stripper == nil {
+		return io.NopCloser(buffered), metadata
+	}
+
+	orientation := 1
+	if metadata != nil && metadata.Orientation > 1 {
+		orientation = metadata.Orientation
+	}
+
+	// The image is filtered while it is read
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(stripper(buffered, writer, orientation))
+	}()
+	return reader, metadata
+}
+
+// ReadImageOrientation returns the EXIF orientation of an image (1 if unknown)
+func ReadImageOrientation(content io.Reader) int {
+	head := make([]byte, imageMetadataPeekSize)
+	n, _ := io.ReadFull(content, head)
+
+	if metadata := parseExif(findExif(head[:n])); metadata != nil && metadata.Orientation > 0 {
+		return metadata.Orientation
+	}
+	return 1
+}
+
+// findExif returns the TIFF data of the EXIF data at the beginning of an image
+func findExif(head []byte) []byte {
+	switch {
+	case bytes.HasPrefix(head, jpegSignature):
+		return findJPEGExif(head)
+	case bytes.HasPrefix(head, pngSignature):
+		return findPNGExif(head)
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return findWebPExif(head)
+	}
+	return nil
+}
+
+// findJPEGExif returns the TIFF data of the EXIF segment (APP1) of a JPEG
+func findJPEGExif(data []byte) []byte {
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil
+		}
+		marker := data[pos+1]
+		// Padding and markers without length
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2
+			continue
+		}
+		// Start of scan, the metadata comes before
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, exifHeader) {
+			return segment[len(exifHeader):]
+		}
+		pos += 2 + length
+	}
+	return nil
+}
+
+// findPNGExif returns the TIFF data of the eXIf chunk of a PNG
+func findPNGExif(data []byte) []byte {
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) {
+			return nil
+		}
+		if chunkType == "eXIf" {
+			return data[pos+8 : pos+8+length]
+		}
+		if chunkType == "IEND" {
+			return nil
+		}
+		pos += 12 + length
+	}
+	return nil
+}
+
+// findWebPExif returns the TIFF data of the EXIF chunk of a WebP
+func findWebPExif(data []byte) []byte {
+	pos := 12
+	for pos+8 <= len(data) {
+		chunkType := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if length < 0 || pos+8+length > len(data) {
+			return nil
+		}
+		if chunkType == "EXIF" {
+			// Some writers include the header of the JPEG segment
+			return bytes.TrimPrefix(data[pos+8:pos+8+length], exifHeader)
+		}
+		// Chunks are padded to an even size
+		pos += 8 + length + length%2
+	}
+	return nil
+}
+
+// EXIF tags that are read
+const (
+	tagOrientation       = 0x0112
+	tagDateTime          = 0x0132
+	tagExifIFD           = 0x8769
+	tagGPSIFD            = 0x8825
+	tagDateTimeOriginal  = 0x9003
+	tagDateTimeDigitized = 0x9004
+	tagGPSLatitudeRef    = 0x0001
+	tagGPSLatitude       = 0x0002
+	tagGPSLongitudeRef   = 0x0003
+	tagGPSLongitude      = 0x0004
+)
+
+// tiffReader reads the entries of the IFDs of TIFF data
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ifdEntry is an entry of an IFD, value contains the raw value bytes
+type ifdEntry struct {
+	valueType uint16
+	count     int
+	value     []byte
+}
+
+// typeSizes are the sizes of the value types of TIFF entries
+var typeSizes = map[uint16]int{
+	1: 1, // BYTE
+	2: 1, // ASCII
+	3: 2, // SHORT
+	4: 4, // LONG
+	5: 8, // RATIONAL
+	7: 1, // UNDEFINED
+	9: 4, // SLONG
+}
+
+// readIFD returns the entries of the IFD at offset
+func (t *tiffReader) readIFD(offset int) map[uint16]ifdEntry {
+	entries := map[uint16]ifdEntry{}
+	if offset < 8 || offset+2 > len(t.data) {
+		return entries
+	}
+
+	count := int(t.order.Uint16(t.data[offset:]))
+	for i := range count {
+		pos := offset + 2 + i*12
+		if pos+12 > len(t.data) {
+			break
+		}
+
+		tag := t.order.Uint16(t.data[pos:])
+		valueType := t.order.Uint16(t.data[pos+2:])
+		valueCount := int(t.order.Uint32(t.data[pos+4:]))
+		size, ok := typeSizes[valueType]
+		if !ok || valueCount <= 0 || valueCount > len(t.data) {
+			continue
+		}
+
+		// Small values are stored in the entry itself
+		length := size * valueCount
+		valuePos := pos + 8
+		if length > 4 {
+			valuePos = int(t.order.Uint32(t.data[pos+8:]))
+		}
+		if valuePos < 0 || valuePos+length > len(t.data) {
+			continue
+		}
+
+		entries[tag] = ifdEntry{valueType: valueType, count: valueCount, value: t.data[valuePos : valuePos+length]}
+	}
+	return entries
+}
+
+// uint returns the first value of a SHORT or LONG entry
+func (t *tiffReader) uint(entry ifdEntry) (int, bool) {
+	switch entry.valueType {
+	case 3:
+		return int(t.order.Uint16(entry.value)), true
+	case 4:
+		return int(t.order.Uint32(entry.value)), true
+	}
+	return 0, false
+}
+
+// string returns the value of an ASCII entry
+func (t *tiffReader) string(entry ifdEntry) string {
+	if entry.valueType != 2 {
+		return ""
+	}
+	return strings.TrimRight(string(entry.value), "\x00 ")
+}
+
+// rationals returns the values of a RATIONAL entry
+func (t *tiffReader) rationals(entry ifdEntry) []float64 {
+	if entry.valueType != 5 {
+		return nil
+	}
+	values := make([]float64, entry.count)
+	for i := range values {
+		numerator := t.order.Uint32(entry.value[i*8:])
+		denominator := t.order.Uint32(entry.value[i*8+4:])
+		if denominator == 0 {
+			return nil
+		}
+		values[i] = float64(numerator) / float64(denominator)
+	}
+	return values
+}
+
+// parseExif reads the relevant values of EXIF (TIFF) data. Returns nil if
+// there is nothing of interest.
+func parseExif(data []byte) *ImageMetadata {
+	if len(data) < 8 {
+		return nil
+	}
+
+	t := &tiffReader{data: data}
+	switch string(data[0:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil
+	}
+
+	metadata := &ImageMetadata{}
+	ifd0 := t.readIFD(int(t.order.Uint32(data[4:])))
+
+	if entry, ok := ifd0[tagOrientation]; ok {
+		if orientation, ok := t.uint(entry); ok && orientation >= 1 && orientation <= 8 {
+			metadata.Orientation = orientation
+		}
+	}
+
+	// The capture time, the modification time is only the fallback
+	var captureTimes []string
+	if entry, ok := ifd0[tagExifIFD]; ok {
+		if offset, ok := t.uint(entry); ok {
+			exifIFD := t.readIFD(offset)
+			captureTimes = append(captureTimes, t.string(exifIFD[tagDateTimeOriginal]), t.string(exifIFD[tagDateTimeDigitized]))
+		}
+	}
+	captureTimes = append(captureTimes, t.string(ifd0[tagDateTime]))
+	for _, value := range captureTimes {
+		captureTime, err := time.Parse("2006:01:02 15:04:05", value)
+		if err == nil && captureTime.Year() > 1900 {
+			metadata.CaptureTime = captureTime
+			break
+		}
+	}
+
+	// The location
+	if entry, ok := ifd0[tagGPSIFD]; ok {
+		if offset, ok := t.uint(entry); ok {
+			gpsIFD := t.readIFD(offset)
+			lat, latOk := gpsCoordinate(t.rationals(gpsIFD[tagGPSLatitude]), t.string(gpsIFD[tagGPSLatitudeRef]))
+			lon, lonOk := gpsCoordinate(t.rationals(gpsIFD[tagGPSLongitude]), t.string(gpsIFD[tagGPSLongitudeRef]))
+			// 0,0 is written by some cameras without a GPS fix
+			if latOk && lonOk && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 && (lat != 0 || lon != 0) {
+				metadata.HasLocation = true
+				metadata.Lat = lat
+				metadata.Lon = lon
+			}
+		}
+	}
+
+	if metadata.Orientation == 0 && metadata.CaptureTime.IsZero() && !metadata.HasLocation {
+		return nil
+	}
+	return metadata
+}
+
+// gpsCoordinate converts degrees, minutes and seconds to a coordinate
+func gpsCoordinate(values []float64, ref string) (float64, bool) {
+	if len(values) != 3 {
+		return 0, false
+	}
+	coordinate := values[0] + values[1]/60 + values[2]/3600
+	if ref == "S" || ref == "W" {
+		coordinate = -coordinate
+	}
+	return coordinate, !math.IsNaN(coordinate) && !math.IsInf(coordinate, 0)
+}
+
+// orientationExif returns TIFF data that only contains the orientation
+func orientationExif(orientation int) []byte {
+	return []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // header, IFD0 at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // orientation, SHORT
+		0, 0, 0, 0, // no next IFD
+	}
+}
+
+// stripJPEGMetadata copies a JPEG without the EXIF, XMP and IPTC segments.
+// The image data after the first scan is copied unchanged.
+func stripJPEGMetadata(r io.Reader, w io.Writer, orientation int) error {
+	buffered := bufio.NewReader(r)
+
+	signature := make([]byte, 2)
+	if _, err := io.ReadFull(buffered, signature); err != nil {
+		return err
+	}
+	if _, err := w.Write(signature); err != nil {
+		return err
+	}
+
+	// Keep the orientation
+	if orientation > 1 {
+		exif := append(append([]byte{}, exifHeader...), orientationExif(orientation)...)
+		segment := append([]byte{0xFF, 0xE1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)}, exif...)
+		if _, err := w.Write(segment); err != nil {
+			return err
+		}
+	}
+
+	for {
+		marker, err := buffered.Peek(2)
+		if err != nil {
+			// Truncated file, it is stored as it is
+			_, err = io.Copy(w, buffered)
+			return err
+		}
+		if marker[0] != 0xFF || marker[1] == 0xDA || marker[1] == 0xD9 {
+			break
+		}
+		if marker[1] == 0xFF {
+			if _, err := buffered.Discard(1); err != nil {
+				return err
+			}
+			continue
+		}
+		if marker[1] == 0x01 || (marker[1] >= 0xD0 && marker[1] <= 0xD7) {
+			if _, err := io.CopyN(w, buffered, 2); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header, err := buffered.Peek(4)
+		if err != nil {
+			_, err = io.Copy(w, buffered)
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return fmt.Errorf("invalid JPEG segment length %d", length)
+		}
+
+		segment := make([]byte, 2+length)
+		if _, err := io.ReadFull(buffered, segment); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		// EXIF and XMP (APP1), IPTC (APP13)
+		data := segment[4:]
+		if (segment[1] == 0xE1 && (bytes.HasPrefix(data, exifHeader) || bytes.HasPrefix(data, xmpHeader))) || segment[1] == 0xED {
+			continue
+		}
+		if _, err := w.Write(segment); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.Copy(w, buffered)
+	return err
+}
+
+// pngMetadataChunks are the chunks of a PNG that are removed
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata copies a PNG without the EXIF and text chunks
+func stripPNGMetadata(r io.Reader, w io.Writer, orientation int) error {
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return err
+	}
+	if _, err := w.Write(signature); err != nil {
+		return err
+	}
+
+	orientationWritten := orientation <= 1
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		chunkType := string(header[4:8])
+
+		if pngMetadataChunks[chunkType] {
+			if _, err := io.CopyN(io.Discard, r, length+4); err != nil {
+				return nil
+			}
+			continue
+		}
+
+		// Keep the orientation (before the image data)
+		if !orientationWritten && chunkType == "IDAT" {
+			if err := writePNGChunk(w, "eXIf", orientationExif(orientation)); err != nil {
+				return err
+			}
+			orientationWritten = true
+		}
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, length+4); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// writePNGChunk writes a chunk with its checksum
+func writePNGChunk(w io.Writer, chunkType string, data []byte) error {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	_, err := w.Write(chunk)
+	return err
+}
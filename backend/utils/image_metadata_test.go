@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// tiffByteOrder is binary.LittleEndian or binary.BigEndian
+type tiffByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// testTIFFEntry is an entry of an IFD built by buildTIFF
+type testTIFFEntry struct {
+	tag       uint16
+	valueType uint16
+	count     int
+	value     []byte
+}
+
+func asciiEntry(tag uint16, value string) testTIFFEntry {
+	return testTIFFEntry{tag: tag, valueType: 2, count: len(value) + 1, value: append([]byte(value), 0)}
+}
+
+func shortEntry(order tiffByteOrder, tag uint16, value uint16) testTIFFEntry {
+	return testTIFFEntry{tag: tag, valueType: 3, count: 1, value: order.AppendUint16(nil, value)}
+}
+
+func rationalEntry(order tiffByteOrder, tag uint16, values ...[2]uint32) testTIFFEntry {
+	var value []byte
+	for _, v := range values {
+		value = order.AppendUint32(value, v[0])
+		value = order.AppendUint32(value, v[1])
+	}
+	return testTIFFEntry{tag: tag, valueType: 5, count: len(values), value: value}
+}
+
+// buildTIFF returns TIFF data with IFD0 and (if not nil) the EXIF and GPS IFDs
+func buildTIFF(order tiffByteOrder, ifd0, exif, gps []testTIFFEntry) []byte {
+	ifdSize := func(entries []testTIFFEntry) int { return 2 + 12*len(entries) + 4 }
+
+	// IFD0 contains the offsets of the other IFDs
+	ifd0 = append([]testTIFFEntry{}, ifd0...)
+	if exif != nil {
+		ifd0 = append(ifd0, testTIFFEntry{tag: tagExifIFD, valueType: 4, count: 1})
+	}
+	if gps != nil {
+		ifd0 = append(ifd0, testTIFFEntry{tag: tagGPSIFD, valueType: 4, count: 1})
+	}
+	exifOffset := 8 + ifdSize(ifd0)
+	gpsOffset := exifOffset
+	if exif != nil {
+		gpsOffset += ifdSize(exif)
+	}
+	dataOffset := gpsOffset
+	if gps != nil {
+		dataOffset += ifdSize(gps)
+	}
+	for i := range ifd0 {
+		switch ifd0[i].tag {
+		case tagExifIFD:
+			ifd0[i].value = order.AppendUint32(nil, uint32(exifOffset))
+		case tagGPSIFD:
+			ifd0[i].value = order.AppendUint32(nil, uint32(gpsOffset))
+		}
+	}
+
+	var data []byte
+	if order == binary.LittleEndian {
+		data = append(data, 'I', 'I')
+	} else {
+		data = append(data, 'M', 'M')
+	}
+	data = order.AppendUint16(data, 42)
+	data = order.AppendUint32(data, 8)
+
+	// Values larger than 4 bytes are stored after the IFDs
+	var values []byte
+	for _, entries := range [][]testTIFFEntry{ifd0, exif, gps} {
+		if entries == nil {
+			continue
+		}
+		data = order.AppendUint16(data, uint16(len(entries)))
+		for _, entry := range entries {
+			data = order.AppendUint16(data, entry.tag)
+			data = order.AppendUint16(data, entry.valueType)
+			data = order.AppendUint32(data, uint32(entry.count))
+			if len(entry.value) > 4 {
+				data = order.AppendUint32(data, uint32(dataOffset+len(values)))
+				values = append(values, entry.value...)
+			} else {
+				data = append(data, entry.value...)
+				data = append(data, make([]byte, 4-len(entry.value))...)
+			}
+		}
+		data = order.AppendUint32(data, 0)
+	}
+
+	return append(data, values...)
+}
+
+// testGPS returns a GPS IFD for 48°8'15" N/S and 11°34'30" E/W
+func testGPS(order tiffByteOrder, latRef, lonRef string) []testTIFFEntry {
+	return []testTIFFEntry{
+		asciiEntry(tagGPSLatitudeRef, latRef),
+		rationalEntry(order, tagGPSLatitude, [2]uint32{48, 1}, [2]uint32{8, 1}, [2]uint32{1500, 100}),
+		asciiEntry(tagGPSLongitudeRef, lonRef),
+		rationalEntry(order, tagGPSLongitude, [2]uint32{11, 1}, [2]uint32{34, 1}, [2]uint32{30, 1}),
+	}
+}
+
+func TestParseExif(t *testing.T) {
+	const lat, lon = 48 + 8.0/60 + 15.0/3600, 11 + 34.0/60 + 30.0/3600
+	captured := time.Date(2024, 4, 3, 18, 30, 5, 0, time.UTC)
+
+	for _, order := range []tiffByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, tc := range []struct {
+			name string
+			data []byte
+			want *ImageMetadata
+		}{
+			{
+				name: "all values",
+				data: buildTIFF(order,
+					[]testTIFFEntry{shortEntry(order, tagOrientation, 6), asciiEntry(tagDateTime, "2025:01:01 00:00:00")},
+					[]testTIFFEntry{asciiEntry(tagDateTimeOriginal, "2024:04:03 18:30:05")},
+					testGPS(order, "N", "E")),
+				want: &ImageMetadata{HasLocation: true, Lat: lat, Lon: lon, CaptureTime: captured, Orientation: 6},
+			},
+			{
+				name: "south west",
+				data: buildTIFF(order, nil, nil, testGPS(order, "S", "W")),
+				want: &ImageMetadata{HasLocation: true, Lat: -lat, Lon: -lon},
+			},
+			{
+				name: "digitized time",
+				data: buildTIFF(order, nil, []testTIFFEntry{asciiEntry(tagDateTimeDigitized, "2024:04:03 18:30:05")}, nil),
+				want: &ImageMetadata{CaptureTime: captured},
+			},
+			{
+				name: "modification time as fallback",
+				data: buildTIFF(order,
+					[]testTIFFEntry{asciiEntry(tagDateTime, "2024:04:03 18:30:05")},
+					[]testTIFFEntry{asciiEntry(tagDateTimeOriginal, "0000:00:00 00:00:00")}, nil),
+				want: &ImageMetadata{CaptureTime: captured},
+			},
+			{
+				name: "no GPS fix",
+				data: buildTIFF(order, nil, nil, []testTIFFEntry{
+					asciiEntry(tagGPSLatitudeRef, "N"),
+					rationalEntry(order, tagGPSLatitude, [2]uint32{0, 1}, [2]uint32{0, 1}, [2]uint32{0, 1}),
+					asciiEntry(tagGPSLongitudeRef, "E"),
+					rationalEntry(order, tagGPSLongitude, [2]uint32{0, 1}, [2]uint32{0, 1}, [2]uint32{0, 1}),
+				}),
+				want: nil,
+			},
+			{
+				name: "zero denominator",
+				data: buildTIFF(order, []testTIFFEntry{shortEntry(order, tagOrientation, 3)}, nil, []testTIFFEntry{
+					rationalEntry(order, tagGPSLatitude, [2]uint32{48, 0}, [2]uint32{8, 1}, [2]uint32{15, 1}),
+					rationalEntry(order, tagGPSLongitude, [2]uint32{11, 1}, [2]uint32{34, 1}, [2]uint32{30, 1}),
+				}),
+				want: &ImageMetadata{Orientation: 3},
+			},
+			{
+				name: "latitude out of range",
+				data: buildTIFF(order, nil, nil, []testTIFFEntry{
+					rationalEntry(order, tagGPSLatitude, [2]uint32{91, 1}, [2]uint32{0, 1}, [2]uint32{0, 1}),
+					rationalEntry(order, tagGPSLongitude, [2]uint32{11, 1}, [2]uint32{34, 1}, [2]uint32{30, 1}),
+				}),
+				want: nil,
+			},
+			{
+				name: "invalid orientation",
+				data: buildTIFF(order, []testTIFFEntry{shortEntry(order, tagOrientation, 9)}, nil, nil),
+				want: nil,
+			},
+			{
+				name: "value outside of the data",
+				data: buildTIFF(order, []testTIFFEntry{{tag: tagDateTime, valueType: 2, count: 20, value: order.AppendUint32(nil, 1<<20)}}, nil, nil),
+				want: nil,
+			},
+		} {
+			t.Run(order.String()+"/"+tc.name, func(t *testing.T) {
+				got := parseExif(tc.data)
+				if (got == nil) != (tc.want == nil) {
+					t.Fatalf("metadata = %+v, want %+v", got, tc.want)
+				}
+				if got == nil {
+					return
+				}
+				if got.Orientation != tc.want.Orientation || !got.CaptureTime.Equal(tc.want.CaptureTime) || got.HasLocation != tc.want.HasLocation ||
+					math.Abs(got.Lat-tc.want.Lat) > 1e-9 || math.Abs(got.Lon-tc.want.Lon) > 1e-9 {
+					t.Errorf("metadata = %+v, want %+v", got, tc.want)
+				}
+			})
+		}
+	}
+}
+
+func TestParseExifInvalidHeader(t *testing.T) {
+	valid := buildTIFF(binary.BigEndian, []testTIFFEntry{shortEntry(binary.BigEndian, tagOrientation, 6)}, nil, nil)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "too short", data: valid[:7]},
+		{name: "byte order", data: append([]byte("XX"), valid[2:]...)},
+		{name: "magic number", data: append([]byte{'M', 'M', 0, 43}, valid[4:]...)},
+		{name: "IFD offset", data: append(append([]byte{}, valid[:4]...), append([]byte{0xFF, 0xFF, 0xFF, 0xF0}, valid[8:]...)...)},
+		{name: "truncated IFD", data: valid[:12]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseExif(tc.data); got != nil {
+				t.Errorf("metadata = %+v, want nil", got)
+			}
+		})
+	}
+}
+
+// testImages returns the TIFF data in a JPEG, PNG and WebP
+func testImages(tiff []byte) map[string][]byte {
+	exif := append(append([]byte{}, exifHeader...), tiff...)
+
+	jpeg := append([]byte{}, jpegSignature...)
+	jpeg = append(jpeg, 0xFF, 0xE0, 0, 4, 'J', 'F') // APP0 before the EXIF data
+	jpeg = append(jpeg, 0xFF, 0xE1, byte((len(exif)+2)>>8), byte(len(exif)+2))
+	jpeg = append(jpeg, exif...)
+	jpeg = append(jpeg, 0xFF, 0xDA, 0, 2, 1, 2, 3, 0xFF, 0xD9)
+
+	png := append([]byte{}, pngSignature...)
+	png = binary.BigEndian.AppendUint32(png, 0)
+	png = append(png, "IHDR"...)
+	png = append(png, 0, 0, 0, 0)
+	png = binary.BigEndian.AppendUint32(png, uint32(len(tiff)))
+	png = append(png, "eXIf"...)
+	png = append(png, tiff...)
+	png = append(png, 0, 0, 0, 0)
+	png = append(png, 0, 0, 0, 1, 'I', 'D', 'A', 'T', 1, 0, 0, 0, 0)
+	png = append(png, 0, 0, 0, 0, 'I', 'E', 'N', 'D', 0, 0, 0, 0)
+
+	webp := []byte("RIFF\x00\x00\x00\x00WEBP")
+	webp = append(webp, "VP8 "...)
+	webp = binary.LittleEndian.AppendUint32(webp, 3)
+	webp = append(webp, 1, 2, 3, 0) // padded to an even size
+	webp = append(webp, "EXIF"...)
+	webp = binary.LittleEndian.AppendUint32(webp, uint32(len(exif)))
+	webp = append(webp, exif...)
+
+	return map[string][]byte{"jpeg": jpeg, "png": png, "webp": webp}
+}
+
+func TestFindExif(t *testing.T) {
+	tiff := buildTIFF(binary.LittleEndian, []testTIFFEntry{shortEntry(binary.LittleEndian, tagOrientation, 8)}, nil, nil)
+
+	for name, image := range testImages(tiff) {
+		t.Run(name, func(t *testing.T) {
+			if got := findExif(image); !bytes.Equal(got, tiff) {
+				t.Errorf("EXIF data = %x, want %x", got, tiff)
+			}
+			if got := ReadImageOrientation(bytes.NewReader(image)); got != 8 {
+				t.Errorf("orientation = %d, want 8", got)
+			}
+			// Cut off within the EXIF data
+			truncated := image[:bytes.Index(image, tiff)+len(tiff)/2]
+			if got := findExif(truncated); got != nil {
+				t.Errorf("EXIF data of a truncated image = %x, want nil", got)
+			}
+		})
+	}
+
+	if got := findExif([]byte("GIF89a")); got != nil {
+		t.Errorf("EXIF data of a GIF = %x, want nil", got)
+	}
+}
+
+func TestInspectImageStripsMetadata(t *testing.T) {
+	var order tiffByteOrder = binary.BigEndian
+	tiff := buildTIFF(order, []testTIFFEntry{shortEntry(order, tagOrientation, 6)}, nil, testGPS(order, "N", "E"))
+
+	for name, image := range testImages(tiff) {
+		if name == "webp" {
+			// WebP images are stored as they are
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			reader, metadata := InspectImage(bytes.NewReader(image), true)
+			stripped, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("reading stripped image: %v", err)
+			}
+
+			if metadata == nil || !metadata.HasLocation || metadata.Orientation != 6 {
+				t.Errorf("metadata = %+v, want location and orientation 6", metadata)
+			}
+			// Only the orientation is kept
+			kept := parseExif(findExif(stripped))
+			if kept == nil || kept.HasLocation || kept.Orientation != 6 {
+				t.Errorf("metadata of the stripped image = %+v, want orientation 6 only", kept)
+			}
+		})
+	}
+
+	// Without strip the image is unchanged
+	image := testImages(tiff)["jpeg"]
+	reader, _ := InspectImage(bytes.NewReader(image), false)
+	defer reader.Close()
+	if content, _ := io.ReadAll(reader); !bytes.Equal(content, image) {
+		t.Errorf("image was changed without strip")
+	}
+}
+
+func FuzzParseExif(f *testing.F) {
+	for _, order := range []tiffByteOrder{binary.LittleEndian, binary.BigEndian} {
+		tiff := buildTIFF(order,
+			[]testTIFFEntry{shortEntry(order, tagOrientation, 6), asciiEntry(tagDateTime, "2024:04:03 18:30:05")},
+			[]testTIFFEntry{asciiEntry(tagDateTimeOriginal, "2024:04:03 18:30:05")},
+			testGPS(order, "N", "E"))
+		f.Add(tiff)
+		for _, image := range testImages(tiff) {
+			f.Add(image)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, metadata := range []*ImageMetadata{parseExif(data), parseExif(findExif(data))} {
+			if metadata == nil {
+				continue
+			}
+			if metadata.Orientation < 0 || metadata.Orientation > 8 {
+				t.Errorf("orientation %d out of range", metadata.Orientation)
+			}
+			if metadata.HasLocation && (math.Abs(metadata.Lat) > 90 || math.Abs(metadata.Lon) > 180) {
+				t.Errorf("location %f,%f out of range", metadata.Lat, metadata.Lon)
+			}
+		}
+	})
+}
@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Types of the problems found by CheckIntegrity
+const (
+	IssueUnreadableMonth  = "unreadable_month"  // month can't be read or decoded
+	IssueDecryptionFailed = "decryption_failed" // value can't be decrypted with the key of the user
+	IssueDanglingFile     = "dangling_file"     // file of a day has no blob
+	IssueOrphanedBlob     = "orphaned_blob"     // blob is not referenced by any day
+	IssueDuplicatePinID   = "duplicate_pin_id"  // two pins of a day have the same id
+)
+
+// IntegrityIssue is a single problem found by CheckIntegrity
+type IntegrityIssue struct {
+	Type     string `json:"type"`
+	Year     int    `json:"year,omitempty"`
+	Month    int    `json:"month,omitempty"`
+	Day      int    `json:"day,omitempty"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+// IntegrityReport is the result of CheckIntegrity
+type IntegrityReport struct {
+	UserID        int              `json:"user_id"`
+	MonthsChecked int              `json:"months_checked"`
+	DaysChecked   int              `json:"days_checked"`
+	FilesChecked  int              `json:"files_checked"`
+	Decrypted     bool             `json:"decrypted"`
+	Repair        bool             `json:"repair"`
+	Issues        []IntegrityIssue `json:"issues"`
+}
+
+func (r *IntegrityReport) add(issue IntegrityIssue) {
+	r.Issues = append(r.Issues, issue)
+}
+
+// CheckIntegrity checks the months and files of a user.
+//
+// Without encKey (admin CLI) the encrypted values are not checked. With repair,
+// dangling file references are removed from the days, duplicate pin ids are
+// renumbered and orphaned blobs that were unreferenced for the grace period of
+// the garbage collection of files are quarantined (unless a month is
+// unreadable, its files are unknown). Unreadable months and values that fail to decrypt are
+// only reported, there is nothing to repair them with.
+//
+// The caller must hold the logs lock of the user.
+func CheckIntegrity(userID int, encKey string, repair bool) (*IntegrityReport, error) {
+	report := &IntegrityReport{
+		UserID:    userID,
+		Decrypted: encKey != "",
+		Repair:    repair,
+		Issues:    []IntegrityIssue{},
+	}
+
+	// All stored files of the user
+	blobs, err := ListFiles(userID)
+	if err != nil {
+		return nil, err
+	}
+	blobExists := map[string]bool{}
+	for _, uuid := range blobs {
+		blobExists[uuid] = true
+	}
+	referenced := map[string]bool{}
+	unreadableMonths := 0
+
+	years, err := GetYears(userID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(years)
+
+	for _, year := range years {
+		yearInt, _ := strconv.Atoi(year)
+		months, err := GetMonths(userID, year)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(months)
+
+		for _, month := range months {
+			monthInt, err := strconv.Atoi(month)
+			if err != nil {
+				continue
+			}
+			report.MonthsChecked++
+
+			content, err := ReadMonth(userID, yearInt, monthInt)
+			if err != nil {
+				report.add(IntegrityIssue{Type: IssueUnreadableMonth, Year: yearInt, Month: monthInt, Detail: err.Error()})
+				unreadableMonths++
+				continue
+			}
+
+			if checkMonth(report, content, yearInt, monthInt, encKey, blobExists, referenced, repair) {
+				if err := SaveMonth(userID, yearInt, monthInt, content); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// Blobs without a day. They may belong to an upload that is not attached
+	// to its day yet, so they are handed to the garbage collection of files,
+	// which quarantines them after the grace period.
+	report.FilesChecked = len(blobs)
+	quarantined := map[string]bool{}
+	if repair && unreadableMonths == 0 {
+		quarantined, err = QuarantineOrphanedFiles(userID, blobs, referenced)
+		if err != nil {
+			Logger.Printf("Error quarantining orphaned files of user %d: %v", userID, err)
+			quarantined = map[string]bool{}
+		}
+	}
+	for _, uuid := range blobs {
+		if referenced[uuid] {
+			continue
+		}
+		report.add(IntegrityIssue{Type: IssueOrphanedBlob, Detail: uuid, Repaired: quarantined[uuid]})
+	}
+
+	return report, nil
+}
+
+// checkMonth checks the days of a month and collects the referenced files.
+// Returns true if the month was repaired and must be saved.
+func checkMonth(report *IntegrityReport, m *Month, year, month int, encKey string, blobExists, referenced map[string]bool, repair bool) bool {
+	modified := false
+
+	for i := range m.Days {
+		day := &m.Days[i]
+		report.DaysChecked++
+
+		issueAt := func(issueType, detail string) IntegrityIssue {
+			return IntegrityIssue{Type: issueType, Year: year, Month: month, Day: day.Day, Detail: detail}
+		}
+
+		// Encrypted values
+		if encKey != "" {
+			type encryptedValue struct{ name, value string }
+			values := []encryptedValue{{"text", day.Text}, {"date_written", day.DateWritten}}
+			for _, h := range day.History {
+				values = append(values,
+					encryptedValue{fmt.Sprintf("history version %d text", h.Version), h.Text},
+					encryptedValue{fmt.Sprintf("history version %d date_written", h.Version), h.DateWritten})
+			}
+			for _, file := range day.Files {
+				values = append(values, encryptedValue{"filename of " + file.UUIDFilename, file.EncFilename})
+			}
+			for _, pin := range day.Pins {
+				values = append(values,
+					encryptedValue{fmt.Sprintf("pin %d latitude", pin.ID), pin.Lat},
+					encryptedValue{fmt.Sprintf("pin %d longitude", pin.ID), pin.Lon},
+					encryptedValue{fmt.Sprintf("pin %d text", pin.ID), pin.Text})
+			}
+
+			for _, v := range values {
+				if v.value == "" {
+					continue
+				}
+				if _, err := DecryptText(v.value, encKey); err != nil {
+					report.add(issueAt(IssueDecryptionFailed, fmt.Sprintf("%s: %v", v.name, err)))
+				}
+			}
+		}
+
+		// Files
+		files := day.Files[:0]
+		for _, file := range day.Files {
+			referenced[file.UUIDFilename] = true
+
+			// Missing thumbnails are removed from the file, it is shown without them
+			thumbnails := file.Thumbnails[:0]
+			for _, size := range file.Thumbnails {
+				thumbnail := ThumbnailUUID(file.UUIDFilename, size)
+				referenced[thumbnail] = true
+				if blobExists[thumbnail] {
+					thumbnails = append(thumbnails, size)
+					continue
+				}
+
+				issue := issueAt(IssueDanglingFile, thumbnail)
+				if repair {
+					issue.Repaired = true
+					modified = true
+				} else {
+					thumbnails = append(thumbnails, size)
+				}
+				report.add(issue)
+			}
+			file.Thumbnails = thumbnails
+
+			if blobExists[file.UUIDFilename] {
+				files = append(files, file)
+				continue
+			}
+
+			issue := issueAt(IssueDanglingFile, file.UUIDFilename)
+			if repair {
+				issue.Repaired = true
+				modified = true
+			} else {
+				files = append(files, file)
+			}
+			report.add(issue)
+		}
+		day.Files = files
+
+		// Pins
+		seen := map[int]bool{}
+		var duplicates []*Pin
+		for j := range day.Pins {
+			pin := &day.Pins[j]
+			if seen[pin.ID] {
+				duplicates = append(duplicates, pin)
+				continue
+			}
+			seen[pin.ID] = true
+		}
+		for _, pin := range duplicates {
+			issue := issueAt(IssueDuplicatePinID, strconv.Itoa(pin.ID))
+			if repair {
+				pin.ID = day.NextPinID()
+				issue.Repaired = true
+				modified = true
+			}
+			report.add(issue)
+		}
+	}
+
+	return modified
+}
@@ -0,0 +1,59 @@
+package utils
+
+import "testing"
+
+// newIntegrityTestStore uses a file store in a temporary DATA_PATH
+func newIntegrityTestStore(t *testing.T) {
+	t.Helper()
+
+	previousStore, previousPath, previousBackend, previousGrace := DataStore, Settings.DataPath, Settings.StorageBackend, Settings.FilesGCGrace
+	Settings.DataPath = t.TempDir()
+	Settings.StorageBackend = "file"
+	DataStore = NewFileStore(Settings.DataPath, NewLocalBlobStore(Settings.DataPath))
+	t.Cleanup(func() {
+		DataStore, Settings.DataPath, Settings.StorageBackend, Settings.FilesGCGrace = previousStore, previousPath, previousBackend, previousGrace
+	})
+}
+
+func TestCheckIntegrityKeepsNewOrphanedFiles(t *testing.T) {
+	newIntegrityTestStore(t)
+	Settings.FilesGCGrace = 24
+
+	// A file of an upload that is not attached to its day yet
+	const uuid = "01890a5d-ac96-774b-bcce-b302099a8057"
+	if err := WriteFile([]byte("content"), 1, uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := CheckIntegrity(1, "", true)
+	if err != nil {
+		t.Fatalf("checking integrity: %v", err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Type != IssueOrphanedBlob || report.Issues[0].Repaired {
+		t.Fatalf("issues = %+v, want one orphaned file that is not repaired", report.Issues)
+	}
+	if _, err := ReadFile(1, uuid); err != nil {
+		t.Fatalf("the new file was removed by the repair: %v", err)
+	}
+
+	// After the grace period, the file is quarantined (not deleted)
+	Settings.FilesGCGrace = 0
+	report, err = CheckIntegrity(1, "", true)
+	if err != nil {
+		t.Fatalf("checking integrity: %v", err)
+	}
+	if len(report.Issues) != 1 || !report.Issues[0].Repaired {
+		t.Fatalf("issues = %+v, want one repaired orphaned file", report.Issues)
+	}
+	if files, _ := ListFiles(1); len(files) != 0 {
+		t.Errorf("files after the repair = %v, want none", files)
+	}
+
+	state, err := readFilesGCState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Quarantine[1][uuid]; !ok {
+		t.Error("the quarantined file is not known to the garbage collection")
+	}
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The tokens are signed with the keys of a key ring in jwt_keys.json, which is
+// created on the first start. Every token names its key in the "kid" header.
+// Rotating adds a new signing key, the previous keys stay valid for
+// LOGOUT_AFTER_DAYS (until the last token signed with them expired).
+//
+// Tokens of older versions have no "kid" header. They were signed with
+// SECRET_TOKEN, which is still accepted for them if it is set.
+
+const jwtKeysFilename = "jwt_keys.json"
+
+// JWTKey is a signing key of the key ring
+type JWTKey struct {
+	ID      string `json:"kid"`
+	Secret  string `json:"secret"`
+	Created string `json:"created"`
+	// Retired is set when the key was replaced by a newer key
+	Retired string `json:"retired,omitempty"`
+}
+
+// jwtKeyRing is the content of jwt_keys.json, the last key signs new tokens
+type jwtKeyRing struct {
+	Keys []JWTKey `json:"keys"`
+}
+
+var (
+	jwtKeys      *jwtKeyRing
+	jwtKeysMutex sync.RWMutex
+)
+
+// InitJWTKeys loads the key ring or creates it with a first key
+func InitJWTKeys() error {
+	jwtKeysMutex.Lock()
+	defer jwtKeysMutex.Unlock()
+
+	ring := &jwtKeyRing{}
+	data, err := os.ReadFile(filepath.Join(Settings.DataPath, jwtKeysFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading %s: %v", jwtKeysFilename, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, ring); err != nil {
+			return fmt.Errorf("error parsing %s: %v", jwtKeysFilename, err)
+		}
+	}
+
+	changed := ring.prune()
+	if len(ring.Keys) == 0 {
+		key, err := newJWTKey()
+		if err != nil {
+			return err
+		}
+		ring.Keys = append(ring.Keys, key)
+		changed = true
+		Logger.Printf("Created new signing key %s for the tokens", key.ID)
+	}
+
+	if changed {
+		if err := writeJWTKeys(ring); err != nil {
+			return err
+		}
+	}
+
+	jwtKeys = ring
+	return nil
+}
+
+// RotateJWTKey adds a new signing key. Returns the ID of the new key.
+func RotateJWTKey() (string, error) {
+	jwtKeysMutex.Lock()
+	defer jwtKeysMutex.Unlock()
+
+	key, err := newJWTKey()
+	if err != nil {
+		return "", err
+	}
+
+	ring := &jwtKeyRing{Keys: append([]JWTKey{}, jwtKeys.Keys...)}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for i := range ring.Keys {
+		if ring.Keys[i].Retired == "" {
+			ring.Keys[i].Retired = now
+		}
+	}
+	ring.Keys = append(ring.Keys, key)
+	ring.prune()
+
+	if err := writeJWTKeys(ring); err != nil {
+		return "", err
+	}
+
+	jwtKeys = ring
+	Logger.Printf("Rotated the signing key for the tokens, new key is %s", key.ID)
+	return key.ID, nil
+}
+
+// currentJWTKey returns the key that signs new tokens
+func currentJWTKey() JWTKey {
+	jwtKeysMutex.RLock()
+	defer jwtKeysMutex.RUnlock()
+
+	return jwtKeys.Keys[len(jwtKeys.Keys)-1]
+}
+
+// jwtKeyByID returns the secret of a key that is still valid
+func jwtKeyByID(kid string) ([]byte, error) {
+	jwtKeysMutex.RLock()
+	defer jwtKeysMutex.RUnlock()
+
+	for _, key := range jwtKeys.Keys {
+		if key.ID == kid && !key.expired() {
+			return base64.URLEncoding.DecodeString(key.Secret)
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %s", kid)
+}
+
+// GetJWTKeys returns the keys without their secrets, as shown to the admin
+func GetJWTKeys() []map[string]any {
+	jwtKeysMutex.RLock()
+	defer jwtKeysMutex.RUnlock()
+
+	keys := []map[string]any{}
+	for i, key := range jwtKeys.Keys {
+		keys = append(keys, map[string]any{
+			"kid":     key.ID,
+			"created": key.Created,
+			"retired": key.Retired,
+			"current": i == len(jwtKeys.Keys)-1,
+		})
+	}
+	return keys
+}
+
+func newJWTKey() (JWTKey, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return JWTKey{}, fmt.Errorf("error generating key id: %v", err)
+	}
+
+	return JWTKey{
+		ID:      hex.EncodeToString(id),
+		Secret:  GenerateSecretToken(),
+		Created: time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// expired checks if all tokens signed with a retired key have expired
+func (k JWTKey) expired() bool {
+	if k.Retired == "" {
+		return false
+	}
+	retired, err := time.Parse(time.RFC3339, k.Retired)
+	if err != nil {
+		return true
+	}
+	return time.Since(retired) > time.Duration(Settings.LogoutAfterDays)*24*time.Hour
+}
+
+// prune removes the expired keys. Returns true if keys were removed.
+func (r *jwtKeyRing) prune() bool {
+	keys := []JWTKey{}
+	for _, key := range r.Keys {
+		if !key.expired() {
+			keys = append(keys, key)
+		}
+	}
+
+	changed := len(keys) != len(r.Keys)
+	r.Keys = keys
+	return changed
+}
+
+// writeJWTKeys atomically writes jwt_keys.json, only readable by the owner
+func writeJWTKeys(ring *jwtKeyRing) error {
+	data, err := json.MarshalIndent(ring, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := createAtomicFile(filepath.Join(Settings.DataPath, jwtKeysFilename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Commit()
+}
@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newJWTKeysTestDir creates the key ring in a temporary DATA_PATH
+func newJWTKeysTestDir(t *testing.T) {
+	t.Helper()
+
+	previousPath, previousLogout, previousSecret := Settings.DataPath, Settings.LogoutAfterDays, Settings.SecretToken
+	jwtKeysMutex.RLock()
+	previousKeys := jwtKeys
+	jwtKeysMutex.RUnlock()
+	Settings.DataPath = t.TempDir()
+	Settings.LogoutAfterDays = 30
+	Settings.SecretToken = ""
+	t.Cleanup(func() {
+		Settings.DataPath, Settings.LogoutAfterDays, Settings.SecretToken = previousPath, previousLogout, previousSecret
+		jwtKeysMutex.Lock()
+		jwtKeys = previousKeys
+		jwtKeysMutex.Unlock()
+	})
+
+	if err := InitJWTKeys(); err != nil {
+		t.Fatalf("creating signing keys: %v", err)
+	}
+}
+
+func TestInitJWTKeys(t *testing.T) {
+	newJWTKeysTestDir(t)
+
+	first := currentJWTKey()
+	info, err := os.Stat(filepath.Join(Settings.DataPath, jwtKeysFilename))
+	if err != nil {
+		t.Fatalf("key ring not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("permissions of the key ring = %v, want 0600", info.Mode().Perm())
+	}
+
+	// A restart loads the same key
+	token, err := GenerateToken(1, "alice", "session", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InitJWTKeys(); err != nil {
+		t.Fatalf("loading signing keys: %v", err)
+	}
+	if key := currentJWTKey(); key != first {
+		t.Errorf("key after restart = %+v, want %+v", key, first)
+	}
+	if _, err := ValidateToken(token); err != nil {
+		t.Errorf("token from before the restart: %v", err)
+	}
+}
+
+func TestRotateJWTKey(t *testing.T) {
+	newJWTKeysTestDir(t)
+
+	oldKey := currentJWTKey()
+	oldToken, err := GenerateToken(1, "alice", "session", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKID, err := RotateJWTKey()
+	if err != nil {
+		t.Fatalf("rotating key: %v", err)
+	}
+	if newKID == oldKey.ID || currentJWTKey().ID != newKID {
+		t.Fatalf("current key = %s, want the new key %s", currentJWTKey().ID, newKID)
+	}
+
+	newToken, err := GenerateToken(1, "alice", "session", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	if err != nil || parsed.Header["kid"] != newKID {
+		t.Errorf("kid of a new token = %v, %v, want %s", parsed.Header["kid"], err, newKID)
+	}
+
+	// Tokens of the retired key stay valid until they expire
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if claims, err := ValidateToken(token); err != nil || claims.UserID != 1 {
+			t.Errorf("%s token: %v", name, err)
+		}
+	}
+
+	keys := GetJWTKeys()
+	if len(keys) != 2 || keys[0]["retired"] == "" || keys[0]["current"] != false || keys[1]["current"] != true {
+		t.Errorf("keys = %v, want the retired and the current key", keys)
+	}
+	for _, key := range keys {
+		if _, ok := key["secret"]; ok {
+			t.Errorf("the secret of a key is shown")
+		}
+	}
+}
+
+func TestRetiredJWTKeyExpires(t *testing.T) {
+	newJWTKeysTestDir(t)
+
+	oldToken, err := GenerateToken(1, "alice", "session", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RotateJWTKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key was retired longer ago than a token lives
+	jwtKeysMutex.Lock()
+	jwtKeys.Keys[0].Retired = time.Now().AddDate(0, 0, -Settings.LogoutAfterDays-1).UTC().Format(time.RFC3339)
+	ring := jwtKeys
+	jwtKeysMutex.Unlock()
+	if err := writeJWTKeys(ring); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ValidateToken(oldToken); err == nil {
+		t.Errorf("token of an expired key was accepted")
+	}
+
+	// The expired key is removed on the next start
+	if err := InitJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := GetJWTKeys(); len(keys) != 1 {
+		t.Errorf("keys after restart = %v, want only the current key", keys)
+	}
+}
+
+func TestValidateTokenKeyID(t *testing.T) {
+	newJWTKeysTestDir(t)
+
+	sign := func(kid string, secret []byte) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+			UserID:           1,
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	for _, tc := range []struct {
+		name        string
+		token       string
+		secretToken string
+		valid       bool
+	}{
+		{name: "unknown key", token: sign("0000000000000000", []byte("secret")), valid: false},
+		{name: "wrong secret", token: sign(currentJWTKey().ID, []byte("secret")), valid: false},
+		{name: "old token with SECRET_TOKEN", token: sign("", []byte("old-secret")), secretToken: "old-secret", valid: true},
+		{name: "old token without SECRET_TOKEN", token: sign("", []byte("old-secret")), valid: false},
+		{name: "old token with another SECRET_TOKEN", token: sign("", []byte("old-secret")), secretToken: "new-secret", valid: false},
+		{name: "unsigned", token: func() string {
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodNone, &Claims{UserID: 1}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return token
+		}(), valid: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			Settings.SecretToken = tc.secretToken
+			_, err := ValidateToken(tc.token)
+			if (err == nil) != tc.valid {
+				t.Errorf("err = %v, want valid: %v", err, tc.valid)
+			}
+		})
+	}
+}
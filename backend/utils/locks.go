@@ -0,0 +1,77 @@
+package utils
+
+import "sync"
+
+// LockManager hands out the locks for the data of a user. Every user has their
+// own locks, so a long running request (import, upload, ...) of one user never
+// blocks the other users.
+//
+// A user's data is guarded by three locks:
+//   - Logs:      the month files and the uploaded files
+//   - Tags:      tags.json
+//   - Templates: templates.json
+//
+// Lock ordering - if a request needs more than one lock, they must always be
+// taken in this order (and released in reverse order) to avoid deadlocks:
+//
+//  1. SessionsMutex (global, the sessions in users.json)
+//  2. PasskeysMutex (global, the passkeys in users.json)
+//  3. UsersFileMutex (global, users.json)
+//  4. Logs of the user
+//  5. Tags of the user
+//  6. Templates of the user
+//  7. UserSettingsMutex (global, taken by WriteUserSettings)
+//
+// Everything that reads and saves the sessions (or the passkeys) holds
+// SessionsMutex (PasskeysMutex) for the whole time, also if users.json is
+// written as a whole (password change).
+//
+// Locks of different users are never held at the same time.
+type LockManager struct {
+	mu    sync.Mutex
+	users map[int]*userLocks
+}
+
+// userLocks are the locks of a single user
+type userLocks struct {
+	logs      sync.RWMutex
+	tags      sync.RWMutex
+	templates sync.RWMutex
+}
+
+// UserLocks is the lock manager used by the handlers
+var UserLocks = NewLockManager()
+
+// NewLockManager creates an empty LockManager
+func NewLockManager() *LockManager {
+	return &LockManager{users: map[int]*userLocks{}}
+}
+
+// get returns the locks of a user, creating them on first use.
+// The locks are never removed, a few bytes per user don't matter.
+func (m *LockManager) get(userID int) *userLocks {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	locks, ok := m.users[userID]
+	if !ok {
+		locks = &userLocks{}
+		m.users[userID] = locks
+	}
+	return locks
+}
+
+// Logs returns the lock for the logs and files of a user
+func (m *LockManager) Logs(userID int) *sync.RWMutex {
+	return &m.get(userID).logs
+}
+
+// Tags returns the lock for the tags of a user
+func (m *LockManager) Tags(userID int) *sync.RWMutex {
+	return &m.get(userID).tags
+}
+
+// Templates returns the lock for the templates of a user
+func (m *LockManager) Templates(userID int) *sync.RWMutex {
+	return &m.get(userID).templates
+}
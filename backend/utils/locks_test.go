@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// saveWithLock saves a log like the SaveLog handler: read, change and write
+// the month while holding the logs lock of the user
+func saveWithLock(locks *LockManager, userID int, text string, holding func()) error {
+	logsMutex := locks.Logs(userID)
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
+	holding()
+
+	content, err := ReadMonth(userID, 2024, 5)
+	if err != nil {
+		return err
+	}
+	content.GetOrCreateDay(17).Text = text
+	return SaveMonth(userID, 2024, 5, content)
+}
+
+func TestLockManagerSavesOfTwoUsersRunConcurrently(t *testing.T) {
+	previous := DataStore
+	DataStore = NewMemoryStore()
+	t.Cleanup(func() { DataStore = previous })
+
+	locks := NewLockManager()
+
+	// Both saves wait inside their lock until the other one holds its lock as
+	// well. With a global lock, the second save could never start.
+	var inside sync.WaitGroup
+	inside.Add(2)
+	holding := func() {
+		inside.Done()
+		inside.Wait()
+	}
+
+	errs := make(chan error, 2)
+	for _, userID := range []int{1, 2} {
+		go func() {
+			errs <- saveWithLock(locks, userID, fmt.Sprintf("Text of user %d", userID), holding)
+		}()
+	}
+
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatalf("save failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the saves of two users blocked each other")
+		}
+	}
+
+	for _, userID := range []int{1, 2} {
+		content, err := ReadMonth(userID, 2024, 5)
+		if err != nil {
+			t.Fatalf("reading month of user %d: %v", userID, err)
+		}
+		day := content.FindDay(17)
+		if want := fmt.Sprintf("Text of user %d", userID); day == nil || day.Text != want {
+			t.Errorf("day of user %d = %+v, want text %q", userID, day, want)
+		}
+	}
+}
+
+func TestLockManagerSavesOfOneUserAreSerialized(t *testing.T) {
+	locks := NewLockManager()
+
+	// The second save of the same user has to wait for the first one
+	logsMutex := locks.Logs(1)
+	logsMutex.Lock()
+
+	acquired := make(chan struct{})
+	go func() {
+		locks.Logs(1).Lock()
+		close(acquired)
+		locks.Logs(1).Unlock()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("the lock of a user was taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	logsMutex.Unlock()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock was not handed over after the unlock")
+	}
+}
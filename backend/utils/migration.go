@@ -293,7 +293,11 @@ func MigrateUserData(username, password string, registerFunc RegisterUserFunc, p
 				}
 
 				// Get intermediate key
-				derivedKey, err := DeriveKeyFromPassword(password, u["salt"].(string))
+				params, err := KeyParams(u)
+				if err != nil {
+					return handleError("Internal Server Error", err)
+				}
+				derivedKey, err := DeriveKeyFromPassword(password, u["salt"].(string), params)
 				if err != nil {
 					return handleError("Internal Server Error", err)
 				}
@@ -309,30 +313,23 @@ func MigrateUserData(username, password string, registerFunc RegisterUserFunc, p
 
 	// Now migrate all the data
 	oldDataDir := filepath.Join(Settings.DataPath, "old", strconv.Itoa(oldUserID))
-	newDataDir := filepath.Join(Settings.DataPath, strconv.Itoa(newUserID))
-
-	// Create new data directory
-	if err := os.MkdirAll(newDataDir, 0755); err != nil {
-		return handleError("Error creating new data directory", err)
-	}
-
 	encKey, err := GetEncryptionKey(newUserID, string(newDerivedKey))
 	if err != nil {
 		return handleError("Error getting encryption key", err)
 	}
 
 	// Migrate templates
-	if err := migrateTemplates(oldDataDir, newDataDir, oldEncKey, encKey, &currentProgress, progressChan); err != nil {
+	if err := migrateTemplates(oldDataDir, newUserID, oldEncKey, encKey, &currentProgress, progressChan); err != nil {
 		return handleError("Error migrating templates", err)
 	}
 
 	// Migrate logs (years/months)
-	if err := migrateLogs(oldDataDir, newDataDir, oldEncKey, encKey, &currentProgress, progressChan); err != nil {
+	if err := migrateLogs(oldDataDir, newUserID, oldEncKey, encKey, &currentProgress, progressChan); err != nil {
 		return handleError("Error migrating logs", err)
 	}
 
 	// Migrate files
-	if err := migrateFiles(filepath.Join(Settings.DataPath, "old", "files"), newDataDir, oldEncKey, encKey, &currentProgress, progressChan); err != nil {
+	if err := migrateFiles(filepath.Join(Settings.DataPath, "old", "files"), newUserID, oldEncKey, encKey, &currentProgress, progressChan); err != nil {
 		return handleError("Error migrating files", err)
 	}
 
@@ -374,7 +371,7 @@ type RegisterUserFunc func(username, password string) (bool, error)
 
 // Helper functions for migration
 
-func migrateTemplates(oldDir, newDir string, oldKey string, newKey string, progress *MigrationProgress, progressChan chan<- MigrationProgress) error {
+func migrateTemplates(oldDir string, newUserID int, oldKey string, newKey string, progress *MigrationProgress, progressChan chan<- MigrationProgress) error {
 	// Check if old templates exist
 	templatesMutex.RLock()
 	oldTemplatesPath := filepath.Join(oldDir, "templates.json")
@@ -493,39 +490,12 @@ func migrateTemplates(oldDir, newDir string, oldKey string, newKey string, progr
 	// Replace the old templates array with the new one
 	templatesData["templates"] = newTemplatesArray
 
-	// Create templates.json file
-	newTemplatesPath := filepath.Join(newDir, "templates.json")
+	// Write the new templates
 	templatesMutex.Lock()
-
-	// Create the directory if it doesn't exist
-	if err := os.MkdirAll(newDir, 0755); err != nil {
-		templatesMutex.Unlock()
-		return fmt.Errorf("error creating templates directory %s: %v", newDir, err)
-	}
-
-	// Create the file
-	file, err := os.Create(newTemplatesPath)
-	if err != nil {
-		templatesMutex.Unlock()
-		return fmt.Errorf("error creating templates file: %v", err)
-	}
-
-	// Write the content to the file with proper indentation
-	var encoder *json.Encoder
-	if Settings.Indent > 0 {
-		encoder = json.NewEncoder(file)
-		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-	} else {
-		encoder = json.NewEncoder(file)
-	}
-
-	if err := encoder.Encode(templatesData); err != nil {
-		file.Close()
+	if err := WriteTemplates(newUserID, templatesData); err != nil {
 		templatesMutex.Unlock()
-		return fmt.Errorf("error encoding templates data: %v", err)
+		return fmt.Errorf("error writing templates: %v", err)
 	}
-
-	file.Close()
 	templatesMutex.Unlock()
 
 	// Update progress and send final update
@@ -537,7 +507,7 @@ func migrateTemplates(oldDir, newDir string, oldKey string, newKey string, progr
 	return nil
 }
 
-func migrateLogs(oldDir, newDir string, oldKey string, newKey string, progress *MigrationProgress, progressChan chan<- MigrationProgress) error {
+func migrateLogs(oldDir string, newUserID int, oldKey string, newKey string, progress *MigrationProgress, progressChan chan<- MigrationProgress) error {
 	// Count all month files in all year directories
 	var allMonthFiles []struct {
 		yearDir   string
@@ -620,18 +590,16 @@ func migrateLogs(oldDir, newDir string, oldKey string, newKey string, progress *
 		}
 
 		oldYearPath := filepath.Join(oldDir, monthInfo.yearDir)
-		newYearPath := filepath.Join(newDir, monthInfo.yearDir)
-
 		oldMonthPath := filepath.Join(oldYearPath, monthInfo.monthFile)
-		newMonthPath := filepath.Join(newYearPath, monthInfo.monthFile)
 
-		// Create year directory if needed
-		logsMutex.Lock()
-		if err := os.MkdirAll(newYearPath, 0755); err != nil {
-			logsMutex.Unlock()
-			return fmt.Errorf("error creating new year directory: %v", err)
+		// Year and month of the new month file
+		year, errYear := strconv.Atoi(monthInfo.yearDir)
+		month, errMonth := strconv.Atoi(strings.TrimSuffix(monthInfo.monthFile, ".json"))
+		if errYear != nil || errMonth != nil {
+			Logger.Printf("Skipping invalid month file %s", oldMonthPath)
+			progress.ErrorCount++
+			continue
 		}
-		logsMutex.Unlock()
 
 		// Read old month file
 		logsMutex.RLock()
@@ -746,45 +714,14 @@ func migrateLogs(oldDir, newDir string, oldKey string, newKey string, progress *
 			}
 		}
 
-		// Write new month file with proper indentation
+		// Write new month file
 		logsMutex.Lock()
-
-		// Create the directory if it doesn't exist (should already be done, but just to be safe)
-		err = os.MkdirAll(filepath.Dir(newMonthPath), 0755)
-		if err != nil {
-			logsMutex.Unlock()
-			Logger.Printf("Error creating directory for %s: %v", newMonthPath, err)
-			progress.ErrorCount++
-			continue
-		}
-
-		// Create the file
-		file, err := os.Create(newMonthPath)
-		if err != nil {
-			logsMutex.Unlock()
-			Logger.Printf("Error creating file %s: %v", newMonthPath, err)
-			progress.ErrorCount++
-			continue
-		}
-
-		// Write the content to the file with proper indentation
-		var encoder *json.Encoder
-		if Settings.Indent > 0 {
-			encoder = json.NewEncoder(file)
-			encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-		} else {
-			encoder = json.NewEncoder(file)
-		}
-
-		if err := encoder.Encode(monthData); err != nil {
-			file.Close()
+		if err := WriteMonth(newUserID, year, month, monthData); err != nil {
 			logsMutex.Unlock()
-			Logger.Printf("Error encoding month data for %s: %v", newMonthPath, err)
+			Logger.Printf("Error writing month %d/%02d: %v", year, month, err)
 			progress.ErrorCount++
 			continue
 		}
-
-		file.Close()
 		logsMutex.Unlock()
 
 		processedMonths++
@@ -799,7 +736,7 @@ func migrateLogs(oldDir, newDir string, oldKey string, newKey string, progress *
 	return nil
 }
 
-func migrateFiles(oldFilesDir, newDir string, oldKey string, newKey string, progress *MigrationProgress, progressChan chan<- MigrationProgress) error {
+func migrateFiles(oldFilesDir string, newUserID int, oldKey string, newKey string, progress *MigrationProgress, progressChan chan<- MigrationProgress) error {
 	// Check if old files directory exists
 	filesMutex.RLock()
 	_, err := os.Stat(oldFilesDir)
@@ -815,16 +752,6 @@ func migrateFiles(oldFilesDir, newDir string, oldKey string, newKey string, prog
 		return nil // No files to migrate
 	}
 
-	// Create new files directory
-	newFilesDir := filepath.Join(newDir, "files")
-	filesMutex.Lock()
-	if err := os.MkdirAll(newFilesDir, 0755); err != nil {
-		filesMutex.Unlock()
-		progress.ErrorCount++
-		return fmt.Errorf("error creating new files directory: %v", err)
-	}
-	filesMutex.Unlock()
-
 	// Convert oldKey from base64 to []byte for decryption
 	oldKeyBytes, err := base64.URLEncoding.DecodeString(oldKey)
 	if err != nil {
@@ -832,19 +759,19 @@ func migrateFiles(oldFilesDir, newDir string, oldKey string, newKey string, prog
 		return fmt.Errorf("error decoding oldKey: %v", err)
 	}
 
-	// First, find all year directories in the new user directory
+	// First, find all years of the new user
 	logsMutex.RLock()
-	yearEntries, err := os.ReadDir(newDir)
+	years, err := GetYears(newUserID)
 	logsMutex.RUnlock()
 	if err != nil {
 		progress.ErrorCount++
-		return fmt.Errorf("error reading new user directory: %v", err)
+		return fmt.Errorf("error reading years of new user: %v", err)
 	}
 
 	// Track all file references
 	type FileRef struct {
-		Year     string
-		Month    string
+		Year     int
+		Month    int
 		Day      int
 		OrigUUID string
 		NewUUID  string // Will be generated later
@@ -856,48 +783,35 @@ func migrateFiles(oldFilesDir, newDir string, oldKey string, newKey string, prog
 	Logger.Println("Scanning logs for file references...")
 
 	// First pass: collect all file references from all logs
-	for _, yearEntry := range yearEntries {
-		// Skip non-directory entries and non-numeric directories
-		if !yearEntry.IsDir() || !isNumeric(yearEntry.Name()) {
+	for _, yearStr := range years {
+		year, err := strconv.Atoi(yearStr)
+		if err != nil {
 			continue
 		}
 
-		yearDir := yearEntry.Name()
-		yearPath := filepath.Join(newDir, yearDir)
-
-		// Read all month files in this year
+		// Read all months in this year
 		logsMutex.RLock()
-		monthEntries, err := os.ReadDir(yearPath)
+		months, err := GetMonths(newUserID, yearStr)
 		logsMutex.RUnlock()
 		if err != nil {
 			progress.ErrorCount++
-			Logger.Printf("Error reading year directory %s: %v", yearPath, err)
+			Logger.Printf("Error reading months of year %s: %v", yearStr, err)
 			continue
 		}
 
-		// Scan each month file for file references
-		for _, monthEntry := range monthEntries {
-			if monthEntry.IsDir() || !strings.HasSuffix(monthEntry.Name(), ".json") {
+		// Scan each month for file references
+		for _, monthStr := range months {
+			month, err := strconv.Atoi(monthStr)
+			if err != nil {
 				continue
 			}
 
-			monthFile := monthEntry.Name()
-			monthPath := filepath.Join(yearPath, monthFile)
-
-			// Read month file
+			// Read month data
 			logsMutex.RLock()
-			monthBytes, err := os.ReadFile(monthPath)
+			monthData, err := GetMonth(newUserID, year, month)
 			logsMutex.RUnlock()
 			if err != nil {
-				Logger.Printf("Error reading month file %s: %v", monthPath, err)
-				progress.ErrorCount++
-				continue
-			}
-
-			// Parse month data
-			var monthData map[string]any
-			if err := json.Unmarshal(monthBytes, &monthData); err != nil {
-				Logger.Printf("Error parsing month data %s: %v", monthPath, err)
+				Logger.Printf("Error reading month %d/%02d: %v", year, month, err)
 				progress.ErrorCount++
 				continue
 			}
@@ -943,8 +857,8 @@ func migrateFiles(oldFilesDir, newDir string, oldKey string, newKey string, prog
 
 					// Add to list of files to migrate
 					fileRefs = append(fileRefs, FileRef{
-						Year:     yearDir,
-						Month:    monthFile,
+						Year:     year,
+						Month:    month,
 						Day:      int(dayNum),
 						OrigUUID: uuid,
 						NewUUID:  "", // Will be generated during migration
@@ -1032,12 +946,11 @@ func migrateFiles(oldFilesDir, newDir string, oldKey string, newKey string, prog
 		}
 
 		// Write new file
-		newFilePath := filepath.Join(newFilesDir, NewUUID)
 		filesMutex.Lock()
-		err = os.WriteFile(newFilePath, newEncrypted, 0644)
+		err = WriteFile(newEncrypted, newUserID, NewUUID)
 		filesMutex.Unlock()
 		if err != nil {
-			Logger.Printf("Error writing new file %s: %v", newFilePath, err)
+			Logger.Printf("Error writing new file %s: %v", NewUUID, err)
 			progress.ErrorCount++
 			continue
 		}
@@ -1056,27 +969,19 @@ func migrateFiles(oldFilesDir, newDir string, oldKey string, newKey string, prog
 	updatedMonths := make(map[string]bool) // Track which month files we've already updated
 
 	for _, fileRef := range fileRefs {
-		monthPath := filepath.Join(newDir, fileRef.Year, fileRef.Month)
+		monthKey := fmt.Sprintf("%d/%02d", fileRef.Year, fileRef.Month)
 
 		// Skip if we've already updated this month
-		if updatedMonths[monthPath] {
+		if updatedMonths[monthKey] {
 			continue
 		}
 
-		// Read month file
+		// Read month data
 		logsMutex.RLock()
-		monthBytes, err := os.ReadFile(monthPath)
+		monthData, err := GetMonth(newUserID, fileRef.Year, fileRef.Month)
 		logsMutex.RUnlock()
 		if err != nil {
-			Logger.Printf("Error reading month file %s: %v", monthPath, err)
-			progress.ErrorCount++
-			continue
-		}
-
-		// Parse month data
-		var monthData map[string]any
-		if err := json.Unmarshal(monthBytes, &monthData); err != nil {
-			Logger.Printf("Error parsing month data %s: %v", monthPath, err)
+			Logger.Printf("Error reading month %s: %v", monthKey, err)
 			progress.ErrorCount++
 			continue
 		}
@@ -1172,39 +1077,17 @@ func migrateFiles(oldFilesDir, newDir string, oldKey string, newKey string, prog
 
 			// Write back the updated month file
 			logsMutex.Lock()
-
-			// Create the file
-			file, err := os.Create(monthPath)
-			if err != nil {
+			if err := WriteMonth(newUserID, fileRef.Year, fileRef.Month, monthData); err != nil {
 				logsMutex.Unlock()
-				Logger.Printf("Error creating file %s: %v", monthPath, err)
+				Logger.Printf("Error writing month %s: %v", monthKey, err)
 				progress.ErrorCount++
 				continue
 			}
-
-			// Write with proper indentation
-			var encoder *json.Encoder
-			if Settings.Indent > 0 {
-				encoder = json.NewEncoder(file)
-				encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-			} else {
-				encoder = json.NewEncoder(file)
-			}
-
-			if err := encoder.Encode(monthData); err != nil {
-				file.Close()
-				logsMutex.Unlock()
-				Logger.Printf("Error encoding month data for %s: %v", monthPath, err)
-				progress.ErrorCount++
-				continue
-			}
-
-			file.Close()
 			logsMutex.Unlock()
 		}
 
 		// Mark this month as updated
-		updatedMonths[monthPath] = true
+		updatedMonths[monthKey] = true
 	}
 
 	// Final progress update
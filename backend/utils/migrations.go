@@ -0,0 +1,444 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Versioned migrations of the data directory.
+//
+// The version of the data in DATA_PATH is recorded in data_version.json.
+// At startup all pending DataMigrations are run in order (after a snapshot of
+// the data directory was taken). Migrations that need the encryption key of a
+// user are registered as UserMigrations instead and run after the user logged
+// in. Their progress is reported like the migration from version 1.
+//
+// To change the data format: append a DataMigration (or UserMigration) with
+// the next version number and increase DataVersion (or UserDataVersion).
+
+// DataVersion is the version of the data directory written by this server
+const DataVersion = 2
+
+// UserDataVersion is the version of the per-user data written by this server.
+// It is stored as "user_data_version" in the entry of the user in users.json.
+const UserDataVersion = 0
+
+// Files and directories of the migration framework in DATA_PATH
+const (
+	dataVersionFilename   = "data_version.json"
+	migrationLockFilename = ".migration.lock"
+	snapshotsDirname      = "snapshots"
+)
+
+// DataMigration upgrades the data directory to Version at startup.
+// It runs before the store is initialized and works on the files directly.
+type DataMigration struct {
+	Version int
+	Name    string
+	Run     func(logger *log.Logger) error
+}
+
+// UserMigration upgrades the data of a single user to Version.
+// It runs after the login of the user, with the user's logs locked.
+type UserMigration struct {
+	Version int
+	Name    string
+	Run     func(userID int, encKey string, progress *MigrationProgress, progressChan chan<- MigrationProgress) error
+}
+
+// dataMigrations must be sorted by version
+var dataMigrations = []DataMigration{
+	{Version: 2, Name: "move_v1_data", Run: HandleOldData},
+}
+
+// userMigrations must be sorted by version
+var userMigrations = []UserMigration{}
+
+// dataVersionInfo is the content of data_version.json
+type dataVersionInfo struct {
+	Version int                `json:"version"`
+	Applied []appliedMigration `json:"applied"`
+}
+
+type appliedMigration struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"applied_at"`
+	Snapshot  string `json:"snapshot,omitempty"`
+}
+
+func init() {
+	// Check the registries, a mistake here would silently skip migrations
+	if len(dataMigrations) > 0 && dataMigrations[len(dataMigrations)-1].Version != DataVersion {
+		panic("the last data migration must have DataVersion")
+	}
+	if len(userMigrations) > 0 && userMigrations[len(userMigrations)-1].Version != UserDataVersion {
+		panic("the last user migration must have UserDataVersion")
+	}
+	for i := 1; i < len(dataMigrations); i++ {
+		if dataMigrations[i].Version <= dataMigrations[i-1].Version {
+			panic("data migrations must be sorted by version")
+		}
+	}
+	for i := 1; i < len(userMigrations); i++ {
+		if userMigrations[i].Version <= userMigrations[i-1].Version {
+			panic("user migrations must be sorted by version")
+		}
+	}
+}
+
+// RunDataMigrations brings the data directory to DataVersion.
+// Returns an error if the data is newer than this server or a migration failed.
+func RunDataMigrations(logger *log.Logger) error {
+	info, err := readDataVersion(logger)
+	if err != nil {
+		return err
+	}
+
+	if info.Version > DataVersion {
+		return fmt.Errorf("the data in %s has version %d, but this version of DailyTxT only supports up to version %d. Please update DailyTxT", Settings.DataPath, info.Version, DataVersion)
+	}
+
+	pending := []DataMigration{}
+	for _, migration := range dataMigrations {
+		if migration.Version > info.Version {
+			pending = append(pending, migration)
+		}
+	}
+
+	if len(pending) == 0 {
+		logger.Printf("Data version: %d, no migrations needed.", info.Version)
+		return writeDataVersion(info)
+	}
+
+	// Only one process may migrate the data
+	unlock, err := lockMigrations()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	snapshot, err := createSnapshot(info.Version, logger)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot before migration: %v", err)
+	}
+
+	for _, migration := range pending {
+		logger.Printf("Running data migration %d (%s)...", migration.Version, migration.Name)
+		if err := migration.Run(logger); err != nil {
+			return fmt.Errorf("data migration %d (%s) failed: %v. A snapshot of the data before the migration is in %s", migration.Version, migration.Name, err, snapshot)
+		}
+
+		info.Version = migration.Version
+		info.Applied = append(info.Applied, appliedMigration{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: time.Now().Format(time.RFC3339),
+			Snapshot:  snapshot,
+		})
+		if err := writeDataVersion(info); err != nil {
+			return fmt.Errorf("error writing %s: %v", dataVersionFilename, err)
+		}
+	}
+
+	logger.Printf("Data migrated to version %d. The snapshot %s can be deleted once everything works.", info.Version, snapshot)
+	return nil
+}
+
+// readDataVersion reads data_version.json. Without the file, the version is
+// detected from the existing data.
+func readDataVersion(logger *log.Logger) (dataVersionInfo, error) {
+	info := dataVersionInfo{Applied: []appliedMigration{}}
+
+	data, err := os.ReadFile(filepath.Join(Settings.DataPath, dataVersionFilename))
+	if err == nil {
+		if err := json.Unmarshal(data, &info); err != nil {
+			return info, fmt.Errorf("error parsing %s: %v", dataVersionFilename, err)
+		}
+		return info, nil
+	}
+	if !os.IsNotExist(err) {
+		return info, fmt.Errorf("error reading %s: %v", dataVersionFilename, err)
+	}
+
+	info.Version = detectDataVersion()
+	logger.Printf("No %s found, detected data version %d", dataVersionFilename, info.Version)
+	return info, nil
+}
+
+// detectDataVersion guesses the version of data without data_version.json
+func detectDataVersion() int {
+	data, err := os.ReadFile(filepath.Join(Settings.DataPath, "users.json"))
+	if err != nil {
+		// New installation (or all data already in the SQLite database)
+		return DataVersion
+	}
+
+	var usersData map[string]any
+	if err := json.Unmarshal(data, &usersData); err != nil {
+		return DataVersion
+	}
+
+	// Users of DailyTxT version 1 have no dailytxt_version=2 field
+	usersArray, _ := usersData["users"].([]any)
+	for _, userInterface := range usersArray {
+		user, ok := userInterface.(map[string]any)
+		if !ok {
+			continue
+		}
+		if version, exists := user["dailytxt_version"]; !exists || version != float64(2) {
+			return 1
+		}
+	}
+
+	return 2
+}
+
+// writeDataVersion atomically writes data_version.json
+func writeDataVersion(info dataVersionInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := createAtomicFile(filepath.Join(Settings.DataPath, dataVersionFilename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// lockMigrations creates the lock file. It is left behind if the server
+// crashes during a migration, then the admin has to check the data.
+func lockMigrations() (func(), error) {
+	lockPath := filepath.Join(Settings.DataPath, migrationLockFilename)
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("%s exists: another instance is migrating the data or a previous migration was interrupted. Check the data (and the snapshots in %s), then remove the lock file", lockPath, snapshotsDirname)
+		}
+		return nil, fmt.Errorf("error creating %s: %v", lockPath, err)
+	}
+
+	fmt.Fprintf(file, "pid %d, started %s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	file.Close()
+
+	return func() {
+		if err := os.Remove(lockPath); err != nil {
+			Logger.Printf("Error removing %s: %v", lockPath, err)
+		}
+	}, nil
+}
+
+// createSnapshot copies the data directory into snapshots/ and returns its path.
+// Only the data a migration can change is copied (users.json, the month files,
+// the SQLite database, ...), the uploaded files are left out. Files stored in
+// S3 are not part of the snapshot either.
+func createSnapshot(version int, logger *log.Logger) (string, error) {
+	snapshot := filepath.Join(Settings.DataPath, snapshotsDirname, fmt.Sprintf("v%d-%s", version, time.Now().Format("20060102-150405")))
+	if err := os.MkdirAll(snapshot, 0755); err != nil {
+		return "", err
+	}
+
+	logger.Printf("Creating snapshot of the data in %s...", snapshot)
+
+	err := filepath.WalkDir(Settings.DataPath, func(srcPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(Settings.DataPath, srcPath)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+
+		if skipInSnapshot(name, entry) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		destPath := filepath.Join(snapshot, name)
+		if entry.IsDir() {
+			return os.MkdirAll(destPath, 0755)
+		}
+		return CopyFile(srcPath, destPath, logger)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return snapshot, nil
+}
+
+// skipInSnapshot checks if a path in DATA_PATH is left out of the snapshots:
+// the migration framework itself, staged uploads and the directories with the
+// uploaded files (<userID>/files and <userID>/quarantine, files/ of version 1)
+func skipInSnapshot(name string, entry fs.DirEntry) bool {
+	if !strings.ContainsRune(name, filepath.Separator) && (isMigrationFile(name) || name == uploadsDirname) {
+		return true
+	}
+
+	return entry.IsDir() && (entry.Name() == "files" || entry.Name() == "quarantine")
+}
+
+// isMigrationFile checks if a name in DATA_PATH belongs to the migration framework
+func isMigrationFile(name string) bool {
+	return name == dataVersionFilename || name == migrationLockFilename || name == snapshotsDirname || strings.HasPrefix(name, "."+dataVersionFilename)
+}
+
+// getUserDataVersion returns the user_data_version of a user (0 if not set)
+func getUserDataVersion(userID int) (int, error) {
+	value, err := getUserValue(userID, "user_data_version")
+	if err != nil {
+		return 0, err
+	}
+	version, _ := value.(float64)
+	return int(version), nil
+}
+
+// setUserDataVersion stores the user_data_version of a user
+func setUserDataVersion(userID int, version int) error {
+	return setUserValue(userID, "user_data_version", version)
+}
+
+// getUserValue returns a value of the entry of a user in users.json (nil if not set)
+func getUserValue(userID int, key string) (any, error) {
+	UsersFileMutex.RLock()
+	defer UsersFileMutex.RUnlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		user, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		if id, ok := user["user_id"].(float64); ok && int(id) == userID {
+			return user[key], nil
+		}
+	}
+
+	return nil, fmt.Errorf("user %d not found", userID)
+}
+
+// setUserValue stores a value in the entry of a user in users.json (nil removes it)
+func setUserValue(userID int, key string, value any) error {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return err
+	}
+
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		user, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		if id, ok := user["user_id"].(float64); ok && int(id) == userID {
+			if value == nil {
+				delete(user, key)
+			} else {
+				user[key] = value
+			}
+			return WriteUsers(users)
+		}
+	}
+
+	return fmt.Errorf("user %d not found", userID)
+}
+
+// HasPendingUserMigrations checks if the data of a user must be migrated after login
+func HasPendingUserMigrations(userID int) bool {
+	if len(userMigrations) == 0 {
+		return false
+	}
+
+	version, err := getUserDataVersion(userID)
+	if err != nil {
+		Logger.Printf("Error reading data version of user %d: %v", userID, err)
+		return false
+	}
+
+	// The last migration has UserDataVersion (checked in init)
+	return version < userMigrations[len(userMigrations)-1].Version
+}
+
+// RunUserMigrations runs all pending UserMigrations of a user and reports the
+// progress to progressChan. derivedKey is the key of the logged in user.
+func RunUserMigrations(userID int, username string, derivedKey string, progressChan chan<- MigrationProgress) error {
+	// Check if a migration is already in progress for this user
+	if IsUserMigrating(username) {
+		return fmt.Errorf("migration already in progress for user %s", username)
+	}
+	SetUserMigrating(username, true)
+	defer SetUserMigrating(username, false)
+
+	version, err := getUserDataVersion(userID)
+	if err != nil {
+		return err
+	}
+
+	encKey, err := GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		return fmt.Errorf("error getting encryption key: %v", err)
+	}
+
+	progress := MigrationProgress{}
+	for _, migration := range userMigrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		Logger.Printf("Running migration %d (%s) for user %d", migration.Version, migration.Name, userID)
+		progress = MigrationProgress{Phase: migration.Name}
+		if progressChan != nil {
+			progressChan <- progress
+		}
+
+		// Lock the logs of this user while migrating
+		logsMutex := UserLocks.Logs(userID)
+		logsMutex.Lock()
+		err := migration.Run(userID, encKey, &progress, progressChan)
+		logsMutex.Unlock()
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Name, err)
+		}
+
+		if err := setUserDataVersion(userID, migration.Version); err != nil {
+			return fmt.Errorf("error saving data version: %v", err)
+		}
+	}
+
+	// Set final progress
+	progress.Phase = "completed"
+	progress.ProcessedItems = 0
+	progress.TotalItems = 0
+	if progressChan != nil {
+		progressChan <- progress
+	}
+
+	return nil
+}
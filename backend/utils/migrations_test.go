@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newMigrationTestUser uses a new in-memory store with one user (ID 1) and
+// returns the derived key of the user
+func newMigrationTestUser(t *testing.T) string {
+	t.Helper()
+
+	previous := DataStore
+	DataStore = NewMemoryStore()
+	t.Cleanup(func() { DataStore = previous })
+
+	derivedKey := make([]byte, 32)
+	encKey := make([]byte, 32)
+	rand.Read(derivedKey)
+	rand.Read(encKey)
+
+	aead, err := CreateAEAD(derivedKey)
+	if err != nil {
+		t.Fatalf("creating cipher: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	encEncKey := aead.Seal(nonce, nonce, encKey, nil)
+
+	err = WriteUsers(map[string]any{
+		"id_counter": float64(1),
+		"users": []any{
+			map[string]any{
+				"user_id":     float64(1),
+				"username":    "alice",
+				"enc_enc_key": base64.StdEncoding.EncodeToString(encEncKey),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("writing users: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(derivedKey)
+}
+
+// registerUserMigrations replaces the registered user migrations for a test
+func registerUserMigrations(t *testing.T, migrations ...UserMigration) {
+	previous := userMigrations
+	userMigrations = migrations
+	t.Cleanup(func() { userMigrations = previous })
+}
+
+// collectProgress runs the user migrations and returns the reported phases
+func collectProgress(derivedKey string) ([]string, error) {
+	progressChan := make(chan MigrationProgress, 100)
+	err := RunUserMigrations(1, "alice", derivedKey, progressChan)
+	close(progressChan)
+
+	var phases []string
+	for progress := range progressChan {
+		phases = append(phases, progress.Phase)
+	}
+	return phases, err
+}
+
+func TestRunUserMigrationsRunsPendingMigrations(t *testing.T) {
+	derivedKey := newMigrationTestUser(t)
+
+	runs := 0
+	registerUserMigrations(t, UserMigration{
+		Version: 1,
+		Name:    "test_migration",
+		Run: func(userID int, encKey string, progress *MigrationProgress, progressChan chan<- MigrationProgress) error {
+			runs++
+			if userID != 1 || encKey == "" {
+				t.Errorf("migration called with user %d and key %q", userID, encKey)
+			}
+			progress.TotalItems = 1
+			progress.ProcessedItems = 1
+			progressChan <- *progress
+			return nil
+		},
+	})
+
+	if !HasPendingUserMigrations(1) {
+		t.Fatal("the registered migration is not pending")
+	}
+
+	phases, err := collectProgress(derivedKey)
+	if err != nil {
+		t.Fatalf("running migrations: %v", err)
+	}
+	want := []string{"test_migration", "test_migration", "completed"}
+	if len(phases) != len(want) {
+		t.Fatalf("progress phases = %v, want %v", phases, want)
+	}
+	for i := range want {
+		if phases[i] != want[i] {
+			t.Fatalf("progress phases = %v, want %v", phases, want)
+		}
+	}
+
+	if version, _ := getUserDataVersion(1); version != 1 {
+		t.Errorf("user data version = %d, want 1", version)
+	}
+	if HasPendingUserMigrations(1) {
+		t.Error("the migration is still pending after it ran")
+	}
+
+	// A second run does nothing
+	if _, err := collectProgress(derivedKey); err != nil {
+		t.Fatalf("running migrations again: %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("migration ran %d times, want 1", runs)
+	}
+}
+
+func TestRunUserMigrationsStopsAtFailedMigration(t *testing.T) {
+	derivedKey := newMigrationTestUser(t)
+
+	var ran []int
+	failing := true
+	migration := func(version int) UserMigration {
+		return UserMigration{
+			Version: version,
+			Name:    "test_migration",
+			Run: func(userID int, encKey string, progress *MigrationProgress, progressChan chan<- MigrationProgress) error {
+				ran = append(ran, version)
+				if version == 2 && failing {
+					return errors.New("broken data")
+				}
+				return nil
+			},
+		}
+	}
+	registerUserMigrations(t, migration(1), migration(2))
+
+	if _, err := collectProgress(derivedKey); err == nil {
+		t.Fatal("the failed migration was not reported")
+	}
+	if version, _ := getUserDataVersion(1); version != 1 {
+		t.Errorf("user data version = %d after the failed migration, want 1", version)
+	}
+	if !HasPendingUserMigrations(1) {
+		t.Error("the failed migration is not pending anymore")
+	}
+
+	// The next login only runs the failed migration
+	failing = false
+	if _, err := collectProgress(derivedKey); err != nil {
+		t.Fatalf("running migrations again: %v", err)
+	}
+	if version, _ := getUserDataVersion(1); version != 2 {
+		t.Errorf("user data version = %d, want 2", version)
+	}
+	if len(ran) != 3 || ran[2] != 2 {
+		t.Errorf("migrations ran in the order %v, want [1 2 2]", ran)
+	}
+}
+
+func TestCreateSnapshotSkipsUploadedFiles(t *testing.T) {
+	previous := Settings.DataPath
+	Settings.DataPath = t.TempDir()
+	t.Cleanup(func() { Settings.DataPath = previous })
+
+	for _, name := range []string{
+		"users.json",
+		SQLiteFilename,
+		"1/tags.json",
+		"1/2024/05.json",
+		"1/files/0f3c2a",
+		"1/quarantine/8d1e4b",
+		"old/files/legacy",
+		"old/users.json",
+		uploadsDirname + "/1/staged",
+		snapshotsDirname + "/v1-20240101-000000/users.json",
+	} {
+		path := filepath.Join(Settings.DataPath, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot, err := createSnapshot(1, Logger)
+	if err != nil {
+		t.Fatalf("creating snapshot: %v", err)
+	}
+
+	for _, name := range []string{"users.json", SQLiteFilename, "1/tags.json", "1/2024/05.json", "old/users.json"} {
+		if _, err := os.Stat(filepath.Join(snapshot, name)); err != nil {
+			t.Errorf("%s is missing in the snapshot: %v", name, err)
+		}
+	}
+	for _, name := range []string{"1/files", "1/quarantine", "old/files", uploadsDirname, snapshotsDirname} {
+		if _, err := os.Stat(filepath.Join(snapshot, name)); !os.IsNotExist(err) {
+			t.Errorf("%s must not be in the snapshot", name)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Month is the content of a month file (<userID>/<year>/<month>.json).
+// All user content (texts, filenames, pin coordinates, ...) is stored encrypted.
+//
+// Keys of the document without a field in the model (e.g. entries quarantined
+// by a schema upgrade) are kept in Extra and written back unchanged, the same
+// holds for the days, files, pins and history versions.
+type Month struct {
+	SchemaVersion int            `json:"schema_version"`
+	Days          []Day          `json:"days"`
+	Extra         map[string]any `json:"-"`
+}
+
+// Day is a single day of a month
+type Day struct {
+	Day          int              `json:"day"`
+	Text         string           `json:"text,omitempty"`         // encrypted
+	DateWritten  string           `json:"date_written,omitempty"` // encrypted
+	IsBookmarked bool             `json:"isBookmarked,omitempty"`
+	Tags         []int            `json:"tags,omitempty"`
+	Files        []FileRef        `json:"files,omitempty"`
+	Pins         []Pin            `json:"pins,omitempty"`
+	History      []HistoryVersion `json:"history,omitempty"`
+	Extra        map[string]any   `json:"-"`
+}
+
+// FileRef references an uploaded file of a day
+type FileRef struct {
+	EncFilename  string         `json:"enc_filename"` // encrypted
+	UUIDFilename string         `json:"uuid_filename"`
+	Size         int64          `json:"size"`
+	Thumbnails   []int          `json:"thumbnails,omitempty"` // sizes of the stored thumbnails
+	Extra        map[string]any `json:"-"`
+}
+
+// Pin is a location on the map. Lat, Lon and Text are encrypted.
+type Pin struct {
+	ID    int            `json:"id"`
+	Lat   string         `json:"lat"`
+	Lon   string         `json:"lon"`
+	Text  string         `json:"text"`
+	Extra map[string]any `json:"-"`
+}
+
+// HistoryVersion is a previous text of a day (both fields encrypted)
+type HistoryVersion struct {
+	Version     int            `json:"version"`
+	Text        string         `json:"text"`
+	DateWritten string         `json:"date_written,omitempty"`
+	Extra       map[string]any `json:"-"`
+}
+
+func (m *Month) UnmarshalJSON(data []byte) error {
+	type plain Month
+	extra, err := unmarshalWithExtra(data, (*plain)(m))
+	m.Extra = extra
+	return err
+}
+
+func (m Month) MarshalJSON() ([]byte, error) {
+	type plain Month
+	return marshalWithExtra(plain(m), m.Extra)
+}
+
+func (d *Day) UnmarshalJSON(data []byte) error {
+	type plain Day
+	extra, err := unmarshalWithExtra(data, (*plain)(d))
+	d.Extra = extra
+	return err
+}
+
+func (d Day) MarshalJSON() ([]byte, error) {
+	type plain Day
+	return marshalWithExtra(plain(d), d.Extra)
+}
+
+func (f *FileRef) UnmarshalJSON(data []byte) error {
+	type plain FileRef
+	extra, err := unmarshalWithExtra(data, (*plain)(f))
+	f.Extra = extra
+	return err
+}
+
+func (f FileRef) MarshalJSON() ([]byte, error) {
+	type plain FileRef
+	return marshalWithExtra(plain(f), f.Extra)
+}
+
+func (p *Pin) UnmarshalJSON(data []byte) error {
+	type plain Pin
+	extra, err := unmarshalWithExtra(data, (*plain)(p))
+	p.Extra = extra
+	return err
+}
+
+func (p Pin) MarshalJSON() ([]byte, error) {
+	type plain Pin
+	return marshalWithExtra(plain(p), p.Extra)
+}
+
+func (h *HistoryVersion) UnmarshalJSON(data []byte) error {
+	type plain HistoryVersion
+	extra, err := unmarshalWithExtra(data, (*plain)(h))
+	h.Extra = extra
+	return err
+}
+
+func (h HistoryVersion) MarshalJSON() ([]byte, error) {
+	type plain HistoryVersion
+	return marshalWithExtra(plain(h), h.Extra)
+}
+
+// unmarshalWithExtra decodes the JSON object into v (pointer to a struct) and
+// returns the keys of the object that v has no field for
+func unmarshalWithExtra(data []byte, v any) (map[string]any, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+
+	var extra map[string]any
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return nil, err
+	}
+
+	t := reflect.TypeOf(v).Elem()
+	for i := range t.NumField() {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "-" {
+			delete(extra, name)
+		}
+	}
+
+	if len(extra) == 0 {
+		return nil, nil
+	}
+	return extra, nil
+}
+
+// marshalWithExtra encodes v (a struct) and adds the extra keys to the object
+func marshalWithExtra(v any, extra map[string]any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	var object map[string]any
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	for key, value := range extra {
+		if _, ok := object[key]; !ok {
+			object[key] = value
+		}
+	}
+
+	return json.Marshal(object)
+}
+
+// ReadMonth retrieves the logs for a specific month as Month
+func ReadMonth(userID int, year, month int) (*Month, error) {
+	content, err := GetMonth(userID, year, month)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := MonthFromMap(content)
+	if err != nil {
+		Logger.Printf("Error decoding month %d/%02d of user %d: %v", year, month, userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read %d/%02d", year, month)
+	}
+
+	return m, nil
+}
+
+// SaveMonth writes the logs for a specific month
+func SaveMonth(userID int, year, month int, m *Month) error {
+	content, err := m.ToMap()
+	if err != nil {
+		Logger.Printf("Error encoding month %d/%02d of user %d: %v", year, month, userID, err)
+		return fmt.Errorf("internal server error when trying to write %d/%02d", year, month)
+	}
+
+	return WriteMonth(userID, year, month, content)
+}
+
+// MonthFromMap converts an (upgraded) month document into a Month
+func MonthFromMap(content map[string]any) (*Month, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Month{SchemaVersion: MonthSchemaVersion}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// DayFromMap converts an entry of the "days" array of an (upgraded) month document into a Day
+func DayFromMap(content map[string]any) (Day, error) {
+	var day Day
+	data, err := json.Marshal(content)
+	if err != nil {
+		return day, err
+	}
+	err = json.Unmarshal(data, &day)
+	return day, err
+}
+
+// ToMap converts the month into the generic document used by the stores
+func (m *Month) ToMap() (map[string]any, error) {
+	m.SchemaVersion = MonthSchemaVersion
+	if m.Days == nil {
+		m.Days = []Day{}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var content map[string]any
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// ToMap converts the day into the generic document of an entry of the "days" array
+func (d Day) ToMap() (map[string]any, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var content map[string]any
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// FindDay returns the day or nil if it does not exist.
+// The pointer is only valid until days are added or removed.
+func (m *Month) FindDay(day int) *Day {
+	for i := range m.Days {
+		if m.Days[i].Day == day {
+			return &m.Days[i]
+		}
+	}
+	return nil
+}
+
+// GetOrCreateDay returns the day, appending an empty one if it does not exist.
+// The pointer is only valid until days are added or removed.
+func (m *Month) GetOrCreateDay(day int) *Day {
+	if d := m.FindDay(day); d != nil {
+		return d
+	}
+
+	m.Days = append(m.Days, Day{Day: day})
+	return &m.Days[len(m.Days)-1]
+}
+
+// RemoveDay removes the day and returns it
+func (m *Month) RemoveDay(day int) (Day, bool) {
+	for i := range m.Days {
+		if m.Days[i].Day == day {
+			removed := m.Days[i]
+			m.Days = append(m.Days[:i], m.Days[i+1:]...)
+			return removed, true
+		}
+	}
+	return Day{}, false
+}
+
+// FindPin returns the pin or nil if it does not exist
+func (d *Day) FindPin(id int) *Pin {
+	for i := range d.Pins {
+		if d.Pins[i].ID == id {
+			return &d.Pins[i]
+		}
+	}
+	return nil
+}
+
+// RemovePin removes the pin and reports if it existed
+func (d *Day) RemovePin(id int) bool {
+	for i := range d.Pins {
+		if d.Pins[i].ID == id {
+			d.Pins = append(d.Pins[:i], d.Pins[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// NextPinID returns the ID for a new pin of the day
+func (d *Day) NextPinID() int {
+	maxID := 0
+	for _, pin := range d.Pins {
+		maxID = max(maxID, pin.ID)
+	}
+	return maxID + 1
+}
+
+// FindFile returns the file or nil if it does not exist
+func (d *Day) FindFile(uuid string) *FileRef {
+	for i := range d.Files {
+		if d.Files[i].UUIDFilename == uuid {
+			return &d.Files[i]
+		}
+	}
+	return nil
+}
+
+// HasTag checks if the tag is assigned to the day
+func (d *Day) HasTag(tagID int) bool {
+	for _, id := range d.Tags {
+		if id == tagID {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveTag removes the tag from the day and reports if it was assigned
+func (d *Day) RemoveTag(tagID int) bool {
+	for i, id := range d.Tags {
+		if id == tagID {
+			d.Tags = append(d.Tags[:i], d.Tags[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ArchiveText moves the current text of the day into its history.
+// Returns false if there is no text.
+func (d *Day) ArchiveText() bool {
+	if d.Text == "" {
+		return false
+	}
+
+	version := 0
+	for _, h := range d.History {
+		version = max(version, h.Version)
+	}
+
+	d.History = append(d.History, HistoryVersion{
+		Version:     version + 1,
+		Text:        d.Text,
+		DateWritten: d.DateWritten,
+	})
+	return true
+}
@@ -0,0 +1,661 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Single sign-on with OpenID Connect (OIDC_ISSUER, OIDC_CLIENT_ID, ...). The
+// provider is found with discovery, the login uses the authorization code flow
+// with PKCE. The provider redirects back to the login page of the frontend,
+// which sends code and state to the server. The server exchanges the code and
+// checks the ID token with the keys of the provider.
+//
+// The provider only authenticates the user. The data stays encrypted with the
+// derived key of the password, so the password is still needed to unlock it
+// ("unlock passphrase"). With OIDC_SUBJECT_KEY, the derived key is also stored
+// encrypted with a key derived from oidc_key.json (in the data directory) and
+// the subject, then a login at the provider is enough. This means that the
+// server alone can decrypt the data of these users!
+//
+// users.json: "oidc" ({"issuer", "subject", "linked", "enc_derived_key"}) maps
+// the subject at the provider to the user. enc_derived_key is removed when the
+// password changes (the derived key changes).
+
+const (
+	oidcDiscoveryTTL   = time.Hour
+	oidcAuthRequestTTL = 10 * time.Minute
+	oidcKeyFilename    = "oidc_key.json"
+)
+
+// ErrOIDCDisabled is returned if single sign-on is not configured
+var ErrOIDCDisabled = errors.New("single sign-on is disabled")
+
+// oidcProviderMetadata is the part of the discovery document that is used
+type oidcProviderMetadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+	SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// oidcAuthRequest is a login that was started at the provider
+type oidcAuthRequest struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// OIDCIdentity is the user as confirmed by the ID token
+type OIDCIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Email    string
+}
+
+// OIDCLink is the mapping of a user to the subject at the provider
+type OIDCLink struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	Linked  string `json:"linked"`
+	// EncDerivedKey is the derived key, encrypted for the subject (OIDC_SUBJECT_KEY)
+	EncDerivedKey string `json:"enc_derived_key,omitempty"`
+}
+
+var (
+	oidcProvider        *oidcProviderMetadata
+	oidcProviderFetched time.Time
+	oidcJWKS            map[string]any
+	oidcMutex           sync.Mutex
+
+	oidcAuthRequests      = map[string]*oidcAuthRequest{}
+	oidcAuthRequestsMutex sync.Mutex
+
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// OIDCEnabled checks if single sign-on is configured
+func OIDCEnabled() bool {
+	return Settings.OIDCIssuer != "" && Settings.OIDCClientID != "" && Settings.OIDCRedirectURL != ""
+}
+
+// PasswordLoginDisabled checks if users have to log in with single sign-on
+// (the password only unlocks the data then)
+func PasswordLoginDisabled() bool {
+	return OIDCEnabled() && Settings.OIDCDisablePasswordLogin
+}
+
+// OIDCAuthURL starts a login at the provider. Returns the URL to redirect the
+// browser to and the state, which comes back with the code.
+func OIDCAuthURL() (string, string, error) {
+	if !OIDCEnabled() {
+		return "", "", ErrOIDCDisabled
+	}
+
+	provider, err := oidcDiscover()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := oidcRandom()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := oidcRandom()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := oidcRandom()
+	if err != nil {
+		return "", "", err
+	}
+
+	oidcAuthRequestsMutex.Lock()
+	// Remove expired requests
+	for s, request := range oidcAuthRequests {
+		if time.Now().After(request.expires) {
+			delete(oidcAuthRequests, s)
+		}
+	}
+	oidcAuthRequests[state] = &oidcAuthRequest{
+		nonce:    nonce,
+		verifier: verifier,
+		expires:  time.Now().Add(oidcAuthRequestTTL),
+	}
+	oidcAuthRequestsMutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {Settings.OIDCClientID},
+		"redirect_uri":          {Settings.OIDCRedirectURL},
+		"scope":                 {strings.Join(Settings.OIDCScopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// OIDCExchange exchanges the code of a login for the tokens and returns the
+// identity from the checked ID token. Every state can only be used once.
+func OIDCExchange(code, state string) (*OIDCIdentity, error) {
+	if !OIDCEnabled() {
+		return nil, ErrOIDCDisabled
+	}
+
+	oidcAuthRequestsMutex.Lock()
+	request, ok := oidcAuthRequests[state]
+	delete(oidcAuthRequests, state)
+	oidcAuthRequestsMutex.Unlock()
+
+	if !ok || time.Now().After(request.expires) {
+		return nil, fmt.Errorf("unknown or expired state")
+	}
+
+	provider, err := oidcDiscover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {Settings.OIDCRedirectURL},
+		"code_verifier": {request.verifier},
+	}
+
+	// Public clients only send their ID. Confidential clients use HTTP Basic,
+	// unless the provider only supports the secret in the body.
+	useBasicAuth := false
+	if Settings.OIDCClientSecret == "" {
+		form.Set("client_id", Settings.OIDCClientID)
+	} else if len(provider.TokenAuthMethods) == 0 || slices.Contains(provider.TokenAuthMethods, "client_secret_basic") {
+		useBasicAuth = true
+	} else {
+		form.Set("client_id", Settings.OIDCClientID)
+		form.Set("client_secret", Settings.OIDCClientSecret)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if useBasicAuth {
+		req.SetBasicAuth(url.QueryEscape(Settings.OIDCClientID), url.QueryEscape(Settings.OIDCClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting tokens: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error reading tokens: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("error parsing tokens: %v", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("no ID token in the response")
+	}
+
+	return verifyIDToken(provider, tokens.IDToken, request.nonce)
+}
+
+// verifyIDToken checks the signature and the claims of an ID token
+func verifyIDToken(provider *oidcProviderMetadata, rawToken, nonce string) (*OIDCIdentity, error) {
+	// HMAC would use the client secret, only keys of the provider are accepted
+	algs := []string{}
+	for _, alg := range provider.SigningAlgs {
+		if alg != "none" && !strings.HasPrefix(alg, "HS") {
+			algs = append(algs, alg)
+		}
+	}
+	if len(algs) == 0 {
+		algs = []string{"RS256"}
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return oidcSigningKey(kid)
+	},
+		jwt.WithValidMethods(algs),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(Settings.OIDCClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); !hmac.Equal([]byte(tokenNonce), []byte(nonce)) {
+		return nil, fmt.Errorf("invalid ID token: nonce does not match")
+	}
+	// A token for several audiences must be issued to this client
+	if azp, ok := claims["azp"].(string); ok && azp != Settings.OIDCClientID {
+		return nil, fmt.Errorf("invalid ID token: issued to %s", azp)
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("invalid ID token: no subject")
+	}
+
+	identity := &OIDCIdentity{Issuer: provider.Issuer, Subject: subject}
+	identity.Username, _ = claims["preferred_username"].(string)
+	identity.Email, _ = claims["email"].(string)
+	return identity, nil
+}
+
+// oidcDiscover returns the metadata of the provider (cached for oidcDiscoveryTTL)
+func oidcDiscover() (*oidcProviderMetadata, error) {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+
+	if oidcProvider != nil && time.Since(oidcProviderFetched) < oidcDiscoveryTTL {
+		return oidcProvider, nil
+	}
+
+	provider := &oidcProviderMetadata{}
+	if err := oidcGetJSON(Settings.OIDCIssuer+"/.well-known/openid-configuration", provider); err != nil {
+		return nil, fmt.Errorf("error loading the discovery document: %v", err)
+	}
+
+	if strings.TrimSuffix(provider.Issuer, "/") != Settings.OIDCIssuer {
+		return nil, fmt.Errorf("issuer of the discovery document is %s, expected %s", provider.Issuer, Settings.OIDCIssuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is incomplete")
+	}
+
+	oidcProvider = provider
+	oidcProviderFetched = time.Now()
+	oidcJWKS = nil
+	return provider, nil
+}
+
+// oidcSigningKey returns a public key of the provider. The keys are loaded
+// again if the key is unknown (the provider rotated its keys).
+func oidcSigningKey(kid string) (any, error) {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+
+	if key, ok := oidcJWKS[kid]; ok {
+		return key, nil
+	}
+	if oidcProvider == nil {
+		return nil, fmt.Errorf("provider not discovered")
+	}
+
+	var jwks struct {
+		Keys []map[string]any `json:"keys"`
+	}
+	if err := oidcGetJSON(oidcProvider.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("error loading the keys of the provider: %v", err)
+	}
+
+	keys := map[string]any{}
+	for _, jwk := range jwks.Keys {
+		if use, ok := jwk["use"].(string); ok && use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			Logger.Printf("Skipping key of the provider: %v", err)
+			continue
+		}
+		id, _ := jwk["kid"].(string)
+		keys[id] = key
+	}
+	oidcJWKS = keys
+
+	// Tokens without key id are accepted if the provider has only one key
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+// parseJWK converts a public key in JWK format (RSA, EC or Ed25519)
+func parseJWK(jwk map[string]any) (any, error) {
+	field := func(name string) ([]byte, error) {
+		value, _ := jwk[name].(string)
+		if value == "" {
+			return nil, fmt.Errorf("missing %s", name)
+		}
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	}
+
+	switch jwk["kty"] {
+	case "RSA":
+		n, err := field("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := field("e")
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk["crv"] {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", jwk["crv"])
+		}
+		x, err := field("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := field("y")
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		return key, nil
+
+	case "OKP":
+		if jwk["crv"] != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %v", jwk["crv"])
+		}
+		x, err := field("x")
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %v", jwk["kty"])
+}
+
+func oidcGetJSON(url string, target any) error {
+	resp, err := oidcHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(target)
+}
+
+// oidcRandom returns a random string for state, nonce and PKCE verifier
+func oidcRandom() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("error generating random value: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// OIDCUserBySubject returns the ID and name of the user linked to the
+// identity (0 if no user is linked)
+func OIDCUserBySubject(identity *OIDCIdentity) (int, string, error) {
+	UsersFileMutex.RLock()
+	defer UsersFileMutex.RUnlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return 0, "", fmt.Errorf("error retrieving users: %v", err)
+	}
+
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		user, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		link, ok := user["oidc"].(map[string]any)
+		if !ok || link["issuer"] != identity.Issuer || link["subject"] != identity.Subject {
+			continue
+		}
+		id, _ := user["user_id"].(float64)
+		username, _ := user["username"].(string)
+		return int(id), username, nil
+	}
+
+	return 0, "", nil
+}
+
+// GetOIDCLink returns the mapping of a user to the provider (nil if not linked)
+func GetOIDCLink(userID int) (*OIDCLink, error) {
+	value, err := getUserValue(userID, "oidc")
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	// users.json is read as map[string]any, convert it back
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	link := &OIDCLink{}
+	if err := json.Unmarshal(data, link); err != nil {
+		return nil, fmt.Errorf("error reading single sign-on link: %v", err)
+	}
+	return link, nil
+}
+
+// LinkOIDC maps the identity to a user. With OIDC_SUBJECT_KEY, the derived key
+// is stored for the subject as well. Fails if another user is linked to it.
+func LinkOIDC(userID int, identity *OIDCIdentity, derivedKey string) error {
+	link := OIDCLink{
+		Issuer:  identity.Issuer,
+		Subject: identity.Subject,
+		Linked:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if existing, err := GetOIDCLink(userID); err == nil && existing != nil &&
+		existing.Issuer == link.Issuer && existing.Subject == link.Subject {
+		link.Linked = existing.Linked
+	}
+
+	if Settings.OIDCSubjectKey {
+		key, err := oidcSubjectKey(identity)
+		if err != nil {
+			return err
+		}
+		if link.EncDerivedKey, err = EncryptText(derivedKey, key); err != nil {
+			return fmt.Errorf("error encrypting derived key: %v", err)
+		}
+	}
+
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return fmt.Errorf("error retrieving users: %v", err)
+	}
+
+	var user map[string]any
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		entry, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		id, _ := entry["user_id"].(float64)
+		if int(id) == userID {
+			user = entry
+			continue
+		}
+		if other, ok := entry["oidc"].(map[string]any); ok && other["issuer"] == link.Issuer && other["subject"] == link.Subject {
+			return fmt.Errorf("the identity is already linked to another user")
+		}
+	}
+	if user == nil {
+		return fmt.Errorf("user %d not found", userID)
+	}
+
+	user["oidc"] = link
+	return WriteUsers(users)
+}
+
+// UnlinkOIDC removes the mapping of a user to the provider
+func UnlinkOIDC(userID int) error {
+	return setUserValue(userID, "oidc", nil)
+}
+
+// UnlockWithOIDCSubject decrypts the derived key that is stored for the
+// subject (OIDC_SUBJECT_KEY). Returns an empty string if there is none.
+func UnlockWithOIDCSubject(userID int, identity *OIDCIdentity) (string, error) {
+	if !Settings.OIDCSubjectKey {
+		return "", nil
+	}
+
+	link, err := GetOIDCLink(userID)
+	if err != nil || link == nil || link.EncDerivedKey == "" {
+		return "", err
+	}
+
+	key, err := oidcSubjectKey(identity)
+	if err != nil {
+		return "", err
+	}
+	derivedKey, err := DecryptText(link.EncDerivedKey, key)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting derived key: %v", err)
+	}
+
+	// Replace the derived key if it is from before an Argon2 upgrade
+	currentKey, err := resolveUserDerivedKey(userID, derivedKey)
+	if err != nil {
+		return "", err
+	}
+	if currentKey != derivedKey {
+		if err := LinkOIDC(userID, identity, currentKey); err != nil {
+			return "", err
+		}
+	}
+	return currentKey, nil
+}
+
+// oidcSubjectKey derives the key for the derived key of a subject from the
+// secret in oidc_key.json (created on first use)
+func oidcSubjectKey(identity *OIDCIdentity) (string, error) {
+	secret, err := oidcSecret()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(identity.Issuer + "\n" + identity.Subject))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+var oidcSecretMutex sync.Mutex
+
+func oidcSecret() ([]byte, error) {
+	oidcSecretMutex.Lock()
+	defer oidcSecretMutex.Unlock()
+
+	var content struct {
+		Secret string `json:"secret"`
+	}
+
+	path := filepath.Join(Settings.DataPath, oidcKeyFilename)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &content); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", oidcKeyFilename, err)
+		}
+		return base64.URLEncoding.DecodeString(content.Secret)
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading %s: %v", oidcKeyFilename, err)
+	}
+
+	content.Secret = GenerateSecretToken()
+	data, err = json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := createAtomicFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := file.Chmod(0600); err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(data); err != nil {
+		return nil, err
+	}
+	if err := file.Commit(); err != nil {
+		return nil, err
+	}
+
+	Logger.Printf("Created %s for the keys of single sign-on subjects", oidcKeyFilename)
+	return base64.URLEncoding.DecodeString(content.Secret)
+}
@@ -0,0 +1,287 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Passkeys (WebAuthn) as replacement of the password. Like a backup code, a
+// passkey stores a copy of the derived key of the user, encrypted with a key
+// from the output of the PRF extension (hmac-secret) of the authenticator.
+// The PRF output is only available while the authenticator is used, so the
+// derived key can't be decrypted with the data in users.json alone.
+//
+// users.json: "passkeys" (list of Passkey). Like the backup codes, they are
+// removed when the password changes (the derived key changes).
+
+// PasskeysMutex makes reading and saving the passkeys of a user atomic, e.g. a
+// login with a passkey must not save the list again after a passkey was
+// removed. It is taken before UsersFileMutex (see LockManager for the order).
+var PasskeysMutex sync.Mutex
+
+// ErrPasskeysDisabled is returned if WEBAUTHN_ORIGINS is not set
+var ErrPasskeysDisabled = errors.New("passkeys are not configured")
+
+// WebAuthn is the relying party of the server (nil if passkeys are disabled)
+var WebAuthn *webauthn.WebAuthn
+
+// PasskeyPRFInput is the input of the PRF extension. The output is still
+// different per passkey, because every credential has its own secret.
+var PasskeyPRFInput = func() []byte {
+	sum := sha256.Sum256([]byte("DailyTxT passkey key"))
+	return sum[:]
+}()
+
+// Passkey is a passkey of a user as stored in users.json
+type Passkey struct {
+	ID            string              `json:"id"`
+	Name          string              `json:"name"`
+	Created       string              `json:"created"`
+	LastUsed      string              `json:"last_used,omitempty"`
+	Credential    webauthn.Credential `json:"credential"`
+	Salt          string              `json:"salt"`
+	EncDerivedKey string              `json:"enc_derived_key"`
+}
+
+// PasskeyUser is a user as seen by WebAuthn
+type PasskeyUser struct {
+	UserID   int
+	Username string
+	Passkeys []Passkey
+}
+
+// WebAuthnID returns the user handle, which is stored in the passkey
+func (u *PasskeyUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.UserID))
+}
+
+func (u *PasskeyUser) WebAuthnName() string {
+	return u.Username
+}
+
+func (u *PasskeyUser) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+func (u *PasskeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.Passkeys))
+	for i, passkey := range u.Passkeys {
+		credentials[i] = passkey.Credential
+	}
+	return credentials
+}
+
+// InitWebAuthn sets up the relying party from WEBAUTHN_ORIGINS. The RP ID is
+// the host of the first origin.
+func InitWebAuthn() error {
+	if len(Settings.WebAuthnOrigins) == 0 {
+		Logger.Println("WEBAUTHN_ORIGINS is empty, passkeys are disabled")
+		return nil
+	}
+
+	origin, err := url.Parse(Settings.WebAuthnOrigins[0])
+	if err != nil || origin.Hostname() == "" {
+		return fmt.Errorf("invalid origin in WEBAUTHN_ORIGINS: %s", Settings.WebAuthnOrigins[0])
+	}
+
+	WebAuthn, err = webauthn.New(&webauthn.Config{
+		RPID:          origin.Hostname(),
+		RPDisplayName: "DailyTxT",
+		RPOrigins:     Settings.WebAuthnOrigins,
+	})
+	return err
+}
+
+// GetPasskeyUser loads a user with the passkeys
+func GetPasskeyUser(userID int) (*PasskeyUser, error) {
+	username, err := getUserValue(userID, "username")
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys, err := GetPasskeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	name, _ := username.(string)
+	return &PasskeyUser{UserID: userID, Username: name, Passkeys: passkeys}, nil
+}
+
+// PasskeyUserByHandle loads the user of a discoverable login by the user handle of the passkey
+func PasskeyUserByHandle(userHandle []byte) (*PasskeyUser, error) {
+	userID, err := strconv.Atoi(string(userHandle))
+	if err != nil {
+		return nil, fmt.Errorf("invalid user handle")
+	}
+	return GetPasskeyUser(userID)
+}
+
+// GetPasskeys returns the passkeys of a user
+func GetPasskeys(userID int) ([]Passkey, error) {
+	value, err := getUserValue(userID, "passkeys")
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys := []Passkey{}
+	if value == nil {
+		return passkeys, nil
+	}
+
+	// users.json is read as map[string]any, convert it back
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &passkeys); err != nil {
+		Logger.Printf("Error reading passkeys of user %d: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read passkeys")
+	}
+	return passkeys, nil
+}
+
+func savePasskeys(userID int, passkeys []Passkey) error {
+	if len(passkeys) == 0 {
+		return setUserValue(userID, "passkeys", nil)
+	}
+	return setUserValue(userID, "passkeys", passkeys)
+}
+
+// passkeyKey derives the key that encrypts the derived key from the PRF output
+func passkeyKey(prfOutput []byte, salt string) (string, error) {
+	if len(prfOutput) != 32 {
+		return "", fmt.Errorf("invalid PRF output")
+	}
+
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := hkdf.Key(sha256.New, prfOutput, saltBytes, "dailytxt passkey", 32)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(key), nil
+}
+
+// AddPasskey saves a new passkey with a copy of the derived key, encrypted with the PRF output
+func AddPasskey(userID int, name string, credential *webauthn.Credential, prfOutput []byte, derivedKey string) error {
+	// Generate a random salt
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("error generating salt: %v", err)
+	}
+	saltBase64 := base64.StdEncoding.EncodeToString(salt)
+
+	key, err := passkeyKey(prfOutput, saltBase64)
+	if err != nil {
+		return fmt.Errorf("error deriving key from PRF output: %v", err)
+	}
+
+	encDerivedKey, err := EncryptText(derivedKey, key)
+	if err != nil {
+		return fmt.Errorf("error encrypting derived key: %v", err)
+	}
+
+	PasskeysMutex.Lock()
+	defer PasskeysMutex.Unlock()
+
+	passkeys, err := GetPasskeys(userID)
+	if err != nil {
+		return err
+	}
+
+	passkeys = append(passkeys, Passkey{
+		ID:            base64.RawURLEncoding.EncodeToString(credential.ID),
+		Name:          name,
+		Created:       time.Now().UTC().Format(time.RFC3339),
+		Credential:    *credential,
+		Salt:          saltBase64,
+		EncDerivedKey: encDerivedKey,
+	})
+	return savePasskeys(userID, passkeys)
+}
+
+// UnlockWithPasskey decrypts the derived key of a user after a login with a
+// passkey and saves the new state (sign count) of the credential. Returns the
+// derived key and the id of the passkey.
+func UnlockWithPasskey(userID int, credential *webauthn.Credential, prfOutput []byte) (string, string, error) {
+	PasskeysMutex.Lock()
+	defer PasskeysMutex.Unlock()
+
+	passkeys, err := GetPasskeys(userID)
+	if err != nil {
+		return "", "", err
+	}
+
+	for i, passkey := range passkeys {
+		if !bytes.Equal(passkey.Credential.ID, credential.ID) {
+			continue
+		}
+
+		key, err := passkeyKey(prfOutput, passkey.Salt)
+		if err != nil {
+			return "", "", err
+		}
+
+		derivedKey, err := DecryptText(passkey.EncDerivedKey, key)
+		if err != nil {
+			return "", "", fmt.Errorf("error decrypting derived key: %v", err)
+		}
+
+		// Replace the derived key if it is from before an Argon2 upgrade
+		currentKey, err := resolveUserDerivedKey(userID, derivedKey)
+		if err != nil {
+			return "", "", err
+		}
+		if currentKey != derivedKey {
+			derivedKey = currentKey
+			if passkeys[i].EncDerivedKey, err = EncryptText(derivedKey, key); err != nil {
+				return "", "", fmt.Errorf("error encrypting derived key: %v", err)
+			}
+		}
+
+		passkeys[i].Credential.Authenticator = credential.Authenticator
+		passkeys[i].LastUsed = time.Now().UTC().Format(time.RFC3339)
+		if err := savePasskeys(userID, passkeys); err != nil {
+			return "", "", err
+		}
+		return derivedKey, passkey.ID, nil
+	}
+
+	return "", "", fmt.Errorf("passkey not found")
+}
+
+// DeletePasskey removes a passkey of a user. Returns the removed passkey (nil
+// if it doesn't exist).
+func DeletePasskey(userID int, id string) (*Passkey, error) {
+	PasskeysMutex.Lock()
+	defer PasskeysMutex.Unlock()
+
+	passkeys, err := GetPasskeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, passkey := range passkeys {
+		if passkey.ID == id {
+			passkeys = append(passkeys[:i], passkeys[i+1:]...)
+			return &passkey, savePasskeys(userID, passkeys)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"crypto/rand"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestDeletePasskeyIsNotUndoneByALogin(t *testing.T) {
+	derivedKey := newMigrationTestUser(t)
+
+	prfOutput := make([]byte, 32)
+	rand.Read(prfOutput)
+	credential := &webauthn.Credential{ID: []byte("credential-1")}
+	if err := AddPasskey(1, "Phone", credential, prfOutput, derivedKey); err != nil {
+		t.Fatalf("adding passkey: %v", err)
+	}
+	passkeys, _ := GetPasskeys(1)
+	if len(passkeys) != 1 {
+		t.Fatalf("passkeys = %d, want 1", len(passkeys))
+	}
+
+	// Logins with the passkey while it is removed
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			UnlockWithPasskey(1, credential, prfOutput)
+		})
+	}
+	removed, err := DeletePasskey(1, passkeys[0].ID)
+	if err != nil || removed == nil {
+		t.Fatalf("removing passkey: %v (removed: %v)", err, removed)
+	}
+	wg.Wait()
+
+	if passkeys, _ := GetPasskeys(1); len(passkeys) != 0 {
+		t.Fatalf("the removed passkey is back: %+v", passkeys)
+	}
+	if _, _, err := UnlockWithPasskey(1, credential, prfOutput); err == nil {
+		t.Error("login with the removed passkey succeeded")
+	}
+}
+
+func TestUnlockWithPasskeyReturnsTheDerivedKey(t *testing.T) {
+	derivedKey := newMigrationTestUser(t)
+
+	prfOutput := make([]byte, 32)
+	rand.Read(prfOutput)
+	credential := &webauthn.Credential{ID: []byte("credential-1")}
+	if err := AddPasskey(1, "Phone", credential, prfOutput, derivedKey); err != nil {
+		t.Fatalf("adding passkey: %v", err)
+	}
+
+	key, id, err := UnlockWithPasskey(1, credential, prfOutput)
+	if err != nil {
+		t.Fatalf("unlocking: %v", err)
+	}
+	if key != derivedKey || id == "" {
+		t.Errorf("UnlockWithPasskey = %q, %q, want the derived key and the passkey id", key, id)
+	}
+
+	// Another authenticator doesn't have the same PRF output
+	wrong := make([]byte, 32)
+	rand.Read(wrong)
+	if _, _, err := UnlockWithPasskey(1, credential, wrong); err == nil {
+		t.Error("unlocking with a wrong PRF output succeeded")
+	}
+}
+
+func TestRevokePasskeySessions(t *testing.T) {
+	derivedKey := newMigrationTestUser(t)
+	previous := Settings.LogoutAfterDays
+	Settings.LogoutAfterDays = 30
+	t.Cleanup(func() { Settings.LogoutAfterDays = previous })
+	r := httptest.NewRequest("POST", "/users/passkeyLogin", nil)
+
+	withPasskey, _, err := CreateSession(1, r, derivedKey, "passkey-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withPassword, _, err := CreateSession(1, r, derivedKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withOtherPasskey, _, err := CreateSession(1, r, derivedKey, "passkey-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, err := RevokePasskeySessions(1, "passkey-1")
+	if err != nil || revoked != 1 {
+		t.Fatalf("RevokePasskeySessions = %d, %v, want 1 session", revoked, err)
+	}
+
+	for id, want := range map[string]bool{withPasskey: false, withPassword: true, withOtherPasskey: true} {
+		if session, _ := findSession(1, id); (session != nil) != want {
+			t.Errorf("session %s exists = %v, want %v", id, session != nil, want)
+		}
+	}
+}
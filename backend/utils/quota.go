@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Storage quotas. The default quota is set with USER_QUOTA_MB, the admin can
+// set a different quota for single users ("quota_mb" in users.json, 0 means
+// unlimited). Calculating the disk usage of a user is expensive (all files are
+// listed), so it is cached and only adjusted by the writes in between.
+
+// ErrQuotaExceeded is returned if a write would exceed the quota of the user
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Cached disk usage is recalculated after this time
+const quotaUsageTTL = 10 * time.Minute
+
+type cachedUsage struct {
+	size       int64
+	calculated time.Time
+}
+
+// QuotaReader reserves the quota in chunks of this size
+const quotaReserveChunk = 4 << 20
+
+var (
+	usageCache      = map[int]cachedUsage{}
+	usageCacheMutex sync.Mutex
+	// Bytes reserved by the writes in progress of each user
+	quotaReserved = map[int]int64{}
+)
+
+// UserQuota returns the quota of a user in bytes (0 is unlimited)
+func UserQuota(userID int) int64 {
+	if quotaMB, ok := UserQuotaOverride(userID); ok {
+		return int64(quotaMB) << 20
+	}
+	return int64(Settings.DefaultQuotaMB) << 20
+}
+
+// UserQuotaOverride returns the quota (in MB) the admin set for a user
+func UserQuotaOverride(userID int) (int, bool) {
+	value, err := getUserValue(userID, "quota_mb")
+	if err != nil {
+		return 0, false
+	}
+	quotaMB, ok := value.(float64)
+	if !ok {
+		return 0, false
+	}
+	return int(quotaMB), true
+}
+
+// SetUserQuotaOverride sets the quota (in MB, 0 is unlimited) of a user. nil
+// removes it, then the default quota applies.
+func SetUserQuotaOverride(userID int, quotaMB *int) error {
+	if quotaMB == nil {
+		return setUserValue(userID, "quota_mb", nil)
+	}
+	return setUserValue(userID, "quota_mb", *quotaMB)
+}
+
+// UserUsage returns the disk usage of a user (cached)
+func UserUsage(userID int) (int64, error) {
+	usageCacheMutex.Lock()
+	cached, ok := usageCache[userID]
+	usageCacheMutex.Unlock()
+	if ok && time.Since(cached.calculated) < quotaUsageTTL {
+		return cached.size, nil
+	}
+
+	size, err := GetUserDiskUsage(userID)
+	if err != nil {
+		Logger.Printf("Error calculating disk usage of user %d: %v", userID, err)
+		return 0, fmt.Errorf("internal server error when trying to calculate disk usage")
+	}
+
+	usageCacheMutex.Lock()
+	usageCache[userID] = cachedUsage{size: size, calculated: time.Now()}
+	usageCacheMutex.Unlock()
+	return size, nil
+}
+
+// AddUserUsage adds written bytes to the cached disk usage of a user
+func AddUserUsage(userID int, size int64) {
+	usageCacheMutex.Lock()
+	defer usageCacheMutex.Unlock()
+
+	if cached, ok := usageCache[userID]; ok {
+		cached.size += size
+		usageCache[userID] = cached
+	}
+}
+
+// InvalidateUserUsage makes the disk usage of a user be recalculated (e.g. after deleting files)
+func InvalidateUserUsage(userID int) {
+	usageCacheMutex.Lock()
+	defer usageCacheMutex.Unlock()
+
+	delete(usageCache, userID)
+}
+
+// QuotaRemaining returns how many bytes a user can still store, without the
+// bytes reserved by writes in progress. ok is false if the user has no quota.
+func QuotaRemaining(userID int) (remaining int64, ok bool, err error) {
+	quota := UserQuota(userID)
+	if quota <= 0 {
+		return 0, false, nil
+	}
+
+	usage, err := UserUsage(userID)
+	if err != nil {
+		return 0, true, err
+	}
+
+	usageCacheMutex.Lock()
+	defer usageCacheMutex.Unlock()
+	return quotaAvailable(userID, quota, usage), true, nil
+}
+
+// quotaAvailable returns the bytes neither used nor reserved. The cached
+// usage is preferred, it contains the writes since usage was read.
+// usageCacheMutex must be held.
+func quotaAvailable(userID int, quota, usage int64) int64 {
+	if cached, ok := usageCache[userID]; ok {
+		usage = cached.size
+	}
+	return max(0, quota-usage-quotaReserved[userID])
+}
+
+// CheckQuota returns ErrQuotaExceeded if a user can't store size more bytes
+func CheckQuota(userID int, size int64) error {
+	remaining, limited, err := QuotaRemaining(userID)
+	if err != nil || !limited {
+		return err
+	}
+	if size > remaining {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// reserveQuota reserves up to size bytes of the remaining quota for a write
+// and returns how many bytes were reserved (0 if the quota is used up)
+func reserveQuota(userID int, quota, size int64) (int64, error) {
+	usage, err := UserUsage(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	usageCacheMutex.Lock()
+	defer usageCacheMutex.Unlock()
+
+	reserved := min(size, quotaAvailable(userID, quota, usage))
+	if reserved > 0 {
+		quotaReserved[userID] += reserved
+	}
+	return reserved, nil
+}
+
+// QuotaReader returns the content until the quota of the user is used up,
+// then ErrQuotaExceeded. It is used when the size is not known in advance
+// (uploads). The bytes are reserved in chunks while they are read, so
+// parallel writes of the user share the remaining quota instead of each
+// getting all of it. Release must be called after the write.
+func QuotaReader(userID int, content io.Reader) (*QuotaLimitedReader, error) {
+	quota := UserQuota(userID)
+	if quota > 0 {
+		// Calculate the usage now, so a failure is reported before the write
+		if _, err := UserUsage(userID); err != nil {
+			return nil, err
+		}
+	}
+	return &QuotaLimitedReader{userID: userID, reader: content, quota: quota}, nil
+}
+
+// QuotaLimitedReader is the reader returned by QuotaReader
+type QuotaLimitedReader struct {
+	userID    int
+	reader    io.Reader
+	quota     int64 // 0 is unlimited
+	remaining int64 // reserved bytes not read yet
+	reserved  int64 // reserved bytes in total
+}
+
+func (q *QuotaLimitedReader) Read(p []byte) (int, error) {
+	if q.quota <= 0 {
+		return q.reader.Read(p)
+	}
+
+	if q.remaining <= 0 {
+		reserved, err := reserveQuota(q.userID, q.quota, max(int64(len(p)), quotaReserveChunk))
+		if err != nil {
+			return 0, err
+		}
+		q.remaining += reserved
+		q.reserved += reserved
+	}
+
+	if q.remaining <= 0 {
+		// Only an error if there is more data
+		var probe [1]byte
+		n, err := q.reader.Read(probe[:])
+		if n > 0 {
+			return 0, ErrQuotaExceeded
+		}
+		return 0, err
+	}
+	if int64(len(p)) > q.remaining {
+		p = p[:q.remaining]
+	}
+	n, err := q.reader.Read(p)
+	q.remaining -= int64(n)
+	return n, err
+}
+
+// Release adds the stored bytes to the cached disk usage of the user and
+// frees the reservation. stored is 0 if nothing was kept (e.g. the write
+// failed or the content was only buffered).
+func (q *QuotaLimitedReader) Release(stored int64) {
+	usageCacheMutex.Lock()
+	defer usageCacheMutex.Unlock()
+
+	if q.reserved > 0 {
+		quotaReserved[q.userID] -= q.reserved
+		if quotaReserved[q.userID] <= 0 {
+			delete(quotaReserved, q.userID)
+		}
+		q.remaining, q.reserved = 0, 0
+	}
+
+	if cached, ok := usageCache[q.userID]; ok {
+		cached.size += stored
+		usageCache[q.userID] = cached
+	}
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// setTestQuota gives all users a quota of quotaMB and no usage
+func setTestQuota(t *testing.T, quotaMB int) {
+	t.Helper()
+
+	newIntegrityTestStore(t)
+	previousQuota := Settings.DefaultQuotaMB
+	Settings.DefaultQuotaMB = quotaMB
+	t.Cleanup(func() {
+		Settings.DefaultQuotaMB = previousQuota
+		usageCacheMutex.Lock()
+		clear(usageCache)
+		clear(quotaReserved)
+		usageCacheMutex.Unlock()
+	})
+}
+
+func TestQuotaReaderSharesTheQuota(t *testing.T) {
+	setTestQuota(t, 6)
+	const quota = 6 << 20
+
+	// Two parallel uploads of 4 MB each: only one fits
+	first, err := QuotaReader(1, bytes.NewReader(make([]byte, 4<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := QuotaReader(1, bytes.NewReader(make([]byte, 4<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(first, make([]byte, 4<<20)); err != nil {
+		t.Fatalf("reading the first upload: %v", err)
+	}
+	if remaining, _, _ := QuotaRemaining(1); remaining != quota-4<<20 {
+		t.Errorf("remaining quota during the upload = %d, want %d", remaining, quota-4<<20)
+	}
+
+	if _, err := io.Copy(io.Discard, second); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("reading the second upload: err = %v, want ErrQuotaExceeded", err)
+	}
+	second.Release(0)
+
+	// Only the stored bytes count after the release
+	first.Release(4 << 20)
+	if remaining, _, _ := QuotaRemaining(1); remaining != quota-4<<20 {
+		t.Errorf("remaining quota after the upload = %d, want %d", remaining, quota-4<<20)
+	}
+	if len(quotaReserved) != 0 {
+		t.Errorf("reservations after the release = %v, want none", quotaReserved)
+	}
+}
+
+func TestQuotaReaderReleasesUnusedReservation(t *testing.T) {
+	setTestQuota(t, 1)
+
+	for _, tc := range []struct {
+		name    string
+		content int
+		stored  int64
+		wantErr bool
+	}{
+		{name: "empty", content: 0, stored: 0},
+		{name: "small", content: 100, stored: 100},
+		{name: "failed write", content: 100, stored: 0},
+		{name: "too large", content: 2 << 20, stored: 0, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			usageCacheMutex.Lock()
+			clear(usageCache)
+			usageCacheMutex.Unlock()
+
+			reader, err := QuotaReader(1, bytes.NewReader(make([]byte, tc.content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = io.Copy(io.Discard, reader)
+			if gotErr := errors.Is(err, ErrQuotaExceeded); gotErr != tc.wantErr {
+				t.Fatalf("err = %v, want quota exceeded: %v", err, tc.wantErr)
+			}
+			reader.Release(tc.stored)
+
+			remaining, _, _ := QuotaRemaining(1)
+			if want := int64(1<<20) - tc.stored; remaining != want {
+				t.Errorf("remaining quota = %d, want %d", remaining, want)
+			}
+		})
+	}
+}
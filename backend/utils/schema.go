@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// MonthSchemaVersion is the version of the month files written by this server.
+// Month files without "schema_version" are version 0.
+//
+// To change the format: increase MonthSchemaVersion and register a function
+// in monthUpgrades that converts a month of the previous version. Upgrades
+// run when a month is read, the upgraded month is stored on the next write.
+const MonthSchemaVersion = 1
+
+// monthUpgrades[v] upgrades a month document from version v to v+1
+var monthUpgrades = map[int]func(content map[string]any) error{
+	0: upgradeMonthV0,
+}
+
+func init() {
+	for version := 0; version < MonthSchemaVersion; version++ {
+		if monthUpgrades[version] == nil {
+			panic(fmt.Sprintf("no upgrade registered for month schema version %d", version))
+		}
+	}
+}
+
+// monthSchemaVersion returns the version of a month document
+func monthSchemaVersion(content map[string]any) int {
+	version, _ := content["schema_version"].(float64)
+	return int(version)
+}
+
+// UpgradeMonth upgrades a month document in place to MonthSchemaVersion.
+// Empty documents (month does not exist) are left untouched.
+func UpgradeMonth(content map[string]any) error {
+	if len(content) == 0 {
+		return nil
+	}
+
+	version := monthSchemaVersion(content)
+	if version > MonthSchemaVersion {
+		return fmt.Errorf("month has schema version %d, this server only supports up to %d", version, MonthSchemaVersion)
+	}
+
+	for ; version < MonthSchemaVersion; version++ {
+		if err := monthUpgrades[version](content); err != nil {
+			return fmt.Errorf("error upgrading month from schema version %d: %v", version, err)
+		}
+		content["schema_version"] = float64(version + 1)
+	}
+
+	return nil
+}
+
+// upgradeMonthV0 normalizes the types of the untyped version 0 files:
+// numbers that were stored as strings (day, pin ids, tag ids), bookmarks
+// stored as numbers and entries that are no objects at all.
+//
+// Nothing is deleted. Entries that can't be used (days without a day number,
+// files without uuid, pins without coordinates, ...) are moved to the list
+// "quarantined_<key>" of the object they were found in, where they survive
+// all later reads and writes and can be repaired by hand.
+func upgradeMonthV0(content map[string]any) error {
+	daysAny, _ := listValue(content, "days")
+	days := make([]any, 0, len(daysAny))
+
+	for _, dayInterface := range daysAny {
+		day, ok := dayInterface.(map[string]any)
+		if !ok {
+			Logger.Printf("Schema upgrade: quarantining invalid day entry %v", dayInterface)
+			quarantine(content, "days", dayInterface)
+			continue
+		}
+
+		dayNum, ok := ToNumber(day["day"])
+		if !ok {
+			Logger.Printf("Schema upgrade: quarantining day without valid day number %v", day["day"])
+			quarantine(content, "days", day)
+			continue
+		}
+		day["day"] = dayNum
+
+		// Encrypted values must be strings
+		for _, key := range []string{"text", "date_written"} {
+			if value, ok := day[key]; ok {
+				if _, ok := value.(string); !ok {
+					quarantine(day, key, value)
+					delete(day, key)
+				}
+			}
+		}
+
+		if bookmarked, ok := day["isBookmarked"]; ok {
+			day["isBookmarked"] = ToBool(bookmarked)
+		}
+
+		if tagsAny, ok := listValue(day, "tags"); ok {
+			tags := make([]any, 0, len(tagsAny))
+			for _, t := range tagsAny {
+				if id, ok := ToNumber(t); ok {
+					tags = append(tags, id)
+				} else {
+					quarantine(day, "tags", t)
+				}
+			}
+			day["tags"] = tags
+		}
+
+		if filesAny, ok := listValue(day, "files"); ok {
+			files := make([]any, 0, len(filesAny))
+			for _, f := range filesAny {
+				file, ok := f.(map[string]any)
+				if !ok {
+					quarantine(day, "files", f)
+					continue
+				}
+				if uuid, ok := file["uuid_filename"].(string); !ok || uuid == "" {
+					Logger.Printf("Schema upgrade: quarantining file without uuid in day %v", dayNum)
+					quarantine(day, "files", file)
+					continue
+				}
+				if _, ok := file["enc_filename"].(string); !ok {
+					file["enc_filename"] = ""
+				}
+				size, _ := ToNumber(file["size"])
+				file["size"] = size
+				files = append(files, file)
+			}
+			day["files"] = files
+		}
+
+		if pinsAny, ok := listValue(day, "pins"); ok {
+			pins := make([]any, 0, len(pinsAny))
+			maxID := 0.0
+			var withoutID []map[string]any
+			for _, p := range pinsAny {
+				pin, ok := p.(map[string]any)
+				if !ok {
+					quarantine(day, "pins", p)
+					continue
+				}
+				lat, latOk := pin["lat"].(string)
+				lon, lonOk := pin["lon"].(string)
+				if !latOk || !lonOk || lat == "" || lon == "" {
+					Logger.Printf("Schema upgrade: quarantining pin without coordinates in day %v", dayNum)
+					quarantine(day, "pins", pin)
+					continue
+				}
+				if _, ok := pin["text"].(string); !ok {
+					pin["text"] = ""
+				}
+				if id, ok := ToNumber(pin["id"]); ok && id > 0 {
+					pin["id"] = id
+					maxID = max(maxID, id)
+				} else {
+					withoutID = append(withoutID, pin)
+				}
+				pins = append(pins, pin)
+			}
+			// Pins without a usable id get new ones
+			for _, pin := range withoutID {
+				maxID++
+				pin["id"] = maxID
+			}
+			day["pins"] = pins
+		}
+
+		if historyAny, ok := listValue(day, "history"); ok {
+			history := make([]any, 0, len(historyAny))
+			for i, h := range historyAny {
+				entry, ok := h.(map[string]any)
+				if !ok {
+					quarantine(day, "history", h)
+					continue
+				}
+				if _, ok := entry["text"].(string); !ok {
+					quarantine(day, "history", entry)
+					continue
+				}
+				if dateWritten, ok := entry["date_written"]; ok {
+					if _, ok := dateWritten.(string); !ok {
+						quarantine(entry, "date_written", dateWritten)
+						delete(entry, "date_written")
+					}
+				}
+				if version, ok := ToNumber(entry["version"]); ok {
+					entry["version"] = version
+				} else {
+					entry["version"] = float64(i + 1)
+				}
+				history = append(history, entry)
+			}
+			day["history"] = history
+		}
+
+		days = append(days, day)
+	}
+
+	content["days"] = days
+	return nil
+}
+
+// listValue returns the list stored under key. A value that is no list is
+// quarantined, null values are removed.
+func listValue(object map[string]any, key string) ([]any, bool) {
+	value, ok := object[key]
+	if !ok {
+		return nil, false
+	}
+
+	list, ok := value.([]any)
+	if !ok {
+		if value != nil {
+			quarantine(object, key, value)
+		}
+		delete(object, key)
+		return nil, false
+	}
+
+	return list, true
+}
+
+// quarantine appends an unusable value of key to the list "quarantined_<key>" of the object
+func quarantine(object map[string]any, key string, value any) {
+	list, _ := object["quarantined_"+key].([]any)
+	object["quarantined_"+key] = append(list, value)
+}
+
+// ToNumber converts JSON numbers, Go ints and numeric strings to float64
+func ToNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		if parsed, err := strconv.Atoi(v); err == nil {
+			return float64(parsed), true
+		}
+	}
+	return 0, false
+}
+
+// ToBool converts bools, numbers and strings like "true" to bool
+func ToBool(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case int:
+		return v != 0
+	case string:
+		parsed, _ := strconv.ParseBool(v)
+		return parsed
+	}
+	return false
+}
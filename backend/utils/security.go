@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/subtle"
@@ -8,7 +9,7 @@ import (
 	"fmt"
 	"io"
 	"math/big"
-	"runtime"
+	"net/http"
 	"strings"
 	"time"
 
@@ -20,14 +21,18 @@ import (
 
 // Claims represents the JWT claims
 type Claims struct {
-	UserID     int    `json:"user_id"`
-	Username   string `json:"name"`
-	DerivedKey string `json:"derived_key"`
+	UserID   int    `json:"user_id"`
+	Username string `json:"name"`
+	// SessionKey decrypts the derived key stored in the session (see sessions.go)
+	SessionKey string `json:"session_key,omitempty"`
+	// DerivedKey is only set in tokens of older versions, which stored the
+	// derived key itself. They are replaced on their next request.
+	DerivedKey string `json:"derived_key,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken creates a new JWT token
-func GenerateToken(userID int, username, derivedKey string) (string, error) {
+// GenerateToken creates a new JWT token for a session
+func GenerateToken(userID int, username, sessionID, sessionKey string) (string, error) {
 	// Create expiration time
 	expirationTime := time.Now().Add(time.Duration(Settings.LogoutAfterDays) * 24 * time.Hour)
 
@@ -35,17 +40,24 @@ func GenerateToken(userID int, username, derivedKey string) (string, error) {
 	claims := &Claims{
 		UserID:     userID,
 		Username:   username,
-		DerivedKey: derivedKey,
+		SessionKey: sessionKey,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	// Create token
+	// Create token, the header names the signing key
+	key := currentJWTKey()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
 
-	// Sign token with secret key
-	tokenString, err := token.SignedString([]byte(Settings.SecretToken))
+	// Sign token with the current key of the key ring
+	secret, err := base64.URLEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return "", err
+	}
+	tokenString, err := token.SignedString(secret)
 	if err != nil {
 		return "", err
 	}
@@ -53,6 +65,18 @@ func GenerateToken(userID int, username, derivedKey string) (string, error) {
 	return tokenString, nil
 }
 
+// SetTokenCookie sets the cookie with the JWT token
+func SetTokenCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    token,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+		Expires:  time.Now().Add(time.Duration(Settings.LogoutAfterDays) * 24 * time.Hour),
+	})
+}
+
 // ValidateToken validates a JWT token and returns the claims
 func ValidateToken(tokenString string) (*Claims, error) {
 	// Parse token
@@ -63,7 +87,16 @@ func ValidateToken(tokenString string) (*Claims, error) {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return []byte(Settings.SecretToken), nil
+		// Tokens of older versions have no key id and were signed with SECRET_TOKEN
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			if Settings.SecretToken == "" {
+				return nil, fmt.Errorf("token without key id")
+			}
+			return []byte(Settings.SecretToken), nil
+		}
+
+		return jwtKeyByID(kid)
 	})
 
 	if err != nil {
@@ -87,10 +120,11 @@ type Argon2Configuration struct {
 }
 
 func getArgon2Configuration() *Argon2Configuration {
+	params := CurrentHashParams()
 	return &Argon2Configuration{
-		TimeCost:   5,
-		MemoryCost: 64 * 1024,
-		Threads:    uint8(runtime.NumCPU()),
+		TimeCost:   params.TimeCost,
+		MemoryCost: params.MemoryCost,
+		Threads:    params.Threads,
 		KeyLength:  32,
 	}
 }
@@ -184,8 +218,9 @@ func VerifyPassword(password, hashBase64 string) bool {
 	return subtle.ConstantTimeCompare(config.HashRaw, computedHash) == 1
 }
 
-// DeriveKeyFromPassword derives a key from a password and salt
-func DeriveKeyFromPassword(password, saltBase64 string) ([]byte, error) {
+// DeriveKeyFromPassword derives a key from a password and salt with the
+// Argon2 parameters stored along with the salt
+func DeriveKeyFromPassword(password, saltBase64 string, params Argon2Params) ([]byte, error) {
 	// Decode salt
 	salt, err := base64.StdEncoding.DecodeString(saltBase64)
 	if err != nil {
@@ -193,7 +228,7 @@ func DeriveKeyFromPassword(password, saltBase64 string) ([]byte, error) {
 	}
 
 	// Derive key
-	key := argon2.IDKey([]byte(password), salt, 3, 64*1024, 4, 32)
+	key := argon2.IDKey([]byte(password), salt, params.TimeCost, params.MemoryCost, params.Threads, 32)
 	return key, nil
 }
 
@@ -291,58 +326,28 @@ func DecryptText(ciphertext, key string) (string, error) {
 	return string(plaintext), nil
 }
 
-// EncryptFile encrypts a file using the provided key
+// EncryptFile encrypts a file using the provided key (see EncryptFileStream)
 func EncryptFile(data []byte, key string) ([]byte, error) {
-	// Decode key
-	keyBytes, err := base64.URLEncoding.DecodeString(key)
+	encrypter, err := EncryptFileStream(bytes.NewReader(data), key)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding key: %v", err)
-	}
-
-	// Create AEAD cipher
-	aead, err := chacha20poly1305.New(keyBytes)
-	if err != nil {
-		return nil, fmt.Errorf("error creating cipher: %v", err)
-	}
-
-	// Create nonce
-	nonce := make([]byte, aead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("error creating nonce: %v", err)
+		return nil, err
 	}
 
-	// Encrypt file
-	ciphertext := aead.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	return io.ReadAll(encrypter)
 }
 
-// DecryptFile decrypts a file using the provided key
+// DecryptFile decrypts a file using the provided key (see DecryptFileStream)
 func DecryptFile(ciphertext []byte, key string) ([]byte, error) {
-	// Decode key
-	keyBytes, err := base64.URLEncoding.DecodeString(key)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding key: %v", err)
+	if !isStreamFile(ciphertext) {
+		return decryptFileV1(ciphertext, key)
 	}
 
-	// Create AEAD cipher
-	aead, err := chacha20poly1305.New(keyBytes)
+	decrypter, err := DecryptFileStream(bytes.NewReader(ciphertext), key)
 	if err != nil {
-		return nil, fmt.Errorf("error creating cipher: %v", err)
-	}
-
-	// Extract nonce from ciphertext
-	if len(ciphertext) < aead.NonceSize() {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
-	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
-
-	// Decrypt file
-	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error decrypting ciphertext: %v", err)
+		return nil, err
 	}
 
-	return plaintext, nil
+	return io.ReadAll(decrypter)
 }
 
 // GetEncryptionKey retrieves the encryption key for a specific user
@@ -366,47 +371,52 @@ func GetEncryptionKey(userID int, derivedKey string) (string, error) {
 		}
 
 		if id, ok := user["user_id"].(float64); ok && int(id) == userID {
-			encEncKey, ok := user["enc_enc_key"].(string)
-			if !ok {
-				return "", fmt.Errorf("user data is not in the correct format")
-			}
+			return encryptionKeyOfUser(user, derivedKey)
+		}
+	}
 
-			// Decode derived key
-			derivedKeyBytes, err := base64.StdEncoding.DecodeString(derivedKey)
-			if err != nil {
-				return "", fmt.Errorf("error decoding derived key: %v", err)
-			}
+	return "", fmt.Errorf("user not found")
+}
 
-			// Create Fernet cipher
-			aead, err := CreateAEAD(derivedKeyBytes)
-			if err != nil {
-				return "", fmt.Errorf("error creating cipher: %v", err)
-			}
+// encryptionKeyOfUser decrypts the encryption key in the entry of a user in users.json
+func encryptionKeyOfUser(user map[string]any, derivedKey string) (string, error) {
+	encEncKey, ok := user["enc_enc_key"].(string)
+	if !ok {
+		return "", fmt.Errorf("user data is not in the correct format")
+	}
 
-			// Decode encrypted key
-			encEncKeyBytes, err := base64.StdEncoding.DecodeString(encEncKey)
-			if err != nil {
-				return "", fmt.Errorf("error decoding encrypted key: %v", err)
-			}
+	// Decode derived key
+	derivedKeyBytes, err := base64.StdEncoding.DecodeString(derivedKey)
+	if err != nil {
+		return "", fmt.Errorf("error decoding derived key: %v", err)
+	}
 
-			// Extract nonce from encrypted key
-			if len(encEncKeyBytes) < aead.NonceSize() {
-				return "", fmt.Errorf("encrypted key too short")
-			}
-			nonce, encKeyBytes := encEncKeyBytes[:aead.NonceSize()], encEncKeyBytes[aead.NonceSize():]
+	// Create Fernet cipher
+	aead, err := CreateAEAD(derivedKeyBytes)
+	if err != nil {
+		return "", fmt.Errorf("error creating cipher: %v", err)
+	}
 
-			// Decrypt key
-			keyBytes, err := aead.Open(nil, nonce, encKeyBytes, nil)
-			if err != nil {
-				return "", fmt.Errorf("error decrypting key: %v", err)
-			}
+	// Decode encrypted key
+	encEncKeyBytes, err := base64.StdEncoding.DecodeString(encEncKey)
+	if err != nil {
+		return "", fmt.Errorf("error decoding encrypted key: %v", err)
+	}
 
-			// Return base64-encoded key
-			return base64.URLEncoding.EncodeToString(keyBytes), nil
-		}
+	// Extract nonce from encrypted key
+	if len(encEncKeyBytes) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted key too short")
 	}
+	nonce, encKeyBytes := encEncKeyBytes[:aead.NonceSize()], encEncKeyBytes[aead.NonceSize():]
 
-	return "", fmt.Errorf("user not found")
+	// Decrypt key
+	keyBytes, err := aead.Open(nil, nonce, encKeyBytes, nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting key: %v", err)
+	}
+
+	// Return base64-encoded key
+	return base64.URLEncoding.EncodeToString(keyBytes), nil
 }
 
 // CheckPasswordForUser checks if the provided password matches the user's password OR on of his backup codes.
@@ -441,8 +451,13 @@ func CheckPasswordForUser(userID int, password string) (string, int, error) {
 			}
 
 			if VerifyPassword(password, passwordHash) {
+				params, err := KeyParams(user)
+				if err != nil {
+					return "", -1, err
+				}
+
 				// Calculate derived key
-				derKey, err := DeriveKeyFromPassword(password, user["salt"].(string))
+				derKey, err := DeriveKeyFromPassword(password, user["salt"].(string), params)
 				if err != nil {
 					return "", -1, fmt.Errorf("error deriving key from password: %v", err)
 				}
@@ -477,7 +492,11 @@ func CheckPasswordForUser(userID int, password string) (string, int, error) {
 				}
 
 				// Calculate derived key
-				tempKey, err := DeriveKeyFromPassword(password, code.(map[string]any)["salt"].(string))
+				params, err := KeyParams(code.(map[string]any))
+				if err != nil {
+					return "", -1, err
+				}
+				tempKey, err := DeriveKeyFromPassword(password, code.(map[string]any)["salt"].(string), params)
 				if err != nil {
 					return "", -1, fmt.Errorf("error deriving key from password: %v", err)
 				}
@@ -487,6 +506,17 @@ func CheckPasswordForUser(userID int, password string) (string, int, error) {
 					return "", -1, fmt.Errorf("error decrypting derived key: %v", err)
 				}
 
+				// The code may still contain the derived key from before an Argon2 upgrade
+				derKey, err = ResolveDerivedKey(user, derKey)
+				if err != nil {
+					return "", -1, err
+				}
+
+				// Doesn't lock users.json, so it can be written here
+				LogSecurityEvent(nil, userID, derKey, "backup_code_used", map[string]any{
+					"remaining": len(backupCodes),
+				})
+
 				return derKey, len(backupCodes), nil
 			}
 
@@ -497,6 +527,20 @@ func CheckPasswordForUser(userID int, password string) (string, int, error) {
 	return "", -1, nil
 }
 
+// VerifyUserPassword checks the password of a user (without the backup codes)
+func VerifyUserPassword(userID int, password string) (bool, error) {
+	passwordHash, err := getUserValue(userID, "password")
+	if err != nil {
+		return false, err
+	}
+
+	hash, ok := passwordHash.(string)
+	if !ok {
+		return false, fmt.Errorf("user data is not in the correct format")
+	}
+	return VerifyPassword(password, hash), nil
+}
+
 func CreatePasswordString() string {
 	var chars string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/+-_*!?#$%&(){}[]=@~"
 	password := make([]byte, 10)
@@ -539,7 +583,8 @@ func GenerateBackupCodes(derived_key string) ([]string, []map[string]any, error)
 		saltBase64 := base64.StdEncoding.EncodeToString(salt)
 
 		// Create derived encryption key to later encrypt the original derived key
-		intermediateKey, err := DeriveKeyFromPassword(code, saltBase64)
+		params := CurrentKeyParams()
+		intermediateKey, err := DeriveKeyFromPassword(code, saltBase64, params)
 		if err != nil {
 			return nil, nil, fmt.Errorf("error deriving key from password: %v", err)
 		}
@@ -553,6 +598,7 @@ func GenerateBackupCodes(derived_key string) ([]string, []map[string]any, error)
 		backupCodes[i] = code
 		codeData[i]["password"] = hash
 		codeData[i]["salt"] = saltBase64
+		codeData[i]["kdf"] = params.String()
 		codeData[i]["enc_derived_key"] = encDerivedKey
 	}
 
@@ -0,0 +1,263 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Every user has a security log with logins, failed attempts, the use of
+// backup codes, password and username changes, exports, backups and imports.
+// The entries are encrypted with the encryption key of the user, so only the
+// user can read them.
+//
+// Some events happen without the key of the user (a wrong password). The log
+// has a key pair for them: the private key is encrypted with the encryption
+// key, the public key is stored in plain. Such events are sealed with the
+// public key ("sealed") and moved to the entries the next time the key is
+// available (at the next login at the latest).
+
+// Older entries are removed from the security log
+const securityLogMaxEntries = 1000
+
+// SecurityLogEntry is an event in the security log of a user
+type SecurityLogEntry struct {
+	Time      string         `json:"time"`
+	Event     string         `json:"event"`
+	IP        string         `json:"ip,omitempty"`
+	UserAgent string         `json:"user_agent,omitempty"`
+	Device    string         `json:"device,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+// securityLogMutex makes reading and writing the security logs atomic
+var securityLogMutex sync.Mutex
+
+// LogSecurityEvent writes an event to the security log of a user. The request
+// (may be nil) gives the client. Without the derived key, the event is sealed
+// until the key is available. Errors are only logged, they never stop the action.
+func LogSecurityEvent(r *http.Request, userID int, derivedKey string, event string, details map[string]any) {
+	entry := SecurityLogEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Event:   event,
+		Details: details,
+	}
+	if r != nil {
+		entry.IP = ClientIP(r)
+		entry.UserAgent = r.UserAgent()
+		entry.Device = DeviceFromUserAgent(entry.UserAgent)
+	}
+
+	securityLogMutex.Lock()
+	defer securityLogMutex.Unlock()
+
+	var err error
+	if derivedKey == "" {
+		err = sealSecurityLogEntry(userID, entry)
+	} else {
+		err = appendSecurityLogEntry(userID, derivedKey, entry)
+	}
+	if err != nil {
+		Logger.Printf("Error writing security log of user %d: %v", userID, err)
+	}
+}
+
+// ReadSecurityLog returns the decrypted security log of a user, newest first
+func ReadSecurityLog(userID int, derivedKey string) ([]SecurityLogEntry, error) {
+	securityLogMutex.Lock()
+	defer securityLogMutex.Unlock()
+
+	encKey, err := GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := GetSecurityLog(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Move the sealed events to the entries first
+	if sealed, _ := content["sealed"].([]any); len(sealed) > 0 {
+		if err := unsealSecurityLog(content, encKey); err != nil {
+			return nil, err
+		}
+		if err := WriteSecurityLog(userID, content); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := []SecurityLogEntry{}
+	encEntries, _ := content["entries"].([]any)
+	for i := len(encEntries) - 1; i >= 0; i-- {
+		encEntry, ok := encEntries[i].(string)
+		if !ok {
+			continue
+		}
+		data, err := DecryptText(encEntry, encKey)
+		if err != nil {
+			Logger.Printf("Error decrypting security log entry of user %d: %v", userID, err)
+			continue
+		}
+
+		var entry SecurityLogEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// appendSecurityLogEntry encrypts an entry and adds it to the log (after the
+// sealed events). Creates the key pair of the log if it is missing.
+func appendSecurityLogEntry(userID int, derivedKey string, entry SecurityLogEntry) error {
+	encKey, err := GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		return err
+	}
+
+	content, err := GetSecurityLog(userID)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := content["public_key"].(string); !ok {
+		publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("error generating key pair: %v", err)
+		}
+		encPrivateKey, err := EncryptText(base64.URLEncoding.EncodeToString(privateKey[:]), encKey)
+		if err != nil {
+			return fmt.Errorf("error encrypting private key: %v", err)
+		}
+		content["public_key"] = base64.StdEncoding.EncodeToString(publicKey[:])
+		content["enc_private_key"] = encPrivateKey
+	}
+
+	if err := unsealSecurityLog(content, encKey); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	encEntry, err := EncryptText(string(data), encKey)
+	if err != nil {
+		return fmt.Errorf("error encrypting entry: %v", err)
+	}
+
+	entries, _ := content["entries"].([]any)
+	content["entries"] = trimSecurityLog(append(entries, encEntry))
+
+	return WriteSecurityLog(userID, content)
+}
+
+// sealSecurityLogEntry adds an entry, sealed with the public key, to the log.
+// The event is dropped if the log has no key pair yet.
+func sealSecurityLogEntry(userID int, entry SecurityLogEntry) error {
+	content, err := GetSecurityLog(userID)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := securityLogPublicKey(content)
+	if err != nil || publicKey == nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	sealedEntry, err := box.SealAnonymous(nil, data, publicKey, rand.Reader)
+	if err != nil {
+		return fmt.Errorf("error sealing entry: %v", err)
+	}
+
+	sealed, _ := content["sealed"].([]any)
+	content["sealed"] = trimSecurityLog(append(sealed, base64.StdEncoding.EncodeToString(sealedEntry)))
+
+	return WriteSecurityLog(userID, content)
+}
+
+// unsealSecurityLog moves the sealed events to the encrypted entries
+func unsealSecurityLog(content map[string]any, encKey string) error {
+	sealed, _ := content["sealed"].([]any)
+	if len(sealed) == 0 {
+		return nil
+	}
+
+	publicKey, err := securityLogPublicKey(content)
+	if err != nil || publicKey == nil {
+		return err
+	}
+
+	encPrivateKey, _ := content["enc_private_key"].(string)
+	privateKeyString, err := DecryptText(encPrivateKey, encKey)
+	if err != nil {
+		return fmt.Errorf("error decrypting private key: %v", err)
+	}
+	privateKeyBytes, err := base64.URLEncoding.DecodeString(privateKeyString)
+	if err != nil || len(privateKeyBytes) != 32 {
+		return fmt.Errorf("invalid private key")
+	}
+	privateKey := new([32]byte)
+	copy(privateKey[:], privateKeyBytes)
+
+	entries, _ := content["entries"].([]any)
+	for _, s := range sealed {
+		sealedString, _ := s.(string)
+		sealedEntry, err := base64.StdEncoding.DecodeString(sealedString)
+		if err != nil {
+			continue
+		}
+		data, ok := box.OpenAnonymous(nil, sealedEntry, publicKey, privateKey)
+		if !ok {
+			Logger.Printf("Error opening sealed security log entry")
+			continue
+		}
+
+		encEntry, err := EncryptText(string(data), encKey)
+		if err != nil {
+			return fmt.Errorf("error encrypting entry: %v", err)
+		}
+		entries = append(entries, encEntry)
+	}
+
+	content["entries"] = trimSecurityLog(entries)
+	delete(content, "sealed")
+	return nil
+}
+
+// securityLogPublicKey returns the public key of the log (nil if there is none)
+func securityLogPublicKey(content map[string]any) (*[32]byte, error) {
+	encoded, ok := content["public_key"].(string)
+	if !ok {
+		return nil, nil
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(keyBytes) != 32 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	publicKey := new([32]byte)
+	copy(publicKey[:], keyBytes)
+	return publicKey, nil
+}
+
+// trimSecurityLog removes the oldest entries above securityLogMaxEntries
+func trimSecurityLog(entries []any) []any {
+	if len(entries) > securityLogMaxEntries {
+		return entries[len(entries)-securityLogMaxEntries:]
+	}
+	return entries
+}
@@ -0,0 +1,517 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every token belongs to a session of the user. RequireAuth only accepts a
+// token if its session still exists, so a session (or all of them) can be
+// revoked before the token expires.
+//
+// The derived key of the user is not part of the token. It is stored in the
+// session, encrypted with a random session key, and only the session key is
+// in the token. A captured token alone doesn't reveal the derived key, and it
+// is useless once its session is revoked.
+//
+// users.json: "sessions" (list of Session), they are removed when the password
+// changes. "legacy_tokens_revoked" is set once the user logged out all other
+// devices, tokens from before the sessions are no longer accepted then.
+
+// sessionTouchInterval limits how often last_seen is written to users.json
+const sessionTouchInterval = 5 * time.Minute
+
+// The sessions are checked on every request. They are cached per user, so
+// users.json is only read again after it was written.
+var (
+	sessionCacheMutex sync.Mutex
+	sessionCache      = map[int]cachedSessions{}
+)
+
+type cachedSessions struct {
+	generation uint64
+	sessions   []Session
+}
+
+// Tokens from before the sessions get a session on their first request. Until
+// the browser stored the new token, parallel requests still send the old one,
+// they get the same new token instead of a session each. Keyed by the SHA-256
+// of the old token.
+var (
+	legacyTokensMutex sync.Mutex
+	legacyTokens      = map[[sha256.Size]byte]legacyTokenUpgrade{}
+)
+
+// legacyTokenReuse is how long the new token of a legacy token is handed out again
+const legacyTokenReuse = 10 * time.Minute
+
+type legacyTokenUpgrade struct {
+	sessionID string
+	token     string
+	created   time.Time
+}
+
+// SessionsMutex makes reading and saving the sessions of a user atomic. It is
+// taken before UsersFileMutex (see LockManager for the order).
+var SessionsMutex sync.Mutex
+
+// Session is a login of a user as stored in users.json
+type Session struct {
+	ID        string `json:"id"`
+	Device    string `json:"device"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	Created   string `json:"created"`
+	LastSeen  string `json:"last_seen"`
+	// EncDerivedKey is the derived key, encrypted with the session key of the token
+	EncDerivedKey string `json:"enc_derived_key,omitempty"`
+	// OutdatedKey is set if EncDerivedKey is from before an Argon2 upgrade
+	OutdatedKey bool `json:"outdated_key,omitempty"`
+	// AdminUntil is set while the session is an admin session
+	AdminUntil string `json:"admin_until,omitempty"`
+	// Passkey is the id of the passkey the session was created with, it ends
+	// when the passkey is removed
+	Passkey string `json:"passkey,omitempty"`
+}
+
+// NewSession creates a session for the client of the request (without saving
+// it). Returns the session and the session key for the token.
+func NewSession(r *http.Request, derivedKey string) (Session, string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return Session{}, "", fmt.Errorf("error generating session id: %v", err)
+	}
+
+	sessionKey, encDerivedKey, err := wrapDerivedKey(derivedKey)
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	userAgent := r.UserAgent()
+	return Session{
+		ID:            base64.RawURLEncoding.EncodeToString(idBytes),
+		Device:        DeviceFromUserAgent(userAgent),
+		UserAgent:     userAgent,
+		IP:            ClientIP(r),
+		Created:       now,
+		LastSeen:      now,
+		EncDerivedKey: encDerivedKey,
+	}, sessionKey, nil
+}
+
+// wrapDerivedKey encrypts the derived key with a new random session key
+func wrapDerivedKey(derivedKey string) (string, string, error) {
+	keyBytes := make([]byte, 32)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return "", "", fmt.Errorf("error generating session key: %v", err)
+	}
+	sessionKey := base64.URLEncoding.EncodeToString(keyBytes)
+
+	encDerivedKey, err := EncryptText(derivedKey, sessionKey)
+	if err != nil {
+		return "", "", fmt.Errorf("error encrypting derived key: %v", err)
+	}
+	return sessionKey, encDerivedKey, nil
+}
+
+// DerivedKey decrypts the derived key of the session with the session key of the token
+func (s *Session) DerivedKey(sessionKey string) (string, error) {
+	if s.EncDerivedKey == "" || sessionKey == "" {
+		return "", fmt.Errorf("session has no key")
+	}
+	return DecryptText(s.EncDerivedKey, sessionKey)
+}
+
+// DeviceFromUserAgent returns a short description like "Firefox on Linux"
+func DeviceFromUserAgent(userAgent string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"), strings.Contains(userAgent, "FxiOS/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	// Android and iOS before Linux and Mac OS, their user agents contain both
+	platform := "unknown OS"
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "Mac OS"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	return browser + " on " + platform
+}
+
+// GetSessions returns the sessions of a user that are not expired yet
+func GetSessions(userID int) ([]Session, error) {
+	// The generation is read first, a write in between only invalidates the cache
+	generation := usersGeneration.Load()
+
+	sessionCacheMutex.Lock()
+	cached, ok := sessionCache[userID]
+	sessionCacheMutex.Unlock()
+
+	var sessions []Session
+	if ok && cached.generation == generation {
+		sessions = slices.Clone(cached.sessions)
+	} else {
+		value, err := getUserValue(userID, "sessions")
+		if err != nil {
+			return nil, err
+		}
+		if sessions, err = parseSessions(userID, value); err != nil {
+			return nil, err
+		}
+
+		sessionCacheMutex.Lock()
+		sessionCache[userID] = cachedSessions{generation: generation, sessions: slices.Clone(sessions)}
+		sessionCacheMutex.Unlock()
+	}
+
+	return activeSessions(sessions), nil
+}
+
+// parseSessions converts the sessions of a user from users.json
+func parseSessions(userID int, value any) ([]Session, error) {
+	sessions := []Session{}
+	if value == nil {
+		return sessions, nil
+	}
+
+	// users.json is read as map[string]any, convert it back
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		Logger.Printf("Error reading sessions of user %d: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read sessions")
+	}
+	return sessions, nil
+}
+
+// activeSessions removes the expired sessions
+func activeSessions(sessions []Session) []Session {
+	// The token of a session expires after LOGOUT_AFTER_DAYS
+	maxAge := time.Duration(Settings.LogoutAfterDays) * 24 * time.Hour
+	active := sessions[:0]
+	for _, session := range sessions {
+		created, err := time.Parse(time.RFC3339, session.Created)
+		if err == nil && time.Since(created) < maxAge {
+			active = append(active, session)
+		}
+	}
+	return active
+}
+
+func saveSessions(userID int, sessions []Session) error {
+	if len(sessions) == 0 {
+		return setUserValue(userID, "sessions", nil)
+	}
+	return setUserValue(userID, "sessions", sessions)
+}
+
+// CreateSession saves a new session for the client of the request (passkeyID
+// is set for a login with a passkey). Returns the ID and the session key for
+// the token.
+func CreateSession(userID int, r *http.Request, derivedKey string, passkeyID string) (string, string, error) {
+	session, sessionKey, err := NewSession(r, derivedKey)
+	if err != nil {
+		return "", "", err
+	}
+	session.Passkey = passkeyID
+
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+
+	sessions, err := GetSessions(userID)
+	if err != nil {
+		return "", "", err
+	}
+
+	sessions = append(sessions, session)
+	if err := saveSessions(userID, sessions); err != nil {
+		return "", "", err
+	}
+	return session.ID, sessionKey, nil
+}
+
+// TouchSession returns a session (nil if it doesn't exist) and updates
+// last_seen and the IP at most every sessionTouchInterval
+func TouchSession(userID int, id string, r *http.Request) (*Session, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	session, err := findSession(userID, id)
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	// Don't write users.json on every request
+	lastSeen, err := time.Parse(time.RFC3339, session.LastSeen)
+	if err == nil && time.Since(lastSeen) < sessionTouchInterval {
+		return session, nil
+	}
+
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+
+	// Read and write users.json in one step, like the other writers
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		user, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		if uid, ok := user["user_id"].(float64); !ok || int(uid) != userID {
+			continue
+		}
+
+		parsed, err := parseSessions(userID, user["sessions"])
+		if err != nil {
+			return nil, err
+		}
+		sessions := activeSessions(parsed)
+
+		// The session may have been revoked since it was found
+		for i := range sessions {
+			if sessions[i].ID != id {
+				continue
+			}
+			sessions[i].LastSeen = time.Now().UTC().Format(time.RFC3339)
+			sessions[i].IP = ClientIP(r)
+			user["sessions"] = sessions
+			return &sessions[i], WriteUsers(users)
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// findSession returns a session that is not expired (nil if it doesn't exist)
+func findSession(userID int, id string) (*Session, error) {
+	sessions, err := GetSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		if sessions[i].ID == id {
+			return &sessions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// UpgradeLegacyToken accepts a token of an older version, which contained the
+// derived key itself, and moves the derived key into the session. Returns a
+// token of the new format (empty if the token can't be replaced).
+func UpgradeLegacyToken(token string, claims *Claims, r *http.Request) (string, error) {
+	// The derived key only works if the password wasn't changed since (it may
+	// be from before an Argon2 upgrade though)
+	derivedKey, err := resolveUserDerivedKey(claims.UserID, claims.DerivedKey)
+	if err != nil {
+		return "", fmt.Errorf("derived key of token is outdated")
+	}
+	claims.DerivedKey = derivedKey
+
+	// Tokens from before the sessions have no session. They are only accepted
+	// if the user didn't log out all other devices.
+	if claims.ID == "" {
+		if revoked, _ := getUserValue(claims.UserID, "legacy_tokens_revoked"); revoked == true {
+			return "", fmt.Errorf("tokens without session are revoked")
+		}
+
+		// Taken before SessionsMutex (in CreateSession)
+		legacyTokensMutex.Lock()
+		defer legacyTokensMutex.Unlock()
+
+		now := time.Now()
+		for hash, upgrade := range legacyTokens {
+			if now.Sub(upgrade.created) > legacyTokenReuse {
+				delete(legacyTokens, hash)
+			}
+		}
+
+		hash := sha256.Sum256([]byte(token))
+		if upgrade, ok := legacyTokens[hash]; ok {
+			claims.ID = upgrade.sessionID
+			return upgrade.token, nil
+		}
+
+		sessionID, sessionKey, err := CreateSession(claims.UserID, r, claims.DerivedKey, "")
+		if err != nil {
+			return "", err
+		}
+		newToken, err := GenerateToken(claims.UserID, claims.Username, sessionID, sessionKey)
+		if err != nil {
+			return "", err
+		}
+
+		claims.ID = sessionID
+		legacyTokens[hash] = legacyTokenUpgrade{sessionID: sessionID, token: newToken, created: now}
+		return newToken, nil
+	}
+
+	sessionKey, encDerivedKey, err := wrapDerivedKey(claims.DerivedKey)
+	if err != nil {
+		return "", err
+	}
+
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+
+	sessions, err := GetSessions(claims.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	for i, session := range sessions {
+		if session.ID != claims.ID {
+			continue
+		}
+
+		// Another request with the same token already replaced it, keep its
+		// session key, else that token stops working
+		if session.EncDerivedKey != "" {
+			return "", nil
+		}
+
+		sessions[i].EncDerivedKey = encDerivedKey
+		if err := saveSessions(claims.UserID, sessions); err != nil {
+			return "", err
+		}
+		return GenerateToken(claims.UserID, claims.Username, session.ID, sessionKey)
+	}
+	return "", fmt.Errorf("session not found")
+}
+
+// UpgradeSessionKey replaces the derived key of a session from before an
+// Argon2 upgrade. The session key of the token stays the same. Returns the
+// current derived key.
+func UpgradeSessionKey(userID int, id, sessionKey, derivedKey string) (string, error) {
+	derivedKey, err := resolveUserDerivedKey(userID, derivedKey)
+	if err != nil {
+		return "", err
+	}
+
+	encDerivedKey, err := EncryptText(derivedKey, sessionKey)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting derived key: %v", err)
+	}
+
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+
+	sessions, err := GetSessions(userID)
+	if err != nil {
+		return "", err
+	}
+
+	for i, session := range sessions {
+		if session.ID == id {
+			sessions[i].EncDerivedKey = encDerivedKey
+			sessions[i].OutdatedKey = false
+			return derivedKey, saveSessions(userID, sessions)
+		}
+	}
+	return "", fmt.Errorf("session not found")
+}
+
+// RevokeSession removes a session of a user. Returns false if it doesn't exist.
+func RevokeSession(userID int, id string) (bool, error) {
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+
+	sessions, err := GetSessions(userID)
+	if err != nil {
+		return false, err
+	}
+
+	for i, session := range sessions {
+		if session.ID == id {
+			sessions = append(sessions[:i], sessions[i+1:]...)
+			return true, saveSessions(userID, sessions)
+		}
+	}
+	return false, nil
+}
+
+// RevokePasskeySessions removes all sessions of a user that were created with
+// a passkey. Returns the number of removed sessions.
+func RevokePasskeySessions(userID int, passkeyID string) (int, error) {
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+
+	sessions, err := GetSessions(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	kept := []Session{}
+	for _, session := range sessions {
+		if session.Passkey != passkeyID {
+			kept = append(kept, session)
+		}
+	}
+	if len(kept) == len(sessions) {
+		return 0, nil
+	}
+	return len(sessions) - len(kept), saveSessions(userID, kept)
+}
+
+// RevokeOtherSessions removes all sessions of a user except the one with keepID
+func RevokeOtherSessions(userID int, keepID string) (int, error) {
+	SessionsMutex.Lock()
+	defer SessionsMutex.Unlock()
+
+	sessions, err := GetSessions(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	kept := []Session{}
+	for _, session := range sessions {
+		if session.ID == keepID {
+			kept = append(kept, session)
+		}
+	}
+	if err := saveSessions(userID, kept); err != nil {
+		return 0, err
+	}
+
+	// Tokens of older versions without a session are logged out as well
+	return len(sessions) - len(kept), setUserValue(userID, "legacy_tokens_revoked", true)
+}
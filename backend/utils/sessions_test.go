@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSessionTestUser uses a new in-memory store with one user (ID 1) and
+// signing keys for the tokens. Returns the derived key of the user.
+func newSessionTestUser(t *testing.T) string {
+	t.Helper()
+
+	derivedKey := newMigrationTestUser(t)
+	previousPath, previousLogout := Settings.DataPath, Settings.LogoutAfterDays
+	Settings.DataPath = t.TempDir()
+	Settings.LogoutAfterDays = 30
+	t.Cleanup(func() { Settings.DataPath, Settings.LogoutAfterDays = previousPath, previousLogout })
+
+	if err := InitJWTKeys(); err != nil {
+		t.Fatalf("creating signing keys: %v", err)
+	}
+	return derivedKey
+}
+
+func TestSessionWrapsDerivedKey(t *testing.T) {
+	const derivedKey = "derived-key-of-the-user"
+	r := httptest.NewRequest("POST", "/users/login", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+
+	session, sessionKey, err := NewSession(r, derivedKey)
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	if session.ID == "" || session.Device != "Firefox on Linux" || session.Created == "" {
+		t.Errorf("session = %+v", session)
+	}
+	if strings.Contains(session.EncDerivedKey, derivedKey) {
+		t.Errorf("the session contains the derived key unencrypted")
+	}
+
+	if got, err := session.DerivedKey(sessionKey); err != nil || got != derivedKey {
+		t.Errorf("derived key = %q, %v, want %q", got, err, derivedKey)
+	}
+
+	// Only the session key of the token unwraps the derived key
+	_, otherKey, err := NewSession(r, derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{otherKey, ""} {
+		if _, err := session.DerivedKey(key); err == nil {
+			t.Errorf("derived key with session key %q: want an error", key)
+		}
+	}
+	if _, err := (&Session{}).DerivedKey(sessionKey); err == nil {
+		t.Errorf("derived key of a session without key: want an error")
+	}
+}
+
+func TestDeviceFromUserAgent(t *testing.T) {
+	for _, tc := range []struct {
+		userAgent string
+		want      string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.0.0", "Edge on Windows"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36", "Chrome on Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15", "Safari on macOS"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1", "Safari on iOS"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36", "Chrome on Android"},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 OPR/111.0.0.0", "Opera on Linux"},
+		{"curl/8.8.0", "Unknown browser on unknown OS"},
+	} {
+		if got := DeviceFromUserAgent(tc.userAgent); got != tc.want {
+			t.Errorf("DeviceFromUserAgent(%q) = %q, want %q", tc.userAgent, got, tc.want)
+		}
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	derivedKey := newSessionTestUser(t)
+	r := httptest.NewRequest("POST", "/users/login", nil)
+
+	ids := make([]string, 3)
+	for i := range ids {
+		id, sessionKey, err := CreateSession(1, r, derivedKey, "")
+		if err != nil {
+			t.Fatalf("creating session: %v", err)
+		}
+		ids[i] = id
+
+		session, err := TouchSession(1, id, r)
+		if err != nil || session == nil {
+			t.Fatalf("new session not found: %v", err)
+		}
+		if got, err := session.DerivedKey(sessionKey); err != nil || got != derivedKey {
+			t.Errorf("derived key of the session = %q, %v", got, err)
+		}
+	}
+
+	if ok, err := RevokeSession(1, ids[0]); !ok || err != nil {
+		t.Fatalf("revoking session: %v, %v", ok, err)
+	}
+	if ok, _ := RevokeSession(1, ids[0]); ok {
+		t.Errorf("revoked the same session twice")
+	}
+	if session, err := TouchSession(1, ids[0], r); session != nil || err != nil {
+		t.Errorf("revoked session = %+v, %v, want nil", session, err)
+	}
+
+	// Logging out all other devices also ends the tokens from before the sessions
+	if count, err := RevokeOtherSessions(1, ids[2]); count != 1 || err != nil {
+		t.Errorf("revoked other sessions = %d, %v, want 1", count, err)
+	}
+	sessions, err := GetSessions(1)
+	if err != nil || len(sessions) != 1 || sessions[0].ID != ids[2] {
+		t.Errorf("sessions = %+v, %v, want only %s", sessions, err, ids[2])
+	}
+	if revoked, _ := getUserValue(1, "legacy_tokens_revoked"); revoked != true {
+		t.Errorf("legacy_tokens_revoked = %v, want true", revoked)
+	}
+}
+
+func TestExpiredSessionsAreIgnored(t *testing.T) {
+	derivedKey := newSessionTestUser(t)
+	r := httptest.NewRequest("POST", "/users/login", nil)
+
+	expired, _, err := NewSession(r, derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.Created = time.Now().AddDate(0, 0, -Settings.LogoutAfterDays-1).UTC().Format(time.RFC3339)
+	active, _, err := NewSession(r, derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSessions(1, []Session{expired, active}); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := GetSessions(1)
+	if err != nil || len(sessions) != 1 || sessions[0].ID != active.ID {
+		t.Errorf("sessions = %+v, %v, want only the active one", sessions, err)
+	}
+	if session, _ := TouchSession(1, expired.ID, r); session != nil {
+		t.Errorf("expired session was accepted")
+	}
+}
+
+func TestUpgradeLegacyTokenCreatesOneSession(t *testing.T) {
+	derivedKey := newSessionTestUser(t)
+	r := httptest.NewRequest("GET", "/logs/getLog", nil)
+
+	// Parallel requests of the browser with the same old token
+	tokens := make([]string, 10)
+	sessionIDs := make([]string, 10)
+	var wg sync.WaitGroup
+	for i := range tokens {
+		wg.Go(func() {
+			claims := &Claims{UserID: 1, Username: "alice", DerivedKey: derivedKey}
+			token, err := UpgradeLegacyToken("legacy-token", claims, r)
+			if err != nil {
+				t.Errorf("upgrading token: %v", err)
+			}
+			tokens[i], sessionIDs[i] = token, claims.ID
+		})
+	}
+	wg.Wait()
+
+	sessions, err := GetSessions(1)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("sessions = %+v, %v, want one", sessions, err)
+	}
+	for i := range tokens {
+		if tokens[i] != tokens[0] || sessionIDs[i] != sessions[0].ID {
+			t.Fatalf("request %d got token %q of session %q, want the same token of session %q", i, tokens[i], sessionIDs[i], sessions[0].ID)
+		}
+	}
+
+	// The new token unwraps the derived key from the session
+	claims, err := ValidateToken(tokens[0])
+	if err != nil {
+		t.Fatalf("validating new token: %v", err)
+	}
+	if claims.DerivedKey != "" {
+		t.Errorf("the new token contains the derived key")
+	}
+	if got, err := sessions[0].DerivedKey(claims.SessionKey); err != nil || got != derivedKey {
+		t.Errorf("derived key of the session = %q, %v, want the key of the old token", got, err)
+	}
+
+	// A token with a wrong derived key gets no session
+	if _, err := UpgradeLegacyToken("other-token", &Claims{UserID: 1, DerivedKey: "wrong"}, r); err == nil {
+		t.Errorf("upgrading a token with a wrong derived key: want an error")
+	}
+
+	// Old tokens are no longer accepted after logging out all other devices
+	if _, err := RevokeOtherSessions(1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpgradeLegacyToken("third-token", &Claims{UserID: 1, DerivedKey: derivedKey}, r); err == nil {
+		t.Errorf("upgrading a token after logging out all devices: want an error")
+	}
+}
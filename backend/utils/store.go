@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store is the persistence layer for all user data. Handlers never touch the
+// filesystem directly but go through the package-level helpers (GetMonth,
+// WriteTags, ReadFile, ...) which delegate to the active store.
+//
+// Implementations return the same shapes as the JSON layout on disk: numbers
+// are decoded as float64 and missing documents are returned as empty maps
+// (or an empty string for the settings) instead of an error.
+type Store interface {
+	GetUsers() (map[string]any, error)
+	WriteUsers(content map[string]any) error
+
+	GetMonth(userID int, year, month int) (map[string]any, error)
+	WriteMonth(userID int, year, month int, content map[string]any) error
+	GetYears(userID int) ([]string, error)
+	GetMonths(userID int, year string) ([]string, error)
+
+	GetTags(userID int) (map[string]any, error)
+	WriteTags(userID int, content map[string]any) error
+
+	GetTemplates(userID int) (map[string]any, error)
+	WriteTemplates(userID int, content map[string]any) error
+
+	GetUserSettings(userID int) (string, error)
+	WriteUserSettings(userID int, content string) error
+
+	GetSecurityLog(userID int) (map[string]any, error)
+	WriteSecurityLog(userID int, content map[string]any) error
+
+	BlobStore
+
+	// DeleteUserData removes everything that belongs to the user (except the
+	// entry in users.json)
+	DeleteUserData(userID int) error
+
+	// UserDiskUsage returns the number of bytes used by the user's data
+	UserDiskUsage(userID int) (int64, error)
+}
+
+// BlobStore stores the encrypted file attachments of the users
+type BlobStore interface {
+	WriteFile(content []byte, userID int, uuid string) error
+	ReadFile(userID int, uuid string) ([]byte, error)
+	RemoveFile(userID int, uuid string) error
+
+	// WriteFileStream writes a file from a reader without keeping it in memory
+	WriteFileStream(content io.Reader, userID int, uuid string) error
+
+	// OpenFile opens a file for reading, the caller must close it. The file
+	// is seekable, so parts of it can be read without reading all of it.
+	OpenFile(userID int, uuid string) (io.ReadSeekCloser, error)
+
+	// ListFiles returns the uuids of all stored files of a user
+	ListFiles(userID int) ([]string, error)
+
+	// FilesSize returns the number of bytes used by all files of a user
+	FilesSize(userID int) (int64, error)
+
+	// RemoveAllFiles removes all files of a user (including the quarantine)
+	RemoveAllFiles(userID int) error
+
+	// QuarantineFile moves a file into the quarantine of the user, where it is
+	// no longer listed. Returns the size of the file.
+	QuarantineFile(userID int, uuid string) (int64, error)
+
+	// RemoveQuarantinedFile removes a file from the quarantine for good
+	RemoveQuarantinedFile(userID int, uuid string) error
+}
+
+// DayFilter restricts the days returned by QueryDays. Zero values don't filter.
+type DayFilter struct {
+	From       time.Time // first day (inclusive)
+	To         time.Time // last day (inclusive)
+	TagID      int       // only days with this tag
+	Bookmarked bool      // only bookmarked days
+	WithFiles  bool      // only days with at least one file
+}
+
+// DayRecord is a day of a user together with its month, as returned by QueryDays
+type DayRecord struct {
+	Year  int
+	Month int
+	Day   Day
+}
+
+// DayDocument is a single entry of the "days" array of a month document, as
+// the stores work with it
+type DayDocument struct {
+	Year  int
+	Month int
+	Day   map[string]any
+}
+
+// DayQuerier is implemented by stores that can select days without
+// decoding every month of a user
+type DayQuerier interface {
+	QueryDays(userID int, filter DayFilter) ([]DayDocument, error)
+}
+
+// DataStore is the active store, set by InitStore
+var DataStore Store
+
+// InitStore creates the store selected by Settings.StorageBackend
+func InitStore() error {
+	store, err := NewStore(Settings.StorageBackend)
+	if err != nil {
+		return err
+	}
+
+	DataStore = store
+	return nil
+}
+
+// NewStore creates a store for the given backend name
+func NewStore(backend string) (Store, error) {
+	backend = strings.ToLower(backend)
+	if backend == "memory" {
+		Logger.Printf("Using in-memory storage - all data will be lost on restart!")
+		return NewMemoryStore(), nil
+	}
+
+	// Clean up after writes that were interrupted by a crash
+	if err := RecoverTempFiles(Settings.DataPath); err != nil {
+		Logger.Printf("Error recovering temporary files: %v", err)
+	}
+
+	blobs, err := NewBlobStore(Settings.BlobBackend)
+	if err != nil {
+		return nil, err
+	}
+
+	switch backend {
+	case "", "file":
+		return NewFileStore(Settings.DataPath, blobs), nil
+	case "sqlite":
+		return NewSQLiteStore(filepath.Join(Settings.DataPath, SQLiteFilename), blobs)
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", backend)
+	}
+}
+
+// NewBlobStore creates the store for the files of the users
+func NewBlobStore(backend string) (BlobStore, error) {
+	local := NewLocalBlobStore(Settings.DataPath)
+
+	switch strings.ToLower(backend) {
+	case "", "local":
+		return local, nil
+	case "s3":
+		return NewS3BlobStore(S3Config{
+			Endpoint:  Settings.S3Endpoint,
+			Bucket:    Settings.S3Bucket,
+			Region:    Settings.S3Region,
+			AccessKey: Settings.S3AccessKey,
+			SecretKey: Settings.S3SecretKey,
+			UseSSL:    Settings.S3UseSSL,
+		}, local)
+	default:
+		return nil, fmt.Errorf("unknown blob backend '%s'", backend)
+	}
+}
+
+// QueryDays returns all days of a user matching the filter, sorted by date
+func QueryDays(userID int, filter DayFilter) ([]DayRecord, error) {
+	if querier, ok := DataStore.(DayQuerier); ok {
+		documents, err := querier.QueryDays(userID, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		records := make([]DayRecord, 0, len(documents))
+		for _, document := range documents {
+			day, err := DayFromMap(document.Day)
+			if err != nil {
+				Logger.Printf("Error decoding day %s of user %d: %v", document.date(), userID, err)
+				return nil, fmt.Errorf("internal server error when trying to query days")
+			}
+			records = append(records, DayRecord{Year: document.Year, Month: document.Month, Day: day})
+		}
+		return records, nil
+	}
+
+	// Fallback: read every month and filter the days
+	records := []DayRecord{}
+	years, err := DataStore.GetYears(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, yearStr := range years {
+		year, err := strconv.Atoi(yearStr)
+		if err != nil {
+			continue
+		}
+
+		months, err := DataStore.GetMonths(userID, yearStr)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, monthStr := range months {
+			month, err := strconv.Atoi(monthStr)
+			if err != nil {
+				continue
+			}
+
+			content, err := ReadMonth(userID, year, month)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, day := range content.Days {
+				record := DayRecord{Year: year, Month: month, Day: day}
+				if filter.matches(record) {
+					records = append(records, record)
+				}
+			}
+		}
+	}
+
+	// Sort by date
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].date() < records[j].date()
+	})
+
+	return records, nil
+}
+
+// matches checks if a day passes the filter
+func (f DayFilter) matches(record DayRecord) bool {
+	date := record.date()
+	if !f.From.IsZero() && date < f.From.Format("2006-01-02") {
+		return false
+	}
+	if !f.To.IsZero() && date > f.To.Format("2006-01-02") {
+		return false
+	}
+	if f.Bookmarked && !record.Day.IsBookmarked {
+		return false
+	}
+	if f.WithFiles && len(record.Day.Files) == 0 {
+		return false
+	}
+	if f.TagID != 0 && !record.Day.HasTag(f.TagID) {
+		return false
+	}
+
+	return true
+}
+
+// date returns the date of the day as "YYYY-MM-DD"
+func (r DayRecord) date() string {
+	return fmt.Sprintf("%04d-%02d-%02d", r.Year, r.Month, r.Day.Day)
+}
+
+// date returns the date of the day as "YYYY-MM-DD"
+func (d DayDocument) date() string {
+	dayNum, _ := d.Day["day"].(float64)
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, int(dayNum))
+}
+
+// dayIsBookmarked checks the bookmark flag of a day
+func dayIsBookmarked(day map[string]any) bool {
+	switch bookmarked := day["isBookmarked"].(type) {
+	case bool:
+		return bookmarked
+	case float64: // if stored as number
+		return bookmarked != 0
+	}
+	return false
+}
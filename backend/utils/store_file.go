@@ -0,0 +1,523 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FileStore keeps all data as JSON files in a directory tree:
+//
+//	users.json
+//	<userID>/tags.json
+//	<userID>/templates.json
+//	<userID>/settings.encrypted
+//	<userID>/<year>/<month>.json
+//
+// The files are stored by the given BlobStore.
+type FileStore struct {
+	root string
+	BlobStore
+}
+
+// NewFileStore creates a FileStore rooted at the given directory
+func NewFileStore(root string, blobs BlobStore) *FileStore {
+	return &FileStore{root: root, BlobStore: blobs}
+}
+
+// GetUsers retrieves the users from the users.json file
+func (s *FileStore) GetUsers() (map[string]any, error) {
+	// Try to open the users.json file
+	filePath := filepath.Join(s.root, "users.json")
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			Logger.Printf("users.json - File not found")
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error opening users.json: %v", err)
+		return nil, fmt.Errorf("internal server error when trying to open users.json")
+	}
+	defer file.Close()
+
+	// Read the file content
+	var content map[string]any
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&content); err != nil {
+		if err == io.EOF {
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error decoding users.json: %v", err)
+		return nil, fmt.Errorf("internal server error when trying to decode users.json")
+	}
+
+	return content, nil
+}
+
+// WriteUsers writes the users to the users.json file
+func (s *FileStore) WriteUsers(content map[string]any) error {
+
+	// Create the users.json file
+	filePath := filepath.Join(s.root, "users.json")
+	file, err := createAtomicFile(filePath)
+	if err != nil {
+		Logger.Printf("Error creating users.json: %v", err)
+		return fmt.Errorf("internal server error when trying to create users.json")
+	}
+	defer file.Close()
+
+	// Write the content to the file
+	var encoder *json.Encoder
+	if Settings.Indent > 0 {
+		encoder = json.NewEncoder(file)
+		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
+	} else {
+		encoder = json.NewEncoder(file)
+	}
+
+	if err := encoder.Encode(content); err != nil {
+		Logger.Printf("Error encoding users.json: %v", err)
+		return fmt.Errorf("internal server error when trying to encode users.json")
+	}
+
+	// Replace users.json with the new content
+	if err := file.Commit(); err != nil {
+		Logger.Printf("Error committing users.json: %v", err)
+		return fmt.Errorf("internal server error when trying to write users.json")
+	}
+
+	return nil
+}
+
+// GetMonth retrieves the logs for a specific month
+func (s *FileStore) GetMonth(userID int, year, month int) (map[string]any, error) {
+	// Try to open the month.json file
+	filePath := filepath.Join(s.root, fmt.Sprintf("%d/%d/%02d.json", userID, year, month))
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error opening %s: %v", filePath, err)
+		return nil, fmt.Errorf("internal server error when trying to open %d/%02d.json", year, month)
+	}
+	defer file.Close()
+
+	// Read the file content
+	var content map[string]any
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&content); err != nil {
+		if err == io.EOF {
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error decoding %s: %v", filePath, err)
+		return nil, fmt.Errorf("internal server error when trying to decode %d/%02d.json", year, month)
+	}
+
+	return content, nil
+}
+
+// WriteMonth writes the logs for a specific month
+func (s *FileStore) WriteMonth(userID int, year, month int, content map[string]any) error {
+	// Create the directory if it doesn't exist
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d/%d", userID, year))
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		Logger.Printf("Error creating directory %s: %v", dirPath, err)
+		return fmt.Errorf("internal server error when trying to create directory %d/%d", userID, year)
+	}
+
+	// Create the month.json file
+	filePath := filepath.Join(dirPath, fmt.Sprintf("%02d.json", month))
+	file, err := createAtomicFile(filePath)
+	if err != nil {
+		Logger.Printf("Error creating %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to create %d/%02d.json", year, month)
+	}
+	defer file.Close()
+
+	// Write the content to the file
+	var encoder *json.Encoder
+	if Settings.Indent > 0 {
+		encoder = json.NewEncoder(file)
+		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
+	} else {
+		encoder = json.NewEncoder(file)
+	}
+
+	if err := encoder.Encode(content); err != nil {
+		Logger.Printf("Error encoding %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to encode %d/%02d.json", year, month)
+	}
+
+	// Replace the month.json file with the new content
+	if err := file.Commit(); err != nil {
+		Logger.Printf("Error committing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to write %d/%02d.json", year, month)
+	}
+
+	return nil
+}
+
+// GetTags retrieves the tags for a specific user
+func (s *FileStore) GetTags(userID int) (map[string]any, error) {
+	// Try to open the tags.json file
+	filePath := filepath.Join(s.root, fmt.Sprintf("%d/tags.json", userID))
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error opening %s: %v", filePath, err)
+		return nil, fmt.Errorf("internal server error when trying to open tags.json")
+	}
+	defer file.Close()
+
+	// Read the file content
+	var content map[string]any
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&content); err != nil {
+		if err == io.EOF {
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error decoding %s: %v", filePath, err)
+		return nil, fmt.Errorf("internal server error when trying to decode tags.json")
+	}
+
+	return content, nil
+}
+
+// WriteTags writes the tags for a specific user
+func (s *FileStore) WriteTags(userID int, content map[string]any) error {
+	// Create the directory if it doesn't exist
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d", userID))
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		Logger.Printf("Error creating directory %s: %v", dirPath, err)
+		return fmt.Errorf("internal server error when trying to create directory %d", userID)
+	}
+
+	// Create the tags.json file
+	filePath := filepath.Join(dirPath, "tags.json")
+	file, err := createAtomicFile(filePath)
+	if err != nil {
+		Logger.Printf("Error creating %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to create tags.json")
+	}
+	defer file.Close()
+
+	// Write the content to the file
+	var encoder *json.Encoder
+	if Settings.Development && Settings.Indent > 0 {
+		encoder = json.NewEncoder(file)
+		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
+	} else {
+		encoder = json.NewEncoder(file)
+	}
+
+	if err := encoder.Encode(content); err != nil {
+		Logger.Printf("Error encoding %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to encode tags.json")
+	}
+
+	// Replace tags.json with the new content
+	if err := file.Commit(); err != nil {
+		Logger.Printf("Error committing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to write tags.json")
+	}
+
+	return nil
+}
+
+// GetUserSettings retrieves the settings for a specific user
+func (s *FileStore) GetUserSettings(userID int) (string, error) {
+	// Try to open the settings.encrypted file
+	filePath := filepath.Join(s.root, fmt.Sprintf("%d/settings.encrypted", userID))
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		Logger.Printf("Error opening %s: %v", filePath, err)
+		return "", fmt.Errorf("internal server error when trying to open settings.encrypted")
+	}
+	defer file.Close()
+
+	// Read the file content
+	content, err := io.ReadAll(file)
+	if err != nil {
+		Logger.Printf("Error reading %s: %v", filePath, err)
+		return "", fmt.Errorf("internal server error when trying to read settings.encrypted")
+	}
+
+	return string(content), nil
+}
+
+// WriteUserSettings writes the settings for a specific user
+func (s *FileStore) WriteUserSettings(userID int, content string) error {
+	// Create the directory if it doesn't exist
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d", userID))
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		Logger.Printf("Error creating directory %s: %v", dirPath, err)
+		return fmt.Errorf("internal server error when trying to create directory %d", userID)
+	}
+
+	// Create the settings.encrypted file
+	filePath := filepath.Join(dirPath, "settings.encrypted")
+	file, err := createAtomicFile(filePath)
+	if err != nil {
+		Logger.Printf("Error creating %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to create settings.encrypted")
+	}
+	defer file.Close()
+
+	// Write the content to the file
+	if _, err := file.WriteString(content); err != nil {
+		Logger.Printf("Error writing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to write settings.encrypted")
+	}
+
+	// Replace settings.encrypted with the new content
+	if err := file.Commit(); err != nil {
+		Logger.Printf("Error committing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to write settings.encrypted")
+	}
+
+	return nil
+}
+
+// GetTemplates retrieves the templates for a specific user
+func (s *FileStore) GetTemplates(userID int) (map[string]any, error) {
+	// Try to open the templates.json file
+	filePath := filepath.Join(s.root, fmt.Sprintf("%d/templates.json", userID))
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			Logger.Printf("%s - File not found", filePath)
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error opening %s: %v", filePath, err)
+		return nil, fmt.Errorf("internal server error when trying to open templates.json")
+	}
+	defer file.Close()
+
+	// Read the file content
+	var content map[string]any
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&content); err != nil {
+		if err == io.EOF {
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error decoding %s: %v", filePath, err)
+		return nil, fmt.Errorf("internal server error when trying to decode templates.json")
+	}
+
+	return content, nil
+}
+
+// WriteTemplates writes the templates for a specific user
+func (s *FileStore) WriteTemplates(userID int, content map[string]any) error {
+	// Create the directory if it doesn't exist
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d", userID))
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		Logger.Printf("Error creating directory %s: %v", dirPath, err)
+		return fmt.Errorf("internal server error when trying to create directory %d", userID)
+	}
+
+	// Create the templates.json file
+	filePath := filepath.Join(dirPath, "templates.json")
+	file, err := createAtomicFile(filePath)
+	if err != nil {
+		Logger.Printf("Error creating %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to create templates.json")
+	}
+	defer file.Close()
+
+	// Write the content to the file
+	var encoder *json.Encoder
+	if Settings.Development && Settings.Indent > 0 {
+		encoder = json.NewEncoder(file)
+		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
+	} else {
+		encoder = json.NewEncoder(file)
+	}
+
+	if err := encoder.Encode(content); err != nil {
+		Logger.Printf("Error encoding %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to encode templates.json")
+	}
+
+	// Replace templates.json with the new content
+	if err := file.Commit(); err != nil {
+		Logger.Printf("Error committing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to write templates.json")
+	}
+
+	return nil
+}
+
+// GetSecurityLog retrieves the security log of a specific user
+func (s *FileStore) GetSecurityLog(userID int) (map[string]any, error) {
+	// Try to open the security_log.json file
+	filePath := filepath.Join(s.root, fmt.Sprintf("%d/security_log.json", userID))
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error opening %s: %v", filePath, err)
+		return nil, fmt.Errorf("internal server error when trying to open security_log.json")
+	}
+	defer file.Close()
+
+	// Read the file content
+	var content map[string]any
+	if err := json.NewDecoder(file).Decode(&content); err != nil {
+		if err == io.EOF {
+			return map[string]any{}, nil
+		}
+		Logger.Printf("Error decoding %s: %v", filePath, err)
+		return nil, fmt.Errorf("internal server error when trying to decode security_log.json")
+	}
+
+	return content, nil
+}
+
+// WriteSecurityLog writes the security log of a specific user
+func (s *FileStore) WriteSecurityLog(userID int, content map[string]any) error {
+	// Create the directory if it doesn't exist
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d", userID))
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		Logger.Printf("Error creating directory %s: %v", dirPath, err)
+		return fmt.Errorf("internal server error when trying to create directory %d", userID)
+	}
+
+	// Create the security_log.json file
+	filePath := filepath.Join(dirPath, "security_log.json")
+	file, err := createAtomicFile(filePath)
+	if err != nil {
+		Logger.Printf("Error creating %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to create security_log.json")
+	}
+	defer file.Close()
+
+	// Write the content to the file
+	encoder := json.NewEncoder(file)
+	if Settings.Development && Settings.Indent > 0 {
+		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
+	}
+
+	if err := encoder.Encode(content); err != nil {
+		Logger.Printf("Error encoding %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to encode security_log.json")
+	}
+
+	// Replace security_log.json with the new content
+	if err := file.Commit(); err != nil {
+		Logger.Printf("Error committing %s: %v", filePath, err)
+		return fmt.Errorf("internal server error when trying to write security_log.json")
+	}
+
+	return nil
+}
+
+// GetYears returns the years available for a specific user
+func (s *FileStore) GetYears(userID int) ([]string, error) {
+	// Try to read the user directory
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d", userID))
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			Logger.Printf("%s - Directory not found", dirPath)
+			return []string{}, nil
+		}
+		Logger.Printf("Error reading directory %s: %v", dirPath, err)
+		return nil, fmt.Errorf("internal server error when trying to read directory %d", userID)
+	}
+
+	// Filter years
+	years := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && len(entry.Name()) == 4 {
+			// Check if the name is a valid year (4 digits)
+			if _, err := strconv.Atoi(entry.Name()); err == nil {
+				years = append(years, entry.Name())
+			}
+		}
+	}
+
+	return years, nil
+}
+
+// GetMonths returns the months available for a specific user and year
+func (s *FileStore) GetMonths(userID int, year string) ([]string, error) {
+	// Try to read the year directory
+	dirPath := filepath.Join(s.root, fmt.Sprintf("%d/%s", userID, year))
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			Logger.Printf("%s - Directory not found", dirPath)
+			return []string{}, nil
+		}
+		Logger.Printf("Error reading directory %s: %v", dirPath, err)
+		return nil, fmt.Errorf("internal server error when trying to read directory %d/%s", userID, year)
+	}
+
+	// Filter months
+	months := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			// Extract month from filename (remove .json)
+			month := strings.TrimSuffix(entry.Name(), ".json")
+			months = append(months, month)
+		}
+	}
+
+	return months, nil
+}
+
+// DeleteUserData removes the files and the whole directory of a specific user
+func (s *FileStore) DeleteUserData(userID int) error {
+	// Remove the files first, they might not be stored in the user directory
+	if err := s.RemoveAllFiles(userID); err != nil {
+		return err
+	}
+
+	// Try to remove the user directory
+	dirPath := filepath.Join(s.root, strconv.Itoa(userID))
+	if err := os.RemoveAll(dirPath); err != nil {
+		Logger.Printf("Error removing directory %s: %v", dirPath, err)
+		return fmt.Errorf("internal server error when trying to remove user data for ID %d", userID)
+	}
+
+	return nil
+}
+
+// UserDiskUsage calculates the size of the user directory and the files of the user
+func (s *FileStore) UserDiskUsage(userID int) (int64, error) {
+	userDataDir := filepath.Join(s.root, strconv.Itoa(userID))
+	filesDir := filepath.Join(userDataDir, "files")
+	var totalSize int64
+
+	// Calculate size recursively (files are counted by the BlobStore)
+	err := filepath.Walk(userDataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // Continue on errors
+		}
+		if info.IsDir() && path == filesDir {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			totalSize += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return totalSize, err
+	}
+
+	filesSize, err := s.FilesSize(userID)
+	return totalSize + filesSize, err
+}
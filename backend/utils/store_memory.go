@@ -0,0 +1,284 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryStore keeps all data in memory. It uses the same keys as the paths of
+// the FileStore and stores the JSON documents encoded, so that callers get
+// exactly the same types back as when reading from disk.
+// It is meant for testing and demo instances - nothing is persisted!
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: map[string][]byte{}}
+}
+
+// getJSON decodes the document stored under key (empty map if not existing)
+func (s *MemoryStore) getJSON(key string) (map[string]any, error) {
+	s.mu.RLock()
+	data, ok := s.data[key]
+	s.mu.RUnlock()
+	if !ok {
+		return map[string]any{}, nil
+	}
+
+	var content map[string]any
+	if err := json.Unmarshal(data, &content); err != nil {
+		Logger.Printf("Error decoding %s: %v", key, err)
+		return nil, fmt.Errorf("internal server error when trying to decode %s", key)
+	}
+	if content == nil {
+		content = map[string]any{}
+	}
+
+	return content, nil
+}
+
+// putJSON encodes the document and stores it under key
+func (s *MemoryStore) putJSON(key string, content map[string]any) error {
+	data, err := json.Marshal(content)
+	if err != nil {
+		Logger.Printf("Error encoding %s: %v", key, err)
+		return fmt.Errorf("internal server error when trying to encode %s", key)
+	}
+
+	s.mu.Lock()
+	s.data[key] = data
+	s.mu.Unlock()
+	return nil
+}
+
+// childNames returns the distinct names directly below prefix
+func (s *MemoryStore) childNames(prefix string, dirs bool) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[string]bool{}
+	for key := range s.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		name, _, isDir := strings.Cut(rest, "/")
+		if isDir == dirs {
+			seen[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *MemoryStore) GetUsers() (map[string]any, error) {
+	return s.getJSON("users.json")
+}
+
+func (s *MemoryStore) WriteUsers(content map[string]any) error {
+	return s.putJSON("users.json", content)
+}
+
+func (s *MemoryStore) GetMonth(userID int, year, month int) (map[string]any, error) {
+	return s.getJSON(fmt.Sprintf("%d/%d/%02d.json", userID, year, month))
+}
+
+func (s *MemoryStore) WriteMonth(userID int, year, month int, content map[string]any) error {
+	return s.putJSON(fmt.Sprintf("%d/%d/%02d.json", userID, year, month), content)
+}
+
+func (s *MemoryStore) GetYears(userID int) ([]string, error) {
+	years := []string{}
+	for _, name := range s.childNames(fmt.Sprintf("%d/", userID), true) {
+		// Check if the name is a valid year (4 digits)
+		if _, err := strconv.Atoi(name); err == nil && len(name) == 4 {
+			years = append(years, name)
+		}
+	}
+	return years, nil
+}
+
+func (s *MemoryStore) GetMonths(userID int, year string) ([]string, error) {
+	months := []string{}
+	for _, name := range s.childNames(fmt.Sprintf("%d/%s/", userID, year), false) {
+		if strings.HasSuffix(name, ".json") {
+			months = append(months, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	return months, nil
+}
+
+func (s *MemoryStore) GetTags(userID int) (map[string]any, error) {
+	return s.getJSON(fmt.Sprintf("%d/tags.json", userID))
+}
+
+func (s *MemoryStore) WriteTags(userID int, content map[string]any) error {
+	return s.putJSON(fmt.Sprintf("%d/tags.json", userID), content)
+}
+
+func (s *MemoryStore) GetTemplates(userID int) (map[string]any, error) {
+	return s.getJSON(fmt.Sprintf("%d/templates.json", userID))
+}
+
+func (s *MemoryStore) WriteTemplates(userID int, content map[string]any) error {
+	return s.putJSON(fmt.Sprintf("%d/templates.json", userID), content)
+}
+
+func (s *MemoryStore) GetSecurityLog(userID int) (map[string]any, error) {
+	return s.getJSON(fmt.Sprintf("%d/security_log.json", userID))
+}
+
+func (s *MemoryStore) WriteSecurityLog(userID int, content map[string]any) error {
+	return s.putJSON(fmt.Sprintf("%d/security_log.json", userID), content)
+}
+
+func (s *MemoryStore) GetUserSettings(userID int) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return string(s.data[fmt.Sprintf("%d/settings.encrypted", userID)]), nil
+}
+
+func (s *MemoryStore) WriteUserSettings(userID int, content string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[fmt.Sprintf("%d/settings.encrypted", userID)] = []byte(content)
+	return nil
+}
+
+func (s *MemoryStore) WriteFile(content []byte, userID int, uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[fmt.Sprintf("%d/files/%s", userID, uuid)] = append([]byte(nil), content...)
+	return nil
+}
+
+func (s *MemoryStore) ReadFile(userID int, uuid string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	content, ok := s.data[fmt.Sprintf("%d/files/%s", userID, uuid)]
+	if !ok {
+		return nil, fmt.Errorf("file not found")
+	}
+	return append([]byte(nil), content...), nil
+}
+
+func (s *MemoryStore) WriteFileStream(content io.Reader, userID int, uuid string) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	return s.WriteFile(data, userID, uuid)
+}
+
+func (s *MemoryStore) OpenFile(userID int, uuid string) (io.ReadSeekCloser, error) {
+	content, err := s.ReadFile(userID, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return memoryFile{bytes.NewReader(content)}, nil
+}
+
+// memoryFile is a file returned by MemoryStore.OpenFile
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) RemoveFile(userID int, uuid string) error {
+	key := fmt.Sprintf("%d/files/%s", userID, uuid)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[key]; !ok {
+		return fmt.Errorf("internal server error when trying to remove file %s", uuid)
+	}
+	delete(s.data, key)
+	return nil
+}
+
+func (s *MemoryStore) ListFiles(userID int) ([]string, error) {
+	return s.childNames(fmt.Sprintf("%d/files/", userID), false), nil
+}
+
+func (s *MemoryStore) FilesSize(userID int) (int64, error) {
+	return s.sizeOf(fmt.Sprintf("%d/files/", userID)), nil
+}
+
+func (s *MemoryStore) RemoveAllFiles(userID int) error {
+	s.deletePrefix(fmt.Sprintf("%d/files/", userID))
+	s.deletePrefix(fmt.Sprintf("%d/quarantine/", userID))
+	return nil
+}
+
+func (s *MemoryStore) QuarantineFile(userID int, uuid string) (int64, error) {
+	key := fmt.Sprintf("%d/files/%s", userID, uuid)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.data[key]
+	if !ok {
+		return 0, fmt.Errorf("internal server error when trying to quarantine file %s", uuid)
+	}
+	delete(s.data, key)
+	s.data[fmt.Sprintf("%d/quarantine/%s", userID, uuid)] = content
+	return int64(len(content)), nil
+}
+
+func (s *MemoryStore) RemoveQuarantinedFile(userID int, uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, fmt.Sprintf("%d/quarantine/%s", userID, uuid))
+	return nil
+}
+
+func (s *MemoryStore) DeleteUserData(userID int) error {
+	s.deletePrefix(fmt.Sprintf("%d/", userID))
+	return nil
+}
+
+func (s *MemoryStore) UserDiskUsage(userID int) (int64, error) {
+	return s.sizeOf(fmt.Sprintf("%d/", userID)), nil
+}
+
+// sizeOf sums up the size of all entries below prefix
+func (s *MemoryStore) sizeOf(prefix string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var totalSize int64
+	for key, data := range s.data {
+		if strings.HasPrefix(key, prefix) {
+			totalSize += int64(len(data))
+		}
+	}
+	return totalSize
+}
+
+// deletePrefix removes all entries below prefix
+func (s *MemoryStore) deletePrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.data {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.data, key)
+		}
+	}
+}
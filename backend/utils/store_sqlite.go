@@ -0,0 +1,1124 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteFilename is the name of the database inside DATA_PATH
+const SQLiteFilename = "dailytxt.db"
+
+// SQLiteStore keeps users, logs, tags, templates and settings in a SQLite
+// database. Each day of a month is a row, and so are its tags, pins and file
+// references, so that days can be selected by date, tag or bookmark without
+// decoding whole months. Encrypted values are stored exactly as in the JSON
+// files. The files themselves stay in a BlobStore.
+type SQLiteStore struct {
+	db    *sql.DB
+	blobs BlobStore
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+-- users.json (user_id 0) and the settings of every user
+CREATE TABLE IF NOT EXISTS documents (
+	user_id INTEGER NOT NULL,
+	name    TEXT NOT NULL,
+	content TEXT NOT NULL,
+	PRIMARY KEY (user_id, name)
+);
+
+-- month files without their days
+CREATE TABLE IF NOT EXISTS months (
+	user_id INTEGER NOT NULL,
+	year    INTEGER NOT NULL,
+	month   INTEGER NOT NULL,
+	content TEXT NOT NULL,
+	PRIMARY KEY (user_id, year, month)
+);
+
+-- days without tags, pins and files (position = index in the days array)
+CREATE TABLE IF NOT EXISTS days (
+	user_id       INTEGER NOT NULL,
+	year          INTEGER NOT NULL,
+	month         INTEGER NOT NULL,
+	position      INTEGER NOT NULL,
+	day           INTEGER NOT NULL,
+	date          TEXT NOT NULL,
+	is_bookmarked INTEGER NOT NULL DEFAULT 0,
+	has_files     INTEGER NOT NULL DEFAULT 0,
+	content       TEXT NOT NULL,
+	PRIMARY KEY (user_id, year, month, position)
+);
+CREATE INDEX IF NOT EXISTS idx_days_date ON days (user_id, date);
+CREATE INDEX IF NOT EXISTS idx_days_bookmarked ON days (user_id, is_bookmarked);
+CREATE INDEX IF NOT EXISTS idx_days_files ON days (user_id, has_files);
+
+CREATE TABLE IF NOT EXISTS day_tags (
+	user_id      INTEGER NOT NULL,
+	year         INTEGER NOT NULL,
+	month        INTEGER NOT NULL,
+	day_position INTEGER NOT NULL,
+	position     INTEGER NOT NULL,
+	tag_id       INTEGER NOT NULL,
+	PRIMARY KEY (user_id, year, month, day_position, position)
+);
+CREATE INDEX IF NOT EXISTS idx_day_tags_tag ON day_tags (user_id, tag_id);
+
+CREATE TABLE IF NOT EXISTS day_pins (
+	user_id      INTEGER NOT NULL,
+	year         INTEGER NOT NULL,
+	month        INTEGER NOT NULL,
+	day_position INTEGER NOT NULL,
+	position     INTEGER NOT NULL,
+	pin_id       TEXT NOT NULL,
+	content      TEXT NOT NULL,
+	PRIMARY KEY (user_id, year, month, day_position, position)
+);
+
+CREATE TABLE IF NOT EXISTS day_files (
+	user_id       INTEGER NOT NULL,
+	year          INTEGER NOT NULL,
+	month         INTEGER NOT NULL,
+	day_position  INTEGER NOT NULL,
+	position      INTEGER NOT NULL,
+	uuid_filename TEXT NOT NULL,
+	size          INTEGER NOT NULL DEFAULT 0,
+	content       TEXT NOT NULL,
+	PRIMARY KEY (user_id, year, month, day_position, position)
+);
+CREATE INDEX IF NOT EXISTS idx_day_files_uuid ON day_files (user_id, uuid_filename);
+
+CREATE TABLE IF NOT EXISTS tags (
+	user_id  INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	tag_id   INTEGER NOT NULL,
+	content  TEXT NOT NULL,
+	PRIMARY KEY (user_id, position)
+);
+CREATE INDEX IF NOT EXISTS idx_tags_id ON tags (user_id, tag_id);
+
+CREATE TABLE IF NOT EXISTS templates (
+	user_id  INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	name     TEXT NOT NULL,
+	content  TEXT NOT NULL,
+	PRIMARY KEY (user_id, position)
+);
+`
+
+// Tables with rows of a single user (documents is handled separately)
+var sqliteUserTables = []string{"months", "days", "day_tags", "day_pins", "day_files", "tags", "templates"}
+
+// NewSQLiteStore opens (or creates) the database at path.
+// If the database is new, existing data of the JSON layout is migrated once.
+func NewSQLiteStore(path string, blobs BlobStore) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %v", path, err)
+	}
+
+	// A single connection serializes all writes, the app is not write-heavy
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create database schema: %v", err)
+	}
+
+	store := &SQLiteStore{db: db, blobs: blobs}
+
+	if err := store.migrateFromJSON(Settings.DataPath); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate JSON data to SQLite: %v", err)
+	}
+
+	if err := store.upgradeMonths(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade months: %v", err)
+	}
+
+	return store, nil
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// sqlExecer is implemented by *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// sqlQueryer is implemented by *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// withTx runs fn in a transaction
+func (s *SQLiteStore) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getDocument reads a raw document (empty string if not existing)
+func getDocument(q sqlQueryer, userID int, name string) (string, bool, error) {
+	var content string
+	err := q.QueryRow("SELECT content FROM documents WHERE user_id = ? AND name = ?", userID, name).Scan(&content)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	return content, true, nil
+}
+
+// putDocument writes a raw document
+func putDocument(e sqlExecer, userID int, name string, content string) error {
+	_, err := e.Exec("INSERT OR REPLACE INTO documents (user_id, name, content) VALUES (?, ?, ?)", userID, name, content)
+	return err
+}
+
+// decodeJSONObject decodes a JSON object (empty map for an empty string)
+func decodeJSONObject(data string) (map[string]any, error) {
+	content := map[string]any{}
+	if data == "" {
+		return content, nil
+	}
+	if err := json.Unmarshal([]byte(data), &content); err != nil {
+		return nil, err
+	}
+	if content == nil {
+		content = map[string]any{}
+	}
+
+	return content, nil
+}
+
+// encodeJSON encodes a value to a JSON string
+func encodeJSON(value any) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// normalizeJSON converts content to the types produced by decoding JSON
+// (float64, []any, map[string]any), as handlers also write ints and typed slices
+func normalizeJSON(content map[string]any) (map[string]any, error) {
+	data, err := encodeJSON(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeJSONObject(data)
+}
+
+// splitArray removes the array key from content, if it only contains objects.
+// The array is replaced by an empty array to remember that it existed.
+// The returned rest is a shallow copy - content itself is not modified.
+func splitArray(content map[string]any, key string) (map[string]any, []map[string]any) {
+	rest := make(map[string]any, len(content))
+	for k, v := range content {
+		rest[k] = v
+	}
+
+	array, ok := content[key].([]any)
+	if !ok {
+		return rest, nil
+	}
+
+	items := make([]map[string]any, 0, len(array))
+	for _, item := range array {
+		itemMap, ok := item.(map[string]any)
+		if !ok {
+			// Keep unusual content as it is
+			return rest, nil
+		}
+		items = append(items, itemMap)
+	}
+
+	rest[key] = []any{}
+	return rest, items
+}
+
+// splitTagIDs removes the tag IDs of a day from content, if they are all integer numbers
+func splitTagIDs(content map[string]any) (map[string]any, []int) {
+	tags, ok := content["tags"].([]any)
+	if !ok {
+		return content, nil
+	}
+
+	tagIDs := make([]int, 0, len(tags))
+	for _, t := range tags {
+		id, ok := t.(float64)
+		if !ok || id != float64(int(id)) {
+			// Keep unusual content as it is
+			return content, nil
+		}
+		tagIDs = append(tagIDs, int(id))
+	}
+
+	content["tags"] = []any{}
+	return content, tagIDs
+}
+
+// appendToArray appends item to the array stored under key
+func appendToArray(content map[string]any, key string, item any) {
+	array, _ := content[key].([]any)
+	content[key] = append(array, item)
+}
+
+func (s *SQLiteStore) GetUsers() (map[string]any, error) {
+	data, _, err := getDocument(s.db, 0, "users")
+	if err != nil {
+		Logger.Printf("Error reading users from database: %v", err)
+		return nil, fmt.Errorf("internal server error when trying to read users")
+	}
+
+	content, err := decodeJSONObject(data)
+	if err != nil {
+		Logger.Printf("Error decoding users: %v", err)
+		return nil, fmt.Errorf("internal server error when trying to decode users")
+	}
+
+	return content, nil
+}
+
+func (s *SQLiteStore) WriteUsers(content map[string]any) error {
+	data, err := encodeJSON(content)
+	if err != nil {
+		Logger.Printf("Error encoding users: %v", err)
+		return fmt.Errorf("internal server error when trying to encode users")
+	}
+
+	if err := putDocument(s.db, 0, "users", data); err != nil {
+		Logger.Printf("Error writing users to database: %v", err)
+		return fmt.Errorf("internal server error when trying to write users")
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) GetMonth(userID int, year, month int) (map[string]any, error) {
+	var content map[string]any
+	err := s.withTx(func(tx *sql.Tx) error {
+		var data string
+		err := tx.QueryRow("SELECT content FROM months WHERE user_id = ? AND year = ? AND month = ?", userID, year, month).Scan(&data)
+		if err == sql.ErrNoRows {
+			content = map[string]any{}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if content, err = decodeJSONObject(data); err != nil {
+			return err
+		}
+
+		records, err := loadDays(tx, "d.user_id = ? AND d.year = ? AND d.month = ?", []any{userID, year, month}, "d.position")
+		if err != nil {
+			return err
+		}
+
+		// "days" is an empty placeholder if the days are stored as rows
+		if placeholder, ok := content["days"].([]any); ok && len(placeholder) == 0 {
+			days := make([]any, 0, len(records))
+			for _, record := range records {
+				days = append(days, record.Day)
+			}
+			content["days"] = days
+		}
+
+		return nil
+	})
+	if err != nil {
+		Logger.Printf("Error reading month %d/%02d of user %d from database: %v", year, month, userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read %d/%02d", year, month)
+	}
+
+	return content, nil
+}
+
+func (s *SQLiteStore) WriteMonth(userID int, year, month int, content map[string]any) error {
+	err := s.withTx(func(tx *sql.Tx) error {
+		return writeMonth(tx, userID, year, month, content)
+	})
+	if err != nil {
+		Logger.Printf("Error writing month %d/%02d of user %d to database: %v", year, month, userID, err)
+		return fmt.Errorf("internal server error when trying to write %d/%02d", year, month)
+	}
+
+	return nil
+}
+
+// writeMonth replaces all rows of a month
+func writeMonth(tx *sql.Tx, userID int, year, month int, content map[string]any) error {
+	content, err := normalizeJSON(content)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"days", "day_tags", "day_pins", "day_files"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ? AND year = ? AND month = ?", userID, year, month); err != nil {
+			return err
+		}
+	}
+
+	rest, days := splitArray(content, "days")
+	restData, err := encodeJSON(rest)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO months (user_id, year, month, content) VALUES (?, ?, ?, ?)", userID, year, month, restData); err != nil {
+		return err
+	}
+
+	for position, day := range days {
+		dayContent, pins := splitArray(day, "pins")
+		dayContent, files := splitArray(dayContent, "files")
+		dayContent, tagIDs := splitTagIDs(dayContent)
+
+		dayNum, _ := day["day"].(float64)
+		record := DayDocument{Year: year, Month: month, Day: day}
+
+		dayData, err := encodeJSON(dayContent)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO days (user_id, year, month, position, day, date, is_bookmarked, has_files, content)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			userID, year, month, position, int(dayNum), record.date(), dayIsBookmarked(day), len(files) > 0, dayData)
+		if err != nil {
+			return err
+		}
+
+		for i, tagID := range tagIDs {
+			_, err := tx.Exec("INSERT INTO day_tags (user_id, year, month, day_position, position, tag_id) VALUES (?, ?, ?, ?, ?, ?)",
+				userID, year, month, position, i, tagID)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, pin := range pins {
+			pinID := fmt.Sprint(pin["id"])
+			pinData, err := encodeJSON(pin)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("INSERT INTO day_pins (user_id, year, month, day_position, position, pin_id, content) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				userID, year, month, position, i, pinID, pinData)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, file := range files {
+			uuid, _ := file["uuid_filename"].(string)
+			size, _ := file["size"].(float64)
+			fileData, err := encodeJSON(file)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("INSERT INTO day_files (user_id, year, month, day_position, position, uuid_filename, size, content) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+				userID, year, month, position, i, uuid, int64(size), fileData)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// dayKey identifies a day row
+type dayKey struct {
+	year, month, position int
+}
+
+// loadDays loads the days matching where (on table alias d) and attaches their tags, pins and files
+func loadDays(q sqlQueryer, where string, args []any, orderBy string) ([]DayDocument, error) {
+	rows, err := q.Query("SELECT d.year, d.month, d.position, d.content FROM days d WHERE "+where+" ORDER BY "+orderBy, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []DayDocument{}
+	byKey := map[dayKey]map[string]any{}
+	for rows.Next() {
+		var key dayKey
+		var data string
+		if err := rows.Scan(&key.year, &key.month, &key.position, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		day, err := decodeJSONObject(data)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		records = append(records, DayDocument{Year: key.year, Month: key.month, Day: day})
+		byKey[key] = day
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return records, nil
+	}
+
+	// Attach the child rows of the selected days
+	children := []struct {
+		table string
+		key   string
+	}{
+		{"day_tags", "tags"},
+		{"day_pins", "pins"},
+		{"day_files", "files"},
+	}
+	for _, child := range children {
+		value := "c.content"
+		if child.table == "day_tags" {
+			value = "c.tag_id"
+		}
+
+		rows, err := q.Query(`SELECT c.year, c.month, c.day_position, `+value+` FROM `+child.table+` c
+			JOIN days d ON d.user_id = c.user_id AND d.year = c.year AND d.month = c.month AND d.position = c.day_position
+			WHERE `+where+` ORDER BY c.year, c.month, c.day_position, c.position`, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var key dayKey
+			var data string
+			if err := rows.Scan(&key.year, &key.month, &key.position, &data); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			day, ok := byKey[key]
+			if !ok {
+				continue
+			}
+
+			if child.table == "day_tags" {
+				tagID, err := strconv.Atoi(data)
+				if err != nil {
+					rows.Close()
+					return nil, err
+				}
+				appendToArray(day, child.key, float64(tagID))
+				continue
+			}
+
+			item, err := decodeJSONObject(data)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			appendToArray(day, child.key, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return records, nil
+}
+
+// QueryDays selects the days using the indexes on date, bookmark flag and tag IDs
+func (s *SQLiteStore) QueryDays(userID int, filter DayFilter) ([]DayDocument, error) {
+	conditions := []string{"d.user_id = ?"}
+	args := []any{userID}
+
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "d.date >= ?")
+		args = append(args, filter.From.Format("2006-01-02"))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "d.date <= ?")
+		args = append(args, filter.To.Format("2006-01-02"))
+	}
+	if filter.Bookmarked {
+		conditions = append(conditions, "d.is_bookmarked = 1")
+	}
+	if filter.WithFiles {
+		conditions = append(conditions, "d.has_files = 1")
+	}
+	if filter.TagID != 0 {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM day_tags t WHERE t.user_id = d.user_id AND t.year = d.year
+			AND t.month = d.month AND t.day_position = d.position AND t.tag_id = ?)`)
+		args = append(args, filter.TagID)
+	}
+
+	var records []DayDocument
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		records, err = loadDays(tx, strings.Join(conditions, " AND "), args, "d.date, d.year, d.month, d.position")
+		return err
+	})
+	if err != nil {
+		Logger.Printf("Error querying days of user %d: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to query days")
+	}
+
+	return records, nil
+}
+
+func (s *SQLiteStore) GetYears(userID int) ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT year FROM months WHERE user_id = ? ORDER BY year", userID)
+	if err != nil {
+		Logger.Printf("Error reading years of user %d from database: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read years of user %d", userID)
+	}
+	defer rows.Close()
+
+	years := []string{}
+	for rows.Next() {
+		var year int
+		if err := rows.Scan(&year); err != nil {
+			return nil, fmt.Errorf("internal server error when trying to read years of user %d", userID)
+		}
+		years = append(years, strconv.Itoa(year))
+	}
+
+	return years, rows.Err()
+}
+
+func (s *SQLiteStore) GetMonths(userID int, year string) ([]string, error) {
+	yearInt, err := strconv.Atoi(year)
+	if err != nil {
+		return []string{}, nil
+	}
+
+	rows, err := s.db.Query("SELECT month FROM months WHERE user_id = ? AND year = ? ORDER BY month", userID, yearInt)
+	if err != nil {
+		Logger.Printf("Error reading months of user %d from database: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read months of %s", year)
+	}
+	defer rows.Close()
+
+	months := []string{}
+	for rows.Next() {
+		var month int
+		if err := rows.Scan(&month); err != nil {
+			return nil, fmt.Errorf("internal server error when trying to read months of %s", year)
+		}
+		months = append(months, fmt.Sprintf("%02d", month))
+	}
+
+	return months, rows.Err()
+}
+
+// getListDocument reads a document whose array key is stored as rows of table
+func (s *SQLiteStore) getListDocument(userID int, name string, table string) (map[string]any, error) {
+	var content map[string]any
+	err := s.withTx(func(tx *sql.Tx) error {
+		data, exists, err := getDocument(tx, userID, name)
+		if err != nil {
+			return err
+		}
+		if content, err = decodeJSONObject(data); err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+
+		// The array is an empty placeholder if its items are stored as rows
+		if placeholder, ok := content[name].([]any); !ok || len(placeholder) != 0 {
+			return nil
+		}
+
+		rows, err := tx.Query("SELECT content FROM "+table+" WHERE user_id = ? ORDER BY position", userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items := []any{}
+		for rows.Next() {
+			var itemData string
+			if err := rows.Scan(&itemData); err != nil {
+				return err
+			}
+			item, err := decodeJSONObject(itemData)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		content[name] = items
+
+		return rows.Err()
+	})
+
+	return content, err
+}
+
+func (s *SQLiteStore) GetTags(userID int) (map[string]any, error) {
+	content, err := s.getListDocument(userID, "tags", "tags")
+	if err != nil {
+		Logger.Printf("Error reading tags of user %d from database: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read tags")
+	}
+
+	return content, nil
+}
+
+func (s *SQLiteStore) WriteTags(userID int, content map[string]any) error {
+	err := s.withTx(func(tx *sql.Tx) error {
+		return writeTags(tx, userID, content)
+	})
+	if err != nil {
+		Logger.Printf("Error writing tags of user %d to database: %v", userID, err)
+		return fmt.Errorf("internal server error when trying to write tags")
+	}
+
+	return nil
+}
+
+// writeTags replaces all tags of a user
+func writeTags(tx *sql.Tx, userID int, content map[string]any) error {
+	content, err := normalizeJSON(content)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM tags WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	rest, tags := splitArray(content, "tags")
+	restData, err := encodeJSON(rest)
+	if err != nil {
+		return err
+	}
+	if err := putDocument(tx, userID, "tags", restData); err != nil {
+		return err
+	}
+
+	for position, tag := range tags {
+		tagID, _ := tag["id"].(float64)
+		tagData, err := encodeJSON(tag)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO tags (user_id, position, tag_id, content) VALUES (?, ?, ?, ?)", userID, position, int(tagID), tagData)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) GetTemplates(userID int) (map[string]any, error) {
+	content, err := s.getListDocument(userID, "templates", "templates")
+	if err != nil {
+		Logger.Printf("Error reading templates of user %d from database: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read templates")
+	}
+
+	return content, nil
+}
+
+func (s *SQLiteStore) WriteTemplates(userID int, content map[string]any) error {
+	err := s.withTx(func(tx *sql.Tx) error {
+		return writeTemplates(tx, userID, content)
+	})
+	if err != nil {
+		Logger.Printf("Error writing templates of user %d to database: %v", userID, err)
+		return fmt.Errorf("internal server error when trying to write templates")
+	}
+
+	return nil
+}
+
+// writeTemplates replaces all templates of a user
+func writeTemplates(tx *sql.Tx, userID int, content map[string]any) error {
+	content, err := normalizeJSON(content)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM templates WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	rest, templates := splitArray(content, "templates")
+	restData, err := encodeJSON(rest)
+	if err != nil {
+		return err
+	}
+	if err := putDocument(tx, userID, "templates", restData); err != nil {
+		return err
+	}
+
+	for position, template := range templates {
+		name, _ := template["name"].(string)
+		templateData, err := encodeJSON(template)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO templates (user_id, position, name, content) VALUES (?, ?, ?, ?)", userID, position, name, templateData)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) GetUserSettings(userID int) (string, error) {
+	content, _, err := getDocument(s.db, userID, "settings")
+	if err != nil {
+		Logger.Printf("Error reading settings of user %d from database: %v", userID, err)
+		return "", fmt.Errorf("internal server error when trying to read settings")
+	}
+
+	return content, nil
+}
+
+func (s *SQLiteStore) WriteUserSettings(userID int, content string) error {
+	if err := putDocument(s.db, userID, "settings", content); err != nil {
+		Logger.Printf("Error writing settings of user %d to database: %v", userID, err)
+		return fmt.Errorf("internal server error when trying to write settings")
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) GetSecurityLog(userID int) (map[string]any, error) {
+	data, _, err := getDocument(s.db, userID, "security_log")
+	if err != nil {
+		Logger.Printf("Error reading security log of user %d from database: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read security log")
+	}
+
+	content, err := decodeJSONObject(data)
+	if err != nil {
+		Logger.Printf("Error decoding security log of user %d: %v", userID, err)
+		return nil, fmt.Errorf("internal server error when trying to decode security log")
+	}
+
+	return content, nil
+}
+
+func (s *SQLiteStore) WriteSecurityLog(userID int, content map[string]any) error {
+	data, err := encodeJSON(content)
+	if err != nil {
+		return err
+	}
+
+	if err := putDocument(s.db, userID, "security_log", data); err != nil {
+		Logger.Printf("Error writing security log of user %d to database: %v", userID, err)
+		return fmt.Errorf("internal server error when trying to write security log")
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) WriteFile(content []byte, userID int, uuid string) error {
+	return s.blobs.WriteFile(content, userID, uuid)
+}
+
+func (s *SQLiteStore) ReadFile(userID int, uuid string) ([]byte, error) {
+	return s.blobs.ReadFile(userID, uuid)
+}
+
+func (s *SQLiteStore) RemoveFile(userID int, uuid string) error {
+	return s.blobs.RemoveFile(userID, uuid)
+}
+
+func (s *SQLiteStore) WriteFileStream(content io.Reader, userID int, uuid string) error {
+	return s.blobs.WriteFileStream(content, userID, uuid)
+}
+
+func (s *SQLiteStore) OpenFile(userID int, uuid string) (io.ReadSeekCloser, error) {
+	return s.blobs.OpenFile(userID, uuid)
+}
+
+func (s *SQLiteStore) ListFiles(userID int) ([]string, error) {
+	return s.blobs.ListFiles(userID)
+}
+
+func (s *SQLiteStore) FilesSize(userID int) (int64, error) {
+	return s.blobs.FilesSize(userID)
+}
+
+func (s *SQLiteStore) RemoveAllFiles(userID int) error {
+	return s.blobs.RemoveAllFiles(userID)
+}
+
+func (s *SQLiteStore) QuarantineFile(userID int, uuid string) (int64, error) {
+	return s.blobs.QuarantineFile(userID, uuid)
+}
+
+func (s *SQLiteStore) RemoveQuarantinedFile(userID int, uuid string) error {
+	return s.blobs.RemoveQuarantinedFile(userID, uuid)
+}
+
+func (s *SQLiteStore) DeleteUserData(userID int) error {
+	err := s.withTx(func(tx *sql.Tx) error {
+		for _, table := range append(sqliteUserTables, "documents") {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Logger.Printf("Error removing data of user %d from database: %v", userID, err)
+		return fmt.Errorf("internal server error when trying to remove user data for ID %d", userID)
+	}
+
+	return s.blobs.RemoveAllFiles(userID)
+}
+
+func (s *SQLiteStore) UserDiskUsage(userID int) (int64, error) {
+	var totalSize int64
+	for _, table := range append(sqliteUserTables, "documents") {
+		column := "content"
+		if table == "day_tags" {
+			column = "tag_id"
+		}
+
+		var size sql.NullInt64
+		if err := s.db.QueryRow("SELECT SUM(LENGTH("+column+")) FROM "+table+" WHERE user_id = ?", userID).Scan(&size); err != nil {
+			return totalSize, err
+		}
+		totalSize += size.Int64
+	}
+
+	filesSize, err := s.blobs.FilesSize(userID)
+	return totalSize + filesSize, err
+}
+
+// upgradeMonths upgrades all months with an old schema version. QueryDays reads
+// the days directly from the rows, so they can't be upgraded when read.
+func (s *SQLiteStore) upgradeMonths() error {
+	type monthKey struct{ userID, year, month int }
+	var outdated []monthKey
+
+	rows, err := s.db.Query("SELECT user_id, year, month, content FROM months")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var key monthKey
+		var data string
+		if err := rows.Scan(&key.userID, &key.year, &key.month, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		rest, err := decodeJSONObject(data)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if monthSchemaVersion(rest) < MonthSchemaVersion {
+			outdated = append(outdated, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range outdated {
+		content, err := s.GetMonth(key.userID, key.year, key.month)
+		if err != nil {
+			return err
+		}
+		if err := UpgradeMonth(content); err != nil {
+			return fmt.Errorf("month %d/%02d of user %d: %v", key.year, key.month, key.userID, err)
+		}
+		if err := s.WriteMonth(key.userID, key.year, key.month, content); err != nil {
+			return err
+		}
+	}
+
+	if len(outdated) > 0 {
+		Logger.Printf("Upgraded %d months to schema version %d", len(outdated), MonthSchemaVersion)
+	}
+
+	return nil
+}
+
+// migrateFromJSON copies the data of the JSON layout into the database once.
+// Afterwards users.json is renamed to users.json.migrated, the other JSON files
+// are left untouched.
+func (s *SQLiteStore) migrateFromJSON(root string) error {
+	var migratedAt string
+	err := s.db.QueryRow("SELECT value FROM meta WHERE key = 'json_migrated_at'").Scan(&migratedAt)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	files := NewFileStore(root, NewLocalBlobStore(root))
+	users, err := files.GetUsers()
+	if err != nil {
+		return err
+	}
+
+	err = s.withTx(func(tx *sql.Tx) error {
+		if len(users) > 0 {
+			Logger.Printf("Migrating data from JSON files to SQLite database...")
+
+			usersData, err := encodeJSON(users)
+			if err != nil {
+				return err
+			}
+			if err := putDocument(tx, 0, "users", usersData); err != nil {
+				return err
+			}
+
+			usersList, _ := users["users"].([]any)
+			for _, u := range usersList {
+				user, ok := u.(map[string]any)
+				if !ok {
+					continue
+				}
+				id, ok := user["user_id"].(float64)
+				if !ok {
+					continue
+				}
+				if err := migrateUserFromJSON(tx, files, int(id)); err != nil {
+					return fmt.Errorf("user %d: %v", int(id), err)
+				}
+			}
+		}
+
+		_, err := tx.Exec("INSERT INTO meta (key, value) VALUES ('json_migrated_at', ?)", time.Now().Format(time.RFC3339))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 {
+		// Rename users.json so the file backend can't silently use outdated data
+		usersPath := filepath.Join(root, "users.json")
+		if err := os.Rename(usersPath, usersPath+".migrated"); err != nil {
+			Logger.Printf("Error renaming %s after migration: %v", usersPath, err)
+		}
+		Logger.Printf("Migration to SQLite completed. The old JSON files were kept and can be deleted.")
+	}
+
+	return nil
+}
+
+// migrateUserFromJSON copies tags, templates, settings, the security log and logs of a single user
+func migrateUserFromJSON(tx *sql.Tx, files *FileStore, userID int) error {
+	tags, err := files.GetTags(userID)
+	if err != nil {
+		return err
+	}
+	if len(tags) > 0 {
+		if err := writeTags(tx, userID, tags); err != nil {
+			return err
+		}
+	}
+
+	templates, err := files.GetTemplates(userID)
+	if err != nil {
+		return err
+	}
+	if len(templates) > 0 {
+		if err := writeTemplates(tx, userID, templates); err != nil {
+			return err
+		}
+	}
+
+	settings, err := files.GetUserSettings(userID)
+	if err != nil {
+		return err
+	}
+	if settings != "" {
+		if err := putDocument(tx, userID, "settings", settings); err != nil {
+			return err
+		}
+	}
+
+	securityLog, err := files.GetSecurityLog(userID)
+	if err != nil {
+		return err
+	}
+	if len(securityLog) > 0 {
+		data, err := encodeJSON(securityLog)
+		if err != nil {
+			return err
+		}
+		if err := putDocument(tx, userID, "security_log", data); err != nil {
+			return err
+		}
+	}
+
+	years, err := files.GetYears(userID)
+	if err != nil {
+		return err
+	}
+	for _, yearStr := range years {
+		year, _ := strconv.Atoi(yearStr)
+		months, err := files.GetMonths(userID, yearStr)
+		if err != nil {
+			return err
+		}
+		for _, monthStr := range months {
+			month, err := strconv.Atoi(monthStr)
+			if err != nil {
+				continue
+			}
+			content, err := files.GetMonth(userID, year, month)
+			if err != nil {
+				return err
+			}
+			if err := UpgradeMonth(content); err != nil {
+				return fmt.Errorf("month %d/%02d: %v", year, month, err)
+			}
+			if err := writeMonth(tx, userID, year, month, content); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newSQLiteTestStore opens a new database in a temporary DATA_PATH. The JSON
+// layout written to the directory before is migrated into it.
+func newSQLiteTestStore(t *testing.T, root string) *SQLiteStore {
+	t.Helper()
+
+	previousPath := Settings.DataPath
+	Settings.DataPath = root
+	t.Cleanup(func() { Settings.DataPath = previousPath })
+
+	store, err := NewSQLiteStore(filepath.Join(root, SQLiteFilename), NewLocalBlobStore(root))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testMonth returns a month document with three days in the shapes the stores return
+func testMonth() map[string]any {
+	return map[string]any{
+		"schema_version": float64(MonthSchemaVersion),
+		"days": []any{
+			map[string]any{
+				"day":          float64(2),
+				"text":         "enc-text-2",
+				"isBookmarked": true,
+				"tags":         []any{float64(1), float64(3)},
+			},
+			map[string]any{
+				"day":  float64(9),
+				"text": "enc-text-9",
+				"files": []any{
+					map[string]any{"enc_filename": "enc-name", "uuid_filename": "01890a5d-ac96-774b-bcce-b302099a8057", "size": float64(12)},
+				},
+				"pins": []any{
+					map[string]any{"id": float64(1), "lat": "enc-lat", "lon": "enc-lon", "text": "enc-pin"},
+				},
+				// Keys without a column are kept
+				"future_key": "kept",
+			},
+			map[string]any{
+				"day":  float64(20),
+				"text": "enc-text-20",
+				"tags": []any{float64(3)},
+			},
+		},
+	}
+}
+
+func TestSQLiteStoreMonthRoundTrip(t *testing.T) {
+	store := newSQLiteTestStore(t, t.TempDir())
+
+	if err := store.WriteMonth(1, 2024, 4, testMonth()); err != nil {
+		t.Fatalf("writing month: %v", err)
+	}
+
+	got, err := store.GetMonth(1, 2024, 4)
+	if err != nil {
+		t.Fatalf("reading month: %v", err)
+	}
+	if want := testMonth(); !reflect.DeepEqual(got, want) {
+		t.Errorf("month = %v, want %v", got, want)
+	}
+
+	// Other users and months are empty
+	if other, err := store.GetMonth(2, 2024, 4); err != nil || len(other) != 0 {
+		t.Errorf("month of another user = %v, %v, want empty", other, err)
+	}
+	if years, err := store.GetYears(1); err != nil || !reflect.DeepEqual(years, []string{"2024"}) {
+		t.Errorf("years = %v, %v, want [2024]", years, err)
+	}
+	if months, err := store.GetMonths(1, "2024"); err != nil || !reflect.DeepEqual(months, []string{"04"}) {
+		t.Errorf("months = %v, %v, want [04]", months, err)
+	}
+
+	// Writing replaces all days of the month
+	month := testMonth()
+	month["days"] = month["days"].([]any)[:1]
+	if err := store.WriteMonth(1, 2024, 4, month); err != nil {
+		t.Fatalf("writing month again: %v", err)
+	}
+	if records, err := store.QueryDays(1, DayFilter{}); err != nil || len(records) != 1 {
+		t.Errorf("days after rewriting the month = %v, %v, want 1 day", records, err)
+	}
+}
+
+func TestSQLiteStoreQueryDays(t *testing.T) {
+	store := newSQLiteTestStore(t, t.TempDir())
+	if err := store.WriteMonth(1, 2024, 4, testMonth()); err != nil {
+		t.Fatalf("writing month: %v", err)
+	}
+
+	date := func(day int) time.Time { return time.Date(2024, 4, day, 0, 0, 0, 0, time.UTC) }
+
+	for _, tc := range []struct {
+		name   string
+		filter DayFilter
+		want   []float64
+	}{
+		{name: "all", filter: DayFilter{}, want: []float64{2, 9, 20}},
+		{name: "from", filter: DayFilter{From: date(9)}, want: []float64{9, 20}},
+		{name: "to", filter: DayFilter{To: date(9)}, want: []float64{2, 9}},
+		{name: "range", filter: DayFilter{From: date(3), To: date(19)}, want: []float64{9}},
+		{name: "tag", filter: DayFilter{TagID: 3}, want: []float64{2, 20}},
+		{name: "unknown tag", filter: DayFilter{TagID: 7}, want: []float64{}},
+		{name: "bookmarked", filter: DayFilter{Bookmarked: true}, want: []float64{2}},
+		{name: "with files", filter: DayFilter{WithFiles: true}, want: []float64{9}},
+		{name: "tag and bookmark", filter: DayFilter{TagID: 3, Bookmarked: true}, want: []float64{2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			records, err := store.QueryDays(1, tc.filter)
+			if err != nil {
+				t.Fatalf("querying days: %v", err)
+			}
+
+			got := []float64{}
+			for _, record := range records {
+				if record.Year != 2024 || record.Month != 4 {
+					t.Errorf("record of %d/%d, want 2024/4", record.Year, record.Month)
+				}
+				got = append(got, record.Day["day"].(float64))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("days = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSQLiteStoreMigratesFromJSON(t *testing.T) {
+	root := t.TempDir()
+
+	// Data of the JSON layout
+	files := NewFileStore(root, NewLocalBlobStore(root))
+	users := map[string]any{
+		"id_counter": float64(1),
+		"users": []any{
+			map[string]any{"user_id": float64(1), "username": "alice"},
+		},
+	}
+	tags := map[string]any{
+		"next_id": float64(2),
+		"tags":    []any{map[string]any{"id": float64(1), "name": "enc-tag", "icon": "enc-icon", "color": "enc-color"}},
+	}
+	templates := map[string]any{
+		"templates": []any{map[string]any{"name": "enc-template", "text": "enc-template-text"}},
+	}
+	for _, write := range []func() error{
+		func() error { return files.WriteUsers(users) },
+		func() error { return files.WriteMonth(1, 2024, 4, testMonth()) },
+		func() error { return files.WriteTags(1, tags) },
+		func() error { return files.WriteTemplates(1, templates) },
+		func() error { return files.WriteUserSettings(1, "enc-settings") },
+	} {
+		if err := write(); err != nil {
+			t.Fatalf("writing JSON data: %v", err)
+		}
+	}
+
+	store := newSQLiteTestStore(t, root)
+
+	if got, err := store.GetUsers(); err != nil || !reflect.DeepEqual(got, users) {
+		t.Errorf("users = %v, %v, want %v", got, err, users)
+	}
+	if got, err := store.GetMonth(1, 2024, 4); err != nil || !reflect.DeepEqual(got, testMonth()) {
+		t.Errorf("month = %v, %v, want %v", got, err, testMonth())
+	}
+	if got, err := store.GetTags(1); err != nil || !reflect.DeepEqual(got, tags) {
+		t.Errorf("tags = %v, %v, want %v", got, err, tags)
+	}
+	if got, err := store.GetTemplates(1); err != nil || !reflect.DeepEqual(got, templates) {
+		t.Errorf("templates = %v, %v, want %v", got, err, templates)
+	}
+	if got, err := store.GetUserSettings(1); err != nil || got != "enc-settings" {
+		t.Errorf("settings = %q, %v, want %q", got, err, "enc-settings")
+	}
+
+	// users.json is renamed, so the file backend can't use outdated data
+	if _, err := os.Stat(filepath.Join(root, "users.json")); !os.IsNotExist(err) {
+		t.Errorf("users.json still exists after the migration: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "users.json.migrated")); err != nil {
+		t.Errorf("users.json.migrated is missing: %v", err)
+	}
+	store.Close()
+
+	// The migration only runs once
+	if err := files.WriteUsers(map[string]any{"id_counter": float64(0), "users": []any{}}); err != nil {
+		t.Fatalf("writing users.json: %v", err)
+	}
+	reopened := newSQLiteTestStore(t, root)
+	if got, err := reopened.GetUsers(); err != nil || !reflect.DeepEqual(got, users) {
+		t.Errorf("users after reopening = %v, %v, want %v", got, err, users)
+	}
+}
@@ -0,0 +1,336 @@
+package utils
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Throttling of password attempts (login, backup, re-authentication and the
+// admin password). Failed attempts are counted per username and per client IP.
+// After the first failures every further attempt has to wait twice as long as
+// the one before, after LOGIN_MAX_ATTEMPTS failures the username is locked for
+// LOGIN_LOCKOUT_MINUTES. The limits of an IP address are four times as high,
+// because many users may share one address.
+//
+// A password check only starts after it reserved an attempt for all its keys
+// (ThrottleBegin), and only a few checks of a key may run at the same time.
+// Otherwise parallel requests would all pass the check before the first
+// failure is counted, each of them running a full Argon2 hash.
+//
+// The state is only kept in memory, a restart resets it.
+
+const (
+	// Failed attempts without any delay
+	throttleFreeAttempts = 2
+	// Factor of the limits for an IP address
+	throttleIPFactor = 4
+	// Password checks of a username that may run at the same time
+	throttleConcurrentAttempts = 1
+	// How long a client is asked to wait while its other attempts are checked
+	throttleBusyWait = time.Second
+)
+
+// ThrottleKind is the type of a throttle key
+type ThrottleKind string
+
+const (
+	ThrottleUser  ThrottleKind = "user"
+	ThrottleIP    ThrottleKind = "ip"
+	ThrottleAdmin ThrottleKind = "admin"
+)
+
+// ThrottleKey identifies what failed attempts are counted for
+type ThrottleKey struct {
+	Kind  ThrottleKind
+	Value string
+}
+
+type throttleEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// Lockout is a currently blocked key, as shown to the admin
+type Lockout struct {
+	Kind         ThrottleKind `json:"kind"`
+	Value        string       `json:"value"`
+	Failures     int          `json:"failures"`
+	BlockedUntil string       `json:"blocked_until"`
+	LockedOut    bool         `json:"locked_out"`
+}
+
+var (
+	throttleEntries = map[ThrottleKey]*throttleEntry{}
+	// Password checks that are running per key
+	throttleInFlight = map[ThrottleKey]int{}
+	throttleMutex    sync.Mutex
+)
+
+// UserThrottleKey returns the key for a username (case-insensitive like the login)
+func UserThrottleKey(username string) ThrottleKey {
+	return ThrottleKey{Kind: ThrottleUser, Value: strings.ToLower(strings.TrimSpace(username))}
+}
+
+// IPThrottleKey returns the key for the client of a request
+func IPThrottleKey(r *http.Request) ThrottleKey {
+	return ThrottleKey{Kind: ThrottleIP, Value: ClientIP(r)}
+}
+
+// AdminThrottleKey returns the key for attempts of a user at the admin password
+func AdminThrottleKey(userID int) ThrottleKey {
+	return ThrottleKey{Kind: ThrottleAdmin, Value: strconv.Itoa(userID)}
+}
+
+// maxFailures returns the number of failures until a key is locked out
+func (k ThrottleKey) maxFailures() int {
+	if k.Kind == ThrottleIP {
+		return Settings.LoginMaxAttempts * throttleIPFactor
+	}
+	return Settings.LoginMaxAttempts
+}
+
+// freeFailures returns the number of failures without any delay
+func (k ThrottleKey) freeFailures() int {
+	if k.Kind == ThrottleIP {
+		return throttleFreeAttempts * throttleIPFactor
+	}
+	return throttleFreeAttempts
+}
+
+// maxConcurrent returns the number of password checks of a key that may run
+// at the same time
+func (k ThrottleKey) maxConcurrent() int {
+	if k.Kind == ThrottleIP {
+		return throttleConcurrentAttempts * throttleIPFactor
+	}
+	return throttleConcurrentAttempts
+}
+
+func lockoutDuration() time.Duration {
+	return time.Duration(Settings.LoginLockoutMins) * time.Minute
+}
+
+// expired checks if an entry can be forgotten
+func (e *throttleEntry) expired(now time.Time) bool {
+	return now.After(e.blockedUntil) && now.Sub(e.lastFailure) > lockoutDuration()
+}
+
+// ThrottleBegin reserves an attempt for all keys before a password is checked.
+// If the client has to wait (after failures, or while too many of its other
+// attempts are checked), nothing is reserved and the time to wait is returned.
+// Otherwise the returned function must be called when the check is done
+// (after ThrottleFailure or ThrottleSuccess).
+func ThrottleBegin(keys ...ThrottleKey) (func(), time.Duration) {
+	throttleMutex.Lock()
+	defer throttleMutex.Unlock()
+
+	if wait := throttleWait(keys); wait > 0 {
+		return nil, wait
+	}
+	for _, key := range keys {
+		if throttleInFlight[key] >= key.maxConcurrent() {
+			return nil, throttleBusyWait
+		}
+	}
+
+	for _, key := range keys {
+		throttleInFlight[key]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			throttleMutex.Lock()
+			defer throttleMutex.Unlock()
+
+			for _, key := range keys {
+				if throttleInFlight[key]--; throttleInFlight[key] <= 0 {
+					delete(throttleInFlight, key)
+				}
+			}
+		})
+	}, 0
+}
+
+// throttleWait returns how long the client has to wait before the next
+// attempt (0 if it may try now). The caller must hold throttleMutex.
+func throttleWait(keys []ThrottleKey) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		entry, ok := throttleEntries[key]
+		if !ok {
+			continue
+		}
+		if entry.expired(now) {
+			delete(throttleEntries, key)
+			continue
+		}
+		if remaining := entry.blockedUntil.Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
+
+// ThrottleFailure counts a failed attempt for all keys
+func ThrottleFailure(keys ...ThrottleKey) {
+	throttleMutex.Lock()
+	defer throttleMutex.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		entry, ok := throttleEntries[key]
+		if !ok || entry.expired(now) {
+			// Forget old entries, so the map doesn't grow with every new address
+			for k, e := range throttleEntries {
+				if e.expired(now) {
+					delete(throttleEntries, k)
+				}
+			}
+
+			entry = &throttleEntry{}
+			throttleEntries[key] = entry
+		}
+
+		entry.failures++
+		entry.lastFailure = now
+
+		if entry.failures >= key.maxFailures() {
+			entry.blockedUntil = now.Add(lockoutDuration())
+			Logger.Printf("Too many failed attempts, %s '%s' is locked for %v", key.Kind, key.Value, lockoutDuration())
+		} else if entry.failures > key.freeFailures() {
+			// 1s, 2s, 4s, ... but never longer than the lockout
+			backoff := time.Duration(math.Pow(2, float64(entry.failures-key.freeFailures()-1))) * time.Second
+			entry.blockedUntil = now.Add(min(backoff, lockoutDuration()))
+		}
+	}
+}
+
+// ThrottleSuccess forgets the failed attempts of the keys after a correct password
+func ThrottleSuccess(keys ...ThrottleKey) {
+	throttleMutex.Lock()
+	defer throttleMutex.Unlock()
+
+	for _, key := range keys {
+		delete(throttleEntries, key)
+	}
+}
+
+// GetLockouts returns all keys that currently have to wait
+func GetLockouts() []Lockout {
+	throttleMutex.Lock()
+	defer throttleMutex.Unlock()
+
+	now := time.Now()
+	lockouts := []Lockout{}
+	for key, entry := range throttleEntries {
+		if !now.Before(entry.blockedUntil) {
+			continue
+		}
+		lockouts = append(lockouts, Lockout{
+			Kind:         key.Kind,
+			Value:        key.Value,
+			Failures:     entry.failures,
+			BlockedUntil: entry.blockedUntil.UTC().Format(time.RFC3339),
+			LockedOut:    entry.failures >= key.maxFailures(),
+		})
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].BlockedUntil > lockouts[j].BlockedUntil
+	})
+	return lockouts
+}
+
+// TooManyAttempts answers with 429 and the seconds to wait in Retry-After
+func TooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	JSONResponse(w, http.StatusTooManyRequests, map[string]any{
+		"error":       "Too many failed attempts",
+		"retry_after": seconds,
+	})
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For is only used if
+// the request comes from a proxy in TRUSTED_PROXIES: the client is the last
+// address in it that isn't a trusted proxy itself.
+func ClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(remote) {
+		if r.Header.Get("X-Forwarded-For") != "" {
+			warnUntrustedProxy(remote)
+		}
+		return remote
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	addresses := []string{}
+	for _, header := range forwarded {
+		for address := range strings.SplitSeq(header, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	// Every proxy appends the address it got the request from
+	for i := len(addresses) - 1; i >= 0; i-- {
+		if !isTrustedProxy(addresses[i]) {
+			// Addresses before it were forwarded by this (untrusted) proxy
+			if i > 0 {
+				warnUntrustedProxy(addresses[i])
+			}
+			return addresses[i]
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses[0]
+	}
+	return remote
+}
+
+// untrustedProxyWarning makes warnUntrustedProxy log only once
+var untrustedProxyWarning sync.Once
+
+// warnUntrustedProxy logs that a proxy which isn't in TRUSTED_PROXIES sent
+// X-Forwarded-For. All clients behind it share its address, so e.g. the
+// lockout after wrong passwords from one client would lock out all of them.
+func warnUntrustedProxy(address string) {
+	untrustedProxyWarning.Do(func() {
+		Logger.Printf("Warning: X-Forwarded-For from %s is ignored because it is not in TRUSTED_PROXIES. If it is your reverse proxy, add it to TRUSTED_PROXIES, otherwise all clients share its address (e.g. for the lockout after wrong passwords).", address)
+	})
+}
+
+// isTrustedProxy checks if an address is in TRUSTED_PROXIES
+func isTrustedProxy(address string) bool {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, proxy := range Settings.TrustedProxies {
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			if prefix.Contains(addr) {
+				return true
+			}
+		} else if proxyAddr, err := netip.ParseAddr(proxy); err == nil && proxyAddr.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
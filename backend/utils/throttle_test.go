@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// resetThrottle clears the throttle state for a test
+func resetThrottle(t *testing.T) {
+	t.Helper()
+
+	previousAttempts, previousLockout := Settings.LoginMaxAttempts, Settings.LoginLockoutMins
+	Settings.LoginMaxAttempts = 5
+	Settings.LoginLockoutMins = 15
+
+	throttleMutex.Lock()
+	throttleEntries = map[ThrottleKey]*throttleEntry{}
+	throttleInFlight = map[ThrottleKey]int{}
+	throttleMutex.Unlock()
+
+	t.Cleanup(func() {
+		Settings.LoginMaxAttempts, Settings.LoginLockoutMins = previousAttempts, previousLockout
+	})
+}
+
+func TestThrottleBeginAllowsOneCheckPerUser(t *testing.T) {
+	resetThrottle(t)
+	user := UserThrottleKey("alice")
+	ip := ThrottleKey{Kind: ThrottleIP, Value: "192.0.2.1"}
+
+	release, wait := ThrottleBegin(user, ip)
+	if wait != 0 {
+		t.Fatalf("first attempt has to wait %v", wait)
+	}
+
+	// A parallel attempt for the same user is refused before the password is checked
+	if _, wait := ThrottleBegin(user, ip); wait == 0 {
+		t.Fatal("parallel attempt for the same user was not refused")
+	}
+
+	// Other users behind the same address may still log in
+	other, wait := ThrottleBegin(UserThrottleKey("bob"), ip)
+	if wait != 0 {
+		t.Fatalf("attempt of another user has to wait %v", wait)
+	}
+	other()
+
+	release()
+	release() // releasing twice doesn't free a second attempt
+	if throttleInFlight[user] != 0 || throttleInFlight[ip] != 0 {
+		t.Fatalf("attempts still running after release: %v", throttleInFlight)
+	}
+
+	release, wait = ThrottleBegin(user, ip)
+	if wait != 0 {
+		t.Fatalf("attempt after release has to wait %v", wait)
+	}
+	release()
+}
+
+func TestThrottleBeginLimitsChecksPerAddress(t *testing.T) {
+	resetThrottle(t)
+	ip := ThrottleKey{Kind: ThrottleIP, Value: "192.0.2.1"}
+
+	var releases []func()
+	for i := range throttleConcurrentAttempts * throttleIPFactor {
+		release, wait := ThrottleBegin(UserThrottleKey(string(rune('a'+i))), ip)
+		if wait != 0 {
+			t.Fatalf("attempt %d has to wait %v", i, wait)
+		}
+		releases = append(releases, release)
+	}
+
+	if _, wait := ThrottleBegin(UserThrottleKey("z"), ip); wait == 0 {
+		t.Error("too many parallel attempts from one address were not refused")
+	}
+
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestThrottleFailureBacksOffAndLocksOut(t *testing.T) {
+	resetThrottle(t)
+	user := UserThrottleKey("alice")
+
+	tests := []struct {
+		failures int
+		wantWait time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 15 * time.Minute},
+	}
+
+	for _, test := range tests {
+		ThrottleFailure(user)
+
+		_, wait := ThrottleBegin(user)
+		if test.wantWait == 0 && wait != 0 {
+			t.Errorf("after %d failures: wait = %v, want none", test.failures, wait)
+		}
+		if test.wantWait != 0 && (wait <= test.wantWait-time.Second || wait > test.wantWait) {
+			t.Errorf("after %d failures: wait = %v, want %v", test.failures, wait, test.wantWait)
+		}
+
+		// The next failure is counted as if the client had waited
+		throttleMutex.Lock()
+		throttleEntries[user].blockedUntil = time.Time{}
+		throttleInFlight = map[ThrottleKey]int{}
+		throttleMutex.Unlock()
+	}
+
+	ThrottleSuccess(user)
+	if _, wait := ThrottleBegin(user); wait != 0 {
+		t.Errorf("wait after a correct password = %v, want none", wait)
+	}
+}
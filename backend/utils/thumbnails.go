@@ -0,0 +1,349 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnails of uploaded images, so a month with many photos doesn't need to
+// download every image in full size. They are JPEGs, encrypted like every
+// other file and stored next to the original as "<uuid>.thumb<size>". The
+// sizes that exist are recorded in the "thumbnails" of the file in the day.
+
+// ThumbnailSizes are the sizes (longest side in pixels) of the thumbnails
+var ThumbnailSizes = []int{1024, 256}
+
+const (
+	// Larger images are not decoded, they would need too much memory
+	maxThumbnailSourcePixels = 60_000_000
+	thumbnailQuality         = 80
+)
+
+// imageExtensions are the files thumbnails are created for
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+// ThumbnailUUID returns the name of the stored thumbnail of a file
+func ThumbnailUUID(uuid string, size int) string {
+	return fmt.Sprintf("%s.thumb%d", uuid, size)
+}
+
+// IsImageFilename checks if thumbnails can be created for a file
+func IsImageFilename(filename string) bool {
+	return imageExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// CreateThumbnails creates the thumbnails of a stored image and returns
+// their sizes. Sizes that are not smaller than the image are skipped.
+// Files that are no (supported) images have no thumbnails.
+func CreateThumbnails(userID int, uuid string, filename string, encKey string) ([]int, error) {
+	if !IsImageFilename(filename) {
+		return nil, nil
+	}
+
+	file, err := OpenFile(userID, uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decrypted, err := NewFileReader(file, encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Thumbnails have no EXIF data, so they are rotated as the image is shown
+	orientation := ReadImageOrientation(decrypted)
+	if _, err := decrypted.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Check the dimensions before decoding the whole image
+	config, _, err := image.DecodeConfig(decrypted)
+	if err != nil {
+		return nil, nil
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		Logger.Printf("No thumbnails for file %s of user %d: image is too large (%dx%d)", uuid, userID, config.Width, config.Height)
+		return nil, nil
+	}
+
+	if _, err := decrypted.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(decrypted)
+	if err != nil {
+		return nil, nil
+	}
+
+	sizes := []int{}
+	source := img
+	for _, size := range ThumbnailSizes {
+		bounds := source.Bounds()
+		if max(img.Bounds().Dx(), img.Bounds().Dy()) <= size {
+			continue
+		}
+
+		// Each thumbnail is scaled from the next larger one, that's much faster
+		width, height := thumbnailDimensions(bounds.Dx(), bounds.Dy(), size)
+		thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+		// Transparent areas become white, JPEG has no alpha channel
+		draw.Draw(thumbnail, thumbnail.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), source, bounds, draw.Over, nil)
+		source = thumbnail
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, orientImage(thumbnail, orientation), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			RemoveThumbnails(userID, uuid, sizes)
+			return nil, err
+		}
+
+		encrypted, err := EncryptFile(buf.Bytes(), encKey)
+		if err != nil {
+			RemoveThumbnails(userID, uuid, sizes)
+			return nil, err
+		}
+		if err := WriteFile(encrypted, userID, ThumbnailUUID(uuid, size)); err != nil {
+			RemoveThumbnails(userID, uuid, sizes)
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes, nil
+}
+
+// thumbnailDimensions scales width and height so the longest side is size
+func thumbnailDimensions(width, height, size int) (int, int) {
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
+
+// orientImage rotates and flips an image according to its EXIF orientation
+func orientImage(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	bounds := image.Rect(0, 0, width, height)
+	// 5 to 8 are rotated by 90 degrees
+	if orientation >= 5 {
+		bounds = image.Rect(0, 0, height, width)
+	}
+
+	oriented := image.NewRGBA(bounds)
+	for y := range height {
+		for x := range width {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+			oriented.SetRGBA(dx, dy, img.RGBAAt(x, y))
+		}
+	}
+	return oriented
+}
+
+// RemoveThumbnails removes the thumbnails of a file
+func RemoveThumbnails(userID int, uuid string, sizes []int) {
+	for _, size := range sizes {
+		if err := RemoveFile(userID, ThumbnailUUID(uuid, size)); err != nil {
+			Logger.Printf("Warning: Failed to delete thumbnail %d of file %s for user %d: %v", size, uuid, userID, err)
+		}
+	}
+}
+
+// Backfill of the thumbnails of files uploaded before thumbnails existed (or
+// imported). It runs in the background after the login of the user.
+
+// backfillRunning contains the users whose thumbnails are being created
+var (
+	backfillRunning = map[int]bool{}
+	backfillMutex   sync.Mutex
+)
+
+// ThumbnailsBackfilled checks if the thumbnails of the existing files of a user were created
+func ThumbnailsBackfilled(userID int) bool {
+	value, err := getUserValue(userID, "thumbnails_backfilled")
+	if err != nil {
+		return true
+	}
+	done, _ := value.(bool)
+	return done
+}
+
+// SetThumbnailsBackfilled marks the files of a user as having thumbnails (e.g. for new users)
+func SetThumbnailsBackfilled(userID int, done bool) error {
+	return setUserValue(userID, "thumbnails_backfilled", done)
+}
+
+// StartThumbnailBackfill creates the missing thumbnails of all images of a
+// user in the background (unless that is already running)
+func StartThumbnailBackfill(userID int, encKey string) {
+	backfillMutex.Lock()
+	defer backfillMutex.Unlock()
+
+	if backfillRunning[userID] {
+		return
+	}
+	backfillRunning[userID] = true
+
+	go func() {
+		defer func() {
+			backfillMutex.Lock()
+			delete(backfillRunning, userID)
+			backfillMutex.Unlock()
+		}()
+
+		created, err := backfillThumbnails(userID, encKey)
+		if err != nil {
+			Logger.Printf("Error creating thumbnails for user %d: %v", userID, err)
+			return
+		}
+		if err := SetThumbnailsBackfilled(userID, true); err != nil {
+			Logger.Printf("Error saving thumbnail state of user %d: %v", userID, err)
+			return
+		}
+		Logger.Printf("Created thumbnails for %d files of user %d", created, userID)
+	}()
+}
+
+// backfillThumbnails creates the missing thumbnails of all images of a user.
+// The logs are only locked while reading and saving a month, not while the
+// images are processed. Returns the number of files that got thumbnails.
+func backfillThumbnails(userID int, encKey string) (int, error) {
+	years, err := GetYears(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, year := range years {
+		yearInt, _ := strconv.Atoi(year)
+		months, err := GetMonths(userID, year)
+		if err != nil {
+			return created, err
+		}
+
+		for _, month := range months {
+			monthInt, err := strconv.Atoi(month)
+			if err != nil {
+				continue
+			}
+
+			n, err := backfillMonthThumbnails(userID, yearInt, monthInt, encKey)
+			created += n
+			if err != nil {
+				return created, err
+			}
+		}
+	}
+
+	return created, nil
+}
+
+// backfillMonthThumbnails creates the missing thumbnails of the images of a month
+func backfillMonthThumbnails(userID, year, month int, encKey string) (int, error) {
+	logsMutex := UserLocks.Logs(userID)
+
+	// Find the images without thumbnails
+	logsMutex.RLock()
+	content, err := ReadMonth(userID, year, month)
+	logsMutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	thumbnails := map[string][]int{}
+	for _, day := range content.Days {
+		for _, file := range day.Files {
+			if file.Thumbnails != nil {
+				continue
+			}
+
+			filename, err := DecryptText(file.EncFilename, encKey)
+			if err != nil || !IsImageFilename(filename) {
+				continue
+			}
+
+			sizes, err := CreateThumbnails(userID, file.UUIDFilename, filename, encKey)
+			if err != nil {
+				Logger.Printf("Error creating thumbnails of file %s of user %d: %v", file.UUIDFilename, userID, err)
+				continue
+			}
+			thumbnails[file.UUIDFilename] = sizes
+		}
+	}
+	if len(thumbnails) == 0 {
+		return 0, nil
+	}
+
+	// The month might have changed in the meantime
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
+	content, err = ReadMonth(userID, year, month)
+	if err != nil {
+		for uuid, sizes := range thumbnails {
+			RemoveThumbnails(userID, uuid, sizes)
+		}
+		return 0, err
+	}
+
+	created := 0
+	for i := range content.Days {
+		for j := range content.Days[i].Files {
+			file := &content.Days[i].Files[j]
+			if sizes, ok := thumbnails[file.UUIDFilename]; ok && file.Thumbnails == nil {
+				file.Thumbnails = sizes
+				delete(thumbnails, file.UUIDFilename)
+				created++
+			}
+		}
+	}
+
+	// Files deleted in the meantime
+	for uuid, sizes := range thumbnails {
+		RemoveThumbnails(userID, uuid, sizes)
+	}
+
+	if err := SaveMonth(userID, year, month, content); err != nil {
+		return 0, err
+	}
+	return created, nil
+}
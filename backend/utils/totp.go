@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTP (RFC 6238) as second factor of the login. The secret is encrypted with
+// the encryption key of the user, like all data of the user. It can only be
+// decrypted after the password was checked (the first step of the login), so
+// it needs no key of its own and reveals nothing without the password.
+//
+// users.json: "totp_secret" (encrypted), "totp_pending_secret" (encrypted,
+// until the setup is confirmed with a code) and "totp_last_step" (a code is
+// only accepted once).
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes of the previous and next period are accepted as well (clock drift)
+	totpSkew   = 1
+	totpIssuer = "DailyTxT"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpMutex makes checking and saving the last used step atomic
+var totpMutex sync.Mutex
+
+// GenerateTOTPSecret creates a new random secret (base32)
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode calculates the code of a secret for a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for range totpDigits {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo), nil
+}
+
+// matchTOTPCode returns the time step of a valid code. Steps up to lastStep
+// were already used and are not accepted again.
+func matchTOTPCode(secret string, code string, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI for authenticator apps
+func TOTPProvisioningURI(secret string, username string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// TOTPQRCode returns the provisioning URI as QR code (PNG)
+func TOTPQRCode(uri string) ([]byte, error) {
+	return qrcode.Encode(uri, qrcode.Medium, 256)
+}
+
+// TOTPEnabled checks if the login of a user needs a TOTP code
+func TOTPEnabled(userID int) bool {
+	secret, err := getUserValue(userID, "totp_secret")
+	if err != nil {
+		return false
+	}
+	encrypted, _ := secret.(string)
+	return encrypted != ""
+}
+
+// StartTOTPSetup creates a new secret for a user. It is only used after
+// ConfirmTOTPSetup, so an unfinished setup doesn't lock the user out.
+func StartTOTPSetup(userID int, encKey string) (string, error) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", fmt.Errorf("error generating secret: %v", err)
+	}
+
+	encrypted, err := EncryptText(secret, encKey)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting secret: %v", err)
+	}
+
+	if err := setUserValue(userID, "totp_pending_secret", encrypted); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ConfirmTOTPSetup enables TOTP for a user if the code matches the secret of the setup
+func ConfirmTOTPSetup(userID int, code string, encKey string) (bool, error) {
+	totpMutex.Lock()
+	defer totpMutex.Unlock()
+
+	value, err := getUserValue(userID, "totp_pending_secret")
+	if err != nil {
+		return false, err
+	}
+	encrypted, _ := value.(string)
+	if encrypted == "" {
+		return false, fmt.Errorf("no TOTP setup started")
+	}
+
+	secret, err := DecryptText(encrypted, encKey)
+	if err != nil {
+		return false, fmt.Errorf("error decrypting secret: %v", err)
+	}
+
+	step, ok := matchTOTPCode(secret, code, 0)
+	if !ok {
+		return false, nil
+	}
+
+	if err := setUserValue(userID, "totp_secret", encrypted); err != nil {
+		return false, err
+	}
+	if err := setUserValue(userID, "totp_last_step", step); err != nil {
+		return false, err
+	}
+	return true, setUserValue(userID, "totp_pending_secret", nil)
+}
+
+// DisableTOTP removes the TOTP secret of a user
+func DisableTOTP(userID int) error {
+	for _, key := range []string{"totp_secret", "totp_pending_secret", "totp_last_step"} {
+		if err := setUserValue(userID, key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyTOTP checks a code of the login. Every code is only accepted once.
+func VerifyTOTP(userID int, code string, encKey string) (bool, error) {
+	totpMutex.Lock()
+	defer totpMutex.Unlock()
+
+	value, err := getUserValue(userID, "totp_secret")
+	if err != nil {
+		return false, err
+	}
+	encrypted, _ := value.(string)
+	if encrypted == "" {
+		return false, fmt.Errorf("TOTP is not enabled")
+	}
+
+	secret, err := DecryptText(encrypted, encKey)
+	if err != nil {
+		return false, fmt.Errorf("error decrypting secret: %v", err)
+	}
+
+	lastValue, _ := getUserValue(userID, "totp_last_step")
+	lastStep, _ := lastValue.(float64)
+
+	step, ok := matchTOTPCode(secret, code, int64(lastStep))
+	if !ok {
+		return false, nil
+	}
+	return true, setUserValue(userID, "totp_last_step", step)
+}
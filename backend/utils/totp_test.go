@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// The secret "12345678901234567890" of the test vectors of RFC 6238 (SHA1)
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The last six digits of the eight digit codes of the RFC
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	} {
+		got, err := totpCode(rfcTOTPSecret, tc.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("code at %d: %v", tc.unix, err)
+		}
+		if got != tc.want {
+			t.Errorf("code at %d = %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+
+	// Secrets are accepted in lower case
+	if got, _ := totpCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1); got != "287082" {
+		t.Errorf("code of the lower case secret = %s, want 287082", got)
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Errorf("code of an invalid secret: want an error")
+	}
+}
+
+// currentTOTPStep runs fn with the current time step, again if the step changed meanwhile
+func currentTOTPStep(fn func(current int64)) {
+	for {
+		current := time.Now().Unix() / totpPeriod
+		fn(current)
+		if time.Now().Unix()/totpPeriod == current {
+			return
+		}
+	}
+}
+
+func TestMatchTOTPCode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		offset   int64 // step of the code relative to the current step
+		format   func(string) string
+		lastStep int64 // relative to the current step, -10 for none
+		want     bool
+	}{
+		{name: "current step", offset: 0, lastStep: -10, want: true},
+		{name: "previous step", offset: -1, lastStep: -10, want: true},
+		{name: "next step", offset: 1, lastStep: -10, want: true},
+		{name: "too old", offset: -2, lastStep: -10, want: false},
+		{name: "too new", offset: 2, lastStep: -10, want: false},
+		{name: "spaces", offset: 0, format: func(code string) string { return " " + code[:3] + " " + code[3:] + " " }, lastStep: -10, want: true},
+		{name: "too short", offset: 0, format: func(code string) string { return code[:5] }, lastStep: -10, want: false},
+		{name: "too long", offset: 0, format: func(code string) string { return code + "0" }, lastStep: -10, want: false},
+		{name: "already used", offset: 0, lastStep: 0, want: false},
+		{name: "older than the used step", offset: -1, lastStep: 0, want: false},
+		{name: "newer than the used step", offset: 1, lastStep: 0, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			currentTOTPStep(func(current int64) {
+				code, err := totpCode(rfcTOTPSecret, current+tc.offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.format != nil {
+					code = tc.format(code)
+				}
+
+				step, ok := matchTOTPCode(rfcTOTPSecret, code, current+tc.lastStep)
+				if ok != tc.want {
+					t.Errorf("accepted = %v, want %v", ok, tc.want)
+				}
+				if ok && step != current+tc.offset {
+					t.Errorf("step = %d, want %d", step, current+tc.offset)
+				}
+			})
+		})
+	}
+}
+
+func TestVerifyTOTPAcceptsCodesOnce(t *testing.T) {
+	derivedKey := newMigrationTestUser(t)
+	encKey, err := GetEncryptionKey(1, derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := StartTOTPSetup(1, encKey)
+	if err != nil {
+		t.Fatalf("starting setup: %v", err)
+	}
+	if TOTPEnabled(1) {
+		t.Fatalf("TOTP enabled before the setup was confirmed")
+	}
+
+	// A new step in between doesn't matter, the codes stay in the window
+	current := time.Now().Unix() / totpPeriod
+	code, _ := totpCode(secret, current)
+	if ok, err := ConfirmTOTPSetup(1, code, encKey); !ok || err != nil {
+		t.Fatalf("confirming setup: %v, %v", ok, err)
+	}
+	if !TOTPEnabled(1) {
+		t.Fatalf("TOTP not enabled after the setup")
+	}
+
+	// The code of the setup can't be used for a login
+	if ok, err := VerifyTOTP(1, code, encKey); ok || err != nil {
+		t.Errorf("replayed code of the setup: %v, %v, want rejected", ok, err)
+	}
+
+	next, _ := totpCode(secret, current+1)
+	if ok, err := VerifyTOTP(1, next, encKey); !ok || err != nil {
+		t.Errorf("code of the next step: %v, %v, want accepted", ok, err)
+	}
+	if ok, _ := VerifyTOTP(1, next, encKey); ok {
+		t.Errorf("replayed code was accepted")
+	}
+
+	// totp_last_step is stored with the user
+	lastStep, _ := getUserValue(1, "totp_last_step")
+	if lastStep != float64(current+1) {
+		t.Errorf("totp_last_step = %v, want %d", lastStep, current+1)
+	}
+
+	if err := DisableTOTP(1); err != nil {
+		t.Fatalf("disabling TOTP: %v", err)
+	}
+	if TOTPEnabled(1) {
+		t.Errorf("TOTP still enabled after disabling it")
+	}
+	if _, err := VerifyTOTP(1, "000000", encKey); err == nil {
+		t.Errorf("verifying a code without TOTP: want an error")
+	}
+}
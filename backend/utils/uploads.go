@@ -0,0 +1,468 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Resumable uploads of files (similar to tus): an upload is created with the
+// size of the file, then the file is sent in chunks, each at the offset where
+// the previous one ended. After a dropped connection the client asks for the
+// offset and continues from there. Once all data is received, the upload is
+// finalized and the file is stored like a normal upload.
+//
+// The received data is staged in DATA_PATH/uploads/<id>/, encrypted with the
+// key of the user: every request is stored as its own segment in the chunked
+// file format. Uploads that are not finalized are removed after
+// UPLOADS_EXPIRY_HOURS without a new chunk.
+
+const (
+	uploadsDirname     = "uploads"
+	uploadMetaFilename = "upload.json"
+)
+
+// MaxOpenUploads is the number of uploads a user can have open at the same time
+const MaxOpenUploads = 20
+
+// Errors of the resumable uploads
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrUploadBusy     = errors.New("upload is in use by another request")
+	ErrUploadOffset   = errors.New("offset does not match the upload")
+	ErrTooManyUploads = errors.New("too many open uploads")
+)
+
+// Upload is the state of a resumable upload (upload.json)
+type Upload struct {
+	ID          string    `json:"id"`
+	UserID      int       `json:"user_id"`
+	UUID        string    `json:"uuid"`
+	EncFilename string    `json:"enc_filename"`
+	Year        int       `json:"year"`
+	Month       int       `json:"month"`
+	Day         int       `json:"day"`
+	Size        int64     `json:"size"`
+	Offset      int64     `json:"offset"`
+	Segments    []int64   `json:"segments"` // unencrypted size of each segment
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ExpiresAt returns the time the upload is removed if it isn't continued
+func (u *Upload) ExpiresAt() time.Time {
+	return u.UpdatedAt.Add(time.Duration(Settings.UploadsExpiry) * time.Hour)
+}
+
+// Complete checks if all data of the upload was received
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Size
+}
+
+// uploadLocks prevents concurrent requests on the same upload
+var (
+	uploadLocks      = map[string]*sync.Mutex{}
+	uploadLocksMutex sync.Mutex
+)
+
+// LockUpload locks an upload without waiting. A client that retries a chunk
+// while the old request is still running gets ErrUploadBusy.
+func LockUpload(id string) (func(), error) {
+	uploadLocksMutex.Lock()
+	defer uploadLocksMutex.Unlock()
+
+	lock, ok := uploadLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		uploadLocks[id] = lock
+	}
+	if !lock.TryLock() {
+		return nil, ErrUploadBusy
+	}
+
+	return func() {
+		uploadLocksMutex.Lock()
+		defer uploadLocksMutex.Unlock()
+		delete(uploadLocks, id)
+		lock.Unlock()
+	}, nil
+}
+
+// uploadsDir returns the directory of the staged uploads. With the memory
+// backend nothing is written to DATA_PATH.
+func uploadsDir() string {
+	if Settings.StorageBackend == "memory" {
+		return filepath.Join(os.TempDir(), "dailytxt-"+uploadsDirname)
+	}
+	return filepath.Join(Settings.DataPath, uploadsDirname)
+}
+
+// uploadDir returns the staging directory of an upload
+func uploadDir(id string) string {
+	return filepath.Join(uploadsDir(), id)
+}
+
+// isUploadID checks that id can be an id created by CreateUpload (and is safe as directory name)
+func isUploadID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// createUploadMutex makes the checks of CreateUpload and the creation atomic
+var createUploadMutex sync.Mutex
+
+// CreateUpload creates the staging directory of a new upload and sets its id.
+// The declared sizes of the open uploads of the user count against the quota:
+// returns ErrQuotaExceeded if the file doesn't fit next to them and
+// ErrTooManyUploads if the user already has MaxOpenUploads open uploads.
+func CreateUpload(upload *Upload) error {
+	createUploadMutex.Lock()
+	defer createUploadMutex.Unlock()
+
+	count, pendingSize := PendingUploads(upload.UserID)
+	if count >= MaxOpenUploads {
+		return ErrTooManyUploads
+	}
+	if err := CheckQuota(upload.UserID, pendingSize+upload.Size); err != nil {
+		return err
+	}
+
+	id, err := GenerateUUID()
+	if err != nil {
+		return err
+	}
+
+	upload.ID = id
+	upload.Offset = 0
+	upload.Segments = []int64{}
+	upload.CreatedAt = time.Now()
+	upload.UpdatedAt = upload.CreatedAt
+
+	if err := os.MkdirAll(uploadDir(id), 0755); err != nil {
+		Logger.Printf("Error creating staging directory of upload %s: %v", id, err)
+		return fmt.Errorf("internal server error when trying to create upload")
+	}
+
+	if err := writeUpload(upload); err != nil {
+		os.RemoveAll(uploadDir(id))
+		return err
+	}
+	return nil
+}
+
+// GetUpload reads the state of an upload of the user
+func GetUpload(userID int, id string) (*Upload, error) {
+	if !isUploadID(id) {
+		return nil, ErrUploadNotFound
+	}
+
+	data, err := os.ReadFile(filepath.Join(uploadDir(id), uploadMetaFilename))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		Logger.Printf("Error reading upload %s: %v", id, err)
+		return nil, fmt.Errorf("internal server error when trying to read upload")
+	}
+
+	upload := &Upload{}
+	if err := json.Unmarshal(data, upload); err != nil {
+		Logger.Printf("Error parsing upload %s: %v", id, err)
+		return nil, fmt.Errorf("internal server error when trying to read upload")
+	}
+
+	// Uploads of other users don't exist for this user
+	if upload.UserID != userID || upload.ID != id {
+		return nil, ErrUploadNotFound
+	}
+
+	return upload, nil
+}
+
+// writeUpload atomically writes upload.json
+func writeUpload(upload *Upload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	file, err := createAtomicFile(filepath.Join(uploadDir(upload.ID), uploadMetaFilename))
+	if err != nil {
+		Logger.Printf("Error writing upload %s: %v", upload.ID, err)
+		return fmt.Errorf("internal server error when trying to write upload")
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		Logger.Printf("Error writing upload %s: %v", upload.ID, err)
+		return fmt.Errorf("internal server error when trying to write upload")
+	}
+	if err := file.Commit(); err != nil {
+		Logger.Printf("Error writing upload %s: %v", upload.ID, err)
+		return fmt.Errorf("internal server error when trying to write upload")
+	}
+	return nil
+}
+
+// segmentPath returns the path of a segment of an upload
+func segmentPath(id string, index int) string {
+	return filepath.Join(uploadDir(id), fmt.Sprintf("%06d", index))
+}
+
+// AppendUpload stores content as the next segment of the upload. offset must
+// be the current offset of the upload. If reading content fails (e.g. the
+// connection dropped), the data received until then is kept, so the client
+// can continue from there. Data beyond the size of the upload is ignored.
+// The caller must hold the lock of the upload.
+func AppendUpload(upload *Upload, offset int64, content io.Reader, encKey string) error {
+	if offset != upload.Offset {
+		return ErrUploadOffset
+	}
+	if upload.Complete() {
+		return nil
+	}
+
+	// Stop at the first error, so the received part can still be encrypted
+	received := &untilErrorReader{reader: io.LimitReader(content, upload.Size-upload.Offset)}
+	encrypted, err := EncryptFileStream(received, encKey)
+	if err != nil {
+		return err
+	}
+
+	index := len(upload.Segments)
+	file, err := createAtomicFile(segmentPath(upload.ID, index))
+	if err != nil {
+		Logger.Printf("Error writing segment %d of upload %s: %v", index, upload.ID, err)
+		return fmt.Errorf("internal server error when trying to write upload")
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, encrypted); err != nil {
+		Logger.Printf("Error writing segment %d of upload %s: %v", index, upload.ID, err)
+		return fmt.Errorf("internal server error when trying to write upload")
+	}
+
+	if received.count == 0 {
+		// Nothing received, no segment needed
+		if received.err != nil {
+			return received.err
+		}
+		return nil
+	}
+
+	if err := file.Commit(); err != nil {
+		Logger.Printf("Error writing segment %d of upload %s: %v", index, upload.ID, err)
+		return fmt.Errorf("internal server error when trying to write upload")
+	}
+
+	upload.Segments = append(upload.Segments, received.count)
+	upload.Offset += received.count
+	upload.UpdatedAt = time.Now()
+	if err := writeUpload(upload); err != nil {
+		// The segment is overwritten by the next request
+		upload.Segments = upload.Segments[:index]
+		upload.Offset -= received.count
+		return err
+	}
+
+	if received.err != nil {
+		Logger.Printf("Upload %s interrupted at offset %d: %v", upload.ID, upload.Offset, received.err)
+	}
+	return nil
+}
+
+// untilErrorReader returns io.EOF instead of the first error of reader
+type untilErrorReader struct {
+	reader io.Reader
+	count  int64
+	err    error
+}
+
+func (r *untilErrorReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, io.EOF
+	}
+
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// OpenUpload returns the decrypted content of a complete upload.
+// The caller must hold the lock of the upload.
+func OpenUpload(upload *Upload, encKey string) (io.ReadCloser, error) {
+	if !upload.Complete() {
+		return nil, fmt.Errorf("upload is incomplete: %d of %d bytes received", upload.Offset, upload.Size)
+	}
+
+	segments := &segmentsReader{}
+	readers := []io.Reader{}
+	for index, size := range upload.Segments {
+		file, err := os.Open(segmentPath(upload.ID, index))
+		if err != nil {
+			segments.Close()
+			Logger.Printf("Error opening segment %d of upload %s: %v", index, upload.ID, err)
+			return nil, fmt.Errorf("internal server error when trying to read upload")
+		}
+		segments.files = append(segments.files, file)
+
+		decrypted, err := DecryptFileStream(file, encKey)
+		if err != nil {
+			segments.Close()
+			return nil, fmt.Errorf("error decrypting segment %d: %v", index, err)
+		}
+
+		// A segment must contain exactly the data that was counted
+		readers = append(readers, &exactReader{reader: decrypted, remaining: size})
+	}
+	segments.reader = io.MultiReader(readers...)
+
+	return segments, nil
+}
+
+// segmentsReader reads all segments of an upload one after another
+type segmentsReader struct {
+	reader io.Reader
+	files  []*os.File
+}
+
+func (s *segmentsReader) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+func (s *segmentsReader) Close() error {
+	for _, file := range s.files {
+		file.Close()
+	}
+	return nil
+}
+
+// exactReader fails if reader doesn't return exactly remaining bytes
+type exactReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	n, err := e.reader.Read(p)
+	e.remaining -= int64(n)
+	if e.remaining < 0 || (err == io.EOF && e.remaining > 0) {
+		return n, fmt.Errorf("segment has the wrong size")
+	}
+	return n, err
+}
+
+// RemoveUpload removes the staging directory of an upload
+func RemoveUpload(id string) error {
+	if !isUploadID(id) {
+		return ErrUploadNotFound
+	}
+	if err := os.RemoveAll(uploadDir(id)); err != nil {
+		Logger.Printf("Error removing upload %s: %v", id, err)
+		return fmt.Errorf("internal server error when trying to remove upload")
+	}
+	return nil
+}
+
+// RemoveUserUploads removes all uploads of a user (when the user is deleted)
+func RemoveUserUploads(userID int) {
+	for _, upload := range listUploads() {
+		if upload.UserID == userID {
+			RemoveUpload(upload.ID)
+		}
+	}
+}
+
+// PendingUploads returns the number of open (not expired) uploads of a user
+// and the sum of their declared sizes
+func PendingUploads(userID int) (count int, size int64) {
+	now := time.Now()
+	for _, upload := range listUploads() {
+		if upload.UserID == userID && now.Before(upload.ExpiresAt()) {
+			count++
+			size += upload.Size
+		}
+	}
+	return count, size
+}
+
+// listUploads reads the state of all staged uploads. Directories without a
+// readable upload.json are returned with only the id and the modification
+// time as UpdatedAt.
+func listUploads() []*Upload {
+	entries, err := os.ReadDir(uploadsDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Logger.Printf("Error reading %s: %v", uploadsDir(), err)
+		}
+		return nil
+	}
+
+	uploads := []*Upload{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !isUploadID(entry.Name()) {
+			continue
+		}
+
+		upload := &Upload{ID: entry.Name(), UserID: -1}
+		data, err := os.ReadFile(filepath.Join(uploadDir(entry.Name()), uploadMetaFilename))
+		if err == nil && json.Unmarshal(data, upload) == nil && upload.ID == entry.Name() {
+			uploads = append(uploads, upload)
+			continue
+		}
+
+		upload = &Upload{ID: entry.Name(), UserID: -1}
+		if info, err := entry.Info(); err == nil {
+			upload.UpdatedAt = info.ModTime()
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads
+}
+
+// RemoveExpiredUploads removes the uploads that were not continued in time
+func RemoveExpiredUploads() {
+	now := time.Now()
+	for _, upload := range listUploads() {
+		if now.Before(upload.ExpiresAt()) {
+			continue
+		}
+
+		// Don't remove an upload that is just receiving data
+		unlock, err := LockUpload(upload.ID)
+		if err != nil {
+			continue
+		}
+		if err := RemoveUpload(upload.ID); err == nil {
+			Logger.Printf("Removed expired upload %s of user %d (%d of %d bytes received)", upload.ID, upload.UserID, upload.Offset, upload.Size)
+		}
+		unlock()
+	}
+}
+
+// StartUploadsCleanup removes expired uploads periodically
+func StartUploadsCleanup() {
+	go func() {
+		for {
+			RemoveExpiredUploads()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+// WebAuthn sends binary data as ArrayBuffer, the server as base64url strings
+
+function toBase64url(buffer) {
+	const bytes = new Uint8Array(buffer);
+	let binary = '';
+	for (const byte of bytes) {
+		binary += String.fromCharCode(byte);
+	}
+	return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function fromBase64url(value) {
+	const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+	const binary = atob(base64.padEnd(base64.length + ((4 - (base64.length % 4)) % 4), '='));
+	return Uint8Array.from(binary, (c) => c.charCodeAt(0));
+}
+
+function decodeCredentialList(list) {
+	return list?.map((c) => ({ ...c, id: fromBase64url(c.id) }));
+}
+
+function decodePRFExtension(extensions) {
+	if (!extensions?.prf?.eval) {
+		return extensions;
+	}
+	return {
+		...extensions,
+		prf: { eval: { first: fromBase64url(extensions.prf.eval.first) } }
+	};
+}
+
+export function passkeysSupported() {
+	return typeof window !== 'undefined' && !!window.PublicKeyCredential;
+}
+
+// createPasskey creates a new passkey with the options of the server
+export async function createPasskey(options) {
+	const publicKey = options.publicKey;
+	const credential = await navigator.credentials.create({
+		publicKey: {
+			...publicKey,
+			challenge: fromBase64url(publicKey.challenge),
+			user: { ...publicKey.user, id: fromBase64url(publicKey.user.id) },
+			excludeCredentials: decodeCredentialList(publicKey.excludeCredentials)
+		}
+	});
+
+	return {
+		id: credential.id,
+		rawId: toBase64url(credential.rawId),
+		type: credential.type,
+		response: {
+			attestationObject: toBase64url(credential.response.attestationObject),
+			clientDataJSON: toBase64url(credential.response.clientDataJSON),
+			transports: credential.response.getTransports?.() ?? []
+		},
+		clientExtensionResults: {}
+	};
+}
+
+// usePasskey signs the challenge of the server and returns the credential and the PRF output
+export async function usePasskey(options) {
+	const publicKey = options.publicKey;
+	const credential = await navigator.credentials.get({
+		publicKey: {
+			...publicKey,
+			challenge: fromBase64url(publicKey.challenge),
+			allowCredentials: decodeCredentialList(publicKey.allowCredentials),
+			extensions: decodePRFExtension(publicKey.extensions)
+		}
+	});
+
+	const prfResult = credential.getClientExtensionResults().prf?.results?.first;
+
+	return {
+		credential: {
+			id: credential.id,
+			rawId: toBase64url(credential.rawId),
+			type: credential.type,
+			response: {
+				authenticatorData: toBase64url(credential.response.authenticatorData),
+				clientDataJSON: toBase64url(credential.response.clientDataJSON),
+				signature: toBase64url(credential.response.signature),
+				userHandle: credential.response.userHandle
+					? toBase64url(credential.response.userHandle)
+					: null
+			},
+			clientExtensionResults: {}
+		},
+		prf: prfResult ? toBase64url(prfResult) : ''
+	};
+}